@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Access log formats.
+const (
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+// Per-tunnel access logs of proxied http requests. nil when access logging is disabled.
+var accessLogs *accessLogger
+
+// accessLogEntry describes one proxied http request.
+type accessLogEntry struct {
+	Time       time.Time     `json:"time"`
+	RequestID  string        `json:"requestId"`
+	TunnelName string        `json:"tunnelName"`
+	RemoteAddr string        `json:"remoteAddr"`
+	Method     string        `json:"method"`
+	URI        string        `json:"uri"` // As sent by the visitor
+	Proto      string        `json:"proto"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"` // Response bytes including headers
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"userAgent,omitempty"`
+	Duration   time.Duration `json:"durationNs"`
+}
+
+// Format returns the entry as a line in format.
+func (e *accessLogEntry) Format(format string) string {
+	if format == accessLogJSON {
+		b, _ := json.Marshal(e)
+		return string(b) + "\n"
+	}
+	// Apache combined log format: %h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"
+	status := "-"
+	if e.Status > 0 {
+		status = strconv.Itoa(e.Status)
+	}
+	return fmt.Sprintf("%s - - [%s] %q %s %d %q %q\n", e.RemoteAddr, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+e.URI+" "+e.Proto, status, e.Bytes, orDash(e.Referer), orDash(e.UserAgent))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// accessLogger writes entries to one file per tunnel name in dir (eg dir/abc.log).
+// A file is rotated once it reaches maxBytes or is older than maxAge; zero disables either limit.
+type accessLogger struct {
+	sync.Mutex
+	dir      string
+	format   string
+	maxBytes int64
+	maxAge   time.Duration
+	files    map[string]*accessLogFile
+}
+
+type accessLogFile struct {
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func newAccessLogger(dir string, format string, maxBytes int64, maxAge time.Duration) (*accessLogger, error) {
+	if format != accessLogCombined && format != accessLogJSON {
+		return nil, fmt.Errorf("invalid access log format %s", format)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &accessLogger{dir: dir, format: format, maxBytes: maxBytes, maxAge: maxAge, files: make(map[string]*accessLogFile)}, nil
+}
+
+// Log appends e to the log of its tunnel.
+func (l *accessLogger) Log(e *accessLogEntry) error {
+	line := e.Format(l.format)
+
+	l.Lock()
+	defer l.Unlock()
+	f, ok := l.files[e.TunnelName]
+	if ok && l.needsRotation(f, int64(len(line))) {
+		f.file.Close()
+		delete(l.files, e.TunnelName)
+		path := l.path(e.TunnelName)
+		if err := os.Rename(path, path+"."+time.Now().Format("20060102-150405.000")); err != nil {
+			return err
+		}
+		ok = false
+	}
+	if !ok {
+		file, err := os.OpenFile(l.path(e.TunnelName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		f = &accessLogFile{file: file, opened: time.Now()}
+		if info, err := file.Stat(); err == nil {
+			f.size = info.Size()
+		}
+		l.files[e.TunnelName] = f
+	}
+	n, err := f.file.WriteString(line)
+	f.size += int64(n)
+	return err
+}
+
+func (l *accessLogger) needsRotation(f *accessLogFile, next int64) bool {
+	if l.maxBytes > 0 && f.size > 0 && f.size+next > l.maxBytes {
+		return true
+	}
+	return l.maxAge > 0 && time.Since(f.opened) > l.maxAge
+}
+
+func (l *accessLogger) path(tunnelName string) string {
+	return filepath.Join(l.dir, filepath.Base(tunnelName)+".log")
+}
+
+// Close closes the open log files.
+func (l *accessLogger) Close() {
+	l.Lock()
+	defer l.Unlock()
+	for name, f := range l.files {
+		f.file.Close()
+		delete(l.files, name)
+	}
+}
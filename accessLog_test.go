@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("accessLog", func() {
+	entry := func() *accessLogEntry {
+		return &accessLogEntry{
+			Time:       time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC),
+			RequestID:  "abc",
+			TunnelName: "demo",
+			RemoteAddr: "10.0.0.1",
+			Method:     "GET",
+			URI:        "/index.html",
+			Proto:      "HTTP/1.1",
+			Status:     200,
+			Bytes:      512,
+			UserAgent:  "curl/8.0",
+		}
+	}
+
+	It("should format entries in the combined log format", func() {
+		Expect(entry().Format(accessLogCombined)).To(Equal(`10.0.0.1 - - [04/Mar/2024:05:06:07 +0000] "GET /index.html HTTP/1.1" 200 512 "-" "curl/8.0"` + "\n"))
+	})
+
+	It("should format entries as json", func() {
+		Expect(entry().Format(accessLogJSON)).To(ContainSubstring(`"tunnelName":"demo"`))
+	})
+
+	It("should write one file per tunnel and rotate it by size", func() {
+		dir, err := os.MkdirTemp("", "accessLog")
+		Expect(err).To(Not(HaveOccurred()))
+		defer os.RemoveAll(dir)
+
+		line := entry().Format(accessLogCombined)
+		sut, err := newAccessLogger(dir, accessLogCombined, int64(len(line)*2), 0)
+		Expect(err).To(Not(HaveOccurred()))
+		defer sut.Close()
+
+		for i := 0; i < 3; i++ {
+			Expect(sut.Log(entry())).To(Succeed())
+		}
+		rotated, _ := filepath.Glob(filepath.Join(dir, "demo.log.*"))
+		Expect(rotated).To(HaveLen(1))
+		current, err := os.ReadFile(filepath.Join(dir, "demo.log"))
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(current)).To(Equal(line))
+	})
+
+	It("should reject unknown formats", func() {
+		_, err := newAccessLogger(os.TempDir(), "xml", 0, 0)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Append-only record of the admin actions that change the server state (eg closing or pausing a tunnel,
+// banning a key or reloading the configuration), kept apart from the operational log.
+// nil when audit logging is disabled.
+var auditLogs *auditLogger
+
+// auditEntry describes one admin action.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`  // Who did it (see adminActor)
+	Action string    `json:"action"` // What was done (eg tunnel.close)
+	Target string    `json:"target,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// auditLogger writes entries as JSON lines to a file that is only ever appended to.
+type auditLogger struct {
+	sync.Mutex
+	file *os.File
+}
+
+func newAuditLogger(path string) (*auditLogger, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{file: file}, nil
+}
+
+// Record appends e to the audit log and flushes it to disk.
+func (l *auditLogger) Record(e *auditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if _, err := l.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Close closes the audit log file.
+func (l *auditLogger) Close() {
+	l.Lock()
+	defer l.Unlock()
+	l.file.Close()
+}
+
+// audit records an admin action when audit logging is enabled.
+// A failure to record is logged only since the action has already taken place.
+func audit(actor string, action string, target string, detail string) {
+	if auditLogs == nil {
+		return
+	}
+	entry := &auditEntry{Time: time.Now().UTC(), Actor: actor, Action: action, Target: target, Detail: detail}
+	if err := auditLogs.Record(entry); err != nil {
+		log.Printf("error writing audit log: %s", err)
+	}
+}
+
+// adminActor returns who sent an admin request: the basic auth user if any, or else the remote address.
+func adminActor(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user + "@" + r.RemoteAddr
+	}
+	return r.RemoteAddr
+}
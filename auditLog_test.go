@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("auditLog", func() {
+	It("should append one json line per admin action", func() {
+		dir, err := os.MkdirTemp("", "auditLog")
+		Expect(err).To(Not(HaveOccurred()))
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "audit.log")
+
+		defer func() { auditLogs = nil }()
+		auditLogs, err = newAuditLogger(path)
+		Expect(err).To(Not(HaveOccurred()))
+		audit("127.0.0.1:5000", "tunnel.close", "demo", "")
+		auditLogs.Close()
+
+		// Reopening keeps the previous entries.
+		auditLogs, err = newAuditLogger(path)
+		Expect(err).To(Not(HaveOccurred()))
+		audit("signal", "config.reload", "", "SIGHUP")
+		auditLogs.Close()
+
+		b, err := os.ReadFile(path)
+		Expect(err).To(Not(HaveOccurred()))
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		Expect(lines).To(HaveLen(2))
+		Expect(lines[0]).To(ContainSubstring(`"actor":"127.0.0.1:5000","action":"tunnel.close","target":"demo"`))
+		Expect(lines[1]).To(ContainSubstring(`"action":"config.reload"`))
+	})
+
+	It("should identify the actor of an admin request", func() {
+		r := httptest.NewRequest("POST", "/tunnels", nil)
+		r.RemoteAddr = "127.0.0.1:5000"
+		Expect(adminActor(r)).To(Equal("127.0.0.1:5000"))
+		r.SetBasicAuth("ops", "secret")
+		Expect(adminActor(r)).To(Equal("ops@127.0.0.1:5000"))
+	})
+})
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authorization headers remembered per tunnel once their password matched a bcrypt hash.
+const basicAuthMaxVerified = 1000
+
+// WWW-Authenticate header of the 401 responses of tunnels protected by basicAuth.
+const basicAuthChallenge = `WWW-Authenticate: Basic realm="tunnel", charset="UTF-8"`
+
+// basicAuth protects an HTTP tunnel with HTTP Basic authentication at the server (auth=user:password). The password
+// can be a bcrypt hash as written by `htpasswd -nB user` so that it is not sent in the clear to the server.
+type basicAuth struct {
+	user     string
+	password string // Empty with a hash
+	hash     []byte
+
+	// bcrypt is slow on purpose, so the SHA-256 of the Authorization headers that matched the hash are kept
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]struct{}
+}
+
+// parseBasicAuth parses the value of the auth option, user:password or user:bcrypt hash.
+func parseBasicAuth(value string) (*basicAuth, error) {
+	user, password, found := cut(value, ":")
+	if !found || user == "" || password == "" {
+		// The value is not logged as it holds a password
+		return nil, errors.New("invalid auth value, expected user:password")
+	}
+	a := &basicAuth{user: user}
+	if strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$") {
+		if _, err := bcrypt.Cost([]byte(password)); err != nil {
+			return nil, errors.New("invalid auth value, the bcrypt hash is malformed")
+		}
+		a.hash = []byte(password)
+		a.verified = make(map[[sha256.Size]byte]struct{})
+	} else {
+		a.password = password
+	}
+	return a, nil
+}
+
+// Allowed returns true if the Authorization header of a request holds the credentials of the tunnel.
+func (a *basicAuth) Allowed(authorization string) bool {
+	scheme, encoded, found := cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	user, password, found := cut(string(decoded), ":")
+	if !found {
+		return false
+	}
+	userMatches := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+	if a.hash == nil {
+		passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1
+		return userMatches && passwordMatches
+	}
+	if !userMatches {
+		return false
+	}
+
+	key := sha256.Sum256([]byte(authorization))
+	a.mu.Lock()
+	_, ok := a.verified[key]
+	a.mu.Unlock()
+	if ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(a.hash, []byte(password)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.verified) >= basicAuthMaxVerified {
+		a.verified = make(map[[sha256.Size]byte]struct{})
+	}
+	a.verified[key] = struct{}{}
+	return true
+}
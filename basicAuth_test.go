@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/base64"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ = Describe("basicAuth", func() {
+	header := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	It("should check a plain password", func() {
+		a, err := parseBasicAuth("alice:s3cret:x")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(a.Allowed(header("alice:s3cret:x"))).To(BeTrue())
+		Expect(a.Allowed("basic " + base64.StdEncoding.EncodeToString([]byte("alice:s3cret:x")))).To(BeTrue())
+		Expect(a.Allowed(header("alice:s3cret"))).To(BeFalse())
+		Expect(a.Allowed(header("bob:s3cret:x"))).To(BeFalse())
+		Expect(a.Allowed("")).To(BeFalse())
+		Expect(a.Allowed("Bearer abc")).To(BeFalse())
+		Expect(a.Allowed("Basic !!!")).To(BeFalse())
+	})
+
+	It("should check a bcrypt hash and remember the matching headers", func() {
+		hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+		Expect(err).To(Not(HaveOccurred()))
+		a, err := parseBasicAuth("alice:" + string(hash))
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(a.password).To(BeEmpty())
+		Expect(a.Allowed(header("alice:s3cret"))).To(BeTrue())
+		Expect(a.verified).To(HaveLen(1))
+		Expect(a.Allowed(header("alice:s3cret"))).To(BeTrue())
+		Expect(a.Allowed(header("alice:other"))).To(BeFalse())
+		Expect(a.Allowed(header("bob:s3cret"))).To(BeFalse())
+		Expect(a.verified).To(HaveLen(1))
+	})
+
+	It("should reject invalid values", func() {
+		for _, value := range []string{"alice", "alice:", ":s3cret", "alice:$2y$10$short"} {
+			_, err := parseBasicAuth(value)
+			Expect(err).To(HaveOccurred(), value)
+			Expect(err.Error()).To(Not(ContainSubstring("s3cret")))
+		}
+		options, err := parseTunnelOptions("type=http,auth=alice:s3cret")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.basicAuth.user).To(Equal("alice"))
+	})
+
+	It("should reject values containing a comma unless the exec request is JSON", func() {
+		for _, request := range []string{"type=http,auth=alice:s3,cret", "type=http,password=s3,cret", "type=http,rewrite=~^/(a|b)$->/x,cret", "tunnelName"} {
+			_, err := parseTunnelOptions(request)
+			Expect(err).To(HaveOccurred(), request)
+			Expect(err.Error()).To(Not(ContainSubstring("cret")), request)
+		}
+		options, err := parseTunnelOptions("type=http,auth=alice:s3cret,")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.basicAuth.user).To(Equal("alice"))
+
+		options, err = parseTunnelOptions(`{"version":1,"type":"http","auth":"alice:s3,cret"}`)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.basicAuth.Allowed(header("alice:s3,cret"))).To(BeTrue())
+		Expect(options.basicAuth.Allowed(header("alice:s3"))).To(BeFalse())
+	})
+})
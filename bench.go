@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// benchmark drives HTTP requests from concurrent clients through a tunnel and measures their latency.
+type benchmark struct {
+	selfTest
+	clients  int           // Concurrent connections sending requests
+	rate     int           // Requests per second over all clients. 0 sends requests as fast as possible.
+	duration time.Duration // How long requests are sent
+	size     int           // Bytes of each response
+	mux      bool          // Multiplex the requests of the tunnel over one channel
+}
+
+// benchmarkResult holds the requests of a benchmark.
+type benchmarkResult struct {
+	latencies []time.Duration // Latency of the successful requests
+	errors    int
+	bytes     int64 // Response body bytes
+	elapsed   time.Duration
+}
+
+// runBench runs `tunnel bench` with args and returns the exit code: 0 unless no request succeeds.
+func runBench(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(out)
+	server := fs.String("server", net.JoinHostPort("localhost", strconv.Itoa(sshPort)), "SSH address of the server.")
+	keyFile := fs.String("key", "", "Private key file of an authorized client. Not needed with --local.")
+	user := fs.String("user", "bench", "SSH user name.")
+	httpPort := fs.Int("httpPort", 80, "Remote port of the HTTP tunnel, one of the server --httpPorts.")
+	httpAddr := fs.String("httpAddr", "", "Address to send HTTP requests to instead of the tunnel URL (eg localhost:80) when the domain does not resolve here.")
+	local := fs.Bool("local", false, "Start a developer mode server (tunnel --dev) for the benchmark and stop it afterwards.")
+	clients := fs.Int("clients", 10, "Number of concurrent clients, each with its own connection.")
+	rate := fs.Int("rate", 0, "Requests per second over all clients. 0 sends requests as fast as possible.")
+	duration := fs.Duration("duration", 10*time.Second, "How long requests are sent.")
+	size := fs.Int("size", 1024, "Bytes of each response.")
+	mux := fs.Bool("mux", false, "Multiplex the requests of the tunnel over one channel (mux=true).")
+	timeout := fs.Duration("timeout", 30*time.Second, "Timeout of opening the tunnel and of each request.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *clients < 1 || *rate < 0 || *size < 0 {
+		fmt.Fprintln(out, "bench: --clients must be positive and --rate and --size not negative")
+		return 2
+	}
+
+	b := &benchmark{
+		selfTest: selfTest{server: *server, user: *user, httpPort: *httpPort, httpAddr: *httpAddr, timeout: *timeout},
+		clients:  *clients, rate: *rate, duration: *duration, size: *size, mux: *mux,
+	}
+	var err error
+	if *local {
+		stop, err := startLocalServer(b.timeout)
+		if err != nil {
+			fmt.Fprintf(out, "bench: %s\n", err)
+			return 1
+		}
+		defer stop()
+		b.server = net.JoinHostPort("localhost", strconv.Itoa(sshPort))
+		b.httpPort = devHTTPPort
+		b.httpAddr = net.JoinHostPort("localhost", strconv.Itoa(devHTTPPort))
+	}
+	switch {
+	case *keyFile != "":
+		b.signer, err = loadClientKey(*keyFile)
+	case *local:
+		// Developer mode servers without authorized keys accept any key
+		b.signer, err = newDevHostKey()
+	default:
+		err = errors.New("--key is required without --local")
+	}
+	if err != nil {
+		fmt.Fprintf(out, "bench: %s\n", err)
+		return 2
+	}
+
+	result, err := b.run(context.Background())
+	if err != nil {
+		fmt.Fprintf(out, "bench: %s\n", err)
+		return 1
+	}
+	result.print(out)
+	if len(result.latencies) == 0 {
+		return 1
+	}
+	return 0
+}
+
+// run opens an HTTP tunnel and sends requests through it from b.clients clients for b.duration.
+func (b *benchmark) run(ctx context.Context) (*benchmarkResult, error) {
+	payload := bytes.Repeat([]byte("a"), b.size)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		w.Write(payload)
+	})
+	options := "type=http,tunnelName=bench-" + newRequestID()[:8]
+	if b.mux {
+		options += ",mux=true"
+	}
+	tunnelURL, closeTunnel, err := b.openTunnel(ctx, options, b.httpPort, serveTunnelHTTP(handler, b.mux))
+	if err != nil {
+		return nil, err
+	}
+	defer closeTunnel()
+	u, transport, err := b.httpTransport(tunnelURL)
+	if err != nil {
+		return nil, err
+	}
+	target := u.String()
+
+	ctx, cancel := context.WithTimeout(ctx, b.duration)
+	defer cancel()
+	var tokens <-chan struct{}
+	if b.rate > 0 {
+		tokens = pace(ctx, b.rate, b.clients)
+	}
+
+	results := make([]benchmarkResult, b.clients)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(r *benchmarkResult) {
+			defer wg.Done()
+			// Each client keeps its own connection
+			client := &http.Client{Transport: transport.Clone(), Timeout: b.timeout}
+			defer client.CloseIdleConnections()
+			for {
+				if tokens != nil {
+					if _, ok := <-tokens; !ok {
+						return
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				sent := time.Now()
+				n, err := sendBenchmarkRequest(client, target)
+				if err != nil {
+					if ctx.Err() == nil {
+						r.errors++
+					}
+					continue
+				}
+				r.latencies = append(r.latencies, time.Since(sent))
+				r.bytes += n
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	total := &benchmarkResult{elapsed: time.Since(start)}
+	for _, r := range results {
+		total.latencies = append(total.latencies, r.latencies...)
+		total.errors += r.errors
+		total.bytes += r.bytes
+	}
+	sort.Slice(total.latencies, func(i, j int) bool { return total.latencies[i] < total.latencies[j] })
+	return total, nil
+}
+
+// sendBenchmarkRequest sends a GET request to target and returns the bytes of the response body.
+func sendBenchmarkRequest(client *http.Client, target string) (int64, error) {
+	resp, err := client.Get(target)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("GET %s: %s", target, resp.Status)
+	}
+	return n, err
+}
+
+// pace returns a channel that receives rate values per second until ctx is done. Values due while every client is
+// busy are sent as soon as one is ready, so that clients catch up with the rate.
+func pace(ctx context.Context, rate int, clients int) <-chan struct{} {
+	tokens := make(chan struct{}, clients)
+	go func() {
+		defer close(tokens)
+		start := time.Now()
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		sent := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			due := int(time.Since(start).Seconds() * float64(rate))
+			for ; sent < due; sent++ {
+				select {
+				case tokens <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return tokens
+}
+
+// percentile returns the latency under which p (0 to 1) of the latencies are, which must be sorted.
+func (r *benchmarkResult) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(r.latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return r.latencies[i]
+}
+
+func (r *benchmarkResult) print(out io.Writer) {
+	seconds := r.elapsed.Seconds()
+	fmt.Fprintf(out, "Requests:   %d (%d errors) in %s\n", len(r.latencies), r.errors, r.elapsed.Round(time.Millisecond))
+	fmt.Fprintf(out, "Rate:       %.1f requests/s\n", float64(len(r.latencies))/seconds)
+	fmt.Fprintf(out, "Throughput: %.2f MB/s\n", float64(r.bytes)/seconds/1e6)
+	round := func(d time.Duration) time.Duration { return d.Round(time.Microsecond) }
+	fmt.Fprintf(out, "Latency:    p50 %s, p90 %s, p99 %s, max %s\n",
+		round(r.percentile(0.5)), round(r.percentile(0.9)), round(r.percentile(0.99)), round(r.percentile(1)))
+}
+
+// startLocalServer starts this binary as a developer mode server and waits until it accepts SSH connections.
+// The returned function stops it.
+func startLocalServer(timeout time.Duration) (func(), error) {
+	addr := net.JoinHostPort("localhost", strconv.Itoa(sshPort))
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a server already listens at %s, drop --local to benchmark it", addr)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, "--dev", "--log=warn")
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	stop := func() {
+		cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return stop, nil
+		}
+		select {
+		case err := <-exited:
+			return nil, fmt.Errorf("the local server exited: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			stop()
+			return nil, fmt.Errorf("the local server did not listen at %s within %s", addr, timeout)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("bench", func() {
+	It("should require a client key without --local", func() {
+		var out bytes.Buffer
+		Expect(runBench([]string{"--server=localhost:1"}, &out)).To(Equal(2))
+		Expect(out.String()).To(ContainSubstring("--key is required"))
+	})
+
+	It("should report latency percentiles", func() {
+		r := &benchmarkResult{elapsed: time.Second, bytes: 2e6}
+		for i := 1; i <= 100; i++ {
+			r.latencies = append(r.latencies, time.Duration(i)*time.Millisecond)
+		}
+		Expect(r.percentile(0.5)).To(Equal(50 * time.Millisecond))
+		Expect(r.percentile(0.99)).To(Equal(99 * time.Millisecond))
+		Expect(r.percentile(1)).To(Equal(100 * time.Millisecond))
+		Expect((&benchmarkResult{}).percentile(0.5)).To(BeZero())
+
+		var out bytes.Buffer
+		r.print(&out)
+		Expect(out.String()).To(ContainSubstring("100.0 requests/s"))
+		Expect(out.String()).To(ContainSubstring("2.00 MB/s"))
+		Expect(out.String()).To(ContainSubstring("p50 50ms, p90 90ms, p99 99ms, max 100ms"))
+	})
+
+	It("should pace requests at the rate", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		received := 0
+		for range pace(ctx, 100, 1) {
+			received++
+		}
+		Expect(received).To(BeNumerically("~", 20, 3))
+	})
+})
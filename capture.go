@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const replayTimeout = 30 * time.Second
+
+// Recent http requests sent through the tunnels. nil when capturing is disabled.
+var requestCaptures *captureRing
+
+// Maximum size of a captured http request (headers and body).
+var captureMaxBytes int
+
+type capturedRequest struct {
+	id          uint64
+	time        time.Time
+	cacheKey    string // Key of the tunnel in sshTunnelListeners
+	tunnelName  string
+	fingerprint string // Public key fingerprint of the tunnel owner
+	method      string
+	uri         string
+	raw         []byte // Request as sent to the client
+	truncated   bool   // Request was larger than captureMaxBytes and cannot be replayed
+}
+
+// captureRing is a bounded ring buffer that keeps the most recent captured requests.
+type captureRing struct {
+	sync.Mutex
+	entries []*capturedRequest
+	next    int
+	lastID  uint64
+}
+
+func newCaptureRing(size int) *captureRing {
+	return &captureRing{entries: make([]*capturedRequest, size)}
+}
+
+// Add stores c overwriting the oldest request if the ring is full.
+func (r *captureRing) Add(c *capturedRequest) {
+	r.Lock()
+	defer r.Unlock()
+	r.lastID++
+	c.id = r.lastID
+	r.entries[r.next] = c
+	r.next = (r.next + 1) % len(r.entries)
+}
+
+// Get returns the captured request with the specified id if it is still in the ring.
+func (r *captureRing) Get(id uint64) (*capturedRequest, bool) {
+	r.Lock()
+	defer r.Unlock()
+	for _, c := range r.entries {
+		if c != nil && c.id == id {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// List returns the captured requests of the tunnels owned by fingerprint, oldest first.
+func (r *captureRing) List(fingerprint string) []*capturedRequest {
+	r.Lock()
+	defer r.Unlock()
+	var list []*capturedRequest
+	for i := 0; i < len(r.entries); i++ {
+		c := r.entries[(r.next+i)%len(r.entries)]
+		if c != nil && c.fingerprint == fingerprint {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// captureBuffer records up to max bytes written to it.
+// Write never fails so that it can be used with io.TeeReader without affecting the request.
+type captureBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	remaining := b.max - b.Len()
+	if remaining < len(p) {
+		b.truncated = true
+		if remaining > 0 {
+			b.Buffer.Write(p[:remaining])
+		}
+		return len(p), nil
+	}
+	b.Buffer.Write(p)
+	return len(p), nil
+}
+
+// replayClient returns the client of the tunnel of c with the key that the request was captured for. The request,
+// with its cookies and credentials, is never sent to a client of another key that took the tunnel name since.
+// sshTunnelListenersLock must be held.
+func replayClient(c *capturedRequest) (sshTunnelsListenerData, error) {
+	sshClient, ok := sshTunnelListeners[c.cacheKey]
+	if !ok {
+		return sshTunnelsListenerData{}, fmt.Errorf("tunnel %s is not connected", c.tunnelName)
+	}
+	members := []sshTunnelsListenerData{sshClient}
+	if sshClient.group != nil {
+		members = sshClient.group.Members()
+	}
+	for _, member := range members {
+		if member.conn != nil && member.conn.Fingerprint() == c.fingerprint {
+			return member, nil
+		}
+	}
+	return sshTunnelsListenerData{}, fmt.Errorf("tunnel %s is now held by another key", c.tunnelName)
+}
+
+// replayRequest sends the captured request again to the current client of its tunnel
+// and copies the response into w.
+func replayRequest(c *capturedRequest, w io.Writer) error {
+	sshTunnelListenersLock.Lock()
+	sshClient, err := replayClient(c)
+	sshTunnelListenersLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sshChannelConn, err := openTunnelChannel(sshClient, "127.0.0.1", 0)
+	if err != nil {
+		return fmt.Errorf("error opening %s channel: %s", forwardedTCPChannelType, err)
+	}
+	defer sshChannelConn.Close()
+
+	// Do not wait forever on a client that never responds.
+	timer := time.AfterFunc(replayTimeout, func() {
+		sshChannelConn.Close()
+	})
+	defer timer.Stop()
+
+	if _, err := sshChannelConn.Write(c.raw); err != nil {
+		return fmt.Errorf("error writing request: %s", err)
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	responseHttpProcessor := getHttpProcessor(&eofReader{r: sshChannelConn}, *buf)
+	defer putHttpProcessor(responseHttpProcessor)
+	responseHttpProcessor.requestMethod = c.method
+	if err := responseHttpProcessor.ReadHeadersIfNeeded(); err != nil {
+		return fmt.Errorf("error reading response: %s", err)
+	}
+	if _, err := io.Copy(w, responseHttpProcessor.GetReader()); err != nil {
+		return fmt.Errorf("error reading response: %s", err)
+	}
+	return nil
+}
+
+// replayCommand lists the captured requests of the caller's tunnels or replays the one with the specified id.
+// Usage: replay [ID]
+func replayCommand(session *commandSession, args []string) error {
+	if requestCaptures == nil {
+		return fmt.Errorf("request capturing is disabled on this server")
+	}
+
+	if len(args) == 0 {
+		for _, c := range requestCaptures.List(session.fingerprint) {
+			note := ""
+			if c.truncated {
+				note = " (too large to replay)"
+			}
+			fmt.Fprintf(session.channel, "%-6d %s %-15s %s %s%s\n", c.id, c.time.Format(time.RFC3339), c.tunnelName, c.method, c.uri, note)
+		}
+		return nil
+	}
+
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid request id %q", args[0])
+	}
+	c, ok := requestCaptures.Get(id)
+	if !ok || c.fingerprint != session.fingerprint {
+		return fmt.Errorf("request %d not found", id)
+	}
+	if c.truncated {
+		return fmt.Errorf("request %d is too large to replay", id)
+	}
+	return replayRequest(c, session.channel)
+}
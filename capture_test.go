@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("capture", func() {
+
+	Context("captureRing", func() {
+
+		It("should keep only the most recent requests", func() {
+			sut := newCaptureRing(2)
+			for _, uri := range []string{"/a", "/b", "/c"} {
+				sut.Add(&capturedRequest{fingerprint: "fp", uri: uri})
+			}
+
+			_, ok := sut.Get(1)
+			Expect(ok).To(BeFalse())
+
+			list := sut.List("fp")
+			Expect(list).To(HaveLen(2))
+			Expect(list[0].uri).To(Equal("/b"))
+			Expect(list[1].uri).To(Equal("/c"))
+			Expect(list[1].id).To(Equal(uint64(3)))
+		})
+
+		It("should list only the requests of the specified fingerprint", func() {
+			sut := newCaptureRing(5)
+			sut.Add(&capturedRequest{fingerprint: "fp1", uri: "/a"})
+			sut.Add(&capturedRequest{fingerprint: "fp2", uri: "/b"})
+
+			list := sut.List("fp2")
+			Expect(list).To(HaveLen(1))
+			Expect(list[0].uri).To(Equal("/b"))
+		})
+	})
+
+	Context("replayRequest", func() {
+
+		It("should not replay a request to a client of another key", func() {
+			newConn := func(fingerprint string) *sshConnection {
+				return newSSHConnection(&ssh.ServerConn{Permissions: &ssh.Permissions{Extensions: map[string]string{"pubkey-fp": fingerprint}}}, nil)
+			}
+			group := newTunnelGroup(stickyNone)
+			group.shared = true
+			group.Add(sshTunnelsListenerData{conn: newConn("fp2"), sessionID: "2", clientID: "2", group: group})
+			group.Add(sshTunnelsListenerData{conn: newConn("fp1"), sessionID: "1", clientID: "1", group: group})
+			primary, _ := group.Primary()
+			sshTunnelListenersLock.Lock()
+			sshTunnelListeners["localhost:80replayed"] = primary
+			sshTunnelListenersLock.Unlock()
+			defer func() {
+				sshTunnelListenersLock.Lock()
+				delete(sshTunnelListeners, "localhost:80replayed")
+				sshTunnelListenersLock.Unlock()
+			}()
+
+			c := &capturedRequest{cacheKey: "localhost:80replayed", tunnelName: "replayed", fingerprint: "fp1"}
+			sshTunnelListenersLock.Lock()
+			member, err := replayClient(c)
+			sshTunnelListenersLock.Unlock()
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(member.sessionID).To(Equal("1"))
+
+			group.Remove("1")
+			err = replayRequest(c, io.Discard)
+			Expect(err).To(MatchError("tunnel replayed is now held by another key"))
+		})
+	})
+
+	Context("captureBuffer", func() {
+
+		It("should truncate writes beyond max without failing", func() {
+			sut := &captureBuffer{max: 5}
+			n, err := sut.Write([]byte("abc"))
+			Expect(n).To(Equal(3))
+			Expect(err).To(Not(HaveOccurred()))
+
+			n, err = sut.Write([]byte(strings.Repeat("d", 10)))
+			Expect(n).To(Equal(10))
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(sut.String()).To(Equal("abcdd"))
+			Expect(sut.truncated).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Pre-opened forwarded-tcpip channels of each HTTP tunnel, so that a request does not wait for the round trip of
+// opening one. Each pooled channel holds a connection to the local server of the client, and channels idle for
+// longer than channelPoolIdle are closed since local servers close idle connections too. These are set from
+// command line flags; a size of 0 disables the pools.
+var (
+	channelPoolSize = 0
+	channelPoolIdle = 30 * time.Second
+)
+
+// Requests served by a pooled channel or by a channel opened on demand, published at /debug/vars of the pprof port.
+var (
+	channelPoolHits   = expvar.NewInt("channelPoolHits")
+	channelPoolMisses = expvar.NewInt("channelPoolMisses")
+)
+
+type pooledChannel struct {
+	channel ssh.Channel
+	opened  time.Time
+	closed  <-chan struct{} // Closed once the client closes the channel
+}
+
+// channelPool keeps up to size idle channels of a tunnel and opens new ones in the background as they are taken.
+type channelPool struct {
+	size    int
+	open    func() (ssh.Channel, <-chan struct{}, error)
+	mu      sync.Mutex
+	idle    []*pooledChannel
+	filling bool
+	closed  bool
+}
+
+// newChannelPool returns a pool of size channels opened with open. The pool is filled from the first Get since
+// clients reject channels until their port forward is accepted.
+func newChannelPool(size int, open func() (ssh.Channel, <-chan struct{}, error)) *channelPool {
+	return &channelPool{size: size, open: open}
+}
+
+// Get returns an idle channel if any and opens another one in the background. It returns false if the pool
+// is empty or nil.
+func (p *channelPool) Get() (ssh.Channel, bool) {
+	if p == nil {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.fill()
+	defer p.mu.Unlock()
+	for len(p.idle) > 0 {
+		c := p.idle[0]
+		p.idle = p.idle[1:]
+		if isChannelClosed(c.closed) {
+			continue
+		}
+		if time.Since(c.opened) > channelPoolIdle {
+			c.channel.Close()
+			continue
+		}
+		channelPoolHits.Add(1)
+		return c.channel, true
+	}
+	channelPoolMisses.Add(1)
+	return nil, false
+}
+
+// fill opens channels in the background until the pool is full. Opening stops at the first error, usually because
+// the SSH connection is gone, and resumes with the next Get.
+func (p *channelPool) fill() {
+	p.mu.Lock()
+	if p.filling || p.closed || len(p.idle) >= p.size || underMemoryPressure.Load() {
+		p.mu.Unlock()
+		return
+	}
+	p.filling = true
+	p.mu.Unlock()
+
+	go func() {
+		for {
+			channel, closed, err := p.open()
+			p.mu.Lock()
+			if err != nil || p.closed {
+				p.filling = false
+				p.mu.Unlock()
+				if err != nil {
+					log.Debugf("error pre-opening forwarded-tcpip channel: %s", err)
+				} else {
+					channel.Close()
+				}
+				return
+			}
+			p.idle = append(p.idle, &pooledChannel{channel: channel, opened: time.Now(), closed: closed})
+			full := len(p.idle) >= p.size
+			if full {
+				p.filling = false
+			}
+			p.mu.Unlock()
+			if full {
+				return
+			}
+		}
+	}()
+}
+
+// Close closes the idle channels and stops filling the pool. It does nothing if the pool is nil.
+func (p *channelPool) Close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, c := range p.idle {
+		c.channel.Close()
+	}
+	p.idle = nil
+}
+
+// Drain closes the idle channels, which are opened again by the next Get. It does nothing if the pool is nil.
+func (p *channelPool) Drain() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.idle {
+		c.channel.Close()
+	}
+	p.idle = nil
+}
+
+func isChannelClosed(closed <-chan struct{}) bool {
+	select {
+	case <-closed:
+		return true
+	default:
+		return false
+	}
+}
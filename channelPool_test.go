@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeChannel is an ssh.Channel that records Close.
+type fakeChannel struct {
+	ssh.Channel
+	closed int32
+}
+
+func (c *fakeChannel) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+var _ = Describe("channelPool", func() {
+	var opened int32
+	open := func() (ssh.Channel, <-chan struct{}, error) {
+		atomic.AddInt32(&opened, 1)
+		return &fakeChannel{}, make(chan struct{}), nil
+	}
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&opened, 0)
+	})
+
+	It("should fill the pool from the first Get", func() {
+		p := newChannelPool(2, open)
+		defer p.Close()
+		Expect(atomic.LoadInt32(&opened)).To(Equal(int32(0)))
+
+		_, ok := p.Get()
+		Expect(ok).To(BeFalse())
+		Eventually(func() int32 { return atomic.LoadInt32(&opened) }).Should(Equal(int32(2)))
+
+		_, ok = p.Get()
+		Expect(ok).To(BeTrue())
+		Eventually(func() int32 { return atomic.LoadInt32(&opened) }).Should(Equal(int32(3)))
+	})
+
+	It("should skip closed and expired channels", func() {
+		defer func(idle time.Duration) { channelPoolIdle = idle }(channelPoolIdle)
+		closed := make(chan struct{})
+		close(closed)
+		expired := &fakeChannel{}
+		p := newChannelPool(2, func() (ssh.Channel, <-chan struct{}, error) { return nil, nil, errors.New("closed") })
+		p.idle = []*pooledChannel{
+			{channel: &fakeChannel{}, opened: time.Now(), closed: closed},
+			{channel: expired, opened: time.Now().Add(-time.Hour), closed: make(chan struct{})},
+		}
+		_, ok := p.Get()
+		Expect(ok).To(BeFalse())
+		Expect(atomic.LoadInt32(&expired.closed)).To(Equal(int32(1)))
+	})
+
+	It("should be disabled when nil", func() {
+		var p *channelPool
+		_, ok := p.Get()
+		Expect(ok).To(BeFalse())
+		p.Close()
+	})
+})
@@ -279,3 +279,32 @@ var _ = Describe("Chunk Reader", func() {
 	})
 
 })
+
+func BenchmarkChunkedReader(b *testing.B) {
+	var buf bytes.Buffer
+	w := httputil.NewChunkedWriter(&buf)
+	chunk := bytes.Repeat([]byte("a"), 4096)
+	for i := 0; i < 16; i++ {
+		w.Write(chunk)
+	}
+	w.Close()
+	buf.WriteString("\r\n")
+
+	readBuf := make([]byte, 32<<10)
+	byter := bytes.NewReader(buf.Bytes())
+	bufr := bufio.NewReader(byter)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(chunk) * 16))
+	for i := 0; i < b.N; i++ {
+		byter.Seek(0, io.SeekStart)
+		bufr.Reset(byter)
+		r := NewChunkedReader(bufr)
+		for {
+			if _, err := r.Read(readBuf); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker tracks consecutive upstream failures of a tunnel.
+// Once tripped, requests are rejected until the cool-down period elapses, after which
+// a single trial request is let through to decide whether to close or re-open the breaker.
+// A nil breaker allows everything.
+type circuitBreaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow returns true if a request can be sent upstream.
+func (b *circuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// Half-open: let this request through and hold the others until it reports back.
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+// Success closes the breaker.
+func (b *circuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.failures = 0
+}
+
+// Failure records an upstream failure and returns true if the breaker has just tripped.
+func (b *circuitBreaker) Failure() bool {
+	if b == nil {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		return b.failures == b.threshold
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("circuitBreaker", func() {
+
+	It("should allow everything when disabled", func() {
+		sut := newCircuitBreaker(0, time.Minute)
+		Expect(sut.Failure()).To(BeFalse())
+		Expect(sut.Allow()).To(BeTrue())
+	})
+
+	It("should trip after consecutive failures", func() {
+		sut := newCircuitBreaker(2, time.Minute)
+		Expect(sut.Failure()).To(BeFalse())
+		Expect(sut.Allow()).To(BeTrue())
+		Expect(sut.Failure()).To(BeTrue())
+		Expect(sut.Allow()).To(BeFalse())
+	})
+
+	It("should reset the count on success", func() {
+		sut := newCircuitBreaker(2, time.Minute)
+		sut.Failure()
+		sut.Success()
+		Expect(sut.Failure()).To(BeFalse())
+		Expect(sut.Allow()).To(BeTrue())
+	})
+
+	It("should let a single trial request through after the cool-down", func() {
+		sut := newCircuitBreaker(1, 10*time.Millisecond)
+		sut.Failure()
+		Expect(sut.Allow()).To(BeFalse())
+		time.Sleep(20 * time.Millisecond)
+		Expect(sut.Allow()).To(BeTrue())
+		Expect(sut.Allow()).To(BeFalse())
+
+		sut.Success()
+		Expect(sut.Allow()).To(BeTrue())
+	})
+})
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var errHostKeyChanged = errors.New("host key changed")
+
+// errTunnelEnded is returned by connect when the server closed the tunnel for good, eg after its idle-timeout.
+var errTunnelEnded = errors.New("tunnel ended by the server")
+
+// Keepalive requests sent by the client so that it notices a dead server and reconnects, like
+// `ssh -o ServerAliveInterval=20 -o ServerAliveCountMax=2` in tunnel.sh.
+const (
+	tunnelClientKeepaliveInterval = 20 * time.Second
+	tunnelClientKeepaliveMaxCount = 2
+)
+
+// tunnelClient opens a tunnel of the server to a local address like `ssh -R` and reconnects with a backoff
+// whenever the SSH connection drops.
+type tunnelClient struct {
+	server     string // SSH address of the server (eg domain.io:5223)
+	config     *ssh.ClientConfig
+	local      string // Address of the local server (eg localhost:3000)
+	tunnelType string // http, https or tcp
+	remotePort int    // Port of the server to listen at
+	options    string // Exec options of the tunnel (see parseTunnelOptions)
+	mux        bool   // Requests are streams of one channel
+	out        io.Writer
+
+	inspector *requestInspector // Records the HTTP requests of the tunnel when not nil
+	label     string            // Name of the tunnel in the inspector
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// stringList is a flag that may be repeated.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// runClient runs `tunnel client` (or the binary linked as tunnel-client) with args and returns the exit code.
+// It only returns once interrupted or when the server rejects the key.
+func runClient(args []string, out io.Writer) int {
+	if len(args) > 0 && args[0] == "start" {
+		return runClientStart(args[1:], out)
+	}
+	return runClientTunnels(splitTunnelArgs(args), out)
+}
+
+// runClientTunnels runs `tunnel-client http 3000 --name api tcp 5432`, which opens one or more tunnels at once, each
+// over its own SSH connection as the server takes one tunnel per connection. It returns the exit code.
+func runClientTunnels(tunnels [][]string, out io.Writer) int {
+	var outMu sync.Mutex
+	profiles := make([]tunnelProfile, len(tunnels))
+	clients := make([]*tunnelClient, len(tunnels))
+	for i, args := range tunnels {
+		p, err := parseTunnelArgs(args, out)
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		if err == nil {
+			// Lines of each tunnel are prefixed with its type and local port
+			var tunnelOut io.Writer = &prefixWriter{w: out, mu: &outMu, prefix: "[" + p.label() + "] "}
+			if len(tunnels) == 1 {
+				tunnelOut = out
+			}
+			clients[i], err = p.newClient(tunnelOut)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "tunnel-client: %s\n", err)
+			return 2
+		}
+		profiles[i] = p
+	}
+	if profiles[0].Inspect != "" {
+		inspector := startInspector(profiles[0].Inspect, out)
+		for i, c := range clients {
+			c.inspect(inspector, profiles[i].label())
+		}
+	}
+	return runTunnelClients(clients, &outMu)
+}
+
+// splitTunnelArgs splits the command line of tunnel-client at each tunnel type (http, https or tcp) into the
+// arguments of each tunnel. Flags before the first tunnel type apply to every tunnel.
+func splitTunnelArgs(args []string) [][]string {
+	var common []string
+	var tunnels [][]string
+	for i, arg := range args {
+		isType := arg == "http" || arg == "https" || arg == "tcp"
+		// The value of a flag, eg --name http
+		if i > 0 && isType {
+			previous := strings.TrimLeft(args[i-1], "-")
+			isType = !strings.HasPrefix(args[i-1], "-") || strings.Contains(previous, "=") || previous == "mux"
+		}
+		switch {
+		case isType:
+			tunnels = append(tunnels, append(append([]string{}, common...), arg))
+		case len(tunnels) == 0:
+			common = append(common, arg)
+		default:
+			tunnels[len(tunnels)-1] = append(tunnels[len(tunnels)-1], arg)
+		}
+	}
+	if len(tunnels) == 0 {
+		return [][]string{common}
+	}
+	return tunnels
+}
+
+// tunnelProfile describes a tunnel of tunnel-client, from its command line or a profile of the configuration file
+// (see clientConfig). Empty fields take their defaults.
+type tunnelProfile struct {
+	Type       string   `yaml:"type"`       // http (default), https or tcp
+	Local      string   `yaml:"local"`      // [HOST:]PORT of the local server
+	Name       string   `yaml:"name"`       // Tunnel name of an HTTP tunnel
+	Host       string   `yaml:"host"`       // Host header sent to the local server. Defaults to Local.
+	RemotePort *int     `yaml:"remotePort"` // Port of the server. Defaults to 80 for HTTP and a random port for TCP.
+	Mux        bool     `yaml:"mux"`
+	Options    []string `yaml:"options"` // Other tunnel options as key=value
+
+	// SSH connection. Server defaults to $TUNNEL_DOMAIN and Key to the first key of ~/.ssh.
+	Server     string `yaml:"server"`
+	Key        string `yaml:"key"`
+	User       string `yaml:"user"`
+	KnownHosts string `yaml:"knownHosts"`
+
+	// Address of the request inspector of the client, from the command line only
+	Inspect string `yaml:"-"`
+}
+
+// parseTunnelArgs returns the tunnel of `tunnel-client http|https|tcp [HOST:]PORT [flags]`. Flags may come before
+// or after the arguments.
+func parseTunnelArgs(args []string, out io.Writer) (tunnelProfile, error) {
+	fs := flag.NewFlagSet("tunnel-client", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprintln(out, "Usage: tunnel-client [http|https|tcp] [HOST:]PORT [flags] [http|https|tcp [HOST:]PORT [flags]...]")
+		fmt.Fprintln(out, "       tunnel-client start [NAME...] [--config FILE]")
+		fmt.Fprintln(out, "Opens a tunnel of the server to a local port, eg tunnel-client http 3000 --name myapp, or the named tunnels of ~/.tunnel.yaml")
+		fs.PrintDefaults()
+	}
+	var p tunnelProfile
+	var remotePort int
+	fs.StringVar(&p.Name, "name", os.Getenv("USER"), "Tunnel name (subdomain or path) of an HTTP tunnel.")
+	fs.StringVar(&p.Server, "server", "", "SSH address of the server. Defaults to $TUNNEL_DOMAIN at port 5223.")
+	fs.StringVar(&p.Key, "key", "", "Private key file. Defaults to the first of ~/.ssh/id_ed25519, ~/.ssh/id_ecdsa and ~/.ssh/id_rsa.")
+	fs.StringVar(&p.User, "user", "", "SSH user name. Defaults to $USER.")
+	fs.IntVar(&remotePort, "remotePort", -1, "Port of the server to listen at. Defaults to 80 for HTTP tunnels and a random port for TCP tunnels.")
+	fs.StringVar(&p.Host, "host", "", "Host header sent to the local server by HTTP tunnels. Defaults to the local address.")
+	fs.BoolVar(&p.Mux, "mux", false, "Multiplex the requests of an HTTP tunnel over one channel.")
+	fs.StringVar(&p.KnownHosts, "knownHosts", "", "known_hosts file to verify the host key of the server with (default ~/.ssh/known_hosts). Servers missing from it are trusted on first use.")
+	fs.Var((*stringList)(&p.Options), "option", "Tunnel option key=value (eg cache=true or rewrite=/api/->/v2/), may be repeated.")
+	fs.StringVar(&p.Inspect, "inspect", defaultInspectorAddr, "Address of the web UI showing the HTTP requests of the tunnels, which can replay them. Empty disables it.")
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return p, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	switch len(positional) {
+	case 2:
+		p.Type, p.Local = positional[0], positional[1]
+	case 1:
+		p.Local = positional[0]
+	default:
+		fs.Usage()
+		return p, errors.New("expected the tunnel type and the local port")
+	}
+	if remotePort >= 0 {
+		p.RemotePort = &remotePort
+	}
+	return p, nil
+}
+
+// label returns the type and local address of the tunnel (eg http 3000) to tell it apart in the output.
+func (p tunnelProfile) label() string {
+	if p.Type == "" {
+		return "http " + p.Local
+	}
+	return p.Type + " " + p.Local
+}
+
+// newClient returns the client of the tunnel described by p.
+func (p tunnelProfile) newClient(out io.Writer) (*tunnelClient, error) {
+	tunnelType := p.Type
+	if tunnelType == "" {
+		tunnelType = "http"
+	}
+	if tunnelType != "http" && tunnelType != "https" && tunnelType != "tcp" {
+		return nil, fmt.Errorf("invalid tunnel type %s, expected http, https or tcp", tunnelType)
+	}
+	local := p.Local
+	if _, err := strconv.Atoi(local); err == nil {
+		local = net.JoinHostPort("localhost", local)
+	}
+	if _, port, err := net.SplitHostPort(local); err != nil {
+		return nil, fmt.Errorf("invalid local address %q", local)
+	} else if n, err := strconv.Atoi(port); err != nil || n <= 0 || n >= 1<<16 {
+		return nil, fmt.Errorf("invalid local port %s", port)
+	}
+	server := p.Server
+	if server == "" && os.Getenv("TUNNEL_DOMAIN") != "" {
+		server = os.Getenv("TUNNEL_DOMAIN")
+	}
+	if server == "" {
+		return nil, errors.New("--server or $TUNNEL_DOMAIN is required")
+	}
+	if !strings.Contains(server, ":") {
+		server = net.JoinHostPort(server, strconv.Itoa(sshPort))
+	}
+	user := p.User
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	knownHosts := p.KnownHosts
+	if knownHosts == "" {
+		knownHosts = filepath.Join("~", ".ssh", "known_hosts")
+	}
+
+	signer, err := loadDefaultClientKey(p.Key)
+	if err != nil {
+		return nil, err
+	}
+	c := &tunnelClient{
+		server: server,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: trustOnFirstUse(expandHome(knownHosts), out),
+			Timeout:         30 * time.Second,
+		},
+		local:      local,
+		tunnelType: tunnelType,
+		mux:        p.Mux,
+		out:        out,
+		minBackoff: time.Second,
+		maxBackoff: 30 * time.Second,
+	}
+
+	// The id lets the server give the tunnel name back after a reconnect
+	options := []string{"type=" + tunnelType, "id=" + newRequestID()}
+	if tunnelType == "tcp" {
+		c.remotePort = 0
+	} else {
+		c.remotePort = 80
+		if p.Name != "" {
+			options = append(options, "tunnelName="+p.Name)
+		}
+		host := p.Host
+		if host == "" {
+			host = local
+		}
+		options = append(options, "header="+host)
+		if c.mux {
+			options = append(options, "mux=true")
+		}
+	}
+	if p.RemotePort != nil {
+		c.remotePort = *p.RemotePort
+	}
+	for _, o := range p.Options {
+		if !strings.Contains(o, "=") || strings.Contains(o, ",") {
+			return nil, fmt.Errorf("invalid option %q, expected key=value", o)
+		}
+		options = append(options, o)
+	}
+	c.options = strings.Join(options, ",")
+	return c, nil
+}
+
+// inspect records the HTTP requests of the tunnel in inspector under label. It must be called before run.
+func (c *tunnelClient) inspect(inspector *requestInspector, label string) {
+	// Private tunnels (inspect=false) write no request lines to inspect
+	if inspector == nil || c.tunnelType == "tcp" || strings.Contains(","+c.options+",", ",inspect=false,") {
+		return
+	}
+	c.inspector, c.label = inspector, label
+	// The request lines of the server feed the inspector
+	c.options += "," + strings.Join(inspectorTunnelOptions, ",")
+}
+
+// run keeps the tunnel open until ctx is done, reconnecting with an exponential backoff.
+func (c *tunnelClient) run(ctx context.Context) error {
+	backoff := c.minBackoff
+	for {
+		start := time.Now()
+		err := c.connect(ctx)
+		if ctx.Err() != nil || errors.Is(err, errTunnelEnded) {
+			return nil
+		}
+		// Retrying cannot fix a rejected key or a changed host key
+		if err != nil && strings.Contains(err.Error(), "unable to authenticate") {
+			return fmt.Errorf("the server rejected the key: %w", err)
+		}
+		if err != nil && strings.Contains(err.Error(), errHostKeyChanged.Error()) {
+			return err
+		}
+		if time.Since(start) > c.maxBackoff {
+			// The tunnel was up for a while, so this is a new outage
+			backoff = c.minBackoff
+		}
+		fmt.Fprintf(c.out, "Disconnected: %s. Reconnecting in %s\n", err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// connect opens the tunnel and prints what the server writes until the connection drops.
+func (c *tunnelClient) connect(ctx context.Context) error {
+	handle := c.forward
+	if c.mux {
+		handle = func(conn net.Conn) {
+			session := newMuxSession(conn, false)
+			defer session.Close()
+			for {
+				stream, err := session.Accept()
+				if err != nil {
+					return
+				}
+				go c.forward(stream)
+			}
+		}
+	}
+	tunnel, err := dialTunnel(ctx, c.server, c.config, c.options, c.remotePort, handle)
+	if err != nil {
+		return err
+	}
+	defer tunnel.client.Close()
+	fmt.Fprintf(c.out, "Tunneling %s -> %s\n", tunnel.address, c.local)
+
+	done := make(chan struct{})
+	defer close(done)
+	go keepalive(tunnel.client, done)
+
+	// Received requests and other messages of the server
+	if c.inspector == nil {
+		io.Copy(c.out, tunnel.output)
+	} else {
+		c.inspectOutput(tunnel.output)
+	}
+	if tunnel.Ended() {
+		return errTunnelEnded
+	}
+	if err := tunnel.client.Wait(); err != nil {
+		return err
+	}
+	return errors.New("connection closed by the server")
+}
+
+// inspectOutput passes the request lines of the server to the inspector and prints them in short, until output
+// ends.
+func (c *tunnelClient) inspectOutput(output *bufio.Reader) {
+	for {
+		line, err := output.ReadString('\n')
+		if r, ok := c.inspector.Ended(c.label, strings.TrimSpace(line)); ok {
+			fmt.Fprintf(c.out, "%s %s %d %dms %dB\n", r.Method, r.Path, r.Status, r.DurationMs, r.Bytes)
+		} else {
+			io.WriteString(c.out, line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// keepalive closes client once the server misses tunnelClientKeepaliveMaxCount keepalive requests in a row, until
+// done is closed.
+func keepalive(client *ssh.Client, done <-chan struct{}) {
+	var missing atomic.Int32
+	ticker := time.NewTicker(tunnelClientKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if missing.Load() >= tunnelClientKeepaliveMaxCount {
+			client.Close()
+			return
+		}
+		missing.Add(1)
+		go func() {
+			// Any reply counts; the server replies true, other servers may reply false
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+				missing.Store(0)
+			}
+		}()
+	}
+}
+
+// forward relays a connection of the tunnel to the local server.
+func (c *tunnelClient) forward(conn net.Conn) {
+	defer conn.Close()
+	local, err := net.DialTimeout("tcp", c.local, 10*time.Second)
+	if err != nil {
+		fmt.Fprintf(c.out, "Could not reach %s: %s\n", c.local, err)
+		return
+	}
+	defer local.Close()
+	go func() {
+		if c.inspector != nil {
+			capture := &captureWriter{}
+			io.Copy(local, io.TeeReader(conn, capture))
+			c.inspector.Captured(c.label, c.local, capture.Bytes(), capture.truncated)
+		} else {
+			io.Copy(local, conn)
+		}
+		// Let the local server finish its response once the visitor is done
+		if tcp, ok := local.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	io.Copy(conn, local)
+}
+
+// loadDefaultClientKey reads the private key of file, or the first default key of ~/.ssh if file is empty.
+func loadDefaultClientKey(file string) (ssh.Signer, error) {
+	if file != "" {
+		return loadClientKey(expandHome(file))
+	}
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		file := expandHome(filepath.Join("~", ".ssh", name))
+		if _, err := os.Stat(file); err == nil {
+			return loadClientKey(file)
+		}
+	}
+	return nil, errors.New("no key found in ~/.ssh, set one with --key")
+}
+
+func expandHome(file string) string {
+	if file != "~" && !strings.HasPrefix(file, "~"+string(filepath.Separator)) {
+		return file
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return file
+	}
+	return filepath.Join(home, file[1:])
+}
+
+// trustOnFirstUse returns a host key callback that verifies the servers of knownHostsFile and trusts the first key
+// of the others for the life of the process, so that a reconnect cannot be taken over with another key.
+func trustOnFirstUse(knownHostsFile string, out io.Writer) ssh.HostKeyCallback {
+	known, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		known = nil
+	}
+	var mu sync.Mutex
+	trusted := map[string]string{}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if known != nil {
+			err := known(hostname, remote, key)
+			var keyErr *knownhosts.KeyError
+			if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+				return err
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fingerprint := ssh.FingerprintSHA256(key)
+		if previous, ok := trusted[hostname]; ok {
+			if previous != fingerprint {
+				return fmt.Errorf("%w for %s from %s to %s", errHostKeyChanged, hostname, previous, fingerprint)
+			}
+			return nil
+		}
+		trusted[hostname] = fingerprint
+		fmt.Fprintf(out, "Warning: %s is not in %s, trusting its host key %s\n", hostname, knownHostsFile, fingerprint)
+		return nil
+	}
+}
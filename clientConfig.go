@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// clientConfig is the configuration file of tunnel-client (~/.tunnel.yaml) with named tunnels, eg
+//
+//	server: mydomain.io
+//	tunnels:
+//	  api:
+//	    local: 3000
+//	    options: [cache=true]
+//	  db:
+//	    type: tcp
+//	    local: 5432
+//
+// The SSH settings at the top level apply to the tunnels that do not set their own.
+type clientConfig struct {
+	Server     string                   `yaml:"server"`
+	Key        string                   `yaml:"key"`
+	User       string                   `yaml:"user"`
+	KnownHosts string                   `yaml:"knownHosts"`
+	Tunnels    map[string]tunnelProfile `yaml:"tunnels"`
+}
+
+// loadClientConfig reads the configuration file of tunnel-client.
+func loadClientConfig(file string) (*clientConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config clientConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &config, nil
+}
+
+// Profile returns the tunnel called name with the defaults of the file. The tunnel name of an HTTP tunnel defaults
+// to name.
+func (c *clientConfig) Profile(name string) (tunnelProfile, error) {
+	p, ok := c.Tunnels[name]
+	if !ok {
+		return p, fmt.Errorf("no tunnel %s in the configuration file", name)
+	}
+	if p.Name == "" {
+		p.Name = name
+	}
+	for _, field := range []struct{ value, fallback *string }{
+		{&p.Server, &c.Server}, {&p.Key, &c.Key}, {&p.User, &c.User}, {&p.KnownHosts, &c.KnownHosts},
+	} {
+		if *field.value == "" {
+			*field.value = *field.fallback
+		}
+	}
+	return p, nil
+}
+
+// runClientStart runs `tunnel-client start [NAME...]`, which opens the named tunnels of the configuration file, or
+// all of them, until interrupted. It returns the exit code.
+func runClientStart(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("start", flag.ContinueOnError)
+	fs.SetOutput(out)
+	configFile := fs.String("config", filepath.Join("~", ".tunnel.yaml"), "Configuration file with the named tunnels.")
+	inspect := fs.String("inspect", defaultInspectorAddr, "Address of the web UI showing the HTTP requests of the tunnels, which can replay them. Empty disables it.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	config, err := loadClientConfig(expandHome(*configFile))
+	if err != nil {
+		fmt.Fprintf(out, "tunnel-client: %s\n", err)
+		return 2
+	}
+	names := fs.Args()
+	if len(names) == 0 {
+		for name := range config.Tunnels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	if len(names) == 0 {
+		fmt.Fprintf(out, "tunnel-client: no tunnels in %s\n", *configFile)
+		return 2
+	}
+
+	// Lines of each tunnel are prefixed with its name
+	var outMu sync.Mutex
+	clients := make([]*tunnelClient, len(names))
+	for i, name := range names {
+		p, err := config.Profile(name)
+		if err == nil {
+			clients[i], err = p.newClient(&prefixWriter{w: out, mu: &outMu, prefix: "[" + name + "] "})
+		}
+		if err != nil {
+			fmt.Fprintf(out, "tunnel-client: %s: %s\n", name, err)
+			return 2
+		}
+	}
+
+	if *inspect != "" {
+		inspector := startInspector(*inspect, out)
+		for i, c := range clients {
+			c.inspect(inspector, names[i])
+		}
+	}
+	return runTunnelClients(clients, &outMu)
+}
+
+// runTunnelClients runs clients at once until interrupted and returns the exit code, 1 if any of them failed. outMu
+// guards the output shared by the clients.
+func runTunnelClients(clients []*tunnelClient, outMu *sync.Mutex) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var wg sync.WaitGroup
+	var failed bool
+	for i := range clients {
+		wg.Add(1)
+		go func(c *tunnelClient) {
+			defer wg.Done()
+			if err := c.run(ctx); err != nil {
+				fmt.Fprintf(c.out, "tunnel-client: %s\n", err)
+				outMu.Lock()
+				failed = true
+				outMu.Unlock()
+			}
+		}(clients[i])
+	}
+	wg.Wait()
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// prefixWriter writes prefix at the start of every line to w, which it shares with other writers through mu.
+type prefixWriter struct {
+	w       io.Writer
+	mu      *sync.Mutex
+	prefix  string
+	midLine bool // The last write did not end a line
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(b)
+	var buf bytes.Buffer
+	for len(b) > 0 {
+		if !p.midLine {
+			buf.WriteString(p.prefix)
+		}
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = b[:i+1]
+		}
+		buf.Write(line)
+		p.midLine = line[len(line)-1] != '\n'
+		b = b[len(line):]
+	}
+	_, err := p.w.Write(buf.Bytes())
+	return n, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("client configuration file", func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "clientConfig")
+		Expect(err).To(Not(HaveOccurred()))
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeConfig := func(content string) string {
+		file := filepath.Join(dir, "tunnel.yaml")
+		Expect(os.WriteFile(file, []byte(content), 0600)).To(Succeed())
+		return file
+	}
+
+	It("should read named tunnels with the defaults of the file", func() {
+		config, err := loadClientConfig(writeConfig(`
+server: mydomain.io
+key: ~/.ssh/work
+tunnels:
+  api:
+    local: 3000
+    host: api.local
+    options: [cache=true, "rewrite=/api/->/v2/"]
+  db:
+    type: tcp
+    local: localhost:5432
+    remotePort: 5432
+    server: other.io:22
+`))
+		Expect(err).To(Not(HaveOccurred()))
+
+		api, err := config.Profile("api")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(api.Local).To(Equal("3000"))
+		Expect(api.Name).To(Equal("api"))
+		Expect(api.Host).To(Equal("api.local"))
+		Expect(api.Server).To(Equal("mydomain.io"))
+		Expect(api.Key).To(Equal("~/.ssh/work"))
+		Expect(api.Options).To(Equal([]string{"cache=true", "rewrite=/api/->/v2/"}))
+
+		db, err := config.Profile("db")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(db.Type).To(Equal("tcp"))
+		Expect(*db.RemotePort).To(Equal(5432))
+		Expect(db.Server).To(Equal("other.io:22"))
+
+		_, err = config.Profile("web")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject unknown fields", func() {
+		_, err := loadClientConfig(writeConfig("tunnels:\n  api:\n    port: 3000\n"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should not start tunnels missing from the file", func() {
+		var out bytes.Buffer
+		Expect(runClientStart([]string{"--config", writeConfig("tunnels:\n  api:\n    local: 3000\n"), "web"}, &out)).To(Equal(2))
+		Expect(out.String()).To(ContainSubstring("no tunnel web"))
+	})
+
+	It("should prefix every line with the tunnel name", func() {
+		var out bytes.Buffer
+		var mu sync.Mutex
+		api := &prefixWriter{w: &out, mu: &mu, prefix: "[api] "}
+		db := &prefixWriter{w: &out, mu: &mu, prefix: "[db] "}
+		n, err := api.Write([]byte("Tunneling a\nReceived"))
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(n).To(Equal(20))
+		api.Write([]byte(" request\n"))
+		db.Write([]byte("Tunneling b\n"))
+		Expect(out.String()).To(Equal("[api] Tunneling a\n[api] Received request\n[db] Tunneling b\n"))
+	})
+})
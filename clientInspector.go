@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Address of the request inspector of tunnel-client, like ngrok's.
+const defaultInspectorAddr = "localhost:4040"
+
+// Requests kept by the request inspector of tunnel-client and the bytes kept of each request.
+const (
+	inspectorMaxRequests = 100
+	inspectorMaxBytes    = 64 << 10
+)
+
+// Request details asked from the server for the inspector, which writes them as a JSON line when a request ends.
+var inspectorTunnelOptions = []string{"log=json", "log-field=method", "log-field=path", "log-field=status", "log-field=duration", "log-field=bytes"}
+
+// inspectedRequest is a request of a tunnel as relayed by the client to the local server, with the details of the
+// request line that the server writes to the session (see sessionLog).
+type inspectedRequest struct {
+	ID         string    `json:"id"` // X-Request-Id added by the server
+	Time       time.Time `json:"time"`
+	Tunnel     string    `json:"tunnel"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"durationMs"`
+	Bytes      int64     `json:"bytes"`
+	Request    string    `json:"request"`             // Raw request, truncated at inspectorMaxBytes
+	Truncated  bool      `json:"truncated,omitempty"` // The request cannot be replayed
+	ReplayOf   string    `json:"replayOf,omitempty"`  // ID of the replayed request
+
+	local string // Address of the local server
+}
+
+// requestInspector keeps the recent requests of the tunnels of a client and serves them to a local web UI that can
+// replay them.
+type requestInspector struct {
+	sync.Mutex
+	requests []*inspectedRequest // Oldest first
+	byID     map[string]*inspectedRequest
+}
+
+func newRequestInspector() *requestInspector {
+	return &requestInspector{byID: make(map[string]*inspectedRequest)}
+}
+
+// startInspector serves a new inspector at addr. It returns nil and prints a warning if addr cannot be listened at,
+// eg because another client inspects its requests there.
+func startInspector(addr string, out io.Writer) *requestInspector {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Fprintf(out, "Warning: the request inspector is disabled: %s\n", err)
+		return nil
+	}
+	inspector := newRequestInspector()
+	go http.Serve(ln, inspector)
+	fmt.Fprintf(out, "Inspecting requests at http://%s\n", ln.Addr())
+	return inspector
+}
+
+// request returns the request with id, adding it if missing. The lock must be held.
+func (in *requestInspector) request(id string) *inspectedRequest {
+	if r, ok := in.byID[id]; ok {
+		return r
+	}
+	r := &inspectedRequest{ID: id, Time: time.Now()}
+	in.requests = append(in.requests, r)
+	in.byID[id] = r
+	if len(in.requests) > inspectorMaxRequests {
+		delete(in.byID, in.requests[0].ID)
+		in.requests = in.requests[1:]
+	}
+	return r
+}
+
+// Captured records the raw request relayed by the tunnel to the local server. Requests without an X-Request-Id,
+// which the server adds to every HTTP request, are ignored.
+func (in *requestInspector) Captured(tunnel string, local string, raw []byte, truncated bool) {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 {
+		return
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw[:end+4])))
+	if err != nil || req.Header.Get("X-Request-Id") == "" {
+		return
+	}
+	in.Lock()
+	defer in.Unlock()
+	r := in.request(req.Header.Get("X-Request-Id"))
+	r.Tunnel, r.local = tunnel, local
+	r.Request, r.Truncated = string(raw), truncated
+	if r.Method == "" {
+		r.Method, r.Path = req.Method, req.RequestURI
+	}
+}
+
+// Ended records the request line of the server (log=json) and returns the request, or false if line is not one.
+// The request line can come before or after the request is captured.
+func (in *requestInspector) Ended(tunnel string, line string) (inspectedRequest, bool) {
+	var event struct {
+		RequestID  string `json:"requestId"`
+		Method     string `json:"method"`
+		Path       string `json:"path"`
+		Status     int    `json:"status"`
+		DurationMs int64  `json:"durationMs"`
+		Bytes      int64  `json:"bytes"`
+	}
+	if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &event) != nil || event.RequestID == "" {
+		return inspectedRequest{}, false
+	}
+	in.Lock()
+	defer in.Unlock()
+	r := in.request(event.RequestID)
+	r.Tunnel = tunnel
+	r.Method, r.Path, r.Status = event.Method, event.Path, event.Status
+	r.DurationMs, r.Bytes = event.DurationMs, event.Bytes
+	return *r, true
+}
+
+// List returns the requests, newest first.
+func (in *requestInspector) List() []inspectedRequest {
+	in.Lock()
+	defer in.Unlock()
+	list := make([]inspectedRequest, 0, len(in.requests))
+	for i := len(in.requests) - 1; i >= 0; i-- {
+		list = append(list, *in.requests[i])
+	}
+	return list
+}
+
+// Replay sends the request with id again to its local server and records it as a new request.
+func (in *requestInspector) Replay(id string) (inspectedRequest, error) {
+	in.Lock()
+	original, ok := in.byID[id]
+	var r inspectedRequest
+	if ok {
+		r = *original
+	}
+	in.Unlock()
+	switch {
+	case !ok:
+		return r, fmt.Errorf("request %s not found", id)
+	case r.Request == "":
+		return r, fmt.Errorf("request %s was not captured", id)
+	case r.Truncated:
+		return r, fmt.Errorf("request %s is larger than %d bytes", id, inspectorMaxBytes)
+	}
+
+	r.ID, r.ReplayOf, r.Time = newRequestID(), id, time.Now()
+	r.Status, r.Bytes = 0, 0
+	conn, err := net.DialTimeout("tcp", r.local, 10*time.Second)
+	if err != nil {
+		return r, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(replayTimeout))
+	if _, err := io.WriteString(conn, r.Request); err != nil {
+		return r, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: r.Method})
+	if err != nil {
+		return r, fmt.Errorf("error reading response: %w", err)
+	}
+	r.Bytes, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return r, fmt.Errorf("error reading response: %w", err)
+	}
+	r.Status = resp.StatusCode
+	r.DurationMs = time.Since(r.Time).Milliseconds()
+
+	in.Lock()
+	defer in.Unlock()
+	replayed := in.request(r.ID)
+	*replayed = r
+	return r, nil
+}
+
+// ServeHTTP serves the web UI of the inspector and its API:
+//
+//	GET /api/requests                 the recent requests, newest first
+//	POST /api/requests/ID/replay      replays a request and returns the new one
+func (in *requestInspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, inspectorPage)
+	case r.URL.Path == "/api/requests" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(in.List())
+	case strings.HasPrefix(r.URL.Path, "/api/requests/") && strings.HasSuffix(r.URL.Path, "/replay"):
+		if r.Method != http.MethodPost {
+			http.Error(w, "replays must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/requests/"), "/replay")
+		replayed, err := in.Replay(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(replayed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// captureWriter keeps the first inspectorMaxBytes written to it.
+type captureWriter struct {
+	bytes.Buffer
+	truncated bool
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if room := inspectorMaxBytes - c.Len(); len(p) > room {
+		c.truncated = true
+		c.Buffer.Write(p[:room])
+	} else {
+		c.Buffer.Write(p)
+	}
+	return len(p), nil
+}
+
+const inspectorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tunnel-client requests</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; }
+tr.selected { background: #eef; }
+tbody tr { cursor: pointer; }
+pre { background: #f6f6f6; padding: 1em; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>Requests</h1>
+<table>
+<thead><tr><th>Time</th><th>Tunnel</th><th>Method</th><th>Path</th><th>Status</th><th>Duration</th><th>Bytes</th><th></th></tr></thead>
+<tbody id="requests"></tbody>
+</table>
+<pre id="request" hidden></pre>
+<script>
+let selected = null;
+function cell(row, text) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  row.appendChild(td);
+}
+async function replay(id) {
+  const resp = await fetch("/api/requests/" + id + "/replay", {method: "POST"});
+  if (!resp.ok) {
+    alert(await resp.text());
+  }
+  refresh();
+}
+async function refresh() {
+  const requests = await (await fetch("/api/requests")).json();
+  const body = document.getElementById("requests");
+  body.replaceChildren();
+  for (const r of requests) {
+    const row = document.createElement("tr");
+    if (r.id === selected) {
+      row.className = "selected";
+      document.getElementById("request").textContent = r.request;
+    }
+    cell(row, new Date(r.time).toLocaleTimeString());
+    cell(row, r.tunnel);
+    cell(row, r.method);
+    cell(row, r.path + (r.replayOf ? " (replay)" : ""));
+    cell(row, r.status || "");
+    cell(row, r.status ? r.durationMs + " ms" : "");
+    cell(row, r.status ? r.bytes : "");
+    const td = document.createElement("td");
+    if (r.request && !r.truncated) {
+      const button = document.createElement("button");
+      button.textContent = "Replay";
+      button.onclick = (e) => { e.stopPropagation(); replay(r.id); };
+      td.appendChild(button);
+    }
+    row.appendChild(td);
+    row.onclick = () => {
+      selected = r.id;
+      const pre = document.getElementById("request");
+      pre.hidden = false;
+      pre.textContent = r.request || "Not captured";
+      refresh();
+    };
+    body.appendChild(row);
+  }
+}
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("request inspector", func() {
+	var inspector *requestInspector
+	var local *httptest.Server
+	var localAddr string
+	BeforeEach(func() {
+		inspector = newRequestInspector()
+		local = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s %s", r.Method, r.URL, body)
+		}))
+		localAddr = strings.TrimPrefix(local.URL, "http://")
+	})
+	AfterEach(func() {
+		local.Close()
+	})
+
+	rawRequest := func(id string) string {
+		return "POST /form?a=1 HTTP/1.1\r\nHost: " + localAddr + "\r\nX-Request-Id: " + id + "\r\nContent-Length: 5\r\n\r\nhello"
+	}
+
+	It("should merge the captured request with the request line of the server", func() {
+		line := `{"requestId":"r1","method":"POST","path":"/form?a=1","status":201,"durationMs":12,"bytes":34}`
+		r, ok := inspector.Ended("http 3000", line)
+		Expect(ok).To(BeTrue())
+		Expect(r.Status).To(Equal(201))
+		inspector.Captured("http 3000", localAddr, []byte(rawRequest("r1")), false)
+		inspector.Captured("http 3000", localAddr, []byte(rawRequest("r2")), false)
+
+		_, ok = inspector.Ended("http 3000", "Received http request r3 from 127.0.0.1:5000")
+		Expect(ok).To(BeFalse())
+		_, ok = inspector.Ended("http 3000", `{"remoteAddr":"127.0.0.1"}`)
+		Expect(ok).To(BeFalse())
+
+		list := inspector.List()
+		Expect(list).To(HaveLen(2))
+		Expect(list[0].ID).To(Equal("r2"))
+		Expect(list[0].Method).To(Equal("POST"))
+		Expect(list[0].Path).To(Equal("/form?a=1"))
+		Expect(list[1].ID).To(Equal("r1"))
+		Expect(list[1].Status).To(Equal(201))
+		Expect(list[1].DurationMs).To(Equal(int64(12)))
+		Expect(list[1].Request).To(Equal(rawRequest("r1")))
+	})
+
+	It("should keep the most recent requests", func() {
+		for i := 0; i < inspectorMaxRequests+5; i++ {
+			inspector.Ended("http 3000", fmt.Sprintf(`{"requestId":"r%d","status":200}`, i))
+		}
+		list := inspector.List()
+		Expect(list).To(HaveLen(inspectorMaxRequests))
+		Expect(list[0].ID).To(Equal(fmt.Sprintf("r%d", inspectorMaxRequests+4)))
+		Expect(inspector.byID).To(HaveLen(inspectorMaxRequests))
+	})
+
+	It("should replay captured requests to the local server", func() {
+		inspector.Captured("http 3000", localAddr, []byte(rawRequest("r1")), false)
+
+		w := httptest.NewRecorder()
+		inspector.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/requests/r1/replay", nil))
+		Expect(w.Code).To(Equal(http.StatusOK))
+		var replayed inspectedRequest
+		Expect(json.NewDecoder(w.Body).Decode(&replayed)).To(Succeed())
+		Expect(replayed.ReplayOf).To(Equal("r1"))
+		Expect(replayed.Status).To(Equal(http.StatusOK))
+		Expect(replayed.Bytes).To(Equal(int64(len("POST /form?a=1 hello"))))
+
+		w = httptest.NewRecorder()
+		inspector.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/requests", nil))
+		var list []inspectedRequest
+		Expect(json.NewDecoder(w.Body).Decode(&list)).To(Succeed())
+		Expect(list).To(HaveLen(2))
+		Expect(list[0].ID).To(Equal(replayed.ID))
+
+		w = httptest.NewRecorder()
+		inspector.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/requests/missing/replay", nil))
+		Expect(w.Code).To(Equal(http.StatusBadGateway))
+		w = httptest.NewRecorder()
+		inspector.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/requests/r1/replay", nil))
+		Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("should not replay truncated requests", func() {
+		inspector.Captured("http 3000", localAddr, []byte(rawRequest("r1")), true)
+		_, err := inspector.Replay("r1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should capture the requests relayed by the client", func() {
+		c := &tunnelClient{local: localAddr, tunnelType: "http", out: io.Discard}
+		c.inspect(inspector, "http 3000")
+		Expect(c.options).To(ContainSubstring("log=json"))
+
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				c.forward(conn)
+			}
+		}()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(Not(HaveOccurred()))
+		defer conn.Close()
+		_, err = io.WriteString(conn, rawRequest("r1"))
+		Expect(err).To(Not(HaveOccurred()))
+		conn.(*net.TCPConn).CloseWrite()
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		Expect(err).To(Not(HaveOccurred()))
+		resp.Body.Close()
+
+		Eventually(inspector.List).Should(HaveLen(1))
+		Expect(inspector.List()[0].Request).To(Equal(rawRequest("r1")))
+	})
+
+	It("should leave private tunnels alone", func() {
+		c := &tunnelClient{tunnelType: "http", options: "type=http,inspect=false"}
+		c.inspect(inspector, "http 3000")
+		Expect(c.inspector).To(BeNil())
+		Expect(c.options).To(Equal("type=http,inspect=false"))
+	})
+
+	It("should leave TCP tunnels alone", func() {
+		c := &tunnelClient{tunnelType: "tcp", options: "type=tcp"}
+		c.inspect(inspector, "tcp 5432")
+		Expect(c.inspector).To(BeNil())
+		Expect(c.options).To(Equal("type=tcp"))
+	})
+})
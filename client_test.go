@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("tunnel client", func() {
+	var dir, keyFile string
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "client")
+		Expect(err).To(Not(HaveOccurred()))
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		Expect(err).To(Not(HaveOccurred()))
+		keyFile = filepath.Join(dir, "id_ed25519")
+		Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)).To(Succeed())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	newTunnelClient := func(args []string, out io.Writer) (*tunnelClient, error) {
+		p, err := parseTunnelArgs(args, out)
+		if err != nil {
+			return nil, err
+		}
+		return p.newClient(out)
+	}
+
+	It("should build the tunnel options from the arguments in any order", func() {
+		var out bytes.Buffer
+		c, err := newTunnelClient([]string{"--server=domain.io", "http", "3000", "--name", "myapp", "--key", keyFile, "--option", "cache=true"}, &out)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(c.server).To(Equal("domain.io:5223"))
+		Expect(c.local).To(Equal("localhost:3000"))
+		Expect(c.remotePort).To(Equal(80))
+		options, err := parseTunnelOptions(c.options)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.tunnelName).To(Equal("myapp"))
+		Expect(options.header).To(Equal("localhost:3000"))
+		Expect(options.cache).To(BeTrue())
+		Expect(c.options).To(ContainSubstring("id="))
+	})
+
+	It("should open TCP tunnels on a random port by default", func() {
+		c, err := newTunnelClient([]string{"tcp", "db.local:5432", "--server=domain.io:22", "--key=" + keyFile}, io.Discard)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(c.server).To(Equal("domain.io:22"))
+		Expect(c.local).To(Equal("db.local:5432"))
+		Expect(c.remotePort).To(Equal(0))
+		Expect(c.options).To(HavePrefix("type=tcp,"))
+		Expect(c.options).To(Not(ContainSubstring("tunnelName")))
+	})
+
+	It("should split the arguments of several tunnels", func() {
+		tunnels := splitTunnelArgs([]string{"--server=domain.io", "--key", keyFile, "http", "3000", "--name", "tcp", "tcp", "5432", "--remotePort=5432", "--mux", "https", "8443"})
+		Expect(tunnels).To(Equal([][]string{
+			{"--server=domain.io", "--key", keyFile, "http", "3000", "--name", "tcp"},
+			{"--server=domain.io", "--key", keyFile, "tcp", "5432", "--remotePort=5432", "--mux"},
+			{"--server=domain.io", "--key", keyFile, "https", "8443"},
+		}))
+		Expect(splitTunnelArgs([]string{"3000", "--name", "myapp"})).To(Equal([][]string{{"3000", "--name", "myapp"}}))
+
+		var labels []string
+		for _, args := range tunnels {
+			p, err := parseTunnelArgs(args, io.Discard)
+			Expect(err).To(Not(HaveOccurred()))
+			labels = append(labels, p.label())
+		}
+		Expect(labels).To(Equal([]string{"http 3000", "tcp 5432", "https 8443"}))
+	})
+
+	It("should reject invalid arguments", func() {
+		defer os.Setenv("TUNNEL_DOMAIN", os.Getenv("TUNNEL_DOMAIN"))
+		os.Unsetenv("TUNNEL_DOMAIN")
+		for _, args := range [][]string{
+			{"--server=domain.io", "--key=" + keyFile},
+			{"--server=domain.io", "--key=" + keyFile, "udp", "3000"},
+			{"--server=domain.io", "--key=" + keyFile, "http", "70000"},
+			{"--server=domain.io", "--key=" + keyFile, "3000", "--option", "cache"},
+			{"--key=" + keyFile, "3000"},
+		} {
+			_, err := newTunnelClient(args, io.Discard)
+			Expect(err).To(HaveOccurred(), strings.Join(args, " "))
+		}
+	})
+
+	It("should trust the first host key of unknown servers and reject another one", func() {
+		_, key1, _ := ed25519.GenerateKey(rand.Reader)
+		_, key2, _ := ed25519.GenerateKey(rand.Reader)
+		signer1, _ := ssh.NewSignerFromKey(key1)
+		signer2, _ := ssh.NewSignerFromKey(key2)
+		addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5223}
+
+		var out bytes.Buffer
+		callback := trustOnFirstUse(filepath.Join(dir, "missing_known_hosts"), &out)
+		Expect(callback("domain.io:5223", addr, signer1.PublicKey())).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("trusting its host key"))
+		Expect(callback("domain.io:5223", addr, signer1.PublicKey())).To(Succeed())
+		Expect(callback("domain.io:5223", addr, signer2.PublicKey())).To(MatchError(ContainSubstring(errHostKeyChanged.Error())))
+	})
+
+	It("should verify servers of the known_hosts file", func() {
+		_, key1, _ := ed25519.GenerateKey(rand.Reader)
+		_, key2, _ := ed25519.GenerateKey(rand.Reader)
+		signer1, _ := ssh.NewSignerFromKey(key1)
+		signer2, _ := ssh.NewSignerFromKey(key2)
+		addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5223}
+		knownHosts := filepath.Join(dir, "known_hosts")
+		line := "[domain.io]:5223 " + string(ssh.MarshalAuthorizedKey(signer1.PublicKey()))
+		Expect(os.WriteFile(knownHosts, []byte(line), 0600)).To(Succeed())
+
+		callback := trustOnFirstUse(knownHosts, io.Discard)
+		Expect(callback("domain.io:5223", addr, signer1.PublicKey())).To(Succeed())
+		Expect(callback("domain.io:5223", addr, signer2.PublicKey())).To(HaveOccurred())
+	})
+
+	It("should forward a connection to the local server", func() {
+		ln, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer ln.Close()
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+
+		c := &tunnelClient{local: ln.Addr().String(), out: io.Discard}
+		client, server := net.Pipe()
+		go c.forward(server)
+		io.WriteString(client, "ping")
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(client, buf)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(buf)).To(Equal("ping"))
+		client.Close()
+	})
+})
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers of the HTTP requests relayed to the node of the cluster that holds their tunnel: the cluster secret, which
+// keeps visitors from forging them, and the address of the visitor. Requests are relayed in plain HTTP, so the secret
+// is only as safe as the private network of the cluster.
+const (
+	clusterRelayHeader   = "X-Tunnel-Cluster-Relay"
+	clusterVisitorHeader = "X-Tunnel-Cluster-Visitor"
+)
+
+// Cluster mode, set from command line flags: the cluster addresses of the other nodes (host:port) and the secret
+// shared by all of them. Empty clusterPeers disables it.
+var (
+	clusterPeers        []string
+	clusterSecret       string
+	clusterSyncInterval = 2 * time.Second
+)
+
+// HTTP requests relayed to another node of the cluster, published at /debug/vars of the pprof port.
+var clusterRelays = expvar.NewInt("clusterRelays")
+
+// HTTP tunnels of the other nodes of the cluster as of their last sync, by cluster address of the node: hash of the
+// client id (see clusterClientHash) by sshTunnelListeners key (eg localhost:80myapp).
+var (
+	peerTunnels     = map[string]map[string]string{}
+	peerTunnelsLock sync.Mutex
+)
+
+// clusterClientHash identifies a client id across the nodes without disclosing it.
+func clusterClientHash(clientID string) string {
+	sum := sha256.Sum256([]byte(clientID))
+	return hex.EncodeToString(sum[:])
+}
+
+// clusterSecretValid compares secret with clusterSecret in constant time.
+func clusterSecretValid(secret string) bool {
+	return clusterSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(clusterSecret)) == 1
+}
+
+// newClusterHandler serves the HTTP tunnels of this node to the other nodes of the cluster at /tunnels.
+func newClusterHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		if !clusterSecretValid(r.Header.Get(clusterRelayHeader)) {
+			http.Error(w, "invalid cluster secret", http.StatusUnauthorized)
+			return
+		}
+		tunnels := map[string]string{}
+		sshTunnelListenersLock.Lock()
+		for key, tunnel := range sshTunnelListeners {
+			tunnels[key] = clusterClientHash(tunnel.clientID)
+		}
+		sshTunnelListenersLock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tunnels)
+	})
+	return mux
+}
+
+// fetchPeerTunnels returns the HTTP tunnels of the node at peer.
+func fetchPeerTunnels(ctx context.Context, client *http.Client, peer string) (map[string]string, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+peer+"/tunnels", nil)
+	req.Header.Set(clusterRelayHeader, clusterSecret)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing tunnels: %s", resp.Status)
+	}
+	tunnels := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&tunnels); err != nil {
+		return nil, err
+	}
+	return tunnels, nil
+}
+
+// syncPeerTunnels lists the HTTP tunnels of every peer every clusterSyncInterval until ctx is done. The tunnels of a
+// peer that does not answer are forgotten until it answers again.
+func syncPeerTunnels(ctx context.Context) {
+	client := &http.Client{Timeout: clusterSyncInterval}
+	sync := func() {
+		for _, peer := range clusterPeers {
+			tunnels, err := fetchPeerTunnels(ctx, client, peer)
+			peerTunnelsLock.Lock()
+			if err != nil {
+				if _, ok := peerTunnels[peer]; ok {
+					log.Printf("error syncing the tunnels of cluster node %s: %s", peer, err)
+				}
+				delete(peerTunnels, peer)
+			} else {
+				if _, ok := peerTunnels[peer]; !ok {
+					log.Printf("Synced %d tunnels of cluster node %s", len(tunnels), peer)
+				}
+				peerTunnels[peer] = tunnels
+			}
+			peerTunnelsLock.Unlock()
+		}
+	}
+
+	sync()
+	ticker := time.NewTicker(clusterSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sync()
+		}
+	}
+}
+
+// peerTunnelTarget returns the public HTTP address, at the HTTP port of addr, of the node of the cluster that holds
+// the tunnel at cacheKey (see sshTunnelListeners).
+func peerTunnelTarget(cacheKey string, addr string) (string, bool) {
+	_, port, _ := net.SplitHostPort(addr)
+	peerTunnelsLock.Lock()
+	defer peerTunnelsLock.Unlock()
+	for _, peer := range clusterPeers {
+		if _, ok := peerTunnels[peer][cacheKey]; ok {
+			host, _, _ := net.SplitHostPort(peer)
+			return net.JoinHostPort(host, port), true
+		}
+	}
+	return "", false
+}
+
+// peerTunnelHeld returns true if another node of the cluster holds the tunnel at cacheKey for another client id
+// than clientID. A client reconnecting to another node keeps its tunnel name. Tunnels opened on another node since
+// its last sync are not known yet, so two nodes can give the same name within clusterSyncInterval.
+func peerTunnelHeld(cacheKey string, clientID string) bool {
+	hash := clusterClientHash(clientID)
+	peerTunnelsLock.Lock()
+	defer peerTunnelsLock.Unlock()
+	for _, tunnels := range peerTunnels {
+		if client, ok := tunnels[cacheKey]; ok && (clientID == "" || client != hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterRelayedRequest returns the address of the visitor of a request relayed by another node of the cluster.
+// The relay headers are removed from every request so that visitors cannot forge them.
+func clusterRelayedRequest(httpProcessor *httpProcessor) (visitor string, relayed bool) {
+	httpProcessor.ReadHeadersIfNeeded()
+	secret, _ := httpProcessor.header(clusterRelayHeader)
+	visitor, _ = httpProcessor.header(clusterVisitorHeader)
+	if secret == "" && visitor == "" {
+		return "", false
+	}
+	httpProcessor.RemoveHeader(clusterRelayHeader)
+	httpProcessor.RemoveHeader(clusterVisitorHeader)
+	return visitor, clusterSecretValid(secret) && visitor != ""
+}
+
+// relayToPeer relays the request of httpProcessor from visitor to the node of the cluster at target, which holds
+// its tunnel, and the response back to httpConnection (see relayToCluster).
+func relayToPeer(httpConnection net.Conn, httpProcessor *httpProcessor, target string, visitor string) error {
+	clusterRelays.Add(1)
+	httpProcessor.AddHeader(clusterRelayHeader, clusterSecret)
+	httpProcessor.AddHeader(clusterVisitorHeader, visitor)
+	return relayToCluster(httpConnection, httpProcessor, target)
+}
+
+// relayedConn is a connection relayed by another node of the cluster, whose remote address is that of the visitor.
+type relayedConn struct {
+	net.Conn
+	visitor net.Addr
+}
+
+func (c *relayedConn) RemoteAddr() net.Addr {
+	return c.visitor
+}
+
+// newRelayedConn returns conn with the remote address visitor (ip:port), or conn if visitor is not an address.
+func newRelayedConn(conn net.Conn, visitor string) net.Conn {
+	host, portStr, err := net.SplitHostPort(visitor)
+	ip := net.ParseIP(host)
+	port, portErr := strconv.Atoi(portStr)
+	if err != nil || ip == nil || portErr != nil {
+		return conn
+	}
+	return &relayedConn{Conn: conn, visitor: &net.TCPAddr{IP: ip, Port: port}}
+}
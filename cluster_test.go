@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("cluster", func() {
+	BeforeEach(func() {
+		clusterSecret = "s3cret"
+	})
+	AfterEach(func() {
+		clusterSecret = ""
+		clusterPeers = nil
+		peerTunnelsLock.Lock()
+		peerTunnels = map[string]map[string]string{}
+		peerTunnelsLock.Unlock()
+	})
+
+	readRequest := func(request string) (*httpProcessor, string, bool) {
+		p := newHttpProcessor(strings.NewReader(request), make([]byte, 4096))
+		p.expectRequest = true
+		visitor, relayed := clusterRelayedRequest(p)
+		b, err := io.ReadAll(p.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		return p, string(b), relayed && visitor == "203.0.113.7:4321"
+	}
+
+	It("should only trust the requests relayed with the cluster secret", func() {
+		_, request, relayed := readRequest("GET / HTTP/1.1\r\nHost: demo.domain.io\r\nX-Tunnel-Cluster-Relay: s3cret\r\nX-Tunnel-Cluster-Visitor: 203.0.113.7:4321\r\n\r\n")
+		Expect(relayed).To(BeTrue())
+		Expect(request).To(Equal("GET / HTTP/1.1\r\nHost: demo.domain.io\r\n\r\n"))
+
+		_, request, relayed = readRequest("GET / HTTP/1.1\r\nHost: demo.domain.io\r\nX-Tunnel-Cluster-Relay: guess\r\nX-Tunnel-Cluster-Visitor: 203.0.113.7:4321\r\n\r\n")
+		Expect(relayed).To(BeFalse())
+		Expect(request).To(Equal("GET / HTTP/1.1\r\nHost: demo.domain.io\r\n\r\n"))
+
+		clusterSecret = ""
+		_, _, relayed = readRequest("GET / HTTP/1.1\r\nHost: demo.domain.io\r\nX-Tunnel-Cluster-Relay: \r\nX-Tunnel-Cluster-Visitor: 203.0.113.7:4321\r\n\r\n")
+		Expect(relayed).To(BeFalse())
+	})
+
+	It("should take the address of the visitor for relayed connections", func() {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		Expect(newRelayedConn(server, "203.0.113.7:4321").RemoteAddr().String()).To(Equal("203.0.113.7:4321"))
+		Expect(newRelayedConn(server, "example.com:80")).To(Equal(server))
+	})
+
+	It("should sync the tunnels of the other nodes", func() {
+		sshTunnelListenersLock.Lock()
+		sshTunnelListeners[":80demo"] = sshTunnelsListenerData{clientID: "client1"}
+		sshTunnelListenersLock.Unlock()
+		defer func() {
+			sshTunnelListenersLock.Lock()
+			delete(sshTunnelListeners, ":80demo")
+			sshTunnelListenersLock.Unlock()
+		}()
+		peer := httptest.NewServer(newClusterHandler())
+		defer peer.Close()
+
+		_, err := fetchPeerTunnels(context.Background(), http.DefaultClient, strings.TrimPrefix(peer.URL, "http://"))
+		Expect(err).To(Not(HaveOccurred()))
+		resp, err := http.Get(peer.URL + "/tunnels")
+		Expect(err).To(Not(HaveOccurred()))
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		address := strings.TrimPrefix(peer.URL, "http://")
+		clusterPeers = []string{address}
+		interval := clusterSyncInterval
+		clusterSyncInterval = 20 * time.Millisecond
+		defer func() { clusterSyncInterval = interval }()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go syncPeerTunnels(ctx)
+		Eventually(func() bool { return peerTunnelHeld(":80demo", "client2") }).Should(BeTrue())
+		Expect(peerTunnelHeld(":80demo", "client1")).To(BeFalse())
+		Expect(peerTunnelHeld(":80other", "client2")).To(BeFalse())
+
+		host, _, _ := net.SplitHostPort(address)
+		target, ok := peerTunnelTarget(":80demo", ":80")
+		Expect(ok).To(BeTrue())
+		Expect(target).To(Equal(net.JoinHostPort(host, "80")))
+		_, ok = peerTunnelTarget(":80other", ":80")
+		Expect(ok).To(BeFalse())
+
+		// The tunnels of a node that went away are forgotten
+		peer.Close()
+		Eventually(func() bool { return peerTunnelHeld(":80demo", "client2") }).Should(BeFalse())
+	})
+})
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Flags applied at runtime when the configuration is reloaded with SIGHUP. Changing the others requires a restart.
+// Limits that are copied when a tunnel is created (eg breakerThreshold) apply to new tunnels only.
+var reloadableFlags = map[string]bool{
+	"log":                    true,
+	"defaultTunnel":          true,
+	"serverHeader":           true,
+	"breakerThreshold":       true,
+	"breakerCooldown":        true,
+	"maxHeaderBytes":         true,
+	"maxHeaderLineBytes":     true,
+	"maxHeaders":             true,
+	"slowRequestTTFB":        true,
+	"slowRequestDuration":    true,
+	"harMaxEntries":          true,
+	"harMaxBodyBytes":        true,
+	"harMaxAge":              true,
+	"maxTunnelAge":           true,
+	"maxConnections":         true,
+	"connectionOverflow":     true,
+	"connectionQueueTimeout": true,
+	"maxSSHConnections":      true,
+	"maxSSHConnectionsPerIP": true,
+}
+
+// runtimeSettings holds the server settings of the reloadableFlags. A reload replaces the whole snapshot (see
+// applyRuntimeFlags) so that connections read consistent values without locking. It must not be modified once stored.
+type runtimeSettings struct {
+	// Tunnel that serves http requests without a Host (eg HTTP/1.0 health checks) in a subdomain setup. Empty to
+	// reject them.
+	defaultTunnelName string
+	// Server header of relayed and generated responses unless a tunnel overrides it with server=. Empty keeps the
+	// Server header of client backends and leaves it out of generated responses.
+	serverHeader string
+	// Consecutive upstream failures after which a tunnel's breaker trips. 0 (the default) disables the breaker.
+	breakerThreshold int
+	// How long a tripped breaker serves 503s before letting a trial request through.
+	breakerCooldown time.Duration
+	// Limits on the headers of requests and responses
+	maxHeaderBytes     int // Request/status line and header lines together; cannot exceed the buffer
+	maxHeaderLineBytes int
+	maxHeaderCount     int
+	// Thresholds above which a proxied http request is logged as slow. 0 disables a threshold.
+	slowRequestTTFB     time.Duration // Time until the tunnel backend starts responding
+	slowRequestDuration time.Duration // Time until the response is fully relayed
+	// Limits of the HAR capture of tunnels created with har=true
+	harMaxEntries   int           // Most recent request/response pairs kept per tunnel
+	harMaxBodyBytes int           // Bodies are truncated beyond this size
+	harMaxAge       time.Duration // Older pairs are dropped
+	// Maximum age of tunnels, overridden per key by the max-tunnel-age option of the authorized keys. 0 lets tunnels
+	// live as long as their SSH connection.
+	maxTunnelAge time.Duration
+	// Limits of the connections handled at once, applied to publicConnections and sshConnections. 0 is unlimited.
+	maxConnections         int
+	connectionOverflow     string
+	connectionQueueTimeout time.Duration
+	maxSSHConnections      int
+	maxSSHConnectionsPerIP int
+}
+
+// Current runtimeSettings (*runtimeSettings), set from command line flags. Reloaded with SIGHUP.
+var currentSettings atomic.Value
+
+func init() {
+	currentSettings.Store(&runtimeSettings{
+		maxHeaderBytes:     bufferSize,
+		maxHeaderLineBytes: 8 << 10,
+		maxHeaderCount:     100,
+		harMaxEntries:      100,
+		harMaxBodyBytes:    64 << 10,
+		harMaxAge:          time.Hour,
+		connectionOverflow: connectionOverflowQueue,
+	})
+}
+
+// settings returns the current server settings.
+func settings() *runtimeSettings {
+	return currentSettings.Load().(*runtimeSettings)
+}
+
+// Public keys allowed to connect (map[string]authorizedKey keyed by the marshaled key). Reloaded with SIGHUP.
+var authorizedKeys atomic.Value
+
+// authorizedKey holds the options of a key in the authorized keys (eg max-tunnel-age="24h" ssh-ed25519 AAAA...).
+type authorizedKey struct {
+	// Overrides maxTunnelAge for the tunnels of the key if set
+	maxTunnelAge    time.Duration
+	hasMaxTunnelAge bool
+}
+
+// permissions returns the SSH permissions of a client authenticated with the key of fingerprint.
+func (k authorizedKey) permissions(fingerprint string) *ssh.Permissions {
+	extensions := map[string]string{
+		// Record the public key used for authentication.
+		"pubkey-fp": fingerprint,
+	}
+	if k.hasMaxTunnelAge {
+		extensions["max-tunnel-age"] = k.maxTunnelAge.String()
+	}
+	return &ssh.Permissions{Extensions: extensions}
+}
+
+// parseAuthorizedKeyOptions returns the options of a key given in the authorized keys. Options that are not
+// about tunnels (eg from="...") are ignored.
+func parseAuthorizedKeyOptions(options []string) (authorizedKey, error) {
+	var key authorizedKey
+	for _, option := range options {
+		name, value, _ := cut(option, "=")
+		if !strings.EqualFold(name, "max-tunnel-age") {
+			continue
+		}
+		age, err := time.ParseDuration(strings.Trim(value, `"`))
+		if err != nil || age < 0 {
+			return key, fmt.Errorf("invalid max-tunnel-age value %s", value)
+		}
+		key.maxTunnelAge, key.hasMaxTunnelAge = age, true
+	}
+	return key, nil
+}
+
+// flagEnvName returns the env variable of a flag: TUNNEL_ followed by the flag name in upper snake case
+// (eg TUNNEL_DOMAIN_URL for domainUrl).
+func flagEnvName(name string) string {
+	var sb strings.Builder
+	sb.WriteString("TUNNEL_")
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 && !unicode.IsUpper(rune(name[i-1])) {
+			sb.WriteByte('_')
+		}
+		sb.WriteRune(unicode.ToUpper(r))
+	}
+	return sb.String()
+}
+
+// applyEnvFlags sets the flags of fs from their env variables (see flagEnvName) except those in cmdline, which
+// were set on the command line and take precedence. It returns the names of the flags set.
+func applyEnvFlags(fs *flag.FlagSet, lookupEnv func(string) (string, bool), cmdline map[string]bool) ([]string, error) {
+	var set []string
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookupEnv(flagEnvName(f.Name))
+		if !ok || cmdline[f.Name] || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("invalid value %s for %s: %s", value, flagEnvName(f.Name), e)
+			return
+		}
+		set = append(set, f.Name)
+	})
+	return set, err
+}
+
+// readConfigFile returns the flags set in the file at path. Each line is name=value where name is a flag name
+// without dashes (eg maxHeaders=50). Blank lines and lines starting with # are skipped.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, found := cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected name=value", path, n)
+		}
+		values[strings.TrimLeft(strings.TrimSpace(name), "-")] = strings.TrimSpace(value)
+	}
+	return values, scanner.Err()
+}
+
+// applyConfigFile sets the flags of fs from the file at path except those in cmdline, which were set on the
+// command line and take precedence. When reload is true, only reloadableFlags are set and the other flags whose
+// value differs are returned in restart. Either all the values are set or none is.
+func applyConfigFile(fs *flag.FlagSet, path string, cmdline map[string]bool, reload bool) (changed []string, restart []string, err error) {
+	values, err := readConfigFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	previous := make(map[string]string)
+	defer func() {
+		if err != nil {
+			for name, value := range previous {
+				fs.Set(name, value)
+			}
+			changed = nil
+		}
+	}()
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil {
+			return nil, nil, fmt.Errorf("%s: unknown flag %s", path, name)
+		}
+		if cmdline[name] || f.Value.String() == values[name] {
+			continue
+		}
+		if reload && !reloadableFlags[name] {
+			restart = append(restart, name)
+			continue
+		}
+		previous[name] = f.Value.String()
+		if err := fs.Set(name, values[name]); err != nil {
+			return nil, nil, fmt.Errorf("%s: invalid value %s for flag %s: %s", path, values[name], name, err)
+		}
+		changed = append(changed, name)
+	}
+	return changed, restart, nil
+}
+
+// reloadConfigFile sets the reloadableFlags of fs from the config file at path (see applyConfigFile) and applies
+// them to the server settings. The flags get their previous values back when the settings reject them, so that fs
+// only ever holds applied values and the next reload sees the same changes.
+func reloadConfigFile(fs *flag.FlagSet, path string, cmdline map[string]bool) (changed []string, restart []string, err error) {
+	previous := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		previous[f.Name] = f.Value.String()
+	})
+	changed, restart, err = applyConfigFile(fs, path, cmdline, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := applyRuntimeFlags(fs); err != nil {
+		for _, name := range changed {
+			fs.Set(name, previous[name])
+		}
+		return nil, nil, err
+	}
+	return changed, restart, nil
+}
+
+// applyRuntimeFlags copies the values of the reloadableFlags of fs to the server settings. The values are all
+// checked first so that an invalid one leaves the current settings as they are.
+func applyRuntimeFlags(fs *flag.FlagSet) error {
+	get := func(name string) interface{} {
+		if f := fs.Lookup(name); f != nil {
+			return f.Value.(flag.Getter).Get()
+		}
+		return nil
+	}
+
+	next := *settings()
+	level := log.GetLevel()
+	if v, ok := get("log").(string); ok {
+		var err error
+		if level, err = log.ParseLevel(v); err != nil {
+			return fmt.Errorf("invalid log level: %s", err)
+		}
+	}
+	if v, ok := get("defaultTunnel").(string); ok {
+		next.defaultTunnelName = strings.ToLower(v)
+	}
+	if v, ok := get("serverHeader").(string); ok {
+		next.serverHeader = v
+	}
+	if v, ok := get("breakerThreshold").(int); ok {
+		next.breakerThreshold = v
+	}
+	if v, ok := get("breakerCooldown").(time.Duration); ok {
+		next.breakerCooldown = v
+	}
+	if v, ok := get("maxHeaderBytes").(int); ok {
+		if v <= 0 || v > bufferSize {
+			return fmt.Errorf("maxHeaderBytes must be between 1 and %d", bufferSize)
+		}
+		next.maxHeaderBytes = v
+	}
+	if v, ok := get("maxHeaderLineBytes").(int); ok {
+		if v <= 0 {
+			return fmt.Errorf("maxHeaderLineBytes must be positive")
+		}
+		next.maxHeaderLineBytes = v
+	}
+	if v, ok := get("maxHeaders").(int); ok {
+		if v <= 0 {
+			return fmt.Errorf("maxHeaders must be positive")
+		}
+		next.maxHeaderCount = v
+	}
+	if v, ok := get("slowRequestTTFB").(time.Duration); ok {
+		next.slowRequestTTFB = v
+	}
+	if v, ok := get("slowRequestDuration").(time.Duration); ok {
+		next.slowRequestDuration = v
+	}
+	if v, ok := get("harMaxEntries").(int); ok {
+		next.harMaxEntries = v
+	}
+	if v, ok := get("harMaxBodyBytes").(int); ok {
+		next.harMaxBodyBytes = v
+	}
+	if v, ok := get("harMaxAge").(time.Duration); ok {
+		next.harMaxAge = v
+	}
+	if v, ok := get("maxTunnelAge").(time.Duration); ok {
+		if v < 0 {
+			return fmt.Errorf("maxTunnelAge must not be negative")
+		}
+		next.maxTunnelAge = v
+	}
+	if v, ok := get("maxConnections").(int); ok {
+		next.maxConnections = v
+	}
+	if v, ok := get("connectionOverflow").(string); ok {
+		next.connectionOverflow = v
+	}
+	if v, ok := get("connectionQueueTimeout").(time.Duration); ok {
+		next.connectionQueueTimeout = v
+	}
+	if err := validateConnLimits(next.maxConnections, next.connectionOverflow, next.connectionQueueTimeout); err != nil {
+		return err
+	}
+	if v, ok := get("maxSSHConnections").(int); ok {
+		if v < 0 {
+			return fmt.Errorf("maxSSHConnections must not be negative")
+		}
+		next.maxSSHConnections = v
+	}
+	if v, ok := get("maxSSHConnectionsPerIP").(int); ok {
+		if v < 0 {
+			return fmt.Errorf("maxSSHConnectionsPerIP must not be negative")
+		}
+		next.maxSSHConnectionsPerIP = v
+	}
+
+	log.SetLevel(level)
+	currentSettings.Store(&next)
+	// The limiters keep counting the connections they let in
+	publicConnections.SetLimits(next.maxConnections, next.connectionOverflow, next.connectionQueueTimeout)
+	sshConnections.SetLimits(next.maxSSHConnections, next.maxSSHConnectionsPerIP)
+	return nil
+}
+
+// loadAuthorizedKeys parses the client public keys (see loadSecret).
+func loadAuthorizedKeys() (map[string]authorizedKey, error) {
+	authorizedKeysBytes, err := loadSecret(authorizedKeysFile, authorizedKeysEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	// Public key authentication is done by comparing
+	// the public key of a received connection
+	// with the entries in the authorized_keys_enc.
+	authorizedKeysMap := map[string]authorizedKey{}
+	for len(authorizedKeysBytes) > 0 {
+		pubKey, _, options, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseAuthorizedKeyOptions(options)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %s", ssh.FingerprintSHA256(pubKey), err)
+		}
+
+		authorizedKeysMap[string(pubKey.Marshal())] = key
+		authorizedKeysBytes = rest
+	}
+	return authorizedKeysMap, nil
+}
+
+// reloadConfig re-reads the config file at path (if any) and the authorized keys and applies the changes that are safe
+// at runtime. Active SSH sessions and tunnels are kept; keys removed from the authorized keys only affect new sessions.
+// An invalid config file leaves its flags as they were, and the other files are reloaded all the same.
+func reloadConfig(path string, cmdline map[string]bool) {
+	log.Println("Reloading configuration")
+
+	var changed []string
+	if path != "" {
+		var restart []string
+		var err error
+		changed, restart, err = reloadConfigFile(flag.CommandLine, path, cmdline)
+		if err != nil {
+			// The other files do not depend on the config file
+			log.Printf("error reloading configuration: %s", err)
+		}
+		if len(restart) > 0 {
+			log.Printf("Ignoring changes to %s until restart", strings.Join(restart, ", "))
+		}
+	}
+
+	keys, err := loadAuthorizedKeys()
+	if err != nil {
+		log.Printf("error reloading authorized keys: %s", err)
+	} else {
+		authorizedKeys.Store(keys)
+		changed = append(changed, "authorized keys")
+	}
+
+	if names, err := loadReservedNames(); err != nil {
+		log.Printf("error reloading reserved names: %s", err)
+	} else if reservedNamesFile != "" {
+		reservedNames.Store(names)
+		changed = append(changed, "reserved names")
+	}
+
+	if denylist, err := loadNameDenylist(); err != nil {
+		log.Printf("error reloading name denylist: %s", err)
+	} else if nameDenylistFile != "" {
+		nameDenylist.Store(denylist)
+		changed = append(changed, "name denylist")
+	}
+
+	log.Printf("Configuration reloaded: %s", strings.Join(changed, ", "))
+	audit("signal", "config.reload", path, strings.Join(changed, ","))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// updateSettings replaces the server settings with a copy changed by update.
+func updateSettings(update func(s *runtimeSettings)) {
+	next := *settings()
+	update(&next)
+	currentSettings.Store(&next)
+}
+
+var _ = Describe("config", func() {
+	var (
+		dir  string
+		path string
+		fs   *flag.FlagSet
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "config")
+		Expect(err).To(Not(HaveOccurred()))
+		path = filepath.Join(dir, "tunnel.conf")
+
+		fs = flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Int("maxHeaders", 100, "")
+		fs.String("serverHeader", "", "")
+		fs.Int("port", 5223, "")
+		fs.Duration("slowRequestTTFB", 0, "")
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+	write := func(content string) {
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+	}
+
+	It("should set the flags of the file except those on the command line", func() {
+		write("# limits\nmaxHeaders=50\n\n--serverHeader = tunnel\nport=22\n")
+		changed, restart, err := applyConfigFile(fs, path, map[string]bool{"port": true}, false)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(changed).To(Equal([]string{"maxHeaders", "serverHeader"}))
+		Expect(restart).To(BeEmpty())
+		Expect(fs.Lookup("maxHeaders").Value.String()).To(Equal("50"))
+		Expect(fs.Lookup("serverHeader").Value.String()).To(Equal("tunnel"))
+		Expect(fs.Lookup("port").Value.String()).To(Equal("5223"))
+	})
+
+	It("should only reload the flags that are safe at runtime", func() {
+		write("maxHeaders=50\nport=22\n")
+		changed, restart, err := applyConfigFile(fs, path, nil, true)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(changed).To(Equal([]string{"maxHeaders"}))
+		Expect(restart).To(Equal([]string{"port"}))
+		Expect(fs.Lookup("port").Value.String()).To(Equal("5223"))
+
+		defer currentSettings.Store(settings())
+		Expect(applyRuntimeFlags(fs)).To(Succeed())
+		Expect(settings().maxHeaderCount).To(Equal(50))
+	})
+
+	It("should apply none of the runtime flags when one is invalid", func() {
+		fs.Duration("maxTunnelAge", 0, "")
+		defer currentSettings.Store(settings())
+		previous := settings()
+		fs.Set("serverHeader", "tunnel")
+		fs.Set("maxTunnelAge", "-1h")
+		Expect(applyRuntimeFlags(fs)).To(MatchError("maxTunnelAge must not be negative"))
+		Expect(settings()).To(BeIdenticalTo(previous))
+		Expect(settings().serverHeader).To(Equal(previous.serverHeader))
+	})
+
+	It("should reject header limits that would fail every request", func() {
+		fs.Int("maxHeaderLineBytes", 8<<10, "")
+		defer currentSettings.Store(settings())
+		previous := settings()
+		fs.Set("maxHeaders", "0")
+		Expect(applyRuntimeFlags(fs)).To(MatchError("maxHeaders must be positive"))
+		fs.Set("maxHeaders", "100")
+		fs.Set("maxHeaderLineBytes", "-1")
+		Expect(applyRuntimeFlags(fs)).To(MatchError("maxHeaderLineBytes must be positive"))
+		Expect(settings()).To(BeIdenticalTo(previous))
+
+		fs.Set("maxHeaderLineBytes", "8192")
+		write("maxHeaders=-5\n")
+		_, _, err := reloadConfigFile(fs, path, nil)
+		Expect(err).To(MatchError("maxHeaders must be positive"))
+		Expect(fs.Lookup("maxHeaders").Value.String()).To(Equal("100"))
+	})
+
+	It("should apply the connection limits to the limiters", func() {
+		fs.Int("maxConnections", 0, "")
+		fs.String("connectionOverflow", connectionOverflowQueue, "")
+		fs.Duration("connectionQueueTimeout", 10*time.Second, "")
+		fs.Int("maxSSHConnectionsPerIP", 0, "")
+		defer func() {
+			fs.Set("maxConnections", "0")
+			fs.Set("connectionOverflow", connectionOverflowQueue)
+			fs.Set("maxSSHConnectionsPerIP", "0")
+			applyRuntimeFlags(fs)
+		}()
+		write("maxConnections=5\nconnectionOverflow=reject\nmaxSSHConnectionsPerIP=2\n")
+		_, _, err := reloadConfigFile(fs, path, nil)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(settings().maxConnections).To(Equal(5))
+		Expect(publicConnections.max).To(Equal(5))
+		Expect(publicConnections.overflow).To(Equal(connectionOverflowReject))
+		Expect(sshConnections.maxPerIP).To(Equal(2))
+
+		write("maxConnections=5\nconnectionOverflow=drop\n")
+		_, _, err = reloadConfigFile(fs, path, nil)
+		Expect(err).To(MatchError("invalid connection overflow drop"))
+		Expect(publicConnections.overflow).To(Equal(connectionOverflowReject))
+		Expect(fs.Lookup("connectionOverflow").Value.String()).To(Equal(connectionOverflowReject))
+	})
+
+	It("should restore the flags of the file when the settings reject them", func() {
+		fs.Duration("maxTunnelAge", 0, "")
+		defer currentSettings.Store(settings())
+		previous := settings()
+		write("serverHeader=tunnel\nmaxTunnelAge=-1h\n")
+		_, _, err := reloadConfigFile(fs, path, nil)
+		Expect(err).To(MatchError("maxTunnelAge must not be negative"))
+		Expect(settings()).To(BeIdenticalTo(previous))
+		Expect(fs.Lookup("serverHeader").Value.String()).To(Equal(""))
+		Expect(fs.Lookup("maxTunnelAge").Value.String()).To(Equal("0s"))
+
+		// The same file fails again, and applies once fixed
+		_, _, err = reloadConfigFile(fs, path, nil)
+		Expect(err).To(HaveOccurred())
+		write("serverHeader=tunnel\nmaxTunnelAge=1h\n")
+		changed, _, err := reloadConfigFile(fs, path, nil)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(changed).To(Equal([]string{"maxTunnelAge", "serverHeader"}))
+		Expect(settings().serverHeader).To(Equal("tunnel"))
+	})
+
+	It("should reload the other files when the config file is invalid", func() {
+		previousKeys, _ := authorizedKeys.Load().(map[string]authorizedKey)
+		previousNames, _ := reservedNames.Load().(map[string][]string)
+		defer func() {
+			if previousKeys == nil {
+				previousKeys = map[string]authorizedKey{}
+			}
+			authorizedKeys.Store(previousKeys)
+			if previousNames == nil {
+				previousNames = map[string][]string{}
+			}
+			reservedNames.Store(previousNames)
+			reservedNamesFile = ""
+		}()
+		reservedNamesFile = filepath.Join(dir, "reserved_names")
+		Expect(os.WriteFile(reservedNamesFile, []byte("reloaded\n"), 0o600)).To(Succeed())
+		write("unknown=1\n")
+		reloadConfig(path, nil)
+		Expect(reservedNameAllowed("reloaded", "")).To(BeFalse())
+	})
+
+	It("should name the env variables of flags", func() {
+		Expect(flagEnvName("domainUrl")).To(Equal("TUNNEL_DOMAIN_URL"))
+		Expect(flagEnvName("slowRequestTTFB")).To(Equal("TUNNEL_SLOW_REQUEST_TTFB"))
+		Expect(flagEnvName("log")).To(Equal("TUNNEL_LOG"))
+	})
+
+	It("should set the flags of the env variables except those on the command line", func() {
+		env := map[string]string{"TUNNEL_MAX_HEADERS": "60", "TUNNEL_PORT": "22"}
+		lookupEnv := func(name string) (string, bool) {
+			v, ok := env[name]
+			return v, ok
+		}
+		set, err := applyEnvFlags(fs, lookupEnv, map[string]bool{"port": true})
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(set).To(Equal([]string{"maxHeaders"}))
+		Expect(fs.Lookup("maxHeaders").Value.String()).To(Equal("60"))
+		Expect(fs.Lookup("port").Value.String()).To(Equal("5223"))
+
+		env["TUNNEL_SLOW_REQUEST_TTFB"] = "abc"
+		_, err = applyEnvFlags(fs, lookupEnv, nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should keep the previous values when the file is invalid", func() {
+		write("serverHeader=none\nslowRequestTTFB=abc\n")
+		_, _, err := applyConfigFile(fs, path, nil, true)
+		Expect(err).To(HaveOccurred())
+		Expect(fs.Lookup("serverHeader").Value.String()).To(Equal(""))
+
+		write("unknown=1\n")
+		_, _, err = applyConfigFile(fs, path, nil, true)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Overflow behaviors of connLimiter once all of its slots are taken.
+const (
+	connectionOverflowQueue  = "queue"  // Wait for a slot up to connectionQueueTimeout
+	connectionOverflowReject = "reject" // Answer 503 (HTTP) or close the connection (TCP) at once
+)
+
+// Public HTTP and TCP connections being handled and those turned away, published at /debug/vars of the pprof port.
+var (
+	publicConnectionsActive   = expvar.NewInt("publicConnectionsActive")
+	publicConnectionsRejected = expvar.NewInt("publicConnectionsRejected")
+)
+
+// Limits the public connections handled at once. Its limits are set from command line flags and reloaded with SIGHUP
+// (see applyRuntimeFlags).
+var publicConnections = &connLimiter{overflow: connectionOverflowQueue}
+
+// connLimiter is a semaphore of the connections accepted from visitors, so that a traffic spike cannot spawn
+// goroutines and buffers without bound. Its limits can change while connections hold slots: a lower limit only turns
+// away further connections.
+type connLimiter struct {
+	mu           sync.Mutex
+	active       int
+	max          int // 0 is unlimited
+	overflow     string
+	queueTimeout time.Duration
+	released     chan struct{} // Closed once a slot may be free, which wakes the queued connections; nil when none waits
+}
+
+func newConnLimiter(max int, overflow string, queueTimeout time.Duration) (*connLimiter, error) {
+	l := &connLimiter{}
+	if err := l.SetLimits(max, overflow, queueTimeout); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetLimits replaces the limits of l. Queued connections are let in if the new limit leaves room for them.
+func (l *connLimiter) SetLimits(max int, overflow string, queueTimeout time.Duration) error {
+	if err := validateConnLimits(max, overflow, queueTimeout); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max, l.overflow, l.queueTimeout = max, overflow, queueTimeout
+	l.wake()
+	return nil
+}
+
+func validateConnLimits(max int, overflow string, queueTimeout time.Duration) error {
+	if overflow != connectionOverflowQueue && overflow != connectionOverflowReject {
+		return fmt.Errorf("invalid connection overflow %s", overflow)
+	}
+	if max < 0 {
+		return fmt.Errorf("maxConnections must not be negative")
+	}
+	if queueTimeout < 0 {
+		return fmt.Errorf("connectionQueueTimeout must not be negative")
+	}
+	return nil
+}
+
+// Acquire takes a slot for a new connection and returns false if the connection must be turned away. Waiting for a
+// slot blocks the accept loop of the listener, which leaves further connections in the backlog of the kernel.
+// It always succeeds if l is nil.
+func (l *connLimiter) Acquire() bool {
+	if l == nil {
+		return true
+	}
+	var timeout <-chan time.Time
+	for {
+		released, queueTimeout, ok := l.tryAcquire()
+		if ok {
+			publicConnectionsActive.Add(1)
+			return true
+		}
+		if queueTimeout <= 0 {
+			break
+		}
+		if timeout == nil {
+			timer := time.NewTimer(queueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-released:
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	publicConnectionsRejected.Add(1)
+	return false
+}
+
+// tryAcquire takes a slot if one is free. Otherwise it returns the channel closed once one may be, and how long to
+// wait for it (0 to turn the connection away at once).
+func (l *connLimiter) tryAcquire() (released <-chan struct{}, queueTimeout time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max <= 0 || l.active < l.max {
+		l.active++
+		return nil, 0, true
+	}
+	if l.overflow == connectionOverflowQueue {
+		queueTimeout = l.queueTimeout
+	}
+	if l.released == nil {
+		l.released = make(chan struct{})
+	}
+	return l.released, queueTimeout, false
+}
+
+// Release frees the slot of a connection once it is closed. It does nothing if l is nil.
+func (l *connLimiter) Release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.wake()
+	publicConnectionsActive.Add(-1)
+}
+
+// wake lets the queued connections try again. l.mu must be held.
+func (l *connLimiter) wake() {
+	if l.released != nil {
+		close(l.released)
+		l.released = nil
+	}
+}
+
+// rejectHttpConnection answers a visitor turned away by publicConnections or the memory budget with a 503 and closes the connection.
+func rejectHttpConnection(conn net.Conn) {
+	go func() {
+		defer conn.Close()
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		writeErrorResponse(conn, settings().serverHeader, newRequestID(), "503 Service Unavailable", "The server is busy.", "Retry-After: 1")
+	}()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("connLimiter", func() {
+	It("should reject connections beyond the limit", func() {
+		l, err := newConnLimiter(1, connectionOverflowReject, time.Second)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(l.Acquire()).To(BeTrue())
+		Expect(l.Acquire()).To(BeFalse())
+		l.Release()
+		Expect(l.Acquire()).To(BeTrue())
+	})
+
+	It("should queue connections until a slot is released or the timeout", func() {
+		l, _ := newConnLimiter(1, connectionOverflowQueue, 50*time.Millisecond)
+		Expect(l.Acquire()).To(BeTrue())
+		Expect(l.Acquire()).To(BeFalse())
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			l.Release()
+		}()
+		Expect(l.Acquire()).To(BeTrue())
+	})
+
+	It("should apply new limits to the connections it already let in", func() {
+		l, _ := newConnLimiter(2, connectionOverflowReject, time.Second)
+		Expect(l.Acquire()).To(BeTrue())
+		Expect(l.Acquire()).To(BeTrue())
+		Expect(l.SetLimits(1, connectionOverflowQueue, time.Second)).To(Succeed())
+		l.Release()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			// A raised limit lets the queued connection in
+			l.SetLimits(2, connectionOverflowQueue, time.Second)
+		}()
+		start := time.Now()
+		Expect(l.Acquire()).To(BeTrue())
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+		Expect(l.SetLimits(0, connectionOverflowReject, 0)).To(Succeed())
+		Expect(l.Acquire()).To(BeTrue())
+		Expect(l.SetLimits(-1, connectionOverflowReject, 0)).To(HaveOccurred())
+	})
+
+	It("should be unlimited when nil", func() {
+		var l *connLimiter
+		Expect(l.Acquire()).To(BeTrue())
+		l.Release()
+	})
+
+	It("should reject an unknown overflow", func() {
+		_, err := newConnLimiter(1, "drop", time.Second)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Streams that fill the buffer of copyConn on every read (eg a large file transfer through a TCP tunnel) get a buffer
+// twice as large after bufferGrowReads reads, up to maxBufferSize. Streams that only use a fraction of it (eg an
+// interactive session) go back to a smaller buffer after bufferShrinkReads reads.
+const (
+	bufferGrowReads   = 4
+	bufferShrinkReads = 16
+	// Number of size classes above bufferSize (bufferSize<<1 to bufferSize<<largeBufferClasses)
+	largeBufferClasses = 8
+)
+
+// Maximum size of the buffers of copyConn. bufferSize or less disables adaptive buffers.
+// This is set from a command line flag.
+var maxBufferSize = 1 << 20
+
+// Pools of the buffers larger than bufferSize by size class: bufferSize<<(i+1) for index i.
+var largeBufPools [largeBufferClasses]sync.Pool
+
+func init() {
+	for i := range largeBufPools {
+		shift := i + 1
+		largeBufPools[i].New = func() interface{} {
+			buffer := make([]byte, bufferSize<<shift)
+			return &buffer
+		}
+	}
+}
+
+// copyConn copies from src to dst until EOF like io.CopyBuffer. When both ends are sockets of the server (eg a
+// relay between two TCP connections), the data is moved by the kernel with splice(2) on Linux and the runtime falls
+// back to a copy elsewhere. Other streams, such as SSH channels which must be encrypted in user space, are copied
+// through buf, or a larger pooled buffer when the stream is fast enough to fill it, rather than the buffer that the
+// ReadFrom/WriteTo methods of net.TCPConn allocate for every connection.
+func copyConn(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	if tcpDst, ok := dst.(*net.TCPConn); ok {
+		switch src.(type) {
+		case *net.TCPConn, *net.UnixConn:
+			return tcpDst.ReadFrom(src)
+		}
+	}
+	return adaptiveCopy(dst, src, buf)
+}
+
+// closeWriter is implemented by the connections and SSH channels whose write side closes on its own (shutdown(2) of
+// TCP, EOF of SSH channels).
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite closes the write side of c if it can be closed on its own, or else c.
+func closeWrite(c io.Closer) error {
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// copyHalf copies from src to dst with copyConn and then closes the write side of dst only, so that the other
+// direction of a relay goes on after a peer half-closes its connection (eg sends a request, shuts down its write
+// side and waits for the reply). An error closes both ends, which ends the other direction too.
+func copyHalf(dst io.WriteCloser, src io.ReadCloser, buf []byte) int64 {
+	written, err := copyConn(dst, src, buf)
+	if err != nil {
+		dst.Close()
+		src.Close()
+		return written
+	}
+	closeWrite(dst)
+	return written
+}
+
+// adaptiveCopy copies from src to dst starting with buf and moves to a larger or smaller buffer of largeBufPools
+// as the reads fill it or not.
+func adaptiveCopy(dst io.Writer, src io.Reader, buf []byte) (written int64, err error) {
+	class := 0 // 0 is buf, otherwise the size class in largeBufPools plus 1
+	current := buf
+	var large *[]byte
+	resize := func(newClass int) {
+		if large != nil {
+			bufferedBytes.Add(-int64(len(*large)))
+			largeBufPools[class-1].Put(large)
+			large = nil
+		}
+		class, current = newClass, buf
+		if class > 0 {
+			large = largeBufPools[class-1].Get().(*[]byte)
+			bufferedBytes.Add(int64(len(*large)))
+			current = *large
+		}
+	}
+	defer resize(0)
+	// Bytes of the pooled buffer counted in bufferedBytes, which is released when moving to another one.
+	heldBytes := func() int {
+		if large == nil {
+			return 0
+		}
+		return len(*large)
+	}
+
+	full, small := 0, 0
+	for {
+		nr, er := src.Read(current)
+		if nr > 0 {
+			nw, ew := dst.Write(current[:nr])
+			if nw < 0 || nr < nw {
+				nw = 0
+				if ew == nil {
+					ew = errors.New("invalid write result")
+				}
+			}
+			written += int64(nw)
+			if ew != nil {
+				return written, ew
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er != io.EOF {
+				err = er
+			}
+			return written, err
+		}
+
+		switch {
+		case nr == len(current):
+			full, small = full+1, 0
+		case nr < len(current)/4:
+			full, small = 0, small+1
+		default:
+			full, small = 0, 0
+		}
+		if full >= bufferGrowReads && class < largeBufferClasses && bufferSize<<(class+1) <= maxBufferSize &&
+			memoryBudgetAllows(bufferSize<<(class+1)-heldBytes()) {
+			resize(class + 1)
+			full = 0
+		} else if small >= bufferShrinkReads && class > 0 {
+			resize(class - 1)
+			small = 0
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("copyConn", func() {
+	It("should copy between TCP connections", func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer ln.Close()
+		src, err := net.Dial("tcp", ln.Addr().String())
+		Expect(err).To(Not(HaveOccurred()))
+		accepted, err := ln.Accept()
+		Expect(err).To(Not(HaveOccurred()))
+		dst, err := net.Dial("tcp", ln.Addr().String())
+		Expect(err).To(Not(HaveOccurred()))
+		received, err := ln.Accept()
+		Expect(err).To(Not(HaveOccurred()))
+
+		payload := strings.Repeat("tunnel", 10000)
+		go func() {
+			io.WriteString(src, payload)
+			src.Close()
+		}()
+		n, err := copyConn(dst, accepted, make([]byte, 16))
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(n).To(Equal(int64(len(payload))))
+		dst.Close()
+
+		b, err := io.ReadAll(received)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(b)).To(Equal(payload))
+	})
+
+	It("should keep the other direction going after a half-close", func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer ln.Close()
+		pair := func() (net.Conn, net.Conn) {
+			dialed, err := net.Dial("tcp", ln.Addr().String())
+			Expect(err).To(Not(HaveOccurred()))
+			accepted, err := ln.Accept()
+			Expect(err).To(Not(HaveOccurred()))
+			return dialed, accepted
+		}
+		// client <-> visitor | relay | backend <-> server
+		client, visitor := pair()
+		backend, server := pair()
+		defer client.Close()
+		defer server.Close()
+		tracked := trackIdle(visitor, 0)
+		go copyHalf(backend, tracked, make([]byte, 16))
+		go copyHalf(tracked, backend, make([]byte, 16))
+
+		io.WriteString(client, "ping")
+		Expect(client.(*net.TCPConn).CloseWrite()).To(Succeed())
+		request, err := io.ReadAll(server)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(request)).To(Equal("ping"))
+		io.WriteString(server, "pong")
+		server.Close()
+		reply, err := io.ReadAll(client)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(reply)).To(Equal("pong"))
+	})
+
+	It("should copy other streams through the buffer", func() {
+		var dst bytes.Buffer
+		n, err := copyConn(&dst, strings.NewReader("abcdef"), make([]byte, 2))
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(n).To(Equal(int64(6)))
+		Expect(dst.String()).To(Equal("abcdef"))
+	})
+
+	It("should grow the buffer of fast streams up to maxBufferSize", func() {
+		defer func(max int) { maxBufferSize = max }(maxBufferSize)
+		maxBufferSize = bufferSize * 4
+
+		dst := &writeSizes{}
+		n, err := copyConn(dst, io.LimitReader(zeroReader{}, int64(bufferSize)*100), make([]byte, bufferSize))
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(n).To(Equal(int64(bufferSize) * 100))
+		Expect(dst.sizes[0]).To(Equal(bufferSize))
+		Expect(dst.sizes[bufferGrowReads]).To(Equal(bufferSize * 2))
+		Expect(dst.sizes[len(dst.sizes)-2]).To(Equal(maxBufferSize))
+	})
+})
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// writeSizes records the size of each write.
+type writeSizes struct {
+	sizes []int
+}
+
+func (w *writeSizes) Write(p []byte) (int, error) {
+	w.sizes = append(w.sizes, len(p))
+	return len(p), nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"expvar"
+	"runtime"
+)
+
+// Runtime and server stats published at /debug/vars of the pprof port (--pprof) along with the expvar
+// defaults (memstats and cmdline). These help tell which part of the server grows without taking a heap profile.
+var (
+	bufPoolAllocated = expvar.NewInt("bufPoolAllocated") // Buffers allocated by bufPool since start
+	bufPoolInUse     = expvar.NewInt("bufPoolInUse")     // Buffers taken from bufPool and not returned yet
+	// HTTP requests answered with a 502 as no channel to the client of the tunnel could be opened
+	channelOpenFailures = expvar.NewInt("channelOpenFailures")
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("sshTunnelListeners", expvar.Func(func() interface{} {
+		sshTunnelListenersLock.Lock()
+		defer sshTunnelListenersLock.Unlock()
+		return len(sshTunnelListeners)
+	}))
+	expvar.Publish("forwards", expvar.Func(func() interface{} {
+		forwardsLock.Lock()
+		defer forwardsLock.Unlock()
+		return len(forwards)
+	}))
+}
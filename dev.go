@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"flag"
+	"math/big"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Developer mode (--dev) runs the full stack locally without DNS setup. lvh.me and all of its subdomains
+// resolve to 127.0.0.1, so tunnels are reachable at eg https://abc.lvh.me:8443.
+const (
+	devDomain    = "lvh.me"
+	devHTTPPort  = 8080
+	devHTTPSPort = 8443
+)
+
+// devMode is true with --dev.
+var devMode bool
+
+// applyDevDefaults sets the defaults of developer mode for the flags of fs that are not in cmdline.
+func applyDevDefaults(fs *flag.FlagSet, cmdline map[string]bool) {
+	defaults := map[string]string{
+		"domainUrl": "https://" + net.JoinHostPort(devDomain, strconv.Itoa(devHTTPSPort)),
+		"httpPorts": strconv.Itoa(devHTTPPort),
+		"log":       "debug",
+	}
+	for name, value := range defaults {
+		if !cmdline[name] && fs.Lookup(name) != nil {
+			fs.Set(name, value)
+		}
+	}
+}
+
+// newDevHostKey returns a throwaway SSH host key. Clients see a new host key on every start.
+func newDevHostKey() (ssh.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// newDevCertificate returns a throwaway self-signed certificate for the dev domain and its subdomains.
+func newDevCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: devDomain},
+		DNSNames:     []string{devDomain, "*." + devDomain, "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// serveDevHTTPS terminates TLS at port with a self-signed certificate and relays the requests to the HTTP
+// listener at httpPort, so that tunnels are also reachable over https.
+func serveDevHTTPS(port int, httpPort int) error {
+	cert, err := newDevCertificate()
+	if err != nil {
+		return err
+	}
+	ln, err := tls.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)), &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return err
+	}
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	log.Printf("Listening for https connections at %s with a self-signed certificate (SHA256 %s)", ln.Addr(), hex.EncodeToString(fingerprint[:]))
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("error accepting https connections at %s: %s", ln.Addr(), err)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				backend, err := net.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(httpPort)))
+				if err != nil {
+					log.Printf("error relaying https connection: %s", err)
+					return
+				}
+				defer backend.Close()
+				go func() {
+					buf := getBuffer()
+					defer putBuffer(buf)
+					copyConn(backend, conn, *buf)
+				}()
+				buf := getBuffer()
+				defer putBuffer(buf)
+				copyConn(conn, backend, *buf)
+			}()
+		}
+	}()
+	return nil
+}
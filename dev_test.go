@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dev", func() {
+	It("should only default the flags that are not set", func() {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		domain := fs.String("domainUrl", "", "")
+		ports := fs.String("httpPorts", "80", "")
+		applyDevDefaults(fs, map[string]bool{"httpPorts": true})
+		Expect(*domain).To(Equal("https://lvh.me:8443"))
+		Expect(*ports).To(Equal("80"))
+	})
+
+	It("should create a certificate for the subdomains", func() {
+		cert, err := newDevCertificate()
+		Expect(err).To(Not(HaveOccurred()))
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(leaf.VerifyHostname("abc.lvh.me")).To(Succeed())
+	})
+
+	It("should keep the port of the domain in tunnel URLs", func() {
+		domain, _ := url.Parse("https://lvh.me:8443")
+		Expect(tunnelURL(*domain, "abc", uint32(httpBindPorts[0]))).To(Equal("https://abc.lvh.me:8443"))
+	})
+})
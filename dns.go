@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DNS providers supported by newDNSProvider.
+const (
+	dnsProviderCloudflare = "cloudflare"
+	dnsProviderRoute53    = "route53"
+)
+
+// dnsRecordTTL is the TTL in seconds of the records created by the server.
+const dnsRecordTTL = 300
+
+// Time between the checks of the DNS records (see watchDomainRecords), so that records removed or changed at the
+// provider are set again.
+var dnsRecordsInterval = 10 * time.Minute
+
+// dnsVerificationPrefix names the TXT record of each domain that tells which server addresses it was set up for,
+// eg _tunnel.domain.io.
+const dnsVerificationPrefix = "_tunnel."
+
+// dnsProvider manages the records of a DNS zone.
+type dnsProvider interface {
+	// Records returns the values of the records of recordType (eg A, AAAA or TXT) named name.
+	Records(ctx context.Context, name string, recordType string) ([]string, error)
+	// SetRecords replaces the records of recordType named name with values.
+	SetRecords(ctx context.Context, name string, recordType string, values []string) error
+}
+
+// newDNSProvider returns the provider named provider for zone, which is a Cloudflare zone id or a Route53 hosted
+// zone id. Credentials are read from the env variables CLOUDFLARE_API_TOKEN or AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and the optional AWS_SESSION_TOKEN.
+func newDNSProvider(provider string, zone string) (dnsProvider, error) {
+	if zone == "" {
+		return nil, fmt.Errorf("missing DNS zone")
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch provider {
+	case dnsProviderCloudflare:
+		token := os.Getenv("CLOUDFLARE_API_TOKEN")
+		if token == "" {
+			return nil, fmt.Errorf("missing env variable CLOUDFLARE_API_TOKEN")
+		}
+		return &cloudflareDNS{baseURL: "https://api.cloudflare.com/client/v4", zone: zone, token: token, client: client}, nil
+	case dnsProviderRoute53:
+		accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if accessKey == "" || secretKey == "" {
+			return nil, fmt.Errorf("missing env variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return &route53DNS{baseURL: "https://route53.amazonaws.com", zone: strings.TrimPrefix(zone, "/hostedzone/"),
+			accessKey: accessKey, secretKey: secretKey, sessionToken: os.Getenv("AWS_SESSION_TOKEN"), client: client}, nil
+	}
+	return nil, fmt.Errorf("invalid DNS provider %s", provider)
+}
+
+// domainRecords returns the A and AAAA records by name that point domain and, unless tunnels are routed by
+// path only, all of its subdomains to ips, and the TXT record that verifies the domain was set up for ips.
+func domainRecords(domain string, ips []net.IP) map[string]map[string][]string {
+	byType := map[string][]string{}
+	for _, ip := range ips {
+		recordType := "AAAA"
+		if ip.To4() != nil {
+			recordType = "A"
+		}
+		byType[recordType] = append(byType[recordType], ip.String())
+	}
+	records := map[string]map[string][]string{domain: byType,
+		dnsVerificationPrefix + domain: {"TXT": {dnsVerificationValue(ips)}}}
+	if routing != routingPath {
+		records["*."+domain] = byType
+	}
+	return records
+}
+
+// dnsVerificationValue returns the value of the TXT record of the domains served at ips.
+func dnsVerificationValue(ips []net.IP) string {
+	return "tunnel-server=" + strings.Join(ipStrings(ips), ",")
+}
+
+// watchDomainRecords checks the records of the served domains every dnsRecordsInterval until ctx is done and sets
+// them again if they were removed or changed at the provider.
+func watchDomainRecords(ctx context.Context, provider dnsProvider, domains []url.URL, ips []net.IP) {
+	go func() {
+		ticker := time.NewTicker(dnsRecordsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			checkCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+			if err := ensureDomainRecords(checkCtx, provider, domains, ips); err != nil {
+				log.Errorf("An error occured checking the DNS records: %s", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// ensureDomainRecords creates the records that point the served domains to ips if they are missing or point
+// elsewhere, and verifies them with the provider. Records that do not resolve yet are only logged since
+// propagation can take a while.
+func ensureDomainRecords(ctx context.Context, provider dnsProvider, domains []url.URL, ips []net.IP) error {
+	for _, domain := range domains {
+		for name, byType := range domainRecords(domain.Hostname(), ips) {
+			for recordType, values := range byType {
+				current, err := provider.Records(ctx, name, recordType)
+				if err != nil {
+					return fmt.Errorf("reading %s records of %s: %w", recordType, name, err)
+				}
+				if sameValues(current, values) {
+					continue
+				}
+				log.Printf("Setting the %s records of %s to %s", recordType, name, strings.Join(values, ","))
+				if err := provider.SetRecords(ctx, name, recordType, values); err != nil {
+					return fmt.Errorf("setting %s records of %s: %w", recordType, name, err)
+				}
+				if current, err = provider.Records(ctx, name, recordType); err != nil || !sameValues(current, values) {
+					return fmt.Errorf("the %s records of %s were not set: %v", recordType, name, err)
+				}
+			}
+		}
+
+		// Verify that the domain resolves to the server
+		addrs, err := net.DefaultResolver.LookupHost(ctx, domain.Hostname())
+		if err != nil || !sameValues(addrs, ipStrings(ips)) {
+			log.Printf("%s does not resolve to %s yet (%v), it may take a while for the DNS records to propagate", domain.Hostname(), strings.Join(ipStrings(ips), ","), addrs)
+		}
+		txts, err := net.DefaultResolver.LookupTXT(ctx, dnsVerificationPrefix+domain.Hostname())
+		if err != nil || !sameValues(txts, []string{dnsVerificationValue(ips)}) {
+			log.Printf("The TXT record of %s%s does not resolve to %s yet (%v), it may take a while for the DNS records to propagate", dnsVerificationPrefix, domain.Hostname(), dnsVerificationValue(ips), txts)
+		}
+	}
+	return nil
+}
+
+// sameValues returns true if a and b have the same values in any order.
+func sameValues(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func ipStrings(ips []net.IP) []string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return s
+}
+
+// cloudflareDNS manages records with the Cloudflare API v4.
+type cloudflareDNS struct {
+	baseURL string
+	zone    string
+	token   string
+	client  *http.Client
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+// do sends a request to the Cloudflare API and decodes the result into result if not nil.
+func (c *cloudflareDNS) do(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+"/zones/"+url.PathEscape(c.zone)+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("%s: %w", resp.Status, err)
+	}
+	if !envelope.Success {
+		var messages []string
+		for _, e := range envelope.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.Join(messages, "; "))
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
+
+func (c *cloudflareDNS) list(ctx context.Context, name string, recordType string) ([]cloudflareRecord, error) {
+	var records []cloudflareRecord
+	query := url.Values{"name": {name}, "type": {recordType}}
+	err := c.do(ctx, http.MethodGet, "/dns_records?"+query.Encode(), nil, &records)
+	return records, err
+}
+
+func (c *cloudflareDNS) Records(ctx context.Context, name string, recordType string) ([]string, error) {
+	records, err := c.list(ctx, name, recordType)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, len(records))
+	for i, r := range records {
+		values[i] = r.Content
+	}
+	return values, nil
+}
+
+func (c *cloudflareDNS) SetRecords(ctx context.Context, name string, recordType string, values []string) error {
+	records, err := c.list(ctx, name, recordType)
+	if err != nil {
+		return err
+	}
+	missing := map[string]bool{}
+	for _, v := range values {
+		missing[v] = true
+	}
+	for _, r := range records {
+		if missing[r.Content] {
+			delete(missing, r.Content)
+			continue
+		}
+		if err := c.do(ctx, http.MethodDelete, "/dns_records/"+url.PathEscape(r.ID), nil, nil); err != nil {
+			return err
+		}
+	}
+	for _, v := range values {
+		if !missing[v] {
+			continue
+		}
+		record := cloudflareRecord{Type: recordType, Name: name, Content: v, TTL: dnsRecordTTL}
+		if err := c.do(ctx, http.MethodPost, "/dns_records", record, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// route53DNS manages records with the Route53 API, signing requests with AWS Signature Version 4.
+type route53DNS struct {
+	baseURL      string
+	zone         string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+type route53RecordSet struct {
+	Name   string   `xml:"Name"`
+	Type   string   `xml:"Type"`
+	TTL    int      `xml:"TTL,omitempty"`
+	Values []string `xml:"ResourceRecords>ResourceRecord>Value"`
+}
+
+func (r *route53DNS) do(ctx context.Context, method string, path string, body []byte, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, r.baseURL+"/2013-04-01/hostedzone/"+r.zone+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	signAWSv4(req, body, r.accessKey, r.secretKey, r.sessionToken, "us-east-1", "route53", time.Now())
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, b)
+	}
+	if result != nil {
+		return xml.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// fqdn returns name with a trailing dot as returned by Route53. Route53 escapes * as \052.
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+func (r *route53DNS) Records(ctx context.Context, name string, recordType string) ([]string, error) {
+	var result struct {
+		RecordSets []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	}
+	query := url.Values{"name": {name}, "type": {recordType}, "maxitems": {"1"}}
+	if err := r.do(ctx, http.MethodGet, "/rrset?"+query.Encode(), nil, &result); err != nil {
+		return nil, err
+	}
+	for _, set := range result.RecordSets {
+		if strings.EqualFold(strings.ReplaceAll(set.Name, `\052`, "*"), fqdn(name)) && set.Type == recordType {
+			if recordType == "TXT" {
+				for i, v := range set.Values {
+					if unquoted, err := strconv.Unquote(v); err == nil {
+						set.Values[i] = unquoted
+					}
+				}
+			}
+			return set.Values, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *route53DNS) SetRecords(ctx context.Context, name string, recordType string, values []string) error {
+	type change struct {
+		Action    string           `xml:"Action"`
+		RecordSet route53RecordSet `xml:"ResourceRecordSet"`
+	}
+	// Route53 expects the values of TXT records in quotes
+	if recordType == "TXT" {
+		quoted := make([]string, len(values))
+		for i, v := range values {
+			quoted[i] = strconv.Quote(v)
+		}
+		values = quoted
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+		Changes []change `xml:"ChangeBatch>Changes>Change"`
+	}{Changes: []change{{Action: "UPSERT", RecordSet: route53RecordSet{Name: fqdn(name), Type: recordType, TTL: dnsRecordTTL, Values: values}}}})
+	if err != nil {
+		return err
+	}
+	return r.do(ctx, http.MethodPost, "/rrset", append([]byte(xml.Header), body...), nil)
+}
+
+// signAWSv4 signs req with AWS Signature Version 4 at time t.
+func signAWSv4(req *http.Request, body []byte, accessKey string, secretKey string, sessionToken string, region string, service string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	// Canonical headers are the host and the x-amz-* headers
+	headers := []string{"host"}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers = append(headers, lower)
+		}
+	}
+	sort.Strings(headers)
+	var canonicalHeaders strings.Builder
+	for _, name := range headers {
+		value := req.Host
+		if value == "" {
+			value = req.URL.Host
+		}
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	// Query parameters are sorted by name and encoded with %20 for spaces
+	canonicalQuery := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), canonicalQuery,
+		canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:])}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dns", func() {
+	It("should point the domain and its subdomains to the server", func() {
+		records := domainRecords("domain.io", []net.IP{net.ParseIP("203.0.113.10"), net.ParseIP("2001:db8::10")})
+		Expect(records).To(HaveLen(3))
+		Expect(records["*.domain.io"]["A"]).To(Equal([]string{"203.0.113.10"}))
+		Expect(records["domain.io"]["AAAA"]).To(Equal([]string{"2001:db8::10"}))
+		Expect(records["_tunnel.domain.io"]["TXT"]).To(Equal([]string{"tunnel-server=203.0.113.10,2001:db8::10"}))
+	})
+
+	It("should replace the records of a Cloudflare zone", func() {
+		// Fake zone with a stale record
+		type record = cloudflareRecord
+		zone := map[string]record{"1": {ID: "1", Type: "A", Name: "domain.io", Content: "198.51.100.1"}}
+		nextID := 2
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Header.Get("Authorization")).To(Equal("Bearer token"))
+			var result interface{}
+			switch {
+			case r.Method == http.MethodGet:
+				list := []record{}
+				for _, rec := range zone {
+					if rec.Name == r.URL.Query().Get("name") && rec.Type == r.URL.Query().Get("type") {
+						list = append(list, rec)
+					}
+				}
+				result = list
+			case r.Method == http.MethodPost:
+				var rec record
+				json.NewDecoder(r.Body).Decode(&rec)
+				rec.ID = string(rune('0' + nextID))
+				nextID++
+				zone[rec.ID] = rec
+			case r.Method == http.MethodDelete:
+				delete(zone, strings.TrimPrefix(r.URL.Path, "/zones/z/dns_records/"))
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": result})
+		}))
+		defer server.Close()
+
+		provider := &cloudflareDNS{baseURL: server.URL, zone: "z", token: "token", client: server.Client()}
+		domain, _ := url.Parse("https://domain.io")
+		Expect(ensureDomainRecords(context.Background(), provider, []url.URL{*domain}, []net.IP{net.ParseIP("203.0.113.10")})).To(Succeed())
+
+		values, err := provider.Records(context.Background(), "domain.io", "A")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(values).To(Equal([]string{"203.0.113.10"}))
+		values, _ = provider.Records(context.Background(), "*.domain.io", "A")
+		Expect(values).To(Equal([]string{"203.0.113.10"}))
+		values, _ = provider.Records(context.Background(), "_tunnel.domain.io", "TXT")
+		Expect(values).To(Equal([]string{"tunnel-server=203.0.113.10"}))
+	})
+})
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Activity event types.
+const (
+	eventTunnelOpen  = "tunnelOpen"
+	eventTunnelClose = "tunnelClose"
+	eventRequest     = "request"
+)
+
+// Events buffered per subscriber. Events are dropped for subscribers that fall further behind.
+const activitySubscriberBuffer = 64
+
+// activityEvent is a tunnel being opened or closed, or the summary of a proxied http request.
+type activityEvent struct {
+	Type           string    `json:"type"`
+	Time           time.Time `json:"time"`
+	TunnelName     string    `json:"tunnelName"`
+	ConnectionType string    `json:"connectionType,omitempty"`
+	RequestID      string    `json:"requestId,omitempty"`
+	Method         string    `json:"method,omitempty"`
+	URI            string    `json:"uri,omitempty"`
+	Status         int       `json:"status,omitempty"`
+	BytesIn        int64     `json:"bytesIn,omitempty"`
+	BytesOut       int64     `json:"bytesOut,omitempty"`
+	DurationMs     int64     `json:"durationMs,omitempty"`
+}
+
+// activityBroker fans out activity events to the subscribers of the /events endpoint.
+type activityBroker struct {
+	sync.Mutex
+	subscribers map[chan *activityEvent]struct{}
+}
+
+var activity = &activityBroker{subscribers: make(map[chan *activityEvent]struct{})}
+
+func init() {
+	// Served by the admin (pprof) port.
+	http.HandleFunc("/events", serveActivityEvents)
+}
+
+// Publish sends e to every subscriber without blocking.
+func (b *activityBroker) Publish(e *activityEvent) {
+	e.Time = time.Now()
+	b.Lock()
+	defer b.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the published events. It must be released with Unsubscribe.
+func (b *activityBroker) Subscribe() chan *activityEvent {
+	ch := make(chan *activityEvent, activitySubscriberBuffer)
+	b.Lock()
+	defer b.Unlock()
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *activityBroker) Unsubscribe(ch chan *activityEvent) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.subscribers, ch)
+}
+
+// serveActivityEvents streams the activity events as server-sent events until the caller disconnects.
+func serveActivityEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := activity.Subscribe()
+	defer activity.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Debugf("error encoding activity event: %s", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
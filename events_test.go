@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("activity events", func() {
+
+	It("should deliver published events to subscribers only", func() {
+		sut := &activityBroker{subscribers: make(map[chan *activityEvent]struct{})}
+		ch := sut.Subscribe()
+		sut.Publish(&activityEvent{Type: eventTunnelOpen, TunnelName: "demo"})
+		Expect((<-ch).TunnelName).To(Equal("demo"))
+
+		sut.Unsubscribe(ch)
+		sut.Publish(&activityEvent{Type: eventTunnelClose, TunnelName: "demo"})
+		Expect(ch).To(BeEmpty())
+	})
+
+	It("should stream events as server-sent events", func() {
+		server := httptest.NewServer(http.HandlerFunc(serveActivityEvents))
+		defer server.Close()
+
+		response, err := http.Get(server.URL)
+		Expect(err).To(Not(HaveOccurred()))
+		defer response.Body.Close()
+		Expect(response.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+		activity.Publish(&activityEvent{Type: eventRequest, TunnelName: "demo", Status: 200})
+		reader := bufio.NewReader(response.Body)
+		line, err := reader.ReadString('\n')
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(line).To(Equal("event: request\n"))
+		line, _ = reader.ReadString('\n')
+		Expect(strings.HasPrefix(line, "data: {")).To(BeTrue())
+		Expect(line).To(ContainSubstring(`"status":200`))
+	})
+})
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tunnelOptions are sent by the client in the exec request as key=value pairs separated by a comma
+// (eg id=dhskjdshf24343,tunnelName=abc,type=http,header=localhost:3000) or as a JSON object. Values containing a
+// comma, such as passwords, need the JSON object.
+type tunnelOptions struct {
+	clientID        string
+	tunnelName      string
+	connectionType  string
+	header          string
+	headerSpecified bool
+	// Cache GET/HEAD responses at the edge (HTTP only)
+	cache bool
+	// URL path rewrite rules applied in order (HTTP only)
+	rewriteRules []rewriteRule
+	// Share the tunnel name with other clients that also specify shared=true (HTTP only)
+	shared bool
+	// Visitor affinity across the clients of a shared tunnel: cookie or ip
+	sticky string
+	// Stand by for the tunnel name of another client of the same key, serving it once that client disconnects
+	// (HTTP only)
+	standby bool
+	// Share of the requests of a shared tunnel relative to the other clients, defaultTunnelWeight if not specified
+	// (HTTP only)
+	weight          int
+	weightSpecified bool
+	// Paths exposed by the tunnel (HTTP only)
+	pathRules pathRules
+	// tunnelName of a shadow tunnel of the same key that gets a copy of each request, whose responses are discarded
+	// (HTTP only)
+	mirror string
+	// Visitors need a share link, valid for this long from the time the tunnel opens (HTTP only)
+	shareLink time.Duration
+	// Server header of responses: none hides it, other values override it (HTTP only)
+	server          string
+	serverSpecified bool
+	// Serve a robots.txt disallowing crawlers and tag responses with X-Robots-Tag (HTTP only)
+	noindex bool
+	// Served base domain of the tunnel URL (eg tun2.dev) if not the default (HTTP only)
+	domain string
+	// Format and fields of the request lines written to the SSH session
+	sessionLog sessionLog
+	// Keep recent request/response pairs downloadable as a HAR file from the admin port (HTTP only)
+	har bool
+	// Relay header names exactly as written instead of parsing them with the MIME reader (HTTP only)
+	preserveHeaderCase bool
+	// Multiplex requests over one channel; only for clients that speak the mux framing (HTTP only)
+	mux bool
+	// Public connections served at once; 0 is unlimited
+	maxConns int
+	// The request is JSON and so are the replies (see execReply)
+	json bool
+	// Credentials visitors must send with HTTP Basic authentication (HTTP only)
+	basicAuth *basicAuth
+	// Password visitors enter in a form, once per browser (HTTP only)
+	passwordPage *passwordPage
+	// Visitor addresses allowed to use the tunnel; empty allows all
+	allowIPs ipAllowList
+	// The tunnel is closed after this long without public traffic; 0 never closes it
+	idleTimeout time.Duration
+	// Path of the local server checked every healthCheckInterval; the tunnel serves 503s while the checks fail (HTTP only)
+	healthCheck string
+	// Check that the local server answers once the tunnel is open and warn the client if not
+	probe bool
+	// Open the TCP tunnel on a free port when the requested one is unavailable (TCP only)
+	portFallback bool
+	// Keepalive settings of the client overriding those of the server; 0 keeps them
+	keepaliveInterval time.Duration
+	keepaliveMaxCount int
+	// Requests are not captured, logged or written to the session, only counted (inspect=false)
+	private bool
+	// Only visitors of internalCIDRs reach the tunnel (visibility=private)
+	internal bool
+	// Path segment of the tunnel URL when tunnels are routed by path (eg myapp for domain.io/myapp), in place of tunnelName
+	path string
+}
+
+// parseTunnelOptions parses the exec request of a tunnel, either key=value pairs or a JSON object (see setJSON).
+// Unknown keys are ignored. Parts without = other than more addresses of allow-ips are an error so that a value
+// containing a comma (eg auth=alice:pa,ss) is never cut short.
+func parseTunnelOptions(request string) (tunnelOptions, error) {
+	var options tunnelOptions
+
+	if strings.HasPrefix(strings.TrimSpace(request), "{") {
+		options.json = true
+		if err := options.setJSON(request); err != nil {
+			return options, err
+		}
+		// Request lines are JSON too unless the client asks otherwise
+		if options.sessionLog.format == "" {
+			options.sessionLog.format = sessionLogJSON
+		}
+		options.applyPrivate()
+		return options, nil
+	}
+
+	lastKey := ""
+	for _, p := range strings.Split(request, ",") {
+		key, value, found := cut(strings.TrimSpace(p), "=")
+		if !found {
+			if key == "" {
+				continue
+			}
+			if lastKey == "" {
+				return options, fmt.Errorf("invalid option %s, expected key=value", key)
+			}
+			// Not echoed as it may be part of a password
+			if !strings.EqualFold(lastKey, "allow-ips") {
+				return options, fmt.Errorf("invalid option after %s, expected key=value (values containing a comma need a JSON exec request)", lastKey)
+			}
+			// More addresses of allow-ips=10.0.0.0/8,203.0.113.5
+			key, value = lastKey, key
+		}
+		lastKey = key
+		if err := options.set(key, value); err != nil {
+			return options, err
+		}
+	}
+	options.applyPrivate()
+
+	return options, nil
+}
+
+// applyPrivate turns off the options that record requests of private tunnels (inspect=false) whatever their order.
+func (options *tunnelOptions) applyPrivate() {
+	if options.private {
+		options.har = false
+		options.sessionLog.format = sessionLogOff
+	}
+}
+
+// setJSON sets the options of a JSON exec request, eg
+//
+//	{"version":1,"type":"http","tunnelName":"abc","cache":true,"rewrite":["/api/->/v2/"]}
+//
+// Keys are those of the key=value pairs and must come with the version of the exec protocol. A list sets its key
+// once per value, in order.
+func (options *tunnelOptions) setJSON(request string) error {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(request))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return fmt.Errorf("invalid JSON exec request: %s", err)
+	}
+	if version, ok := fields["version"].(json.Number); !ok || version.String() != strconv.Itoa(execProtocolVersion) {
+		return fmt.Errorf("unsupported exec protocol version %v, expected %d", fields["version"], execProtocolVersion)
+	}
+	delete(fields, "version")
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values, ok := fields[key].([]interface{})
+		if !ok {
+			values = []interface{}{fields[key]}
+		}
+		for _, v := range values {
+			value, err := jsonOptionValue(key, v)
+			if err != nil {
+				return err
+			}
+			if err := options.set(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jsonOptionValue returns the value of key in a JSON object of options as in a key=value pair.
+func jsonOptionValue(key string, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case json.Number:
+		return v.String(), nil
+	}
+	return "", fmt.Errorf("invalid %s value %v", key, v)
+}
+
+// set sets the option of key to value.
+func (options *tunnelOptions) set(key string, value string) error {
+	switch strings.ToLower(key) {
+	case "id":
+		options.clientID = strings.ToLower(value)
+	case "tunnelname":
+		options.tunnelName = strings.ToLower(value)
+	case "path":
+		options.path = strings.ToLower(strings.Trim(value, "/"))
+	case "type":
+		options.connectionType = strings.ToLower(value)
+		if options.connectionType != "https" && options.connectionType != "http" && options.connectionType != "tcp" {
+			return fmt.Errorf("invalid connectionType %s", options.connectionType)
+		}
+	case "header":
+		options.header = strings.ToLower(value)
+		options.headerSpecified = true
+	case "cache":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid cache value %s", value)
+		}
+		options.cache = b
+	case "rewrite":
+		rule, err := parseRewriteRule(value)
+		if err != nil {
+			return err
+		}
+		options.rewriteRules = append(options.rewriteRules, rule)
+	case "allow-paths", "deny-paths":
+		if err := options.pathRules.Add(value, strings.ToLower(key) == "allow-paths"); err != nil {
+			return err
+		}
+	case "health-check":
+		if !strings.HasPrefix(value, "/") {
+			return fmt.Errorf("invalid health-check value %s, expected a path starting with /", value)
+		}
+		options.healthCheck = value
+	case "probe":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid probe value %s", value)
+		}
+		options.probe = b
+	case "port-fallback":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid port-fallback value %s", value)
+		}
+		options.portFallback = b
+	case "noindex":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid noindex value %s", value)
+		}
+		options.noindex = b
+	case "domain":
+		options.domain = strings.ToLower(value)
+	case "log":
+		if err := options.sessionLog.SetFormat(value); err != nil {
+			return err
+		}
+	case "log-field":
+		if err := options.sessionLog.AddField(value); err != nil {
+			return err
+		}
+	case "har":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid har value %s", value)
+		}
+		options.har = b
+	case "server":
+		options.server = value
+		options.serverSpecified = true
+	case "shared":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid shared value %s", value)
+		}
+		options.shared = b
+	case "mirror":
+		options.mirror = strings.ToLower(value)
+	case "weight":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 10000 {
+			return fmt.Errorf("invalid weight value %s", value)
+		}
+		options.weight, options.weightSpecified = n, true
+	case "standby":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid standby value %s", value)
+		}
+		options.standby = b
+	case "preserveheadercase":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid preserveHeaderCase value %s", value)
+		}
+		options.preserveHeaderCase = b
+	case "mux":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid mux value %s", value)
+		}
+		options.mux = b
+	case "max-conns":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid max-conns value %s", value)
+		}
+		options.maxConns = n
+	case "auth":
+		a, err := parseBasicAuth(value)
+		if err != nil {
+			return err
+		}
+		options.basicAuth = a
+	case "password":
+		p, err := parsePasswordPage(value)
+		if err != nil {
+			return err
+		}
+		options.passwordPage = p
+	case "inspect":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid inspect value %s", value)
+		}
+		options.private = !b
+	case "share-link":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid share-link value %s", value)
+		}
+		options.shareLink = d
+	case "idle-timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid idle-timeout value %s", value)
+		}
+		options.idleTimeout = d
+	case "keepalive-interval":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Second || d > maxClientKeepaliveInterval {
+			return fmt.Errorf("invalid keepalive-interval value %s, expected 1s to %s", value, maxClientKeepaliveInterval)
+		}
+		options.keepaliveInterval = d
+	case "keepalive-count":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxClientKeepaliveMaxCount {
+			return fmt.Errorf("invalid keepalive-count value %s, expected 1 to %d", value, maxClientKeepaliveMaxCount)
+		}
+		options.keepaliveMaxCount = n
+	case "allow-ips":
+		if err := options.allowIPs.Add(value); err != nil {
+			return err
+		}
+	case "visibility":
+		switch strings.ToLower(value) {
+		case "public":
+			options.internal = false
+		case "private":
+			options.internal = true
+		default:
+			return fmt.Errorf("invalid visibility value %s", value)
+		}
+	case "sticky":
+		options.sticky = strings.ToLower(value)
+		if options.sticky != stickyCookie && options.sticky != stickyIP {
+			return fmt.Errorf("invalid sticky value %s", value)
+		}
+	}
+
+	return nil
+}
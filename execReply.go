@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Version of the JSON exec protocol, which clients send in their requests (see setJSON) and get back in the replies.
+const execProtocolVersion = 1
+
+// execReply is the reply to a JSON exec request, written to the session as one line once the tunnel is open or
+// refused, once more if the server closes the tunnel, and with only warnings for the problems found once it is open.
+// The lines in between are the request lines of the tunnel, in JSON unless the client asks otherwise.
+type execReply struct {
+	Version int    `json:"version"`
+	Type    string `json:"type,omitempty"` // http, https or tcp
+	URL     string `json:"url,omitempty"`
+	// URL by path of HTTP tunnels routed both ways (--routing=both), for networks that do not resolve subdomains
+	FallbackURL string   `json:"fallbackUrl,omitempty"`
+	TunnelName  string   `json:"tunnelName,omitempty"` // HTTP tunnels only
+	Host        string   `json:"host,omitempty"`
+	Port        int      `json:"port,omitempty"`
+	Warnings    []string `json:"warnings,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Closed      string   `json:"closed,omitempty"` // Why the server closed the tunnel after opening it
+}
+
+// sessionReplier writes the replies of the server to the exec request of a tunnel: a line of text for each message,
+// or an execReply if the request was JSON.
+type sessionReplier struct {
+	w        io.Writer
+	json     bool
+	warnings []string
+	opened   bool // Warnings are written at once rather than with the reply of the tunnel
+}
+
+// Warn tells the client about a problem that does not keep the tunnel from opening.
+func (r *sessionReplier) Warn(message string) {
+	if r.json {
+		r.warnings = append(r.warnings, message)
+		if r.opened {
+			r.write(execReply{})
+		}
+		return
+	}
+	io.WriteString(r.w, message+"\n")
+}
+
+// Fail tells the client why the tunnel is refused.
+func (r *sessionReplier) Fail(message string) {
+	if r.json {
+		r.write(execReply{Error: message})
+		return
+	}
+	io.WriteString(r.w, message+"\n")
+}
+
+// OpenedHTTP tells the client the URL of its HTTP tunnel, and its fallback URL if not empty on the next line.
+func (r *sessionReplier) OpenedHTTP(connectionType string, url string, fallbackURL string, tunnelName string, port uint32) {
+	r.opened = true
+	if r.json {
+		r.write(execReply{Type: connectionType, URL: url, FallbackURL: fallbackURL, TunnelName: tunnelName, Port: int(port)})
+		return
+	}
+	io.WriteString(r.w, url+"\n")
+	if fallbackURL != "" {
+		io.WriteString(r.w, fallbackURL+"\n")
+	}
+}
+
+// OpenedTCP tells the client the address of its TCP tunnel.
+func (r *sessionReplier) OpenedTCP(host string, port int) {
+	r.opened = true
+	if r.json {
+		address := net.JoinHostPort(host, strconv.Itoa(port))
+		r.write(execReply{Type: string(TCPConnectionType), URL: "tcp://" + address, Host: host, Port: port})
+		return
+	}
+	io.WriteString(r.w, fmt.Sprintf("%s:%d\n", host, port))
+}
+
+// Closed tells the client why the server closed its tunnel.
+func (r *sessionReplier) Closed(message string) {
+	if r.json {
+		r.write(execReply{Closed: message})
+		return
+	}
+	io.WriteString(r.w, message+"\n")
+}
+
+func (r *sessionReplier) write(reply execReply) {
+	reply.Version = execProtocolVersion
+	reply.Warnings, r.warnings = r.warnings, nil
+	b, _ := json.Marshal(reply)
+	r.w.Write(append(b, '\n'))
+}
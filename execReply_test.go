@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JSON exec protocol", func() {
+	It("should parse JSON exec requests like key=value pairs", func() {
+		options, err := parseTunnelOptions(`{"version":1,"type":"http","tunnelName":"Abc","cache":true,"max-conns":3,"rewrite":["/api/->/v2/","/a,b/->/c/"]}`)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.json).To(BeTrue())
+		Expect(options.connectionType).To(Equal("http"))
+		Expect(options.tunnelName).To(Equal("abc"))
+		Expect(options.cache).To(BeTrue())
+		Expect(options.maxConns).To(Equal(3))
+		Expect(options.rewriteRules).To(HaveLen(2))
+		Expect(options.sessionLog.format).To(Equal(sessionLogJSON))
+
+		options, err = parseTunnelOptions(`{"version":1,"type":"tcp","log":"plain"}`)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.sessionLog.format).To(Equal(sessionLogPlain))
+
+		options, err = parseTunnelOptions("type=http,tunnelName=abc")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.json).To(BeFalse())
+	})
+
+	It("should reject invalid JSON exec requests", func() {
+		for _, request := range []string{
+			`{"type":"http"}`,
+			`{"version":2,"type":"http"}`,
+			`{"version":1,"type":"http"`,
+			`{"version":1,"cache":{"enabled":true}}`,
+			`{"version":1,"type":"udp"}`,
+		} {
+			options, err := parseTunnelOptions(request)
+			Expect(err).To(HaveOccurred(), request)
+			Expect(options.json).To(BeTrue())
+		}
+	})
+
+	It("should reply with text lines to legacy requests", func() {
+		var b bytes.Buffer
+		r := &sessionReplier{w: &b}
+		r.Warn("Specified tunnelName 'a-' not valid")
+		r.OpenedHTTP("http", "https://x.domain.io", "", "x", 80)
+		r.OpenedTCP("domain.io", 1000)
+		r.Fail("TCP port 80 is reserved for HTTP tunnels.")
+		Expect(b.String()).To(Equal("Specified tunnelName 'a-' not valid\nhttps://x.domain.io\ndomain.io:1000\nTCP port 80 is reserved for HTTP tunnels.\n"))
+
+		b.Reset()
+		r.OpenedHTTP("http", "https://x.domain.io", "https://domain.io/x", "x", 80)
+		Expect(b.String()).To(Equal("https://x.domain.io\nhttps://domain.io/x\n"))
+	})
+
+	It("should reply with one JSON line to JSON requests", func() {
+		var b bytes.Buffer
+		r := &sessionReplier{w: &b, json: true}
+		r.Warn("Specified tunnelName 'a-' not valid")
+		r.OpenedHTTP("https", "https://x.domain.io", "", "x", 443)
+		Expect(b.String()).To(HaveSuffix("\n"))
+		Expect(b.String()).To(MatchJSON(`{"version":1,"type":"https","url":"https://x.domain.io","tunnelName":"x","port":443,"warnings":["Specified tunnelName 'a-' not valid"]}`))
+
+		b.Reset()
+		r = &sessionReplier{w: &b, json: true}
+		r.OpenedHTTP("https", "https://x.domain.io", "https://domain.io/x", "x", 443)
+		Expect(b.String()).To(MatchJSON(`{"version":1,"type":"https","url":"https://x.domain.io","fallbackUrl":"https://domain.io/x","tunnelName":"x","port":443}`))
+
+		b.Reset()
+		r = &sessionReplier{w: &b, json: true}
+		r.OpenedTCP("domain.io", 1000)
+		Expect(b.String()).To(MatchJSON(`{"version":1,"type":"tcp","url":"tcp://domain.io:1000","host":"domain.io","port":1000}`))
+
+		b.Reset()
+		r = &sessionReplier{w: &b, json: true}
+		r.Fail("Domain x.io is not served.")
+		Expect(b.String()).To(MatchJSON(`{"version":1,"error":"Domain x.io is not served."}`))
+	})
+})
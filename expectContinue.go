@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// How long to wait for the client's backend to answer a request with `Expect: 100-continue`
+// before sending a 100 Continue to the visitor on its behalf.
+const expectContinueTimeout = time.Second
+
+// continueResponder sends a synthesized 100 Continue to the visitor unless the backend
+// starts responding first. This unblocks visitors whose request would otherwise stall when
+// the backend does not send interim responses (eg HTTP/1.0 servers).
+// A nil continueResponder does nothing.
+type continueResponder struct {
+	sync.Mutex
+	timer     *time.Timer
+	responded bool
+}
+
+func newContinueResponder(w io.Writer, timeout time.Duration) *continueResponder {
+	c := &continueResponder{}
+	c.timer = time.AfterFunc(timeout, func() {
+		c.Lock()
+		defer c.Unlock()
+		if !c.responded {
+			c.responded = true
+			io.WriteString(w, "HTTP/1.1 100 Continue\r\n\r\n")
+		}
+	})
+	return c
+}
+
+// Responded stops the timer once the backend response has started.
+// Any synthesized 100 Continue is fully written by the time it returns.
+func (c *continueResponder) Responded() {
+	if c == nil {
+		return
+	}
+	c.timer.Stop()
+	c.Lock()
+	defer c.Unlock()
+	c.responded = true
+}
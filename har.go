@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Captured request/response pairs by tunnel name. They outlive the tunnel until they expire so that
+// they can be downloaded after the client disconnects.
+var harCaptures = &harRegistry{logs: make(map[string][]*harRecord)}
+
+func init() {
+	// Served by the admin (pprof) port.
+	http.HandleFunc("/har", serveHar)
+}
+
+// harRecord is a request and its response as relayed, each truncated to its headers plus harMaxBodyBytes.
+type harRecord struct {
+	started  time.Time
+	duration time.Duration
+	scheme   string
+	request  []byte
+	response []byte
+	// The response was cut at harMaxBodyBytes
+	truncated bool
+}
+
+type harRegistry struct {
+	sync.Mutex
+	logs map[string][]*harRecord
+}
+
+// Add stores r for tunnelName dropping the oldest and expired records.
+func (h *harRegistry) Add(tunnelName string, r *harRecord) {
+	h.Lock()
+	defer h.Unlock()
+	records := append(h.logs[tunnelName], r)
+	if maxEntries := settings().harMaxEntries; len(records) > maxEntries {
+		records = records[len(records)-maxEntries:]
+	}
+	h.logs[tunnelName] = records
+	h.expire()
+}
+
+// Get returns the records of tunnelName that have not expired.
+func (h *harRegistry) Get(tunnelName string) []*harRecord {
+	h.Lock()
+	defer h.Unlock()
+	h.expire()
+	return append([]*harRecord{}, h.logs[tunnelName]...)
+}
+
+// expire drops the records older than harMaxAge. h must be locked.
+func (h *harRegistry) expire() {
+	cutoff := time.Now().Add(-settings().harMaxAge)
+	for name, records := range h.logs {
+		i := 0
+		for i < len(records) && records[i].started.Before(cutoff) {
+			i++
+		}
+		if i == len(records) {
+			delete(h.logs, name)
+		} else if i > 0 {
+			h.logs[name] = records[i:]
+		}
+	}
+}
+
+// HAR 1.2 format. See http://www.softwareishard.com/blog/har-12-spec/
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			headers = append(headers, harNameValue{Name: name, Value: v})
+		}
+	}
+	return headers
+}
+
+// Entry converts the raw request and response into a HAR entry. Truncated bodies are kept as captured.
+func (r *harRecord) Entry() (harEntry, error) {
+	entry := harEntry{
+		StartedDateTime: r.started.Format(time.RFC3339Nano),
+		Time:            float64(r.duration.Microseconds()) / 1000,
+		Timings:         harTimings{Send: 0, Wait: float64(r.duration.Microseconds()) / 1000, Receive: 0},
+	}
+
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(r.request)))
+	if err != nil {
+		return entry, err
+	}
+	requestBody, _ := io.ReadAll(request.Body)
+	u := *request.URL
+	u.Scheme = r.scheme
+	if u.Host == "" {
+		u.Host = request.Host
+	}
+	entry.Request = harRequest{
+		Method:      request.Method,
+		URL:         u.String(),
+		HTTPVersion: request.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(request.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: bytes.Index(r.request, []byte("\r\n\r\n")) + 4,
+		BodySize:    len(requestBody),
+	}
+	for name, values := range request.URL.Query() {
+		for _, v := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: v})
+		}
+	}
+	for _, c := range request.Cookies() {
+		entry.Request.Cookies = append(entry.Request.Cookies, harNameValue{Name: c.Name, Value: c.Value})
+	}
+	if len(requestBody) > 0 {
+		entry.Request.PostData = &harPostData{MimeType: request.Header.Get("Content-Type"), Text: string(requestBody)}
+	}
+
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(r.response)), request)
+	if err != nil {
+		// Keep the request of a backend that did not respond
+		entry.Response = harResponse{Cookies: []harNameValue{}, Headers: []harNameValue{}, HeadersSize: -1, BodySize: -1}
+		return entry, nil
+	}
+	responseBody, _ := io.ReadAll(response.Body)
+	entry.Response = harResponse{
+		Status:      response.StatusCode,
+		StatusText:  http.StatusText(response.StatusCode),
+		HTTPVersion: response.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(response.Header),
+		Content:     harContent{Size: len(responseBody), MimeType: response.Header.Get("Content-Type")},
+		RedirectURL: response.Header.Get("Location"),
+		HeadersSize: bytes.Index(r.response, []byte("\r\n\r\n")) + 4,
+		BodySize:    len(responseBody),
+	}
+	for _, c := range response.Cookies() {
+		entry.Response.Cookies = append(entry.Response.Cookies, harNameValue{Name: c.Name, Value: c.Value})
+	}
+	if utf8.Valid(responseBody) {
+		entry.Response.Content.Text = string(responseBody)
+	} else {
+		entry.Response.Content.Text = base64.StdEncoding.EncodeToString(responseBody)
+		entry.Response.Content.Encoding = "base64"
+	}
+	if r.truncated {
+		entry.Response.Content.Comment = "truncated"
+	}
+	return entry, nil
+}
+
+// serveHar writes the captured requests of a tunnel as a HAR file.
+// Usage: GET /har?tunnel=NAME
+func serveHar(w http.ResponseWriter, r *http.Request) {
+	tunnelName := r.URL.Query().Get("tunnel")
+	if tunnelName == "" {
+		http.Error(w, "missing tunnel query parameter", http.StatusBadRequest)
+		return
+	}
+	har := harFile{Log: harLog{Version: "1.2", Creator: harCreator{Name: "tunnel", Version: "1.0"}, Entries: []harEntry{}}}
+	for _, record := range harCaptures.Get(tunnelName) {
+		entry, err := record.Entry()
+		if err != nil {
+			continue
+		}
+		har.Log.Entries = append(har.Log.Entries, entry)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+tunnelName+`.har"`)
+	json.NewEncoder(w).Encode(har)
+}
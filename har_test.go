@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("har", func() {
+	record := func(started time.Time) *harRecord {
+		return &harRecord{
+			started:  started,
+			duration: 15 * time.Millisecond,
+			scheme:   "https",
+			request:  []byte("POST /hook?id=1 HTTP/1.1\r\nHost: demo.domain.io\r\nContent-Type: application/json\r\nContent-Length: 2\r\n\r\n{}"),
+			response: []byte("HTTP/1.1 201 Created\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n\r\nok"),
+		}
+	}
+
+	It("should convert a record into a HAR entry", func() {
+		entry, err := record(time.Now()).Entry()
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(entry.Request.Method).To(Equal("POST"))
+		Expect(entry.Request.URL).To(Equal("https://demo.domain.io/hook?id=1"))
+		Expect(entry.Request.QueryString).To(Equal([]harNameValue{{Name: "id", Value: "1"}}))
+		Expect(entry.Request.PostData.Text).To(Equal("{}"))
+		Expect(entry.Response.Status).To(Equal(201))
+		Expect(entry.Response.Content.Text).To(Equal("ok"))
+		Expect(entry.Time).To(Equal(15.0))
+	})
+
+	It("should keep the most recent records and drop expired ones", func() {
+		defer currentSettings.Store(settings())
+		updateSettings(func(s *runtimeSettings) { s.harMaxEntries = 2 })
+		registry := &harRegistry{logs: make(map[string][]*harRecord)}
+
+		registry.Add("demo", record(time.Now().Add(-2*settings().harMaxAge)))
+		Expect(registry.Get("demo")).To(BeEmpty())
+
+		first, second, third := record(time.Now()), record(time.Now()), record(time.Now())
+		registry.Add("demo", first)
+		registry.Add("demo", second)
+		registry.Add("demo", third)
+		Expect(registry.Get("demo")).To(Equal([]*harRecord{second, third}))
+	})
+
+	It("should serve the captures of a tunnel as a HAR file", func() {
+		harCaptures.Add("har-test", record(time.Now()))
+
+		w := httptest.NewRecorder()
+		serveHar(w, httptest.NewRequest(http.MethodGet, "/har?tunnel=har-test", nil))
+		Expect(w.Code).To(Equal(http.StatusOK))
+
+		var har harFile
+		Expect(json.Unmarshal(w.Body.Bytes(), &har)).To(Succeed())
+		Expect(har.Log.Version).To(Equal("1.2"))
+		Expect(har.Log.Entries).To(HaveLen(1))
+
+		w = httptest.NewRecorder()
+		serveHar(w, httptest.NewRequest(http.MethodGet, "/har", nil))
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+	})
+})
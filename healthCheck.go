@@ -0,0 +1,117 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Local servers of HTTP tunnels with a health-check option are sent a GET request for its path every
+// healthCheckInterval. After healthCheckFailures failed checks in a row the tunnel is unhealthy: it serves 503s and
+// leaves the rotation of a shared tunnel until a check passes again. These are set from command line flags.
+var (
+	healthCheckInterval = 10 * time.Second
+	healthCheckFailures = 2
+)
+
+// Tunnels that became unhealthy, published at /debug/vars of the pprof port.
+var tunnelsUnhealthy = expvar.NewInt("tunnelsUnhealthy")
+
+// tunnelHealth is the outcome of the health checks of a tunnel, shared by all the copies of its listener data.
+// A nil tunnelHealth is always healthy.
+type tunnelHealth struct {
+	sync.Mutex
+	path      string
+	failures  int
+	unhealthy bool
+}
+
+func newTunnelHealth(path string) *tunnelHealth {
+	return &tunnelHealth{path: path}
+}
+
+// Healthy returns false while the local server of the tunnel fails its health checks.
+func (h *tunnelHealth) Healthy() bool {
+	if h == nil {
+		return true
+	}
+	h.Lock()
+	defer h.Unlock()
+	return !h.unhealthy
+}
+
+// Record records the outcome of a health check and returns true if the health of the tunnel changed.
+func (h *tunnelHealth) Record(err error) bool {
+	h.Lock()
+	defer h.Unlock()
+	if err == nil {
+		h.failures = 0
+		changed := h.unhealthy
+		h.unhealthy = false
+		return changed
+	}
+	h.failures++
+	if h.failures >= healthCheckFailures && !h.unhealthy {
+		h.unhealthy = true
+		return true
+	}
+	return false
+}
+
+// retryAfterSeconds returns d in whole seconds for a Retry-After header, at least 1.
+func retryAfterSeconds(d time.Duration) int {
+	if s := int(d.Seconds()); s > 1 {
+		return s
+	}
+	return 1
+}
+
+// checkHealth sends a health check to the local server of tunnel, which passes with a 2xx or 3xx response.
+func checkHealth(tunnel sshTunnelsListenerData) error {
+	status, err := requestLocalServer(tunnel, http.MethodGet, tunnel.health.path, "tunnel-health-check")
+	if err != nil {
+		return err
+	}
+	if status < 200 || status >= 400 {
+		return fmt.Errorf("status %d", status)
+	}
+	return nil
+}
+
+// runHealthChecks checks the health of the local server of tunnel every healthCheckInterval and tells the client
+// through w when it changes. It returns when the connection of the tunnel closes.
+func runHealthChecks(tunnel sshTunnelsListenerData, w io.Writer) {
+	closed := make(chan struct{})
+	go func() {
+		tunnel.conn.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+
+		err := checkHealth(tunnel)
+		if !tunnel.health.Record(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Tunnel of session %s is unhealthy: %s", tunnel.sessionID, err)
+			tunnelsUnhealthy.Add(1)
+			io.WriteString(w, fmt.Sprintf("Health check %s failed %d times in a row (%s), serving 503\n", tunnel.health.path, healthCheckFailures, err))
+		} else {
+			log.Printf("Tunnel of session %s is healthy again", tunnel.sessionID)
+			io.WriteString(w, fmt.Sprintf("Health check %s passed, serving requests again\n", tunnel.health.path))
+		}
+	}
+}
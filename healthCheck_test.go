@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.String()
+}
+
+var _ = Describe("health checks", func() {
+	It("should turn unhealthy after failures in a row and healthy after a success", func() {
+		var health *tunnelHealth
+		Expect(health.Healthy()).To(BeTrue())
+
+		health = newTunnelHealth("/healthz")
+		failure := errors.New("status 500")
+		for i := 1; i < healthCheckFailures; i++ {
+			Expect(health.Record(failure)).To(BeFalse())
+		}
+		Expect(health.Healthy()).To(BeTrue())
+		Expect(health.Record(failure)).To(BeTrue())
+		Expect(health.Healthy()).To(BeFalse())
+		Expect(health.Record(failure)).To(BeFalse())
+
+		Expect(health.Record(nil)).To(BeTrue())
+		Expect(health.Healthy()).To(BeTrue())
+		Expect(health.Record(nil)).To(BeFalse())
+	})
+
+	It("should leave unhealthy members out of the rotation of a shared tunnel", func() {
+		group := newTunnelGroup(stickyIP)
+		sick := newTunnelHealth("/healthz")
+		for i := 0; i < healthCheckFailures; i++ {
+			sick.Record(errors.New("status 500"))
+		}
+		group.Add(sshTunnelsListenerData{clientID: "a", sessionID: "1", health: sick})
+		group.Add(sshTunnelsListenerData{clientID: "b", sessionID: "2"})
+		for i := 0; i < 10; i++ {
+			member, _, _ := group.Pick(fmt.Sprintf("10.0.0.%d", i), nil)
+			Expect(member.sessionID).To(Equal("2"))
+		}
+
+		// All members are unhealthy: they serve the 503s
+		group.Remove("2")
+		member, _, _ := group.Pick("10.0.0.1", nil)
+		Expect(member.sessionID).To(Equal("1"))
+	})
+
+	It("should parse the health-check option", func() {
+		options, err := parseTunnelOptions("type=http,health-check=/healthz")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.healthCheck).To(Equal("/healthz"))
+		_, err = parseTunnelOptions("type=http,health-check=healthz")
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("through the tunnel", func() {
+		var listener net.Listener
+		var client *ssh.Client
+		var tunnel sshTunnelsListenerData
+		var statuses chan int
+		var paths chan string
+		var interval time.Duration
+		BeforeEach(func() {
+			interval = healthCheckInterval
+			healthCheckInterval = 20 * time.Millisecond
+			_, key, _ := ed25519.GenerateKey(rand.Reader)
+			signer, _ := ssh.NewSignerFromKey(key)
+			config := &ssh.ServerConfig{NoClientAuth: true}
+			config.AddHostKey(signer)
+			var err error
+			listener, err = net.Listen("tcp", "localhost:0")
+			Expect(err).To(Not(HaveOccurred()))
+			serverConn := make(chan *sshConnection, 1)
+			go func(listener net.Listener, serverConn chan *sshConnection) {
+				nConn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					for newChannel := range chans {
+						newChannel.Reject(ssh.Prohibited, "")
+					}
+				}()
+				serverConn <- newSSHConnection(conn, context.Background())
+			}(listener, serverConn)
+			client, err = ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+			Expect(err).To(Not(HaveOccurred()))
+
+			// The local server answers the health checks with the statuses sent to the channel
+			statuses = make(chan int, 10)
+			paths = make(chan string, 10)
+			go func(channels <-chan ssh.NewChannel, statuses chan int, paths chan string) {
+				for newChannel := range channels {
+					channel, reqs, err := newChannel.Accept()
+					if err != nil {
+						return
+					}
+					go ssh.DiscardRequests(reqs)
+					request, err := http.ReadRequest(bufio.NewReader(channel))
+					if err == nil {
+						paths <- request.URL.Path
+						fmt.Fprintf(channel, "HTTP/1.1 %d Status\r\nContent-Length: 0\r\n\r\n", <-statuses)
+					}
+					channel.Close()
+				}
+			}(client.HandleChannelOpen(forwardedTCPChannelType), statuses, paths)
+			conn := <-serverConn
+			tunnel = sshTunnelsListenerData{conn: conn, connectionType: "http", health: newTunnelHealth("/healthz"),
+				reqPayload: &remoteForwardRequest{BindAddr: "localhost", BindPort: 8080}}
+		})
+		AfterEach(func() {
+			healthCheckInterval = interval
+			client.Close()
+			listener.Close()
+		})
+
+		It("should pass with 2xx and 3xx responses only", func() {
+			statuses <- 204
+			Expect(checkHealth(tunnel)).To(Succeed())
+			Expect(<-paths).To(Equal("/healthz"))
+			statuses <- 503
+			Expect(checkHealth(tunnel)).To(MatchError("status 503"))
+		})
+
+		It("should tell the client when the health of the tunnel changes", func() {
+			for i := 0; i < healthCheckFailures; i++ {
+				statuses <- 500
+			}
+			statuses <- 200
+			out := &syncBuffer{}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				runHealthChecks(tunnel, out)
+			}()
+
+			Eventually(out.String).Should(ContainSubstring(fmt.Sprintf("Health check /healthz failed %d times in a row (status 500), serving 503\n", healthCheckFailures)))
+			Eventually(out.String).Should(ContainSubstring("Health check /healthz passed, serving requests again\n"))
+			client.Close()
+			Eventually(done).Should(BeClosed())
+		})
+	})
+})
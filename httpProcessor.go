@@ -4,16 +4,28 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
 	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/http/httpguts"
 )
 
+// errMalformedRequest is returned when the stream is expected to start with a request that does not parse strictly.
+var errMalformedRequest = errors.New("malformed http request")
+
+// errMissingHost is returned when a request has no Host header, ?host= query nor absolute URL (eg HTTP/1.0).
+var errMissingHost = errors.New("could not find Host header")
+
+// errHeadersTooLarge is returned when the headers exceed one of the header limits.
+var errHeadersTooLarge = errors.New("http headers too large")
+
 type httpProcessor struct {
 	buf                     []byte
 	reader                  io.Reader
@@ -24,16 +36,33 @@ type httpProcessor struct {
 	parsedHeaders           bool
 	lastError               error
 	request                 bool // Is this a request or response?
+	expectRequest           bool // Reject anything but a well-formed request; set by the caller.
+	// Parse headers without the MIME reader and keep their names as written when adding headers; set by the caller.
+	preserveHeaderCase bool
+	headerNames        map[string]string // Canonical header name to the name as written. Only set if preserveHeaderCase.
 
 	// Http request requestMethod. When this wraps a response, we need to know the accoisated request http requestMethod.
 	// This will be passed in.
-	requestMethod      string
-	requestRawURI      string
-	headers            map[string][]string
+	requestMethod string
+	requestRawURI string
+	requestProto  string
+	// Header lines as read, in which headers are looked up without building the header map (see eachHeaderValue)
+	headerLines string
+	// Names of the headers edited since they were read, looked up in the buffer instead of headerLines; all of them
+	// once more than fit
+	editedHeaders     [4]string
+	editedHeaderCount int
+	// Built on first use (see GetHeaders) and then kept in sync with the buffer
+	headers map[string][]string
+	// Parsed on first use (see requestURL)
 	URL                *url.URL
+	urlParsed          bool
 	bodyStartsIndex    int
 	bodyLength         int64
 	headerBodyReader   io.Reader
+	bodyReader         io.LimitedReader     // Backs headerBodyReader for bodies of known length
+	chunkedBody        chunkedMessageReader // Backs headerBodyReader for chunked bodies
+	chunkedBuf         *bufio.Reader        // Buffer of chunkedBody, kept by Reset
 	responseStatusCode int
 }
 
@@ -47,25 +76,178 @@ func newHttpProcessor(rd io.Reader, buffer []byte) *httpProcessor {
 	return p
 }
 
+// Processors of finished requests and responses, reused to cut allocations on busy tunnels.
+var httpProcessorPool = sync.Pool{
+	New: func() interface{} {
+		return new(httpProcessor)
+	},
+}
+
+// getHttpProcessor returns a processor of rd from httpProcessorPool. It must be returned with putHttpProcessor once
+// none of its readers is in use.
+func getHttpProcessor(rd io.Reader, buffer []byte) *httpProcessor {
+	p := httpProcessorPool.Get().(*httpProcessor)
+	p.Reset(rd, buffer)
+	return p
+}
+
+func putHttpProcessor(p *httpProcessor) {
+	p.Reset(nil, nil)
+	httpProcessorPool.Put(p)
+}
+
+// Reset makes h process rd from the start as if it were new. Headers and URLs returned before are not modified.
+func (h *httpProcessor) Reset(rd io.Reader, buffer []byte) {
+	*h = httpProcessor{reader: rd, buf: buffer, chunkedBuf: h.chunkedBuf}
+}
+
 // BytesRead returns Number of bytes Read so far
 func (h *httpProcessor) BytesRead() int64 {
 	return h.totalBytes
 }
+
+// GetHeaders returns the headers, parsed into a map on the first call. Messages are relayed without the map unless
+// it is asked for, since the headers the processor needs are looked up in the header lines (see header).
 func (h *httpProcessor) GetHeaders() (map[string][]string, error) {
 	err := h.ReadHeadersIfNeeded()
+	if h.headers == nil && h.parsedHeaders {
+		start := bytes.IndexByte(h.buf[:h.bodyStartsIndex], '\n') + 1
+		h.headers, _, _ = parseHeaders(string(h.buf[start:h.bodyStartsIndex]), h.preserveHeaderCase)
+	}
 	return h.headers, err
 }
 
-// IsRequestChunked returns true if request is chunked; it assumes we already Read the headers
-func (h *httpProcessor) IsRequestChunked() bool {
-	if l, ok := h.headers["Transfer-Encoding"]; ok && len(l) > 0 {
-		if l[0] == "chunked" {
+// eachHeaderValue calls f with the values of the header name, whatever its case, until f returns false. The values
+// come from the header map if built, or else from the header lines as read unless the header was edited since, in
+// which case they are copied from the buffer.
+func (h *httpProcessor) eachHeaderValue(name string, f func(value string) bool) {
+	if h.headers != nil {
+		for _, v := range h.headers[textproto.CanonicalMIMEHeaderKey(name)] {
+			if !f(v) {
+				return
+			}
+		}
+		return
+	}
+	if !h.headerEdited(name) {
+		for lines := h.headerLines; lines != ""; {
+			var line string
+			line, lines, _ = cut(lines, "\n")
+			// Names are compared once their length matches
+			if len(line) > len(name) && line[len(name)] == ':' && strings.EqualFold(line[:len(name)], name) &&
+				!f(strings.TrimSpace(strings.TrimSuffix(line[len(name)+1:], "\r"))) {
+				return
+			}
+		}
+		return
+	}
+	for start := 0; ; {
+		lineStart, end, found := h.findHeaderLineFrom(start, name)
+		if !found {
+			return
+		}
+		_, v, _ := bytes.Cut(bytes.TrimSuffix(h.buf[lineStart:end], []byte("\r")), []byte(":"))
+		if !f(string(bytes.TrimSpace(v))) {
+			return
+		}
+		start = end + 1
+	}
+}
+
+// header returns the first value of the header name.
+func (h *httpProcessor) header(name string) (value string, ok bool) {
+	h.eachHeaderValue(name, func(v string) bool {
+		value, ok = v, true
+		return false
+	})
+	return value, ok
+}
+
+// headerValues returns the values of the header name.
+func (h *httpProcessor) headerValues(name string) (values []string) {
+	h.eachHeaderValue(name, func(v string) bool {
+		values = append(values, v)
+		return true
+	})
+	return values
+}
+
+// singleHeader returns the value of the header name unless it has none or several.
+func (h *httpProcessor) singleHeader(name string) (value string, ok bool) {
+	count := 0
+	h.eachHeaderValue(name, func(v string) bool {
+		value, count = v, count+1
+		return count < 2
+	})
+	return value, count == 1
+}
+
+// headerEdited returns true if the header name may have been edited since the header lines were read.
+func (h *httpProcessor) headerEdited(name string) bool {
+	if h.editedHeaderCount > len(h.editedHeaders) {
+		return true
+	}
+	for _, edited := range h.editedHeaders[:h.editedHeaderCount] {
+		if strings.EqualFold(edited, name) {
 			return true
 		}
 	}
 	return false
 }
 
+func (h *httpProcessor) markHeaderEdited(name string) {
+	if h.headerEdited(name) {
+		return
+	}
+	if h.editedHeaderCount < len(h.editedHeaders) {
+		h.editedHeaders[h.editedHeaderCount] = name
+	}
+	h.editedHeaderCount++
+}
+
+// IsRequestChunked returns true if request is chunked; it assumes we already Read the headers
+func (h *httpProcessor) IsRequestChunked() bool {
+	v, _ := h.header("Transfer-Encoding")
+	return v == "chunked"
+}
+
+// IsStreamingResponse returns true if the response body is an event stream or is delimited by the connection closing
+// rather than by a length; it assumes we already Read the headers
+func (h *httpProcessor) IsStreamingResponse() bool {
+	if h.request || !h.parsedHeaders {
+		return false
+	}
+	if v, ok := h.header("Content-Type"); ok && strings.HasPrefix(strings.ToLower(v), "text/event-stream") {
+		return true
+	}
+	if _, ok := h.header("Content-Length"); ok || h.IsRequestChunked() {
+		return false
+	}
+	length, _ := h.GetContentLength()
+	return length > 0
+}
+
+// ExpectsContinue returns true if the request waits for a 100 Continue before sending its body; it assumes we already Read the headers
+func (h *httpProcessor) ExpectsContinue() bool {
+	if v, ok := h.header("Expect"); ok {
+		return h.request && strings.ToLower(v) == "100-continue"
+	}
+	return false
+}
+
+// IsInterimResponse returns true if this is an informational (1xx) response other than 101 Switching Protocols
+// which is followed by another response on the same connection.
+func (h *httpProcessor) IsInterimResponse() bool {
+	return !h.request && h.parsedHeaders && h.responseStatusCode >= 100 && h.responseStatusCode < 200 && h.responseStatusCode != 101
+}
+
+// UnreadBuffer returns a copy of the bytes buffered but not Read yet (eg the beginning of the next response).
+func (h *httpProcessor) UnreadBuffer() []byte {
+	unread := make([]byte, h.bufWritePos-h.bufReadPos)
+	copy(unread, h.buf[h.bufReadPos:h.bufWritePos])
+	return unread
+}
+
 func (h *httpProcessor) Close() {
 	h.lastError = io.ErrUnexpectedEOF
 }
@@ -76,8 +258,8 @@ func (h *httpProcessor) GetReferer() (string, error) {
 		return "", err
 	}
 
-	if header, ok := h.headers["Referer"]; ok && len(header) == 1 {
-		return header[0], nil
+	if header, ok := h.singleHeader("Referer"); ok {
+		return header, nil
 	}
 
 	return "", errors.New("could not find Referer header")
@@ -90,19 +272,27 @@ func (h *httpProcessor) GetHost() (string, error) {
 	}
 
 	// TODO: Add unit test
-	// See if the host is in the url
-	if h.URL != nil {
-		host := h.URL.Query().Get("host")
-		if host != "" {
-			return host, nil
+	// See if the host is in the url. Only request targets that are not a path (see isAbsoluteForm) or whose query may
+	// set it can hold one, so that the others are not parsed.
+	if !strings.HasPrefix(h.requestRawURI, "/") || queryMayHaveHost(h.requestRawURI) {
+		if u := h.requestURL(); u != nil {
+			host := u.Query().Get("host")
+			if host != "" {
+				return host, nil
+			}
+			// The host of an absolute request URL (eg GET http://a.domain.io/ HTTP/1.1) takes precedence over the
+			// Host header. See https://www.rfc-editor.org/rfc/rfc9112#section-3.2.2
+			if u.IsAbs() && u.Host != "" {
+				return u.Host, nil
+			}
 		}
 	}
 	// Fallback to headers
-	if header, ok := h.headers["Host"]; ok && len(header) == 1 {
-		return header[0], nil
+	if header, ok := h.singleHeader("Host"); ok {
+		return header, nil
 	}
 
-	return "", errors.New("could not find Host header")
+	return "", errMissingHost
 }
 
 func (h *httpProcessor) GetURLPath() (string, error) {
@@ -112,13 +302,48 @@ func (h *httpProcessor) GetURLPath() (string, error) {
 	}
 
 	// TODO: Add unit test
-	if h.URL != nil {
-		path := h.URL.Path
+	if u := h.requestURL(); u != nil {
+		path := u.Path
 		return path, nil
 	}
 	return "", errors.New("could not find URL path")
 }
 
+// queryMayHaveHost returns true if the query of requestURI may have a host key. Keys with escapes may decode to
+// host, which takes parsing the URL to find out.
+func queryMayHaveHost(requestURI string) bool {
+	_, query, ok := cut(requestURI, "?")
+	for ok && query != "" {
+		var pair string
+		pair, query, _ = cut(query, "&")
+		if key, _, _ := cut(pair, "="); key == "host" || strings.Contains(key, "%") {
+			return true
+		}
+	}
+	return false
+}
+
+// requestURL returns the request target parsed on first use, or nil if it is not a valid one.
+func (h *httpProcessor) requestURL() *url.URL {
+	if !h.urlParsed && h.request {
+		h.urlParsed = true
+		if u, err := url.ParseRequestURI(h.requestRawURI); err == nil {
+			h.URL = u
+		}
+	}
+	return h.URL
+}
+
+// isAbsoluteForm returns true if the request target is an absolute URL (eg GET http://a.domain.io/ HTTP/1.1), as
+// sent to proxies.
+func (h *httpProcessor) isAbsoluteForm() bool {
+	if strings.HasPrefix(h.requestRawURI, "/") {
+		return false
+	}
+	u := h.requestURL()
+	return u != nil && u.IsAbs()
+}
+
 // Read reads data into p replacing the header if found.
 // It returns the number of bytes written into p.
 // It is important to only call reader.Read at most once since this can cause blocking.
@@ -134,51 +359,70 @@ func (h *httpProcessor) Read(p []byte) (n int, err error) {
 		if !h.parsedHeaders && h.bufReadPos == h.bufWritePos {
 			h.bufReadPos = 0
 			h.bufWritePos = 0
-
-			n, err := h.reader.Read(h.buf)
-			if err != nil {
-				h.lastError = err
-				return n, h.lastError
-			}
-			h.totalBytes += int64(n)
-			h.bufferBytesRead += h.totalBytes
-
-			h.bufWritePos += n
 		}
 
 		if !h.parsedHeaders {
 			h.request = false
-			// Find headers delimiter
-			// Give up if it's not in the buffer.
-			firstLineEndPos := bytes.Index(h.buf, []byte("\r\n"))
+			// Read until the headers are complete or fill the buffer. They may arrive over several reads, whose
+			// total time the caller bounds with a read deadline (see headerTimeout).
+			// Only the bytes read belong to this message; the rest of the buffer may hold an earlier one
+			delimiter := []byte("\r\n\r\n")
+			delimiterIndex := bytes.Index(h.buf[:h.bufWritePos], delimiter)
+			for delimiterIndex < 0 && h.bufWritePos < settings().maxHeaderBytes && h.bufWritePos < len(h.buf) {
+				n, err := h.reader.Read(h.buf[h.bufWritePos:])
+				h.totalBytes += int64(n)
+				h.bufferBytesRead += int64(n)
+				h.bufWritePos += n
+				if err != nil {
+					h.lastError = err
+					return 0, h.lastError
+				}
+				// The delimiter may straddle the previous read
+				searchFrom := h.bufWritePos - n - len(delimiter) + 1
+				if searchFrom < 0 {
+					searchFrom = 0
+				}
+				if i := bytes.Index(h.buf[searchFrom:h.bufWritePos], delimiter); i >= 0 {
+					delimiterIndex = searchFrom + i
+				}
+			}
+			firstLineEndPos := bytes.Index(h.buf[:h.bufWritePos], []byte("\r\n"))
 			if firstLineEndPos < 0 {
 				h.lastError = errors.New("could not find the  http status line within the allocated buffer")
 				return 0, h.lastError
 			}
-			delimiter := []byte("\r\n\r\n")
-			delimiterIndex := bytes.Index(h.buf, delimiter)
 			if delimiterIndex > 0 {
+				if err := checkHeaderLimits(h.buf[:delimiterIndex+4]); err != nil {
+					h.lastError = err
+					return 0, err
+				}
 				h.bodyStartsIndex = delimiterIndex + 4
-				reader := bufio.NewReader(bytes.NewReader(h.buf[firstLineEndPos+2 : delimiterIndex+4]))
-				tp := textproto.NewReader(reader)
-
-				mimeHeader, err := tp.ReadMIMEHeader()
+				// The request/status line and the header values are sliced from a single copy of the headers, which
+				// stays valid while the buffer is edited. The header map is only built when asked for (see
+				// GetHeaders), or right away for folded lines and names kept as written.
+				block := string(h.buf[:h.bodyStartsIndex])
+				h.headerLines = block[firstLineEndPos+2:]
+				folded, err := scanHeaders(h.headerLines, h.preserveHeaderCase && !h.expectRequest)
+				if err == nil && (folded || h.preserveHeaderCase) {
+					h.headers, h.headerNames, err = parseHeaders(h.headerLines, h.preserveHeaderCase)
+				}
 				if err != nil {
+					if h.expectRequest {
+						err = fmt.Errorf("%w: %s", errMalformedRequest, err)
+					}
 					h.lastError = err
 					return 0, err
 				}
 
 				// Assume this is a request, not response to get the URL.
-				line := string(h.buf[0:firstLineEndPos])
-				if method, requestURI, _, ok := h.parseRequestLine(line); ok {
+				line := block[:firstLineEndPos]
+				if method, requestURI, proto, ok := h.parseRequestLine(line); ok {
 					if h.validMethod(method) {
 						// This is a request at this point
 						h.request = true
 						h.requestMethod = method
 						h.requestRawURI = requestURI
-						if u, err := url.ParseRequestURI(requestURI); err == nil {
-							h.URL = u
-						}
+						h.requestProto = proto
 					}
 				}
 
@@ -189,7 +433,13 @@ func (h *httpProcessor) Read(p []byte) (n int, err error) {
 					}
 				}
 
-				h.headers = mimeHeader
+				if h.expectRequest {
+					if err := h.validateRequest(line); err != nil {
+						h.lastError = err
+						return 0, err
+					}
+				}
+
 				h.parsedHeaders = true
 
 				// headers end here
@@ -197,6 +447,9 @@ func (h *httpProcessor) Read(p []byte) (n int, err error) {
 				h.GetContentLength()
 				h.adjustBodyReader()
 
+			} else if h.bufWritePos >= settings().maxHeaderBytes || h.bufWritePos == len(h.buf) {
+				h.lastError = fmt.Errorf("%w: could not find the end of the headers within %d bytes", errHeadersTooLarge, h.bufWritePos)
+				return 0, h.lastError
 			} else {
 				h.lastError = errors.New("could not Read the headers within the allocated buffer")
 				return 0, h.lastError
@@ -280,61 +533,349 @@ func (h *httpProcessor) validMethod(method string) bool {
 	*/
 	return len(method) > 0 && strings.IndexFunc(method, isNotToken) == -1
 }
+
+// scanHeaders checks the header lines in block up to the empty line that ends them as parseHeaders does, without
+// building the header map. It returns true if a value is folded over several lines.
+func scanHeaders(block string, raw bool) (folded bool, err error) {
+	first := true
+	for len(block) > 0 {
+		var line string
+		line, block, _ = cut(block, "\n")
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if first {
+				return false, fmt.Errorf("malformed MIME header initial line: %q", line)
+			}
+			folded = true
+			continue
+		}
+		first = false
+		if _, _, ok := splitHeaderLine(line, raw); !ok {
+			return false, fmt.Errorf("malformed MIME header line: %q", line)
+		}
+	}
+	return folded, nil
+}
+
+// splitHeaderLine returns the name and value of a header line. Unless raw, the name must be a valid token and the
+// value must have no control characters.
+func splitHeaderLine(line string, raw bool) (name, value string, ok bool) {
+	name, value, ok = cut(line, ":")
+	if raw {
+		ok = ok && name != "" && strings.TrimSpace(name) == name
+	} else {
+		ok = ok && httpguts.ValidHeaderFieldName(name) && validHeaderValue(value)
+	}
+	return name, value, ok
+}
+
+// parseHeaders parses the header lines in block up to the empty line that ends them like the MIME reader of
+// textproto, except that the values are sliced from block instead of copied one by one. Unless raw, the names must be
+// valid tokens. With raw, unusual names are kept as written, which the MIME reader rejects or rewrites, and names maps
+// the canonical names of the returned headers back to the names as written.
+func parseHeaders(block string, raw bool) (headers textproto.MIMEHeader, names map[string]string, err error) {
+	lines := strings.Count(block, "\n")
+	headers = make(textproto.MIMEHeader, lines)
+	if raw {
+		names = make(map[string]string, lines)
+	}
+	// Most headers have a single value, so their value slices share one allocation.
+	values := make([]string, lines)
+	var last string
+	for len(block) > 0 {
+		var line string
+		line, block, _ = cut(block, "\n")
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// Obsolete line folding continues the previous value
+			if last == "" {
+				return nil, nil, fmt.Errorf("malformed MIME header initial line: %q", line)
+			}
+			v := headers[last]
+			v[len(v)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := splitHeaderLine(line, raw)
+		if !ok {
+			return nil, nil, fmt.Errorf("malformed MIME header line: %q", line)
+		}
+		last = textproto.CanonicalMIMEHeaderKey(name)
+		if raw {
+			if _, ok := names[last]; !ok {
+				names[last] = name
+			}
+		}
+		value = strings.TrimSpace(value)
+		if v, ok := headers[last]; ok {
+			headers[last] = append(v, value)
+		} else {
+			headers[last], values = values[:1:1], values[1:]
+			headers[last][0] = value
+		}
+	}
+	return headers, names, nil
+}
+
+// validHeaderValue returns true if value has no control characters but tabs, as the MIME reader requires.
+func validHeaderValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// validateRequest checks the request line strictly so that garbage is not passed through to client backends. The
+// header lines of requests are checked as strictly when read (see scanHeaders).
+func (h *httpProcessor) validateRequest(line string) error {
+	if !h.request {
+		return fmt.Errorf("%w: invalid request line %q", errMalformedRequest, line)
+	}
+	_, requestURI, proto, _ := h.parseRequestLine(line)
+	if major, _, ok := http.ParseHTTPVersion(proto); !ok || major != 1 {
+		return fmt.Errorf("%w: unsupported protocol %q", errMalformedRequest, proto)
+	}
+	for i := 0; i < len(requestURI); i++ {
+		// No whitespace nor control characters in the request target.
+		if requestURI[i] <= ' ' || requestURI[i] == 0x7f {
+			return fmt.Errorf("%w: invalid request target %q", errMalformedRequest, requestURI)
+		}
+	}
+	return nil
+}
+
+// checkHeaderLimits checks the size of block, the request/status line and headers up to the empty line, against the header limits.
+func checkHeaderLimits(block []byte) error {
+	limits := settings()
+	if len(block) > limits.maxHeaderBytes {
+		return fmt.Errorf("%w: %d bytes exceed the limit of %d", errHeadersTooLarge, len(block), limits.maxHeaderBytes)
+	}
+	block = bytes.TrimSuffix(block, []byte("\r\n\r\n"))
+	// Skip the request/status line
+	if headers := bytes.Count(block, []byte("\n")); headers > limits.maxHeaderCount {
+		return fmt.Errorf("%w: %d headers exceed the limit of %d", errHeadersTooLarge, headers, limits.maxHeaderCount)
+	}
+	for i := bytes.IndexByte(block, '\n'); i >= 0; {
+		block = block[i+1:]
+		line := block
+		if i = bytes.IndexByte(block, '\n'); i >= 0 {
+			line = block[:i]
+		}
+		if len(line) > limits.maxHeaderLineBytes {
+			return fmt.Errorf("%w: header line of %d bytes exceeds the limit of %d", errHeadersTooLarge, len(line), limits.maxHeaderLineBytes)
+		}
+	}
+	return nil
+}
+
 func isNotToken(r rune) bool {
 	return !httpguts.IsTokenRune(r)
 }
 
 func (h *httpProcessor) replaceHeader(headerName string, headerValue string) {
 	h.ReadHeadersIfNeeded()
+	oldValue, ok := h.singleHeader(headerName)
+	if !h.parsedHeaders || !ok {
+		return
+	}
 	if h.headers != nil {
-		if oldHeader, ok := h.headers[headerName]; ok && len(oldHeader) == 1 {
-			h.headers[headerName] = []string{headerValue}
-
-			// Update internal buffer if it has not been used
-			if !h.bufferUsed {
-				var start = 0
-				found := false
-				c := 0
-				for {
-					// Expect "HeaderName:" since the same value of the header could be somewhere else (eg url)
-					if c >= len(h.buf) {
-						break
-					}
-					start = bytes.Index(h.buf[c:], []byte(headerName))
-					if start < 0 {
-						break
-					}
-					c = c + start
-					// header name must be followed by ":"
-					if string(h.buf[c+len(headerName):])[0] != byte(':') {
-						c = c + len(headerName)
-						continue
-					}
-					// header name must be preceded by "\n"
-					if h.buf[c-1:][0] != byte('\n') {
-						c = c + len(headerName)
-						continue
-					}
-					found = true
-					break
-				}
-				if !found {
-					return
-				}
-				start = c
-				end := bytes.Index(h.buf[start:], []byte("\n"))
-				if end < 0 {
-					return
-				}
-				end += start
-				temp := h.buf[start:end] // Host: a.b.c
-				tempFixed := bytes.Replace(temp, []byte(oldHeader[0]), []byte(headerValue), 1)
-				h.buf = bytes.Replace(h.buf, temp, tempFixed, 1)
-				headerDiff := len(headerValue) - len(oldHeader[0])
-				h.adjustBufferPositions(headerDiff)
+		h.headers[textproto.CanonicalMIMEHeaderKey(headerName)][0] = headerValue
+	}
+
+	// Update internal buffer if it has not been used
+	if !h.bufferUsed {
+		start, end, found := h.findHeaderLine(headerName)
+		if !found {
+			return
+		}
+		// Only the value is replaced (eg a.b.c in Host: a.b.c)
+		valueStart := start + bytes.IndexByte(h.buf[start:end], ':') + 1
+		for valueStart < end && (h.buf[valueStart] == ' ' || h.buf[valueStart] == '\t') {
+			valueStart++
+		}
+		valueEnd := valueStart + len(oldValue)
+		if valueEnd > end || string(h.buf[valueStart:valueEnd]) != oldValue {
+			// Folded over several lines
+			return
+		}
+		h.markHeaderEdited(headerName)
+		h.adjustBufferPositions(h.spliceBuffer(valueStart, valueEnd, headerValue))
+	}
+}
+
+// AddHeader adds a header line at the end of the headers.
+// It has no effect once the buffer has been used.
+func (h *httpProcessor) AddHeader(headerName string, headerValue string) {
+	h.ReadHeadersIfNeeded()
+	if !h.parsedHeaders || h.bufferUsed {
+		return
+	}
+
+	// Insert before the empty line that ends the headers
+	if name, ok := h.headerNames[textproto.CanonicalMIMEHeaderKey(headerName)]; ok {
+		headerName = name
+	}
+	insertAt := h.bodyStartsIndex - 2
+	offset := h.spliceBuffer(insertAt, insertAt, headerName, ": ", headerValue, "\r\n")
+
+	if h.headers != nil {
+		headerName = textproto.CanonicalMIMEHeaderKey(headerName)
+		h.headers[headerName] = append(h.headers[headerName], headerValue)
+	}
+	h.markHeaderEdited(headerName)
+	h.adjustBufferPositions(offset)
+}
+
+// PreserveHeaderCase keeps header names as written when adding headers.
+// Headers Read after this call are parsed without the MIME reader.
+func (h *httpProcessor) PreserveHeaderCase() {
+	h.preserveHeaderCase = true
+	if h.parsedHeaders && !h.bufferUsed {
+		start := bytes.Index(h.buf, []byte("\n")) + 1
+		if _, names, err := parseHeaders(string(h.buf[start:h.bodyStartsIndex]), true); err == nil {
+			h.headerNames = names
+		}
+	}
+}
+
+// findHeaderLine returns the position in the buffer of the first line of the header headerName, whatever its case,
+// where end is the index of the line's "\n".
+func (h *httpProcessor) findHeaderLine(headerName string) (start, end int, found bool) {
+	return h.findHeaderLineFrom(0, headerName)
+}
+
+// findHeaderLineFrom is findHeaderLine for the lines from index from of the buffer on.
+func (h *httpProcessor) findHeaderLineFrom(from int, headerName string) (start, end int, found bool) {
+	// Skip the request/status line and stop before the empty line that ends the headers
+	start = bytes.Index(h.buf, []byte("\n")) + 1
+	if start > 0 && from > start {
+		start = from
+	}
+	for start > 0 && start < h.bodyStartsIndex-2 {
+		end = bytes.Index(h.buf[start:h.bodyStartsIndex], []byte("\n"))
+		if end < 0 {
+			break
+		}
+		end += start
+		name, _, _ := bytes.Cut(h.buf[start:end], []byte(":"))
+		if strings.EqualFold(string(bytes.TrimSpace(name)), headerName) {
+			return start, end, true
+		}
+		start = end + 1
+	}
+	return 0, 0, false
+}
+
+// RemoveHeader removes every line of the header headerName.
+// It has no effect once the buffer has been used.
+func (h *httpProcessor) RemoveHeader(headerName string) {
+	h.ReadHeadersIfNeeded()
+	if !h.parsedHeaders || h.bufferUsed {
+		return
+	}
+	if _, ok := h.header(headerName); !ok {
+		return
+	}
+	h.markHeaderEdited(headerName)
+	for {
+		start, end, found := h.findHeaderLine(headerName)
+		if !found {
+			break
+		}
+		h.adjustBufferPositions(h.spliceBuffer(start, end+1))
+	}
+	if h.headers != nil {
+		delete(h.headers, textproto.CanonicalMIMEHeaderKey(headerName))
+	}
+}
+
+// hopByHopHeaders only apply to a single connection and are removed in addition to the headers listed in Connection.
+var hopByHopHeaders = []string{"Keep-Alive", "Te", "Proxy-Authorization", "Proxy-Authenticate", "Proxy-Connection", "Upgrade"}
+
+// IsUpgrade returns true if the request asks to switch protocols (eg websockets) or the response accepts it
+func (h *httpProcessor) IsUpgrade() bool {
+	if _, ok := h.header("Upgrade"); !ok {
+		return false
+	}
+	upgrade := false
+	h.eachHeaderValue("Connection", func(v string) bool {
+		for v != "" {
+			var token string
+			token, v, _ = cut(v, ",")
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				upgrade = true
 			}
 		}
+		return !upgrade
+	})
+	return upgrade
+}
+
+// StripHopByHopHeaders removes the hop-by-hop headers before relaying the message.
+// Connection itself and the message framing headers are kept since the body is relayed as is,
+// and so is Upgrade for genuine upgrades.
+// It has no effect once the buffer has been used.
+func (h *httpProcessor) StripHopByHopHeaders() {
+	h.ReadHeadersIfNeeded()
+	if !h.parsedHeaders || h.bufferUsed {
+		return
+	}
+	upgrade := h.IsUpgrade()
+	strip := func(name string) {
+		switch {
+		case name == "", strings.EqualFold(name, "Connection"), strings.EqualFold(name, "Transfer-Encoding"),
+			strings.EqualFold(name, "Content-Length"), strings.EqualFold(name, "Host"):
+			return
+		case strings.EqualFold(name, "Upgrade") && upgrade:
+			return
+		}
+		h.RemoveHeader(name)
+	}
+	for _, name := range hopByHopHeaders {
+		strip(name)
+	}
+	// Connection is kept, so its values are not modified while the headers they list are removed. Its options are
+	// collected first since the lines they are read from may move as headers are removed.
+	options := make([]string, 0, 8)
+	h.eachHeaderValue("Connection", func(v string) bool {
+		for v != "" {
+			var option string
+			option, v, _ = cut(v, ",")
+			options = append(options, strings.TrimSpace(option))
+		}
+		return true
+	})
+	for _, option := range options {
+		strip(option)
+	}
+}
+
+// spliceBuffer replaces h.buf[start:end] with the concatenation of replacement and returns the change in length.
+// The bytes read after end are moved within the buffer when it has room, so that editing headers does not allocate.
+func (h *httpProcessor) spliceBuffer(start, end int, replacement ...string) int {
+	diff := -(end - start)
+	for _, s := range replacement {
+		diff += len(s)
+	}
+	if h.bufWritePos+diff <= len(h.buf) {
+		copy(h.buf[end+diff:], h.buf[end:h.bufWritePos])
+	} else {
+		buf := make([]byte, h.bufWritePos+diff)
+		copy(buf, h.buf[:start])
+		copy(buf[end+diff:], h.buf[end:h.bufWritePos])
+		h.buf = buf
 	}
+	for _, s := range replacement {
+		start += copy(h.buf[start:], s)
+	}
+	return diff
 }
 
 func (h *httpProcessor) adjustBufferPositions(offset int) {
@@ -347,7 +888,7 @@ func (h *httpProcessor) adjustBufferPositions(offset int) {
 func (h *httpProcessor) replaceHttpRequestURL(newURL string) {
 	h.ReadHeadersIfNeeded()
 
-	if h.URL != nil && h.request {
+	if h.requestURL() != nil && h.request {
 
 		// Assume newURL is valid
 		var err error
@@ -358,21 +899,13 @@ func (h *httpProcessor) replaceHttpRequestURL(newURL string) {
 
 		// Update internal buffer if it has not been used
 		if !h.bufferUsed {
-			start := bytes.Index(h.buf, []byte(h.requestRawURI))
-			if start < 0 {
-				return
-			}
-			end := bytes.Index(h.buf[start:], []byte("\n"))
-			if end < 0 {
+			// The request line is method SP request-target SP protocol
+			start := len(h.requestMethod) + 1
+			end := start + len(h.requestRawURI)
+			if end > h.bufWritePos || string(h.buf[start:end]) != h.requestRawURI {
 				return
 			}
-			end += start
-			temp := h.buf[start:end]
-			tempFixed := bytes.Replace(temp, []byte(h.requestRawURI), []byte(newURL), 1)
-			h.buf = bytes.Replace(h.buf, temp, tempFixed, 1)
-			diff := len(newURL) - len(h.requestRawURI)
-
-			h.adjustBufferPositions(diff)
+			h.adjustBufferPositions(h.spliceBuffer(start, end, newURL))
 			h.requestRawURI = newURL
 		}
 	}
@@ -382,19 +915,22 @@ func (h *httpProcessor) replaceHttpRequestURL(newURL string) {
 func (h *httpProcessor) SetHostHeader(header string) {
 	h.ReadHeadersIfNeeded()
 
-	h.replaceHeader("Host", header)
+	if _, ok := h.header("Host"); !ok && h.request {
+		// HTTP/1.0 requests may not have one
+		h.AddHeader("Host", header)
+	} else {
+		h.replaceHeader("Host", header)
+	}
 
 	// Replace origin only if its value matches the proxy domain
-	if h.headers != nil {
-		if oldHeader, ok := h.headers["Origin"]; ok && len(oldHeader) == 1 {
-			domainEndIndex := strings.Index(domainURL, "/")
-			if domainEndIndex == -1 {
-				domainEndIndex = len(domainURL)
-			}
+	if oldHeader, ok := h.singleHeader("Origin"); ok {
+		domainEndIndex := strings.Index(domainURL, "/")
+		if domainEndIndex == -1 {
+			domainEndIndex = len(domainURL)
+		}
 
-			if strings.Contains(strings.ToLower(oldHeader[0]), strings.ToLower(domainURL[:domainEndIndex])) {
-				h.replaceHeader("Origin", strings.Replace(oldHeader[0], domainURL[:domainEndIndex], header, 1))
-			}
+		if strings.Contains(strings.ToLower(oldHeader), strings.ToLower(domainURL[:domainEndIndex])) {
+			h.replaceHeader("Origin", strings.Replace(oldHeader, domainURL[:domainEndIndex], header, 1))
 		}
 	}
 }
@@ -423,17 +959,17 @@ func (h *httpProcessor) GetContentLength() (int64, bool) {
 		return 0, true
 	}
 
-	if l, ok := h.headers["Content-Length"]; ok && len(l) > 0 {
-		l, err := strconv.ParseInt(l[0], 10, 64)
+	// See https://www.rfc-editor.org/rfc/rfc9110.html
+	// For 204, 304 and 1xx there is no content in the response body even if content-length is missing.
+	if !h.request && (h.responseStatusCode == 204 || h.responseStatusCode == 304 || (h.responseStatusCode >= 100 && h.responseStatusCode < 200)) {
+		return 0, true
+	}
+
+	if l, ok := h.header("Content-Length"); ok {
+		l, err := strconv.ParseInt(l, 10, 64)
 		if err != nil {
 			return 0, false
 		}
-		// See https://www.rfc-editor.org/rfc/rfc9110.html
-		// For 204, 304 and 1xx there is no content in the response body
-		log.Debugf("h.responseStatusCode: %v", h.responseStatusCode)
-		if h.responseStatusCode == 204 || h.responseStatusCode == 304 || (h.responseStatusCode >= 100 && h.responseStatusCode < 200) {
-			return 0, true
-		}
 
 		// Responses to HEAD and CONNECT requests have no content even if content-length has a value.
 		if !h.request && h.requestMethod == "CONNECT" && (h.responseStatusCode >= 200 && h.responseStatusCode < 300) {
@@ -455,14 +991,15 @@ func (h *httpProcessor) GetContentLength() (int64, bool) {
 		return h.bufferBytesRead - int64(h.bodyStartsIndex), true
 	}
 
-	// For response, if the cached body in buffer is 0, then assume it's 0. This is valid for 304s for example.
-	// if the cached body in buffer is > 0, then keep reading until the response TCP connection closes. This is also a valid scenario.
-	// To mimic the latter, use a very large value 2<<62 - 1 - h.bufferBytesRead
-	if h.bufferBytesRead-int64(h.bodyStartsIndex) > 0 {
-		return 2<<62 - 1 - h.bufferBytesRead, true
-	} else {
+	// Responses to HEAD requests have no content.
+	if h.requestMethod == "HEAD" {
 		return 0, true
 	}
+
+	// For response, keep reading until the response TCP connection closes even if nothing follows the headers yet.
+	// This is how server-sent events and long-poll responses are delimited.
+	// To mimic that, use a very large value 2<<62 - 1 - h.bufferBytesRead
+	return 2<<62 - 1 - h.bufferBytesRead, true
 }
 
 func (h *httpProcessor) GetReader() io.Reader {
@@ -472,17 +1009,22 @@ func (h *httpProcessor) GetReader() io.Reader {
 
 // TODO: Minimize calls to this function
 func (h *httpProcessor) adjustBodyReader() {
-
-	// Look for persistent connections such as Web sockets
-	upgradeConn := false
-	if v, ok := h.headers["Connection"]; ok {
-		if strings.ToLower(v[0]) == "upgrade" {
-			upgradeConn = true
-			log.Debugf("Connection is an upgrade")
-		}
+	// Only the length of the headers changes once the reader is set, since the framing headers are never edited
+	switch h.headerBodyReader {
+	case io.Reader(&h.bodyReader):
+		h.bodyLength, _ = h.GetContentLength()
+		h.bodyReader.N = int64(h.bodyStartsIndex) + h.bodyLength
+		return
+	case io.Reader(&h.chunkedBody):
+		h.chunkedBody.headers.N = int64(h.bodyStartsIndex)
+		return
+	case io.Reader(h):
+		return
 	}
 
-	if upgradeConn {
+	// Look for persistent connections such as Web sockets, the same genuine upgrades whose Upgrade header is relayed
+	if h.IsUpgrade() {
+		log.Debugf("Connection is an upgrade")
 		// Persist TCP connection by not limiting the body
 		h.headerBodyReader = h
 
@@ -490,9 +1032,40 @@ func (h *httpProcessor) adjustBodyReader() {
 		// TODO: Though acceptable behavior in terms of .Read to return partial data.
 		// A single Read call on this reader is not going to return the full cached buffer data in one call, so
 		// we might need to write a variant of multireader that reads the full buffer (ie only the buffer data) from limitReader and ChunkReader
-		h.headerBodyReader = io.MultiReader(io.LimitReader(h, int64(h.bodyStartsIndex)), NewChunkedReader(h))
+		if h.chunkedBuf == nil {
+			h.chunkedBuf = bufio.NewReader(h)
+		} else {
+			h.chunkedBuf.Reset(h)
+		}
+		h.chunkedBody = chunkedMessageReader{
+			headers: io.LimitedReader{R: h, N: int64(h.bodyStartsIndex)},
+			chunks:  chunkedReader{r: h.chunkedBuf},
+		}
+		h.headerBodyReader = &h.chunkedBody
 	} else {
 		h.bodyLength, _ = h.GetContentLength()
-		h.headerBodyReader = io.LimitReader(h, int64(h.bodyStartsIndex)+h.bodyLength)
+		h.bodyReader = io.LimitedReader{R: h, N: int64(h.bodyStartsIndex) + h.bodyLength}
+		h.headerBodyReader = &h.bodyReader
+	}
+}
+
+// chunkedMessageReader reads the headers of a message, then its chunked body without the chunk framing, like
+// io.MultiReader(headers, NewChunkedReader(...)) without allocating.
+type chunkedMessageReader struct {
+	headers io.LimitedReader
+	chunks  chunkedReader
+}
+
+func (r *chunkedMessageReader) Read(p []byte) (int, error) {
+	if r.headers.N > 0 {
+		n, err := r.headers.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		r.headers.N = 0
+		if n > 0 {
+			return n, nil
+		}
 	}
+	return r.chunks.Read(p)
 }
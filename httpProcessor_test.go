@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"strings"
+	"testing"
+	"testing/iotest"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -138,7 +141,7 @@ var _ = Describe("HttpProcessor", func() {
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(host, expectedHeader)
 
-			origin := sut.headers["Origin"][0]
+			origin := sut.headerValues("Origin")[0]
 			Expect(origin, "https://"+expectedHeader+":123")
 
 			p := make([]byte, len(body)+2*(len(expectedHeader)-len(oldHeader)))
@@ -162,10 +165,10 @@ var _ = Describe("HttpProcessor", func() {
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(host, expectedHeader)
 
-			origin := sut.headers["Origin"][0]
+			origin := sut.headerValues("Origin")[0]
 			Expect(origin, "https://"+expectedHeader+":123")
 
-			hostX := sut.headers["Hostx"][0]
+			hostX := sut.headerValues("Hostx")[0]
 			Expect(hostX, "another.io")
 
 			p := make([]byte, len(body)+2*(len(expectedHeader)-len(oldHeader)))
@@ -188,7 +191,7 @@ var _ = Describe("HttpProcessor", func() {
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(host, expectedHeader)
 
-			origin := sut.headers["Origin"][0]
+			origin := sut.headerValues("Origin")[0]
 			Expect(origin, "https://"+expectedHeader+":123")
 
 			p := make([]byte, len(body)+2*(len(expectedHeader)-len(oldHeader)))
@@ -451,4 +454,437 @@ var _ = Describe("HttpProcessor", func() {
 		Expect(host).To(Equal(header))
 	})
 
+	It("should add a header at the end of the headers", func() {
+		body := "HTTP/1.1 200 OK\r\nContent-Length: 12\r\nContent-Type: application/json\r\n\r\nBody is here"
+		reader := strings.NewReader(body)
+		buffer := make([]byte, len(body))
+		sut := newHttpProcessor(reader, buffer)
+		sut.AddHeader("Set-Cookie", "a=b")
+
+		p, err := io.ReadAll(sut.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(p)).To(Equal(strings.Replace(body, "\r\n\r\n", "\r\nSet-Cookie: a=b\r\n\r\n", 1)))
+		Expect(sut.headerValues("Set-Cookie")).To(Equal([]string{"a=b"}))
+	})
+
+	It("should detect Expect: 100-continue on requests", func() {
+		body := "POST / HTTP/1.1\r\nHost: domain.io\r\nExpect: 100-Continue\r\nContent-Length: 12\r\n\r\n"
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+		Expect(sut.ReadHeadersIfNeeded()).To(Succeed())
+		Expect(sut.ExpectsContinue()).To(BeTrue())
+	})
+
+	It("should read an interim response and keep the final response unread", func() {
+		interim := "HTTP/1.1 100 Continue\r\n\r\n"
+		final := "HTTP/1.1 200 OK\r\nContent-Length: 12\r\n\r\nBody is here"
+		reader := strings.NewReader(interim + final)
+		buffer := make([]byte, len(interim+final))
+		sut := newHttpProcessor(reader, buffer)
+		Expect(sut.ReadHeadersIfNeeded()).To(Succeed())
+		Expect(sut.IsInterimResponse()).To(BeTrue())
+
+		p, err := io.ReadAll(sut.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(p)).To(Equal(interim))
+
+		next := newHttpProcessor(io.MultiReader(bytes.NewReader(sut.UnreadBuffer()), reader), make([]byte, len(final)))
+		Expect(next.ReadHeadersIfNeeded()).To(Succeed())
+		Expect(next.IsInterimResponse()).To(BeFalse())
+		p, err = io.ReadAll(next.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(p)).To(Equal(final))
+	})
+
+	It("should stream an event stream response until the connection closes", func() {
+		headers := "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nCache-Control: no-cache\r\n\r\n"
+		events := "data: one\n\ndata: two\n\n"
+		reader := io.MultiReader(strings.NewReader(headers), strings.NewReader(events))
+		sut := newHttpProcessor(reader, make([]byte, len(headers)*2))
+		Expect(sut.ReadHeadersIfNeeded()).To(Succeed())
+		Expect(sut.IsStreamingResponse()).To(BeTrue())
+
+		p, err := io.ReadAll(sut.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(p)).To(Equal(headers + events))
+	})
+
+	It("should not treat a response with content-length as a stream", func() {
+		body := "HTTP/1.1 200 OK\r\nContent-Length: 12\r\n\r\nBody is here"
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+		Expect(sut.ReadHeadersIfNeeded()).To(Succeed())
+		Expect(sut.IsStreamingResponse()).To(BeFalse())
+	})
+
+	It("should reject malformed requests when a request is expected", func() {
+		for _, body := range []string{
+			"GET /\r\nHost: domain.io\r\n\r\n",
+			"GET / HTTP/2.0\r\nHost: domain.io\r\n\r\n",
+			"GET /a\x01b HTTP/1.1\r\nHost: domain.io\r\n\r\n",
+			"GET / HTTP/1.1\r\nHost: domain.io\r\nX-Bad: a\x01b\r\n\r\n",
+		} {
+			sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+			sut.expectRequest = true
+			_, err := sut.GetHost()
+			Expect(errors.Is(err, errMalformedRequest)).To(BeTrue(), body)
+		}
+	})
+
+	It("should reject headers exceeding the header count and line limits", func() {
+		for _, body := range []string{
+			"GET / HTTP/1.1\r\nHost: domain.io\r\n" + strings.Repeat("X-A: b\r\n", settings().maxHeaderCount) + "\r\n",
+			"HTTP/1.1 200 OK\r\nX-A: " + strings.Repeat("b", settings().maxHeaderLineBytes) + "\r\n\r\n",
+		} {
+			sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+			err := sut.ReadHeadersIfNeeded()
+			Expect(errors.Is(err, errHeadersTooLarge)).To(BeTrue(), body)
+		}
+	})
+
+	It("should reject headers that do not fit in the buffer", func() {
+		body := "HTTP/1.1 200 OK\r\nX-A: " + strings.Repeat("b", 64) + "\r\n\r\n"
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, 32))
+		err := sut.ReadHeadersIfNeeded()
+		Expect(errors.Is(err, errHeadersTooLarge)).To(BeTrue())
+	})
+
+	It("should accept a well-formed request when a request is expected", func() {
+		body := "POST /path?a=b HTTP/1.1\r\nHost: domain.io\r\nContent-Length: 12\r\n\r\nBody is here"
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+		sut.expectRequest = true
+		host, err := sut.GetHost()
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(host).To(Equal("domain.io"))
+	})
+
+	It("should strip hop-by-hop headers", func() {
+		body := "GET / HTTP/1.1\r\nHost: domain.io\r\nConnection: keep-alive, X-Secret\r\nKeep-Alive: timeout=5\r\nX-Secret: a\r\nTE: trailers\r\nAccept: */*\r\nProxy-Authorization: Basic YQ==\r\n\r\n"
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+		sut.StripHopByHopHeaders()
+
+		p, err := io.ReadAll(sut.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(p)).To(Equal("GET / HTTP/1.1\r\nHost: domain.io\r\nConnection: keep-alive, X-Secret\r\nAccept: */*\r\n\r\n"))
+		Expect(sut.headerValues("X-Secret")).To(BeEmpty())
+	})
+
+	It("should keep Upgrade for upgrade requests", func() {
+		body := "GET /ws HTTP/1.1\r\nHost: domain.io\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+		Expect(sut.ReadHeadersIfNeeded()).To(Succeed())
+		Expect(sut.IsUpgrade()).To(BeTrue())
+		sut.StripHopByHopHeaders()
+
+		p, err := io.ReadAll(sut.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(p)).To(Equal(body))
+	})
+
+	It("should relay the stream of upgrades listed among other Connection options", func() {
+		// As sent by Firefox for websockets
+		headers := "GET /ws HTTP/1.1\r\nHost: domain.io\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n"
+		// The frames arrive after the headers were read
+		stream := "\x81\x05hello"
+		sut := newHttpProcessor(io.MultiReader(strings.NewReader(headers), strings.NewReader(stream)), make([]byte, 1024))
+		Expect(sut.ReadHeadersIfNeeded()).To(Succeed())
+		Expect(sut.IsUpgrade()).To(BeTrue())
+		sut.StripHopByHopHeaders()
+
+		p, err := io.ReadAll(sut.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(p)).To(Equal(headers + stream))
+	})
+
+	It("should keep header names as written when preserving header case", func() {
+		body := "HTTP/1.1 200 OK\r\ncontent-length: 12\r\nset-cookie: a=b\r\nX-DEVICE-ID: 7\r\n\r\nBody is here"
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+		sut.preserveHeaderCase = true
+		sut.AddHeader("Set-Cookie", "c=d")
+
+		p, err := io.ReadAll(sut.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(p)).To(Equal(strings.Replace(body, "\r\n\r\n", "\r\nset-cookie: c=d\r\n\r\n", 1)))
+		Expect(sut.headerValues("X-Device-Id")).To(Equal([]string{"7"}))
+		Expect(sut.headerValues("Set-Cookie")).To(Equal([]string{"a=b", "c=d"}))
+	})
+
+	It("should replace only the value of a lowercase Host header", func() {
+		body := "GET / HTTP/1.1\r\nhost: domain.io\r\n\r\n"
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+		sut.PreserveHeaderCase()
+		sut.SetHostHeader("localhost:3000")
+
+		p, err := io.ReadAll(sut.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(p)).To(Equal("GET / HTTP/1.1\r\nhost: localhost:3000\r\n\r\n"))
+	})
+
+	It("should fall back to the host of an absolute request URL", func() {
+		body := "GET http://abc.domain.io/path HTTP/1.0\r\n\r\n"
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+		host, err := sut.GetHost()
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(host).To(Equal("abc.domain.io"))
+	})
+
+	It("should return errMissingHost for HTTP/1.0 requests without a Host", func() {
+		body := "GET /path HTTP/1.0\r\n\r\n"
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+		_, err := sut.GetHost()
+		Expect(err).To(Equal(errMissingHost))
+	})
+
+	It("should add the Host header to HTTP/1.0 requests without one", func() {
+		body := "GET /path HTTP/1.0\r\nAccept: */*\r\n\r\n"
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+		sut.SetHostHeader("localhost:3000")
+
+		p, err := io.ReadAll(sut.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(p)).To(Equal("GET /path HTTP/1.0\r\nAccept: */*\r\nHost: localhost:3000\r\n\r\n"))
+	})
+
+	It("should prefer the host of an absolute request URL over the Host header", func() {
+		body := "GET http://abc.domain.io/path HTTP/1.1\r\nHost: other.domain.io\r\n\r\n"
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)))
+		host, err := sut.GetHost()
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(host).To(Equal("abc.domain.io"))
+	})
+
+	It("should process a new request after Reset", func() {
+		first := "POST /a HTTP/1.1\r\nHost: a.domain.io\r\nContent-Length: 2\r\n\r\nab"
+		second := "GET /b HTTP/1.1\r\nHost: b.domain.io\r\n\r\n"
+		buf := make([]byte, 256)
+		sut := getHttpProcessor(strings.NewReader(first), buf)
+		defer putHttpProcessor(sut)
+		headers, err := sut.GetHeaders()
+		Expect(err).To(Not(HaveOccurred()))
+		io.ReadAll(sut.GetReader())
+
+		sut.Reset(strings.NewReader(second), buf)
+		host, err := sut.GetHost()
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(host).To(Equal("b.domain.io"))
+		Expect(sut.requestMethod).To(Equal("GET"))
+		p, err := io.ReadAll(sut.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(p)).To(Equal(second))
+		// Headers returned before Reset are kept
+		Expect(headers["Content-Length"]).To(Equal([]string{"2"}))
+	})
+
+	It("should edit headers within the buffer", func() {
+		body := "GET /a HTTP/1.1\r\nHost: a.domain.io\r\nKeep-Alive: 5\r\n\r\n"
+		buf := make([]byte, 256)
+		sut := newHttpProcessor(strings.NewReader(body), buf)
+		sut.StripHopByHopHeaders()
+		sut.AddHeader("Via", viaHeader)
+		sut.replaceHttpRequestURL("/b")
+		Expect(&sut.buf[0]).To(BeIdenticalTo(&buf[0]))
+
+		p, err := io.ReadAll(sut.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(p)).To(Equal("GET /b HTTP/1.1\r\nHost: a.domain.io\r\nVia: 1.1 tunnel\r\n\r\n"))
+	})
+
+	It("should ignore the bytes of an earlier message left in the buffer", func() {
+		buf := []byte("GET /old HTTP/1.1\r\nHost: old.domain.io\r\n\r\n")
+		sut := newHttpProcessor(strings.NewReader("GET /new HTTP/1.1\r\n"), buf)
+		_, err := sut.GetHost()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should read headers that arrive over several reads", func() {
+		body := "GET /path HTTP/1.1\r\nHost: a.domain.io\r\nContent-Length: 4\r\n\r\nbody"
+		sut := newHttpProcessor(iotest.OneByteReader(strings.NewReader(body)), make([]byte, 128))
+		host, err := sut.GetHost()
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(host).To(Equal("a.domain.io"))
+		result, err := io.ReadAll(sut)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(result)).To(Equal(body))
+	})
+
+	Context("allocations", func() {
+		// readRequest returns the allocations of reading request with a reused processor after calling edit.
+		readRequest := func(request string, edit func(p *httpProcessor)) float64 {
+			reader := strings.NewReader(request)
+			buf := make([]byte, 4096)
+			body := make([]byte, 4096)
+			p := newHttpProcessor(reader, buf)
+			return testing.AllocsPerRun(100, func() {
+				reader.Reset(request)
+				p.Reset(reader, buf)
+				edit(p)
+				if _, err := readFull(p.GetReader(), body); err != nil {
+					Fail(err.Error())
+				}
+			})
+		}
+
+		It("should read a request in a few allocations", func() {
+			if testing.Short() {
+				Skip("skipping in short mode")
+			}
+			// The headers as a string; neither the header map nor the URL are built
+			Expect(readRequest(benchmarkRequest, func(p *httpProcessor) {})).To(BeNumerically("<=", 1))
+		})
+
+		It("should relay the requests of tunnels that rewrite nothing without building the header map", func() {
+			if testing.Short() {
+				Skip("skipping in short mode")
+			}
+			Expect(readRequest(benchmarkRequest, passThrough)).To(BeNumerically("<=", 1))
+
+			p := newHttpProcessor(strings.NewReader(benchmarkRequest), make([]byte, 4096))
+			passThrough(p)
+			Expect(p.headers).To(BeNil())
+			Expect(p.URL).To(BeNil())
+			Expect(p.headerValues("X-Request-Id")).To(Equal([]string{"0123456789abcdef"}))
+			Expect(p.headerValues("Connection")).To(Equal([]string{"keep-alive"}))
+			relayed, err := io.ReadAll(p.GetReader())
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(string(relayed)).To(Equal(strings.Replace(benchmarkRequest, "\r\n\r\n", "\r\nVia: 1.1 tunnel\r\nX-Request-Id: 0123456789abcdef\r\n\r\n", 1)))
+
+			// Headers asked for later are those of the edited request
+			headers, err := p.GetHeaders()
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(headers["Via"]).To(Equal([]string{viaHeader}))
+			Expect(headers["Host"]).To(Equal([]string{"abc.domain.io"}))
+		})
+
+		It("should read a chunked request in a few allocations", func() {
+			if testing.Short() {
+				Skip("skipping in short mode")
+			}
+			request := "POST /upload HTTP/1.1\r\nHost: abc.domain.io\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"
+			Expect(readRequest(request, func(p *httpProcessor) {})).To(BeNumerically("<=", 5))
+		})
+
+		It("should edit headers without allocating", func() {
+			if testing.Short() {
+				Skip("skipping in short mode")
+			}
+			request := strings.Replace(benchmarkRequest, "Origin: https://abc.domain.io\r\n", "", 1)
+			read := readRequest(request, func(p *httpProcessor) {})
+			edited := readRequest(request, func(p *httpProcessor) {
+				p.SetHostHeader("localhost:3000")
+				p.StripHopByHopHeaders()
+				p.RemoveHeader("Cookie")
+			})
+			Expect(edited).To(Equal(read))
+		})
+	})
+
 })
+
+// benchmarkRequest is a typical browser request relayed through an HTTP tunnel.
+const benchmarkRequest = "POST /api/items?page=2 HTTP/1.1\r\n" +
+	"Host: abc.domain.io\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0\r\n" +
+	"Accept: application/json\r\n" +
+	"Accept-Language: en-US,en;q=0.5\r\n" +
+	"Accept-Encoding: gzip, deflate, br\r\n" +
+	"Origin: https://abc.domain.io\r\n" +
+	"Referer: https://abc.domain.io/items\r\n" +
+	"Cookie: session=0123456789abcdef; theme=dark\r\n" +
+	"Content-Type: application/json\r\n" +
+	"Content-Length: 13\r\n" +
+	"Connection: keep-alive\r\n" +
+	"\r\n" +
+	`{"name":"a"}` + "\n"
+
+func BenchmarkHttpProcessorRead(b *testing.B) {
+	reader := strings.NewReader(benchmarkRequest)
+	buf := make([]byte, 4096)
+	body := make([]byte, 4096)
+	p := newHttpProcessor(reader, buf)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkRequest)))
+	for i := 0; i < b.N; i++ {
+		reader.Reset(benchmarkRequest)
+		p.Reset(reader, buf)
+		if _, err := readFull(p.GetReader(), body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// passThrough does to p what the server does to the requests of tunnels that rewrite nothing (see
+// handleHttpConnection).
+func passThrough(p *httpProcessor) {
+	p.expectRequest = true
+	p.GetHost()
+	p.GetContentLength()
+	clusterRelayedRequest(p)
+	p.StripHopByHopHeaders()
+	p.AddHeader("Via", viaHeader)
+	p.RemoveHeader("X-Request-Id")
+	p.AddHeader("X-Request-Id", "0123456789abcdef")
+}
+
+func BenchmarkHttpProcessorPassThrough(b *testing.B) {
+	reader := strings.NewReader(benchmarkRequest)
+	buf := make([]byte, 4096)
+	body := make([]byte, 4096)
+	p := newHttpProcessor(reader, buf)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkRequest)))
+	for i := 0; i < b.N; i++ {
+		reader.Reset(benchmarkRequest)
+		p.Reset(reader, buf)
+		passThrough(p)
+		if _, err := readFull(p.GetReader(), body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHttpProcessorReadChunked(b *testing.B) {
+	request := "POST /upload HTTP/1.1\r\nHost: abc.domain.io\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n"
+	reader := strings.NewReader(request)
+	buf := make([]byte, 4096)
+	body := make([]byte, 4096)
+	p := newHttpProcessor(reader, buf)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(request)
+		p.Reset(reader, buf)
+		if _, err := readFull(p.GetReader(), body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHttpProcessorSetHostHeader(b *testing.B) {
+	domainURL = "domain.io"
+	reader := strings.NewReader(benchmarkRequest)
+	buf := make([]byte, 4096)
+	body := make([]byte, 4096)
+	p := newHttpProcessor(reader, buf)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(benchmarkRequest)
+		p.Reset(reader, buf)
+		p.SetHostHeader("localhost:3000")
+		if _, err := readFull(p.GetReader(), body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// readFull reads r until EOF into buf, which must be large enough.
+func readFull(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
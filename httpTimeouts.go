@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// How long a public http connection may take to send the headers of a request once it starts, and may wait for
+// the next request, so that clients trickling bytes (slowloris) do not hold connections forever. These are set
+// from command line flags. 0 disables a timeout.
+var (
+	headerTimeout = 20 * time.Second
+	idleTimeout   = 2 * time.Minute
+)
+
+// requestDeadline bounds the reads of the headers of the next request on a public http connection. It reads from
+// the connection so that the wait for a request (idleTimeout) becomes headerTimeout when its first byte arrives.
+type requestDeadline struct {
+	conn    net.Conn
+	started bool // The headers deadline applies
+}
+
+// Wait sets the deadline of the next request. The first request of a connection gets headerTimeout right away.
+func (d *requestDeadline) Wait(first bool) {
+	d.started = first
+	if first {
+		d.set(headerTimeout)
+	} else {
+		d.set(idleTimeout)
+	}
+}
+
+func (d *requestDeadline) Read(p []byte) (int, error) {
+	n, err := d.conn.Read(p)
+	if n > 0 && !d.started {
+		d.started = true
+		d.set(headerTimeout)
+	}
+	return n, err
+}
+
+// Done clears the deadline once the headers are read so that bodies and upgraded connections are not cut off.
+func (d *requestDeadline) Done() {
+	d.conn.SetReadDeadline(time.Time{})
+}
+
+func (d *requestDeadline) set(timeout time.Duration) {
+	if timeout <= 0 {
+		d.conn.SetReadDeadline(time.Time{})
+		return
+	}
+	d.conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// isTimeout returns true if err comes from a read past a deadline.
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("requestDeadline", func() {
+	var server, client net.Conn
+	BeforeEach(func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer listener.Close()
+		client, err = net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(Not(HaveOccurred()))
+		server, err = listener.Accept()
+		Expect(err).To(Not(HaveOccurred()))
+	})
+	AfterEach(func() {
+		client.Close()
+		server.Close()
+	})
+	It("should time out headers that trickle in", func() {
+		defer func(header time.Duration) { headerTimeout = header }(headerTimeout)
+		headerTimeout = 200 * time.Millisecond
+		go func(client net.Conn) {
+			for i := 0; i < 10; i++ {
+				if _, err := client.Write([]byte("G")); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}(client)
+		deadline := &requestDeadline{conn: server}
+		deadline.Wait(true)
+		sut := newHttpProcessor(deadline, make([]byte, 128))
+		start := time.Now()
+		err := sut.ReadHeadersIfNeeded()
+		Expect(isTimeout(err)).To(BeTrue())
+		Expect(time.Since(start)).To(BeNumerically("<", 400*time.Millisecond))
+	})
+
+	It("should wait idleTimeout for the next request and then headerTimeout", func() {
+		defer func(header, idle time.Duration) { headerTimeout, idleTimeout = header, idle }(headerTimeout, idleTimeout)
+		headerTimeout, idleTimeout = 300*time.Millisecond, time.Second
+		go func(client net.Conn) {
+			time.Sleep(500 * time.Millisecond)
+			client.Write([]byte("GET / HTTP/1.1\r\n"))
+		}(client)
+		deadline := &requestDeadline{conn: server}
+		deadline.Wait(false)
+		sut := newHttpProcessor(deadline, make([]byte, 128))
+		start := time.Now()
+		err := sut.ReadHeadersIfNeeded()
+		Expect(isTimeout(err)).To(BeTrue())
+		Expect(time.Since(start)).To(BeNumerically("~", 800*time.Millisecond, 150*time.Millisecond))
+	})
+
+	It("should not bound reads once the headers are read", func() {
+		defer func(header time.Duration) { headerTimeout = header }(headerTimeout)
+		headerTimeout = 100 * time.Millisecond
+		deadline := &requestDeadline{conn: server}
+		deadline.Wait(true)
+		deadline.Done()
+		go func(client net.Conn) {
+			time.Sleep(200 * time.Millisecond)
+			client.Write([]byte("body"))
+		}(client)
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(deadline, buf)
+		Expect(err).To(Not(HaveOccurred()))
+	})
+})
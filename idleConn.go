@@ -0,0 +1,161 @@
+package main
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Public connections closed for being idle, published at /debug/vars of the pprof port.
+var idleConnectionsClosed = expvar.NewInt("idleConnectionsClosed")
+
+// How long a proxied public connection may go without reading or writing a byte before it is closed, and the same
+// for websockets and other upgraded http connections, which often stay quiet for longer.
+// These are set from command line flags. 0 disables it.
+var (
+	connectionIdleTimeout = 15 * time.Minute
+	websocketIdleTimeout  = time.Hour
+)
+
+// idleConn is a net.Conn that is closed once no byte has been read or written for its timeout, which frees the
+// SSH channel and the file descriptor held by an abandoned client.
+type idleConn struct {
+	net.Conn
+	lastActivity atomic.Int64 // Unix nanoseconds
+
+	mu      sync.Mutex
+	timeout time.Duration
+	timer   *time.Timer // nil once stopped
+	also    io.Closer   // Closed along with the connection when idle (eg the SSH channel of a request)
+}
+
+// Connections of trackIdle not yet closed nor stopped, which closeIdleConnections closes to shed load.
+var idleConns = struct {
+	sync.Mutex
+	m map[*idleConn]struct{}
+}{m: make(map[*idleConn]struct{})}
+
+// trackIdle returns conn closed once idle for timeout. 0 never closes it.
+func trackIdle(conn net.Conn, timeout time.Duration) *idleConn {
+	c := &idleConn{Conn: conn}
+	c.lastActivity.Store(time.Now().UnixNano())
+	c.SetTimeout(timeout)
+	idleConns.Lock()
+	idleConns.m[c] = struct{}{}
+	idleConns.Unlock()
+	return c
+}
+
+// closeIdleConnections closes the connections of trackIdle idle for at least minIdle and returns how many.
+func closeIdleConnections(minIdle time.Duration) int {
+	var idle []*idleConn
+	idleConns.Lock()
+	for c := range idleConns.m {
+		if c.idle() >= minIdle {
+			idle = append(idle, c)
+		}
+	}
+	idleConns.Unlock()
+	for _, c := range idle {
+		c.reapNow()
+	}
+	return len(idle)
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// SetTimeout changes the idle time after which the connection is closed, counted from its last activity.
+func (c *idleConn) SetTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = timeout
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if timeout > 0 {
+		c.timer = time.AfterFunc(timeout-c.idle(), c.reap)
+	}
+}
+
+// CloseWith sets a closer to close along with the connection when it is idle. nil clears it.
+func (c *idleConn) CloseWith(also io.Closer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.also = also
+}
+
+// Stop stops closing the connection when idle, such as when it is relayed without reading through c.
+func (c *idleConn) Stop() {
+	c.SetTimeout(0)
+	idleConns.Lock()
+	delete(idleConns.m, c)
+	idleConns.Unlock()
+}
+
+func (c *idleConn) Close() error {
+	c.Stop()
+	return c.Conn.Close()
+}
+
+// CloseWrite shuts down the write side of the connection, or closes it if that cannot be done on its own.
+func (c *idleConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *idleConn) idle() time.Duration {
+	return time.Since(time.Unix(0, c.lastActivity.Load()))
+}
+
+func (c *idleConn) reap() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer == nil {
+		return
+	}
+	if idle := c.idle(); idle < c.timeout {
+		c.timer.Reset(c.timeout - idle)
+		return
+	}
+	c.timer = nil
+	idleConnectionsClosed.Add(1)
+	log.Printf("Closing connection from %s idle for %s", c.RemoteAddr(), c.timeout)
+	c.closeConn()
+}
+
+// reapNow closes the connection and what goes with it regardless of its timeout.
+func (c *idleConn) reapNow() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.closeConn()
+}
+
+func (c *idleConn) closeConn() {
+	c.Conn.Close()
+	if c.also != nil {
+		c.also.Close()
+	}
+}
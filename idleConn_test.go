@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+var _ = Describe("idleConn", func() {
+	var server, client net.Conn
+	BeforeEach(func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer listener.Close()
+		client, err = net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(Not(HaveOccurred()))
+		server, err = listener.Accept()
+		Expect(err).To(Not(HaveOccurred()))
+	})
+	AfterEach(func() {
+		client.Close()
+		server.Close()
+	})
+
+	It("should close the connection once idle", func() {
+		closed := idleConnectionsClosed.Value()
+		conn := trackIdle(server, 100*time.Millisecond)
+		also := &closeRecorder{}
+		conn.CloseWith(also)
+		start := time.Now()
+		_, err := client.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+		Expect(time.Since(start)).To(BeNumerically("~", 100*time.Millisecond, 50*time.Millisecond))
+		Expect(idleConnectionsClosed.Value()).To(Equal(closed + 1))
+		Eventually(func() bool {
+			conn.mu.Lock()
+			defer conn.mu.Unlock()
+			return also.closed
+		}).Should(BeTrue())
+	})
+
+	It("should keep the connection open while bytes flow", func() {
+		conn := trackIdle(server, 150*time.Millisecond)
+		defer conn.Close()
+		go func(client net.Conn) {
+			for i := 0; i < 6; i++ {
+				client.Write([]byte("a"))
+				time.Sleep(50 * time.Millisecond)
+			}
+		}(client)
+		buf := make([]byte, 1)
+		for i := 0; i < 6; i++ {
+			_, err := conn.Read(buf)
+			Expect(err).To(Not(HaveOccurred()))
+		}
+		Expect(conn.Write([]byte("b"))).To(Equal(1))
+	})
+
+	It("should not close the connection once stopped or with a timeout of 0", func() {
+		conn := trackIdle(server, 50*time.Millisecond)
+		conn.Stop()
+		time.Sleep(100 * time.Millisecond)
+		Expect(conn.Write([]byte("a"))).To(Equal(1))
+		conn.SetTimeout(0)
+		time.Sleep(100 * time.Millisecond)
+		Expect(conn.Write([]byte("a"))).To(Equal(1))
+	})
+
+	It("should close the connections idle for long enough to shed load", func() {
+		conn := trackIdle(server, 0)
+		defer conn.Close()
+		Expect(closeIdleConnections(time.Hour)).To(Equal(0))
+		time.Sleep(20 * time.Millisecond)
+		Expect(closeIdleConnections(10 * time.Millisecond)).To(BeNumerically(">=", 1))
+		_, err := client.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+		conn.Close()
+		idleConns.Lock()
+		defer idleConns.Unlock()
+		Expect(idleConns.m).To(Not(HaveKey(conn)))
+	})
+
+	It("should count a longer timeout from the last activity", func() {
+		conn := trackIdle(server, 50*time.Millisecond)
+		conn.SetTimeout(300 * time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
+		Expect(conn.Write([]byte("a"))).To(Equal(1))
+		start := time.Now()
+		client.Read(make([]byte, 1))
+		_, err := client.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+		Expect(time.Since(start)).To(BeNumerically("~", 300*time.Millisecond, 60*time.Millisecond))
+	})
+})
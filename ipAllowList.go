@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipAllowList limits the visitors of a tunnel to IP addresses and CIDR ranges (eg allow-ips=10.0.0.0/8,203.0.113.5).
+// An empty list allows every visitor.
+type ipAllowList []*net.IPNet
+
+// Add adds the comma separated addresses and ranges of value.
+func (l *ipAllowList) Add(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("invalid allow-ips value %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			*l = append(*l, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid allow-ips value %s", entry)
+		}
+		*l = append(*l, network)
+	}
+	return nil
+}
+
+// Allowed returns true if the visitor at addr may use the tunnel.
+func (l ipAllowList) Allowed(addr net.Addr) bool {
+	if len(l) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the addresses and ranges of the list comma separated.
+func (l ipAllowList) String() string {
+	entries := make([]string, len(l))
+	for i, network := range l {
+		entries[i] = network.String()
+	}
+	return strings.Join(entries, ",")
+}
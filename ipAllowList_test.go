@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ipAllowList", func() {
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 5000}
+	}
+
+	It("should allow every visitor when empty", func() {
+		Expect(ipAllowList{}.Allowed(addr("198.51.100.1"))).To(BeTrue())
+	})
+
+	It("should allow the listed addresses and ranges only", func() {
+		var l ipAllowList
+		Expect(l.Add("10.0.0.0/8, 203.0.113.5,2001:db8::/32")).To(Succeed())
+		Expect(l.Allowed(addr("10.1.2.3"))).To(BeTrue())
+		Expect(l.Allowed(addr("::ffff:10.1.2.3"))).To(BeTrue())
+		Expect(l.Allowed(addr("203.0.113.5"))).To(BeTrue())
+		Expect(l.Allowed(addr("203.0.113.6"))).To(BeFalse())
+		Expect(l.Allowed(addr("2001:db8::1"))).To(BeTrue())
+		Expect(l.Allowed(addr("2001:db9::1"))).To(BeFalse())
+		Expect(l.Allowed(&net.UnixAddr{Name: "/tmp/socket", Net: "unix"})).To(BeFalse())
+	})
+
+	It("should reject invalid addresses", func() {
+		var l ipAllowList
+		Expect(l.Add("10.0.0.0/33")).To(Not(Succeed()))
+		Expect(l.Add("example.com")).To(Not(Succeed()))
+	})
+
+	It("should read the addresses following allow-ips in the exec request", func() {
+		options, err := parseTunnelOptions("type=tcp,allow-ips=10.0.0.0/8,203.0.113.5,max-conns=2")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.allowIPs).To(HaveLen(2))
+		Expect(options.maxConns).To(Equal(2))
+		Expect(options.allowIPs.Allowed(addr("203.0.113.5"))).To(BeTrue())
+		Expect(options.allowIPs.Allowed(addr("198.51.100.1"))).To(BeFalse())
+
+		// Only allow-ips takes more values
+		_, err = parseTunnelOptions("type=tcp,allow-ips=10.0.0.0/8,max-conns=2,198.51.100.1")
+		Expect(err).To(HaveOccurred())
+
+		options, err = parseTunnelOptions(`{"version":1,"type":"http","allow-ips":["10.0.0.0/8","203.0.113.5"]}`)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.allowIPs).To(HaveLen(2))
+
+		_, err = parseTunnelOptions("type=tcp,allow-ips=10.0.0.0/8,bogus")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Time between the sweeps of the janitor (see sweepOrphanedTunnels).
+// This is set from a command line flag. 0 disables it.
+var janitorInterval = time.Minute
+
+// TCP listeners and HTTP tunnels left behind by SSH connections that closed, removed by the janitor, published at
+// /debug/vars of the pprof port. Any count is a leak of a cleanup path.
+var orphanedTunnelsRemoved = expvar.NewInt("orphanedTunnelsRemoved")
+
+// startJanitor sweeps orphaned tunnels every janitorInterval until ctx is done.
+func startJanitor(ctx context.Context) {
+	if janitorInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if removed := sweepOrphanedTunnels(); removed > 0 {
+				orphanedTunnelsRemoved.Add(int64(removed))
+			}
+		}
+	}()
+}
+
+// sweepOrphanedTunnels cross-checks forwards and sshTunnelListeners with the SSH connections that hold them, closes
+// the TCP listeners and removes the HTTP tunnels (names, aliases and members of shared tunnels) of the connections
+// that closed, and returns how many. A connection is marked closed once its own cleanup ran (see
+// sshConnection.MarkClosed), so whatever is left of it is a leak.
+func sweepOrphanedTunnels() int {
+	removed := 0
+	forwardsLock.Lock()
+	for addr, forward := range forwards {
+		if forward.conType != TCPConnectionType || forward.conn == nil || !forward.conn.Closed() {
+			continue
+		}
+		log.Warnf("Closing TCP listener %s left by closed session %s", addr, forward.sessionID)
+		delete(forwards, addr)
+		forward.listener.Close()
+		reservations.Close(tcpReservationKey(addr), forward.fingerprint)
+		removed++
+	}
+	forwardsLock.Unlock()
+
+	sshTunnelListenersLock.Lock()
+	defer sshTunnelListenersLock.Unlock()
+	for cacheKey, tunnel := range sshTunnelListeners {
+		members := []sshTunnelsListenerData{tunnel}
+		if tunnel.group != nil {
+			members = tunnel.group.Members()
+		}
+		for _, member := range members {
+			if member.conn == nil || !member.conn.Closed() {
+				continue
+			}
+			if !removeTunnelListener(cacheKey, member.sessionID) && !removeTunnelAlias(cacheKey, member.sessionID) {
+				continue
+			}
+			log.Warnf("Removed tunnel %s left by closed session %s", cacheKey, member.sessionID)
+			if name := member.conn.GetTunnelName(); name != nil && member.reqPayload != nil {
+				addr := net.JoinHostPort(member.reqPayload.BindAddr, strconv.Itoa(int(member.reqPayload.BindPort)))
+				if cacheKey == addr+*name {
+					reservations.Close(httpReservationKey(addr, *name), member.conn.Fingerprint())
+				}
+			}
+			removed++
+		}
+	}
+	return removed
+}
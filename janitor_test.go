@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("janitor", func() {
+	newConn := func(tunnelName string, closed bool) *sshConnection {
+		conn := newSSHConnection(&ssh.ServerConn{}, nil)
+		conn.SetTunnelName(tunnelName)
+		if closed {
+			conn.MarkClosed()
+		}
+		return conn
+	}
+	payload := &remoteForwardRequest{BindAddr: "", BindPort: 80}
+
+	AfterEach(func() {
+		forwardsLock.Lock()
+		delete(forwards, "localhost:40001")
+		delete(forwards, "localhost:40002")
+		forwardsLock.Unlock()
+		sshTunnelListenersLock.Lock()
+		delete(sshTunnelListeners, ":80gone")
+		delete(sshTunnelListeners, ":80alive")
+		delete(sshTunnelListeners, ":80shared")
+		sshTunnelListenersLock.Unlock()
+	})
+
+	It("should remove what closed connections left behind", func() {
+		orphan, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		live, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer live.Close()
+		forwardsLock.Lock()
+		forwards["localhost:40001"] = forwardsListenerData{listener: orphan, conType: TCPConnectionType, sessionID: "1", conn: newConn("", true)}
+		forwards["localhost:40002"] = forwardsListenerData{listener: live, conType: TCPConnectionType, sessionID: "2", conn: newConn("", false)}
+		forwardsLock.Unlock()
+
+		group := newTunnelGroup(stickyNone)
+		group.shared = true
+		group.Add(sshTunnelsListenerData{clientID: "3", sessionID: "3", reqPayload: payload, group: group, conn: newConn("shared", false)})
+		group.Add(sshTunnelsListenerData{clientID: "4", sessionID: "4", reqPayload: payload, group: group, conn: newConn("shared", true)})
+		sshTunnelListenersLock.Lock()
+		sshTunnelListeners[":80gone"] = sshTunnelsListenerData{sessionID: "5", reqPayload: payload, conn: newConn("gone", true)}
+		sshTunnelListeners[":80alive"] = sshTunnelsListenerData{sessionID: "6", reqPayload: payload, conn: newConn("alive", false)}
+		sshTunnelListeners[":80shared"], _ = group.Primary()
+		sshTunnelListenersLock.Unlock()
+
+		Expect(sweepOrphanedTunnels()).To(Equal(3))
+		_, err = orphan.Accept()
+		Expect(err).To(HaveOccurred())
+		forwardsLock.Lock()
+		_, orphanKept := forwards["localhost:40001"]
+		_, liveKept := forwards["localhost:40002"]
+		forwardsLock.Unlock()
+		Expect(orphanKept).To(BeFalse())
+		Expect(liveKept).To(BeTrue())
+		sshTunnelListenersLock.Lock()
+		_, goneKept := sshTunnelListeners[":80gone"]
+		_, aliveKept := sshTunnelListeners[":80alive"]
+		shared := sshTunnelListeners[":80shared"]
+		sshTunnelListenersLock.Unlock()
+		Expect(goneKept).To(BeFalse())
+		Expect(aliveKept).To(BeTrue())
+		Expect(shared.sessionID).To(Equal("3"))
+		Expect(group.Members()).To(HaveLen(1))
+
+		Expect(sweepOrphanedTunnels()).To(BeZero())
+	})
+})
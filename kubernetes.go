@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Paths of the credentials that Kubernetes mounts into pods.
+const (
+	kubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubernetesCAPath    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// kubernetesTunnelAnnotation names the tunnel of an Ingress rule instead of the subdomain of its host.
+const kubernetesTunnelAnnotation = "tunnel/name"
+
+// Cluster services exposed as tunnels by Ingress resources: service address (eg web.default.svc:80) by tunnelName.
+// Requests for these tunnel names that have no SSH client are relayed to the service directly.
+var (
+	clusterTunnels     = map[string]string{}
+	clusterTunnelsLock sync.Mutex
+)
+
+// ingress is the part of a networking.k8s.io/v1 Ingress used to expose services.
+type ingress struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Annotations     map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		IngressClassName *string `json:"ingressClassName"`
+		Rules            []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []struct {
+					Path    string `json:"path"`
+					Backend struct {
+						Service *struct {
+							Name string `json:"name"`
+							Port struct {
+								Number int `json:"number"`
+							} `json:"port"`
+						} `json:"service"`
+					} `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+// ingressList is a networking.k8s.io/v1 IngressList, whose resourceVersion the Ingresses are watched from.
+type ingressList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []ingress `json:"items"`
+}
+
+// ingressEvent is an event of a watch of the Ingresses (ADDED, MODIFIED, DELETED, BOOKMARK or ERROR).
+type ingressEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// ingressTunnels returns the services exposed by the Ingresses of ingressClass by tunnelName. The tunnelName of a
+// rule is the kubernetesTunnelAnnotation or the subdomain of its host. Each rule is served by the backend of its
+// first path, as tunnels are not routed by path; port names are not supported.
+func ingressTunnels(list *ingressList, ingressClass string) map[string]string {
+	tunnels := map[string]string{}
+	for _, ingress := range list.Items {
+		if ingress.Spec.IngressClassName == nil || *ingress.Spec.IngressClassName != ingressClass {
+			continue
+		}
+		for _, rule := range ingress.Spec.Rules {
+			if rule.HTTP == nil || len(rule.HTTP.Paths) == 0 || rule.HTTP.Paths[0].Backend.Service == nil {
+				continue
+			}
+			service := rule.HTTP.Paths[0].Backend.Service
+			if len(rule.HTTP.Paths) > 1 {
+				log.Warnf("Ingress %s/%s: only the first path of host %q is served, by service %s", ingress.Metadata.Namespace, ingress.Metadata.Name, rule.Host, service.Name)
+			}
+			if service.Port.Number == 0 {
+				log.Printf("Ingress %s/%s: service %s must use a port number", ingress.Metadata.Namespace, ingress.Metadata.Name, service.Name)
+				continue
+			}
+
+			tunnelName := ingress.Metadata.Annotations[kubernetesTunnelAnnotation]
+			if tunnelName == "" {
+				domain := requestDomain(rule.Host)
+				tunnelName, _ = extractSubdomain(rule.Host, domain.Hostname())
+			}
+			if !tunnelNameValid(tunnelName) {
+				log.Printf("Ingress %s/%s: no valid tunnelName for host %q", ingress.Metadata.Namespace, ingress.Metadata.Name, rule.Host)
+				continue
+			}
+			tunnels[tunnelName] = net.JoinHostPort(service.Name+"."+ingress.Metadata.Namespace+".svc", strconv.Itoa(service.Port.Number))
+		}
+	}
+	return tunnels
+}
+
+// clusterTunnelTarget returns the service exposed as tunnelName by an Ingress.
+func clusterTunnelTarget(tunnelName string) (string, bool) {
+	clusterTunnelsLock.Lock()
+	defer clusterTunnelsLock.Unlock()
+	target, ok := clusterTunnels[tunnelName]
+	return target, ok
+}
+
+// clusterTunnelName returns true if tunnelName is exposed by an Ingress, which SSH clients cannot take.
+func clusterTunnelName(tunnelName string) bool {
+	_, ok := clusterTunnelTarget(tunnelName)
+	return ok
+}
+
+// exposeIngresses serves the services of the Ingresses of ingressClass as tunnels in place of those served so far.
+func exposeIngresses(ingresses map[string]ingress, ingressClass string) {
+	list := &ingressList{}
+	for _, ingress := range ingresses {
+		list.Items = append(list.Items, ingress)
+	}
+	tunnels := ingressTunnels(list, ingressClass)
+
+	clusterTunnelsLock.Lock()
+	defer clusterTunnelsLock.Unlock()
+	for name, target := range tunnels {
+		if clusterTunnels[name] != target {
+			log.Printf("Exposing service %s as tunnelName %s", target, name)
+		}
+	}
+	for name := range clusterTunnels {
+		if _, ok := tunnels[name]; !ok {
+			log.Printf("No longer exposing tunnelName %s", name)
+		}
+	}
+	clusterTunnels = tunnels
+}
+
+// applyIngressEvents applies the events of a watch read from r to ingresses (by namespace/name) until r ends, and
+// returns the resourceVersion to watch from next. An ERROR event, such as when resourceVersion is too old, is
+// returned as an error so that the Ingresses are listed again.
+func applyIngressEvents(r io.Reader, ingresses map[string]ingress, ingressClass string, resourceVersion string) (string, error) {
+	decoder := json.NewDecoder(r)
+	for {
+		var event ingressEvent
+		if err := decoder.Decode(&event); err == io.EOF {
+			return resourceVersion, nil
+		} else if err != nil {
+			return resourceVersion, err
+		}
+		if event.Type == "ERROR" {
+			return resourceVersion, fmt.Errorf("watching ingresses: %s", event.Object)
+		}
+		var object ingress
+		if err := json.Unmarshal(event.Object, &object); err != nil {
+			return resourceVersion, err
+		}
+		resourceVersion = object.Metadata.ResourceVersion
+		key := object.Metadata.Namespace + "/" + object.Metadata.Name
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			ingresses[key] = object
+		case "DELETED":
+			delete(ingresses, key)
+		default:
+			// BOOKMARK only moves resourceVersion
+			continue
+		}
+		exposeIngresses(ingresses, ingressClass)
+	}
+}
+
+// watchIngresses lists the Ingresses of ingressClass with the in-cluster service account, exposes their services as
+// tunnels and watches them for changes until ctx is done. Each watch lasts renewal before it is made again.
+func watchIngresses(ctx context.Context, ingressClass string, renewal time.Duration) error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	ca, err := os.ReadFile(kubernetesCAPath)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	// Watches last until the server ends them (timeoutSeconds), so only the headers have a timeout
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ResponseHeaderTimeout: 30 * time.Second},
+	}
+	url := "https://" + net.JoinHostPort(host, port) + "/apis/networking.k8s.io/v1/ingresses"
+
+	get := func(query string) (*http.Response, error) {
+		// The token is rotated by the kubelet
+		token, err := os.ReadFile(kubernetesTokenPath)
+		if err != nil {
+			return nil, err
+		}
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url+query, nil)
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("getting ingresses: %s", resp.Status)
+		}
+		return resp, nil
+	}
+	ingresses := map[string]ingress{}
+	list := func() (string, error) {
+		resp, err := get("")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		var list ingressList
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			return "", err
+		}
+		ingresses = map[string]ingress{}
+		for _, ingress := range list.Items {
+			ingresses[ingress.Metadata.Namespace+"/"+ingress.Metadata.Name] = ingress
+		}
+		exposeIngresses(ingresses, ingressClass)
+		return list.Metadata.ResourceVersion, nil
+	}
+	watch := func(resourceVersion string) (string, error) {
+		resp, err := get(fmt.Sprintf("?watch=1&allowWatchBookmarks=true&resourceVersion=%s&timeoutSeconds=%d", resourceVersion, int(renewal.Seconds())))
+		if err != nil {
+			return resourceVersion, err
+		}
+		defer resp.Body.Close()
+		return applyIngressEvents(resp.Body, ingresses, ingressClass, resourceVersion)
+	}
+
+	resourceVersion, err := list()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			resourceVersion, err = watch(resourceVersion)
+			for err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("error watching ingresses: %s", err)
+				// The watch starts over from a new list after a pause
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(5 * time.Second):
+				}
+				resourceVersion, err = list()
+			}
+		}
+	}()
+	return nil
+}
+
+// relayToCluster relays the request of httpProcessor to the service at target and its response back to
+// httpConnection. The backend connection is not reused. Only errors before the response starts are returned.
+func relayToCluster(httpConnection net.Conn, httpProcessor *httpProcessor, target string) error {
+	backend, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	httpProcessor.StripHopByHopHeaders()
+	httpProcessor.AddHeader("Via", viaHeader)
+	httpProcessor.AddHeader("Connection", "close")
+
+	requestDone := make(chan struct{})
+	go func() {
+		defer close(requestDone)
+		buf := getBuffer()
+		defer putBuffer(buf)
+		copyConn(backend, httpProcessor.GetReader(), *buf)
+	}()
+	buf := getBuffer()
+	defer putBuffer(buf)
+	copyConn(httpConnection, backend, *buf)
+
+	// httpProcessor is reused once this returns
+	httpConnection.Close()
+	<-requestDone
+	return nil
+}
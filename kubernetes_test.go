@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("kubernetes", func() {
+	BeforeEach(func() {
+		u, _ := url.Parse("https://domain.io")
+		domainURIs = []url.URL{*u}
+		domainURI = *u
+	})
+
+	AfterEach(func() {
+		domainURIs = nil
+		domainURI = url.URL{}
+	})
+
+	It("should expose the services of the ingresses of the class", func() {
+		var list ingressList
+		Expect(json.Unmarshal([]byte(`{"items": [
+			{"metadata": {"name": "web", "namespace": "default"},
+			 "spec": {"ingressClassName": "tunnel", "rules": [
+				{"host": "web.domain.io", "http": {"paths": [{"backend": {"service": {"name": "web", "port": {"number": 8080}}}}]}},
+				{"host": "named.domain.io", "http": {"paths": [{"backend": {"service": {"name": "web", "port": {"name": "http"}}}}]}}
+			 ]}},
+			{"metadata": {"name": "api", "namespace": "apps", "annotations": {"tunnel/name": "api"}},
+			 "spec": {"ingressClassName": "tunnel", "rules": [
+				{"host": "other.io", "http": {"paths": [{"backend": {"service": {"name": "api", "port": {"number": 80}}}}]}}
+			 ]}},
+			{"metadata": {"name": "nginx", "namespace": "default"},
+			 "spec": {"ingressClassName": "nginx", "rules": [
+				{"host": "nginx.domain.io", "http": {"paths": [{"backend": {"service": {"name": "nginx", "port": {"number": 80}}}}]}}
+			 ]}}
+		]}`), &list)).To(Succeed())
+
+		Expect(ingressTunnels(&list, "tunnel")).To(Equal(map[string]string{
+			"web": "web.default.svc:8080",
+			"api": "api.apps.svc:80",
+		}))
+	})
+
+	It("should apply the events of a watch", func() {
+		defer func() {
+			clusterTunnelsLock.Lock()
+			clusterTunnels = map[string]string{}
+			clusterTunnelsLock.Unlock()
+		}()
+		ingresses := map[string]ingress{}
+		events := `{"type": "ADDED", "object": {"metadata": {"name": "web", "namespace": "default", "resourceVersion": "11"},
+			"spec": {"ingressClassName": "tunnel", "rules": [
+				{"host": "web.domain.io", "http": {"paths": [{"backend": {"service": {"name": "web", "port": {"number": 8080}}}}]}}]}}}
+			{"type": "ADDED", "object": {"metadata": {"name": "api", "namespace": "apps", "resourceVersion": "12"},
+			"spec": {"ingressClassName": "tunnel", "rules": [
+				{"host": "api.domain.io", "http": {"paths": [{"backend": {"service": {"name": "api", "port": {"number": 80}}}}]}}]}}}
+			{"type": "DELETED", "object": {"metadata": {"name": "web", "namespace": "default", "resourceVersion": "13"}}}
+			{"type": "BOOKMARK", "object": {"metadata": {"resourceVersion": "14"}}}`
+		resourceVersion, err := applyIngressEvents(strings.NewReader(events), ingresses, "tunnel", "10")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(resourceVersion).To(Equal("14"))
+		Expect(ingresses).To(HaveLen(1))
+		Expect(clusterTunnelName("web")).To(BeFalse())
+		target, ok := clusterTunnelTarget("api")
+		Expect(ok).To(BeTrue())
+		Expect(target).To(Equal("api.apps.svc:80"))
+
+		// The Ingresses are listed again after an error
+		_, err = applyIngressEvents(strings.NewReader(`{"type": "ERROR", "object": {"code": 410}}`), ingresses, "tunnel", "14")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reserve the tunnel names of the ingresses", func() {
+		clusterTunnelsLock.Lock()
+		clusterTunnels = map[string]string{"web": "web.default.svc:8080"}
+		clusterTunnelsLock.Unlock()
+		defer func() {
+			clusterTunnelsLock.Lock()
+			clusterTunnels = map[string]string{}
+			clusterTunnelsLock.Unlock()
+		}()
+		sshTunnelListenersLock.Lock()
+		unavailable := tunnelNameUnavailable("localhost:80", "web", "client", "SHA256:key")
+		available := tunnelNameUnavailable("localhost:80", "other", "client", "SHA256:key")
+		sshTunnelListenersLock.Unlock()
+		Expect(unavailable).To(Equal("is reserved"))
+		Expect(available).To(BeEmpty())
+	})
+})
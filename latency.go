@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upper bounds in seconds of the latency histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Tunnels beyond this number share the latency histograms of latencyOtherTunnels to bound the size of /debug/vars.
+const (
+	latencyMaxTunnels   = 100
+	latencyOtherTunnels = "other"
+)
+
+// Latency histograms of the proxied http requests by tunnel name, published as latency at /debug/vars of the pprof port.
+var latencyMetrics = newLatencyRegistry(latencyMaxTunnels)
+
+func init() {
+	expvar.Publish("latency", latencyMetrics)
+}
+
+// histogram counts observations in cumulative latencyBuckets like Prometheus histograms.
+type histogram struct {
+	sync.Mutex
+	counts []uint64 // Per bucket, non-cumulative; the last one is +Inf
+	count  uint64
+	sum    float64 // Seconds
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+// Observe records a latency of d.
+func (h *histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+	for i < len(latencyBuckets) && seconds > latencyBuckets[i] {
+		i++
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += seconds
+}
+
+// MarshalJSON returns the cumulative count of each bucket by upper bound along with the total count and sum.
+func (h *histogram) MarshalJSON() ([]byte, error) {
+	h.Lock()
+	defer h.Unlock()
+	buckets := make(map[string]uint64, len(h.counts))
+	var cumulative uint64
+	for i, c := range h.counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = strconv.FormatFloat(latencyBuckets[i], 'f', -1, 64)
+		}
+		buckets[le] = cumulative
+	}
+	return json.Marshal(struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Count   uint64            `json:"count"`
+		Sum     float64           `json:"sum"`
+	}{buckets, h.count, math.Round(h.sum*1e6) / 1e6})
+}
+
+// tunnelLatency holds the histograms of one tunnel.
+type tunnelLatency struct {
+	ChannelOpen *histogram `json:"channelOpen"` // Time to open the SSH channel to the client
+	TTFB        *histogram `json:"ttfb"`        // Time until the response headers arrived
+	Duration    *histogram `json:"duration"`    // Time until the response was fully relayed
+}
+
+type latencyRegistry struct {
+	sync.Mutex
+	max     int
+	tunnels map[string]*tunnelLatency
+}
+
+func newLatencyRegistry(max int) *latencyRegistry {
+	return &latencyRegistry{max: max, tunnels: make(map[string]*tunnelLatency)}
+}
+
+// Get returns the histograms of tunnelName, or those shared by the other tunnels once max tunnels are tracked.
+func (r *latencyRegistry) Get(tunnelName string) *tunnelLatency {
+	r.Lock()
+	defer r.Unlock()
+	if l, ok := r.tunnels[tunnelName]; ok {
+		return l
+	}
+	named := len(r.tunnels)
+	if _, ok := r.tunnels[latencyOtherTunnels]; ok {
+		named--
+	}
+	if named >= r.max {
+		tunnelName = latencyOtherTunnels
+		if l, ok := r.tunnels[tunnelName]; ok {
+			return l
+		}
+	}
+	l := &tunnelLatency{ChannelOpen: newHistogram(), TTFB: newHistogram(), Duration: newHistogram()}
+	r.tunnels[tunnelName] = l
+	return l
+}
+
+// Remove drops the histograms of a closed tunnel.
+func (r *latencyRegistry) Remove(tunnelName string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.tunnels, tunnelName)
+}
+
+// String implements expvar.Var.
+func (r *latencyRegistry) String() string {
+	r.Lock()
+	defer r.Unlock()
+	b, _ := json.Marshal(r.tunnels)
+	return string(b)
+}
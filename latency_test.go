@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("latency", func() {
+	It("should count observations in cumulative buckets", func() {
+		h := newHistogram()
+		h.Observe(3 * time.Millisecond)
+		h.Observe(200 * time.Millisecond)
+		h.Observe(time.Minute)
+
+		var out struct {
+			Buckets map[string]uint64
+			Count   uint64
+			Sum     float64
+		}
+		b, err := json.Marshal(h)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(json.Unmarshal(b, &out)).To(Succeed())
+		Expect(out.Count).To(Equal(uint64(3)))
+		Expect(out.Sum).To(BeNumerically("~", 60.203, 0.0001))
+		Expect(out.Buckets["0.005"]).To(Equal(uint64(1)))
+		Expect(out.Buckets["0.25"]).To(Equal(uint64(2)))
+		Expect(out.Buckets["30"]).To(Equal(uint64(2)))
+		Expect(out.Buckets["+Inf"]).To(Equal(uint64(3)))
+	})
+
+	It("should bound the number of tunnels", func() {
+		r := newLatencyRegistry(2)
+		a := r.Get("a")
+		Expect(r.Get("a")).To(BeIdenticalTo(a))
+		r.Get("b")
+		other := r.Get("c")
+		Expect(r.Get("d")).To(BeIdenticalTo(other))
+		Expect(r.String()).To(ContainSubstring(`"other"`))
+
+		r.Remove("a")
+		Expect(r.Get("e")).To(Not(BeIdenticalTo(other)))
+	})
+})
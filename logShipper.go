@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Log sinks supported by logShipper.
+const (
+	logShipperLoki          = "loki"
+	logShipperElasticsearch = "elasticsearch"
+)
+
+// Ships server and access logs to Loki or Elasticsearch. nil when log shipping is disabled.
+var logShipping *logShipper
+
+// Logs that could not be shipped, published at /debug/vars of the pprof port.
+var (
+	logShipperDropped = expvar.NewInt("logShipperDropped") // Queue full: the sink is too slow or down
+	logShipperFailed  = expvar.NewInt("logShipperFailed")  // The sink rejected a batch after retries
+)
+
+// logShipperRetries is the number of times a batch is sent again after a failure, waiting twice as long each time.
+const logShipperRetries = 3
+
+// shippedLog is one log line of a stream (server or access).
+type shippedLog struct {
+	time   time.Time
+	stream string
+	fields map[string]interface{}
+}
+
+// logShipper batches logs and pushes them to a Loki push API (eg http://loki:3100/loki/api/v1/push) or an
+// Elasticsearch bulk endpoint (eg http://es:9200/_bulk). Logs are queued without blocking the caller and are
+// dropped while the queue is full, so a slow sink never slows down the tunnels.
+type logShipper struct {
+	sink      string
+	url       string
+	batchSize int
+	interval  time.Duration
+	client    *http.Client
+	queue     chan *shippedLog
+	wg        sync.WaitGroup
+	backoff   time.Duration // First retry delay
+}
+
+func newLogShipper(sink string, url string, batchSize int, queueSize int, interval time.Duration) (*logShipper, error) {
+	if sink != logShipperLoki && sink != logShipperElasticsearch {
+		return nil, fmt.Errorf("invalid log shipper %s", sink)
+	}
+	if url == "" {
+		return nil, fmt.Errorf("missing log shipper url")
+	}
+	s := &logShipper{
+		sink:      sink,
+		url:       url,
+		batchSize: batchSize,
+		interval:  interval,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		queue:     make(chan *shippedLog, queueSize),
+		backoff:   time.Second,
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// Ship queues a log line of stream.
+func (s *logShipper) Ship(stream string, t time.Time, fields map[string]interface{}) {
+	select {
+	case s.queue <- &shippedLog{time: t, stream: stream, fields: fields}:
+	default:
+		logShipperDropped.Add(1)
+	}
+}
+
+// ShipAccessLog queues an access log entry.
+func (s *logShipper) ShipAccessLog(e *accessLogEntry) {
+	var fields map[string]interface{}
+	b, _ := json.Marshal(e)
+	json.Unmarshal(b, &fields)
+	s.Ship("access", e.Time, fields)
+}
+
+func (s *logShipper) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire queues a server log entry.
+func (s *logShipper) Fire(e *log.Entry) error {
+	fields := make(map[string]interface{}, len(e.Data)+2)
+	for k, v := range e.Data {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		fields[k] = v
+	}
+	fields["level"] = e.Level.String()
+	fields["msg"] = e.Message
+	s.Ship("server", e.Time, fields)
+	return nil
+}
+
+// Close sends the queued logs and stops the shipper.
+func (s *logShipper) Close() {
+	close(s.queue)
+	s.wg.Wait()
+}
+
+func (s *logShipper) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	batch := make([]*shippedLog, 0, s.batchSize)
+	for {
+		select {
+		case l, ok := <-s.queue:
+			if !ok {
+				s.send(batch)
+				return
+			}
+			batch = append(batch, l)
+			if len(batch) < s.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		s.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send pushes batch to the sink retrying failures. The queue fills up meanwhile which pushes back on new logs.
+func (s *logShipper) send(batch []*shippedLog) {
+	if len(batch) == 0 {
+		return
+	}
+	body, contentType := s.encode(batch)
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		err := s.post(body, contentType)
+		if err == nil {
+			return
+		}
+		if attempt == logShipperRetries {
+			logShipperFailed.Add(int64(len(batch)))
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *logShipper) post(body []byte, contentType string) error {
+	resp, err := s.client.Post(s.url, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("log shipper response %s", resp.Status)
+	}
+	// The bulk API reports failed documents in the body of a 200 response
+	if s.sink == logShipperElasticsearch {
+		var result struct {
+			Errors bool `json:"errors"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Errors {
+			return fmt.Errorf("elasticsearch bulk request had errors")
+		}
+	}
+	return nil
+}
+
+// encode returns the request body of batch for the sink and its content type.
+func (s *logShipper) encode(batch []*shippedLog) ([]byte, string) {
+	var buf bytes.Buffer
+	if s.sink == logShipperElasticsearch {
+		for _, l := range batch {
+			l.fields["@timestamp"] = l.time.UTC().Format(time.RFC3339Nano)
+			action, _ := json.Marshal(map[string]interface{}{"index": map[string]string{"_index": "tunnel-" + l.stream}})
+			doc, _ := json.Marshal(l.fields)
+			buf.Write(action)
+			buf.WriteByte('\n')
+			buf.Write(doc)
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), "application/x-ndjson"
+	}
+
+	// Loki: one stream per label set with values of [unix epoch in nanoseconds, line]
+	type lokiStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	streams := map[string]*lokiStream{}
+	var order []string
+	for _, l := range batch {
+		stream, ok := streams[l.stream]
+		if !ok {
+			stream = &lokiStream{Stream: map[string]string{"job": "tunnel", "stream": l.stream}}
+			streams[l.stream] = stream
+			order = append(order, l.stream)
+		}
+		line, _ := json.Marshal(l.fields)
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(l.time.UnixNano(), 10), string(line)})
+	}
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, name := range order {
+		push.Streams = append(push.Streams, streams[name])
+	}
+	json.NewEncoder(&buf).Encode(push)
+	return buf.Bytes(), "application/json"
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("logShipper", func() {
+	var (
+		lock     sync.Mutex
+		bodies   []string
+		failures int
+		server   *httptest.Server
+	)
+	BeforeEach(func() {
+		bodies = nil
+		failures = 0
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			b, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, string(b))
+			w.Write([]byte(`{"errors":false}`))
+		}))
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	received := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, bodies...)
+	}
+
+	It("should push batches to loki", func() {
+		s, err := newLogShipper(logShipperLoki, server.URL, 2, 10, time.Hour)
+		Expect(err).To(Not(HaveOccurred()))
+		s.Fire(&log.Entry{Time: time.Unix(1, 0), Level: log.InfoLevel, Message: "started", Data: log.Fields{}})
+		s.ShipAccessLog(&accessLogEntry{Time: time.Unix(2, 0), TunnelName: "demo", Status: 200})
+		Eventually(received).Should(HaveLen(1))
+		s.Close()
+
+		var push struct {
+			Streams []struct {
+				Stream map[string]string
+				Values [][2]string
+			}
+		}
+		Expect(json.Unmarshal([]byte(received()[0]), &push)).To(Succeed())
+		Expect(push.Streams).To(HaveLen(2))
+		Expect(push.Streams[0].Stream["stream"]).To(Equal("server"))
+		Expect(push.Streams[0].Values[0][0]).To(Equal("1000000000"))
+		Expect(push.Streams[1].Values[0][1]).To(ContainSubstring(`"tunnelName":"demo"`))
+	})
+
+	It("should retry and flush on close to elasticsearch", func() {
+		failures = 1
+		s, err := newLogShipper(logShipperElasticsearch, server.URL, 100, 10, time.Hour)
+		Expect(err).To(Not(HaveOccurred()))
+		s.backoff = time.Millisecond
+		s.ShipAccessLog(&accessLogEntry{Time: time.Unix(2, 0), TunnelName: "demo"})
+		s.Close()
+
+		Expect(received()).To(HaveLen(1))
+		lines := strings.Split(strings.TrimSpace(received()[0]), "\n")
+		Expect(lines).To(HaveLen(2))
+		Expect(lines[0]).To(Equal(`{"index":{"_index":"tunnel-access"}}`))
+		Expect(lines[1]).To(ContainSubstring(`"@timestamp":"1970-01-01T00:00:02Z"`))
+	})
+
+	It("should drop logs when the queue is full", func() {
+		s := &logShipper{queue: make(chan *shippedLog, 1)}
+		dropped := logShipperDropped.Value()
+		s.Ship("server", time.Now(), map[string]interface{}{})
+		s.Ship("server", time.Now(), map[string]interface{}{})
+		Expect(logShipperDropped.Value()).To(Equal(dropped + 1))
+	})
+})
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/hex"
 	"flag"
 	"fmt"
@@ -12,27 +11,46 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/joho/godotenv"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 )
 
-// DNS domainURL. This might include a path but only when domainPath is true.
+// DNS domainURL. This might include a path but only when tunnels are routed by path.
 // This will be used for both TCP and HTTP tunnels. For TCP, the host name part is used.
 var domainURL string
 var domainURI url.URL
 
-// Indicates a url path (ie not subdomain) setup.
-var domainPath bool
+// Routing modes of http requests to tunnels.
+const (
+	routingSubdomain = "subdomain" // abc.domain.io
+	routingPath      = "path"      // domain.io/abc
+	routingBoth      = "both"      // abc.domain.io, or domain.io/abc for requests that are not for a subdomain
+)
+
+var routing = routingSubdomain
 
 const sshPort = 5223
-const clientKeepaliveInterval = 5 * time.Second
-const clientKeepaliveMaxCount = 2
+
+// Keepalive requests are sent to clients every clientKeepaliveInterval and clients that miss clientKeepaliveMaxCount
+// replies in a row are disconnected. These are set from --keepaliveInterval and --keepaliveMaxCount and clients can
+// override them with keepalive-interval= and keepalive-count= up to the limits below.
+var clientKeepaliveInterval = 5 * time.Second
+var clientKeepaliveMaxCount = 2
+
+const maxClientKeepaliveInterval = 5 * time.Minute
+const maxClientKeepaliveMaxCount = 10
+
+// Keepalive request sent to clients, and those clients send with their own keepalives (eg OpenSSH ServerAliveInterval).
+const serverKeepaliveRequestType = "keepalive@domain.io"
+
+var clientKeepaliveRequestTypes = []string{"keepalive@openssh.com", serverKeepaliveRequestType}
 
 const forwardTCPRequestType = "tcpip-forward"
 const cancelForwardTCPRequestType = "cancel-tcpip-forward"
@@ -49,98 +67,479 @@ func init() {
 }
 
 func main() {
+	if filepath.Base(os.Args[0]) == "tunnel-client" {
+		os.Exit(runClient(os.Args[1:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		os.Exit(runClient(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Exit(runSelfTest(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:], os.Stdout))
+	}
 
 	// --domainUrl="https://domain.io"
-	domainPtr := flag.String("domainUrl", "", "DNS domain URL (eg https://domain.io) that points to this server. Users will use this url to send HTTP requests and will use the host part of this url for TCP communication.")
+	domainPtr := flag.String("domainUrl", "", "DNS domain URL (eg https://domain.io) that points to this server. Users will use this url to send HTTP requests and will use the host part of this url for TCP communication. Several comma separated domains can be served; the first one is the default of tunnels.")
 
 	// --domainPath=true or --domainPath
-	domainPathPtr := flag.Bool("domainPath", false, "Instead of subdomains, use a URL query path for user tunnels.")
+	domainPathPtr := flag.Bool("domainPath", false, "Instead of subdomains, use a URL query path for user tunnels. Same as --routing=path.")
+
+	// --routing=path
+	routingPtr := flag.String("routing", "", "How http requests are routed to tunnels: subdomain (abc.domain.io), path (domain.io/abc) for deployments without wildcard DNS, or both. Defaults to subdomain.")
+
+	// --basePath=/tunnels
+	basePathPtr := flag.String("basePath", "", "URL path under which tunnels are routed by path (eg /tunnels for domain.io/tunnels/abc). Overrides the path of --domainUrl.")
+
+	// --httpPorts=80,8080
+	httpPortsPtr := flag.String("httpPorts", "80", "Comma separated ports of the HTTP listeners shared by the HTTP tunnels. Clients pick one with --remote-port; the first is the default.")
+
+	// --httpSocket=/run/tunnel/http.sock
+	httpSocketPtr := flag.String("httpSocket", "", "Unix socket path to listen at for http requests instead of the first of --httpPorts, for a reverse proxy on the same host.")
+
+	// --httpSocketMode=0660
+	httpSocketModePtr := flag.String("httpSocketMode", "0660", "File mode of --httpSocket.")
+
+	// --dnsProvider=cloudflare
+	dnsProviderPtr := flag.String("dnsProvider", "", "Creates the DNS records of the domains at startup, and sets them again every 10 minutes if they changed, with this provider (cloudflare or route53). Credentials are read from CLOUDFLARE_API_TOKEN or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.")
+
+	// --dnsZone=023e105f4ecef8ad9ca31a8372d0c353
+	dnsZonePtr := flag.String("dnsZone", "", "Cloudflare zone id or Route53 hosted zone id of the domains for --dnsProvider.")
+
+	// --dnsPublicIP=203.0.113.10,2001:db8::10
+	dnsPublicIPPtr := flag.String("dnsPublicIP", "", "Comma-separated public IPv4 and IPv6 addresses of the server that the domains point to for --dnsProvider.")
+
+	// --dev
+	flag.BoolVar(&devMode, "dev", false, "Developer mode: serves tunnels at *.lvh.me on high ports over http and https with a self-signed certificate and a throwaway host key. Without authorized keys, any key is accepted at localhost.")
+
+	// --ingressClass=tunnel
+	ingressClassPtr := flag.String("ingressClass", "", "Exposes the cluster services of the Kubernetes Ingresses with this ingressClassName as tunnels. Empty disables the Kubernetes mode.")
+
+	// --ingressResync=5m
+	ingressResyncPtr := flag.Duration("ingressResync", 5*time.Minute, "How long a watch of the Kubernetes Ingresses lasts before it is renewed. Changes are applied as they happen.")
+
+	// --clusterAddr=10.0.0.1:7946
+	clusterAddrPtr := flag.String("clusterAddr", "", "Address at which the other nodes of the cluster list the HTTP tunnels of this node. Empty disables the cluster mode.")
+
+	// --clusterPeers=10.0.0.2:7946,10.0.0.3:7946
+	clusterPeersPtr := flag.String("clusterPeers", "", "Comma separated clusterAddr of the other nodes of the cluster. Requests for their HTTP tunnels are relayed to them.")
+
+	// --clusterSecret=s3cret
+	flag.StringVar(&clusterSecret, "clusterSecret", "", "Secret shared by the nodes of the cluster. Required by the cluster mode.")
+
+	// --shareLinkSecret=s3cret
+	flag.StringVar(&shareLinkSecret, "shareLinkSecret", "", "Secret signing the share links (share-link=) and password cookies (password=) of tunnels. Empty generates one at startup, so that share links stop working and visitors enter passwords again on restart. The nodes of a cluster share it.")
+
+	// --user=nobody
+	userPtr := flag.String("user", "", "User to run as after binding the listening ports when started as root.")
+
+	// --privilegedPortOffset=8000
+	flag.IntVar(&privilegedPortOffset, "privilegedPortOffset", privilegedPortOffset, "Added to a port below 1024 that cannot be bound for lack of permission to listen at a high port instead (eg 8080 for 80). 0 disables the fallback.")
+
+	// --defaultTunnel=status
+	flag.String("defaultTunnel", "", "Tunnel name that serves http requests without a Host header nor ?host= query when subdomains are used. Such requests are rejected if empty.")
+
+	// --config=/etc/tunnel.conf
+	configPtr := flag.String("config", "", "File of flags, one name=value per line (eg maxHeaders=50). Flags on the command line take precedence. Reloaded on SIGHUP.")
+
+	// --envFile=secrets.env
+	flag.StringVar(&envFile, "envFile", envFile, "Optional dotenv file to read authorized_keys_enc and ssh_host_key_enc from when they are not env variables. Empty disables it.")
+
+	// --authorizedKeysFile=/etc/tunnel/authorized_keys
+	flag.StringVar(&authorizedKeysFile, "authorizedKeysFile", "", "authorized_keys file of the clients. Takes precedence over authorized_keys_enc.")
+
+	// --reservedNames=/etc/tunnel/reserved_names
+	flag.StringVar(&reservedNamesFile, "reservedNames", "", "File of the tunnel names that random names never take and only the keys listed for them can claim: one name per line followed by the SHA256 fingerprints of those keys. Empty disables it.")
+
+	// --nameDenylist=/etc/tunnel/name_denylist
+	flag.StringVar(&nameDenylistFile, "nameDenylist", "", "File of the regular expressions of the tunnel names that nobody gets, one per line. Empty disables it.")
+
+	// --internalCIDRs=10.0.0.0/8,192.168.0.0/16
+	internalCIDRsPtr := flag.String("internalCIDRs", "", "Comma separated CIDR ranges of the visitors that reach private tunnels (visibility=private), eg 127.0.0.1/32 for the server host. Empty lets no one in.")
+
+	// --profanityFilter=true
+	flag.BoolVar(&profanityFilter, "profanityFilter", profanityFilter, "Refuse tunnel names containing profanity.")
+
+	// --hostKeyFile=/etc/tunnel/ssh_host_key
+	flag.StringVar(&hostKeyFile, "hostKeyFile", "", "Private SSH host key file. Takes precedence over ssh_host_key_enc.")
 
 	// --log=info
-	logPtr := flag.String("log", "info", "Log level: debug, info, warn, or error.")
+	flag.String("log", "info", "Log level: debug, info, warn, or error.")
 
 	// --pprof=6060
 	// Spin up pprof endpoints at port 6060
-	pprofPtr := flag.Int("pprof", 0, "port number to spin up pprof endpoints for. Useful for debugging and troubleshooting.")
+	pprofPtr := flag.Int("pprof", 0, "port number to spin up pprof and expvar (/debug/vars) endpoints for. Useful for debugging and troubleshooting.")
+
+	// --captureSize=50
+	captureSizePtr := flag.Int("captureSize", 0, "Number of recent http requests kept for replay, cookies and credentials included. 0 disables capturing.")
+
+	// --captureMaxBytes=65536
+	captureMaxBytesPtr := flag.Int("captureMaxBytes", 64<<10, "Maximum size in bytes of a captured http request. Larger requests cannot be replayed.")
+
+	// --maxTunnelAge=24h
+	flag.Duration("maxTunnelAge", 0, "Age at which tunnels are closed and their clients told so. The max-tunnel-age option of a key in the authorized keys overrides it. 0 disables it.")
+
+	// --breakerThreshold=5
+	flag.Int("breakerThreshold", 0, "Consecutive requests that a tunnel backend failed to answer (reset, closed or timed out) after which the tunnel serves 503s for the cool-down period. 0 disables the circuit breaker.")
+
+	// --breakerCooldown=30s
+	flag.Duration("breakerCooldown", 30*time.Second, "How long a tunnel serves 503s once its circuit breaker trips.")
+
+	// --cacheMaxEntryBytes=1048576
+	cacheMaxEntryBytesPtr := flag.Int("cacheMaxEntryBytes", 1<<20, "Maximum size in bytes of a response cached for tunnels created with cache=true.")
+
+	// --cacheMaxEntries=100
+	cacheMaxEntriesPtr := flag.Int("cacheMaxEntries", 100, "Maximum number of responses cached per tunnel created with cache=true.")
+
+	// --accessLogDir=/var/log/tunnel
+	accessLogDirPtr := flag.String("accessLogDir", "", "Directory of the access logs of http tunnels, one file per tunnel name. Empty disables access logs.")
+
+	// --accessLogFormat=combined
+	accessLogFormatPtr := flag.String("accessLogFormat", accessLogCombined, "Access log format: combined (Apache combined log format) or json.")
+
+	// --accessLogMaxBytes=10485760
+	accessLogMaxBytesPtr := flag.Int64("accessLogMaxBytes", 10<<20, "Size in bytes at which an access log is rotated. 0 disables size-based rotation.")
+
+	// --accessLogMaxAge=24h
+	accessLogMaxAgePtr := flag.Duration("accessLogMaxAge", 24*time.Hour, "Age at which an access log is rotated. 0 disables time-based rotation.")
+
+	// --harMaxEntries=100
+	flag.Int("harMaxEntries", 100, "Number of recent http requests kept in the HAR capture of each tunnel created with har=true.")
+
+	// --harMaxBodyBytes=65536
+	flag.Int("harMaxBodyBytes", 64<<10, "Maximum size in bytes of a request or response body in the HAR capture. Larger bodies are truncated.")
+
+	// --harMaxAge=1h
+	flag.Duration("harMaxAge", time.Hour, "Age at which requests are dropped from the HAR capture.")
+
+	// --syslog=udp://localhost:514
+	syslogPtr := flag.String("syslog", "", "Also sends the log to a syslog endpoint in the RFC 5424 format: udp://host:514, tcp://host:514, tls://host:6514 or unix:///dev/log.")
+
+	// --syslogAppName=tunnel
+	syslogAppNamePtr := flag.String("syslogAppName", "tunnel", "APP-NAME of the syslog messages.")
+
+	// --logShipper=loki
+	logShipperPtr := flag.String("logShipper", "", "Ships the server and access logs to loki or elasticsearch at --logShipperUrl. Empty disables log shipping.")
+
+	// --logShipperUrl=http://localhost:3100/loki/api/v1/push
+	logShipperURLPtr := flag.String("logShipperUrl", "", "Loki push API or Elasticsearch bulk API URL (eg http://localhost:9200/_bulk).")
+
+	// --logShipperBatch=500
+	logShipperBatchPtr := flag.Int("logShipperBatch", 500, "Maximum number of logs sent in one request to the log shipper.")
+
+	// --logShipperInterval=2s
+	logShipperIntervalPtr := flag.Duration("logShipperInterval", 2*time.Second, "Maximum time a log waits before being shipped.")
+
+	// --logShipperQueue=10000
+	logShipperQueuePtr := flag.Int("logShipperQueue", 10000, "Number of logs waiting to be shipped beyond which new logs are dropped.")
+
+	// --auditLog=/var/log/tunnel/audit.log
+	auditLogPtr := flag.String("auditLog", "", "File to which admin actions that change the server state are appended as JSON lines. Empty disables the audit log.")
+
+	// --reservations=/var/lib/tunnel/reservations.json
+	reservationsPtr := flag.String("reservations", "", "File in which the tunnel names and TCP ports are reserved for the keys that use them, so that they get them back after a restart of the server. Empty disables reservations.")
+
+	// --reservationTTL=24h
+	reservationTTLPtr := flag.Duration("reservationTTL", 24*time.Hour, "How long a tunnel name or TCP port stays reserved for its key once its tunnel is closed.")
+
+	// --slowRequestTTFB=5s
+	flag.Duration("slowRequestTTFB", 0, "Logs http requests whose tunnel backend takes longer than this to start responding. 0 disables it.")
+
+	// --slowRequestDuration=30s
+	flag.Duration("slowRequestDuration", 0, "Logs http requests that take longer than this to complete, except streaming responses. 0 disables it.")
+
+	// --serverHeader=none
+	flag.String("serverHeader", "", "Server header of http responses: none hides it and other values override it. Empty keeps the header of client backends. Tunnels can override it with server=.")
+
+	// --channelPoolSize=2
+	flag.IntVar(&channelPoolSize, "channelPoolSize", channelPoolSize, "Number of idle channels pre-opened for each HTTP tunnel so that requests do not wait for a channel to open. Each holds a connection to the local server. 0 disables the pools.")
+
+	// --channelPoolIdle=30s
+	flag.DurationVar(&channelPoolIdle, "channelPoolIdle", channelPoolIdle, "Age after which an idle pre-opened channel is closed instead of used.")
+
+	// --maxConnections=10000
+	flag.Int("maxConnections", 0, "Maximum number of public http and TCP connections handled at once. 0 is unlimited.")
+
+	// --connectionOverflow=queue
+	flag.String("connectionOverflow", connectionOverflowQueue, "What happens to connections beyond --maxConnections: queue (wait for --connectionQueueTimeout, then reject) or reject (503 for http, closed for TCP).")
+
+	// --connectionQueueTimeout=10s
+	flag.Duration("connectionQueueTimeout", 10*time.Second, "How long a connection beyond --maxConnections waits for another one to close.")
+
+	// --memoryLimit=2147483648
+	flag.Int64Var(&memoryLimit, "memoryLimit", 0, "Soft limit in bytes of the memory of the server (like GOMEMLIMIT, which it defaults to). Close to it, new public connections are answered with a 503 (http) or closed (TCP), idle connections and pre-opened channels are closed and buffers stop growing. 0 disables it.")
+
+	// --janitorInterval=1m
+	flag.DurationVar(&janitorInterval, "janitorInterval", janitorInterval, "Time between the checks for the TCP listeners and HTTP tunnels left behind by closed SSH connections, which are removed and counted in orphanedTunnelsRemoved. 0 disables it.")
+
+	// --maxSSHConnections=1000
+	flag.Int("maxSSHConnections", 0, "Maximum number of SSH connections handled at once. Further connections are closed. 0 is unlimited.")
+
+	// --maxSSHConnectionsPerIP=10
+	flag.Int("maxSSHConnectionsPerIP", 0, "Maximum number of SSH connections handled at once from one source IP. Further connections are closed. 0 is unlimited.")
+
+	// --healthCheckInterval=10s
+	flag.DurationVar(&healthCheckInterval, "healthCheckInterval", healthCheckInterval, "Time between the health checks of the tunnels with a health-check option.")
+
+	// --healthCheckFailures=2
+	flag.IntVar(&healthCheckFailures, "healthCheckFailures", healthCheckFailures, "Failed health checks in a row after which a tunnel serves 503s until a check passes.")
+
+	// --keepaliveInterval=5s
+	flag.DurationVar(&clientKeepaliveInterval, "keepaliveInterval", clientKeepaliveInterval, fmt.Sprintf("Time between the keepalive requests sent to SSH clients. Clients can override it with keepalive-interval= up to %s.", maxClientKeepaliveInterval))
+
+	// --keepaliveMaxCount=2
+	flag.IntVar(&clientKeepaliveMaxCount, "keepaliveMaxCount", clientKeepaliveMaxCount, fmt.Sprintf("Number of keepalive requests in a row an SSH client may leave unanswered before it is disconnected. Clients can override it with keepalive-count= up to %d.", maxClientKeepaliveMaxCount))
+
+	// --maxBufferedBytes=1073741824
+	flag.Int64Var(&maxBufferedBytes, "maxBufferedBytes", 0, "Bytes of relay and header buffers held by connections beyond which new public connections are answered with a 503 (http) or closed (TCP) and buffers stop growing. 0 is unlimited.")
+
+	// --bufferSize=32768
+	flag.IntVar(&bufferSize, "bufferSize", bufferSize, "Size in bytes of the buffers used to relay connections and to read http headers.")
+
+	// --maxBufferSize=1048576
+	flag.IntVar(&maxBufferSize, "maxBufferSize", maxBufferSize, "Size in bytes up to which the buffer of a connection grows while it fills it, such as a large file transfer through a TCP tunnel. --bufferSize or less disables growing buffers.")
+
+	// --maxHeaderBytes=32768
+	flag.Int("maxHeaderBytes", bufferSize, fmt.Sprintf("Maximum size in bytes of the headers of an http request or response, up to %d. Larger requests get a 431 response.", bufferSize))
+
+	// --maxHeaderLineBytes=8192
+	flag.Int("maxHeaderLineBytes", 8<<10, "Maximum size in bytes of a single http header line.")
+
+	// --maxHeaders=100
+	flag.Int("maxHeaders", 100, "Maximum number of headers in an http request or response.")
+
+	// --headerTimeout=20s
+	flag.DurationVar(&headerTimeout, "headerTimeout", headerTimeout, "Time a public http connection has to send the headers of a request once it starts. Slower requests get a 408 response. 0 disables it.")
+
+	// --idleTimeout=2m
+	flag.DurationVar(&idleTimeout, "idleTimeout", idleTimeout, "Time a public http connection may wait for its next request before it is closed. 0 disables it.")
+
+	// --connectionIdleTimeout=15m
+	flag.DurationVar(&connectionIdleTimeout, "connectionIdleTimeout", connectionIdleTimeout, "Time a proxied public HTTP or TCP connection may go without sending or receiving a byte before it is closed. 0 disables it.")
+
+	// --websocketIdleTimeout=1h
+	flag.DurationVar(&websocketIdleTimeout, "websocketIdleTimeout", websocketIdleTimeout, "Same as --connectionIdleTimeout for websockets and other upgraded http connections. 0 disables it.")
+
+	// --sshCiphers=aes128-gcm@openssh.com,chacha20-poly1305@openssh.com
+	sshCiphersPtr := flag.String("sshCiphers", "", fmt.Sprintf("Comma separated SSH ciphers offered to clients, most preferred first. Empty keeps the defaults. Supported: %s.", strings.Join(sshSupportedCiphers, ",")))
+
+	// --sshMACs=hmac-sha2-256-etm@openssh.com
+	sshMACsPtr := flag.String("sshMACs", "", fmt.Sprintf("Comma separated SSH MAC algorithms offered to clients, most preferred first. Empty keeps the defaults. Supported: %s.", strings.Join(sshSupportedMACs, ",")))
+
+	// --sshKexAlgorithms=curve25519-sha256
+	sshKexAlgorithmsPtr := flag.String("sshKexAlgorithms", "", fmt.Sprintf("Comma separated SSH key exchange algorithms offered to clients, most preferred first. Empty keeps the defaults. Supported: %s.", strings.Join(sshSupportedKexAlgorithms, ",")))
 
 	flag.Parse()
 
+	// Flags set on the command line take precedence over TUNNEL_* env variables, which take precedence over
+	// the config file, including on reload.
+	cmdlineFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		cmdlineFlags[f.Name] = true
+	})
+	envFlags, err := applyEnvFlags(flag.CommandLine, os.LookupEnv, cmdlineFlags)
+	if err != nil {
+		log.Fatalf("An error occured reading the env variables: %s", err)
+	}
+	for _, name := range envFlags {
+		cmdlineFlags[name] = true
+	}
+	if *configPtr != "" {
+		if _, _, err := applyConfigFile(flag.CommandLine, *configPtr, cmdlineFlags, false); err != nil {
+			log.Fatalf("An error occured reading the config file: %s", err)
+		}
+	}
+
+	if devMode {
+		setFlags := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) {
+			setFlags[f.Name] = true
+		})
+		applyDevDefaults(flag.CommandLine, setFlags)
+	}
+
 	if domainPtr == nil || *domainPtr == "" {
 		log.Fatalln("DNS domain is empty.")
 	}
-	domainURL = *domainPtr
+	for _, d := range strings.Split(*domainPtr, ",") {
+		uriPtr, err := url.Parse(strings.TrimSpace(d))
+		if err != nil || uriPtr.Hostname() == "" {
+			log.Fatalf("An error occured parsing domainURL %s: %v", d, err)
+		}
+		domainURIs = append(domainURIs, *uriPtr)
+	}
+	domainURL = strings.TrimSpace(strings.Split(*domainPtr, ",")[0])
+	domainURI = domainURIs[0]
 
-	uriPtr, err := url.Parse(domainURL)
-	if err != nil {
-		log.Fatalf("An error occured parsing domainURL: %s", err)
+	flag.Visit(func(f *flag.Flag) {
+		httpBindPortsSet = httpBindPortsSet || f.Name == "httpPorts"
+	})
+	httpBindPorts = nil
+	for _, p := range strings.Split(*httpPortsPtr, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || port <= 0 || port >= 1<<16 {
+			log.Fatalf("Invalid http port %s.", p)
+		}
+		httpBindPorts = append(httpBindPorts, port)
 	}
-	domainURI = *uriPtr
 
-	if domainPathPtr != nil {
-		domainPath = *domainPathPtr
+	switch *routingPtr {
+	case "":
+		if *domainPathPtr {
+			routing = routingPath
+		}
+	case routingSubdomain, routingPath, routingBoth:
+		routing = *routingPtr
+	default:
+		log.Fatalf("Invalid routing %s.", *routingPtr)
+	}
+	if *basePathPtr != "" {
+		for i := range domainURIs {
+			domainURIs[i].Path = "/" + strings.Trim(*basePathPtr, "/")
+		}
+		domainURI = domainURIs[0]
 	}
 
-	// For local development
-	godotenv.Load("secrets.env")
+	if healthCheckInterval <= 0 {
+		log.Fatalf("Invalid healthCheckInterval %s.", healthCheckInterval)
+	}
+	if healthCheckFailures < 1 {
+		log.Fatalf("healthCheckFailures must be at least 1.")
+	}
+	if clientKeepaliveInterval <= 0 {
+		log.Fatalf("Invalid keepaliveInterval %s.", clientKeepaliveInterval)
+	}
+	if clientKeepaliveMaxCount < 1 {
+		log.Fatalf("keepaliveMaxCount must be at least 1.")
+	}
 
-	log.SetOutput(os.Stdout)
+	if bufferSize < 4<<10 {
+		log.Fatalf("bufferSize must be at least %d.", 4<<10)
+	}
+	if f := flag.Lookup("maxHeaderBytes"); !cmdlineFlags["maxHeaderBytes"] && f.Value.String() == f.DefValue && bufferSize < 32<<10 {
+		// The default header limit is the buffer size
+		f.Value.Set(strconv.Itoa(bufferSize))
+	}
 
-	logLevel, err := log.ParseLevel(*logPtr)
-	if err != nil {
-		log.Fatalf("An error occured parsing log level: %s", err)
+	// Settings that can also change at runtime (see reloadConfig)
+	if err := applyRuntimeFlags(flag.CommandLine); err != nil {
+		log.Fatalf("%s.", err)
 	}
-	log.SetLevel(logLevel)
 
-	var authorizedKeysBytes []byte
-	if os.Getenv("authorized_keys_enc") != "" {
-		authorizedKeysBytes, err = base64.StdEncoding.DecodeString(os.Getenv("authorized_keys_enc"))
+	cacheMaxEntryBytes = *cacheMaxEntryBytesPtr
+	cacheMaxEntries = *cacheMaxEntriesPtr
+
+	if *captureSizePtr > 0 {
+		requestCaptures = newCaptureRing(*captureSizePtr)
+		captureMaxBytes = *captureMaxBytesPtr
 	}
-	if err != nil {
-		log.Fatalf("Failed to parse authorized_keys_enc env variable, err: %v", err)
+
+	if *accessLogDirPtr != "" {
+		accessLogs, err = newAccessLogger(*accessLogDirPtr, *accessLogFormatPtr, *accessLogMaxBytesPtr, *accessLogMaxAgePtr)
+		if err != nil {
+			log.Fatalf("An error occured opening the access logs: %s", err)
+		}
 	}
 
-	cancellationCtx, cancelBackground := context.WithCancel(context.Background())
-	defer cancelBackground()
+	if *auditLogPtr != "" {
+		auditLogs, err = newAuditLogger(*auditLogPtr)
+		if err != nil {
+			log.Fatalf("An error occured opening the audit log: %s", err)
+		}
+	}
+
+	if *reservationsPtr != "" {
+		reservations, err = newReservationStore(*reservationsPtr, *reservationTTLPtr)
+		if err != nil {
+			log.Fatalf("An error occured loading the reservations: %s", err)
+		}
+	}
 
-	// Public key authentication is done by comparing
-	// the public key of a received connection
-	// with the entries in the authorized_keys_enc.
+	log.SetOutput(os.Stdout)
 
-	authorizedKeysMap := map[string]bool{}
-	for len(authorizedKeysBytes) > 0 {
-		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
+	if *syslogPtr != "" {
+		hook, err := newSyslogHook(*syslogPtr, *syslogAppNamePtr)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("An error occured connecting to syslog: %s", err)
 		}
+		defer hook.Close()
+		log.AddHook(hook)
+	}
 
-		authorizedKeysMap[string(pubKey.Marshal())] = true
-		authorizedKeysBytes = rest
+	if *logShipperPtr != "" {
+		logShipping, err = newLogShipper(*logShipperPtr, *logShipperURLPtr, *logShipperBatchPtr, *logShipperQueuePtr, *logShipperIntervalPtr)
+		if err != nil {
+			log.Fatalf("An error occured starting the log shipper: %s", err)
+		}
+		log.AddHook(logShipping)
+	}
+
+	authorizedKeysMap, err := loadAuthorizedKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	authorizedKeys.Store(authorizedKeysMap)
+	reservedNamesMap, err := loadReservedNames()
+	if err != nil {
+		log.Fatalf("An error occured reading the reserved names: %s", err)
+	}
+	reservedNames.Store(reservedNamesMap)
+	denylist, err := loadNameDenylist()
+	if err != nil {
+		log.Fatalf("An error occured reading the name denylist: %s", err)
+	}
+	nameDenylist.Store(denylist)
+	if err := internalCIDRs.Add(*internalCIDRsPtr); err != nil {
+		log.Fatalf("Invalid --internalCIDRs: %s", err)
+	}
+	if shareLinkSecret == "" {
+		if shareLinkSecret, err = newShareLinkSecret(); err != nil {
+			log.Fatalf("An error occured generating the share link secret: %s", err)
+		}
 	}
+	acceptAnyKey := devMode && len(authorizedKeysMap) == 0
+	if acceptAnyKey {
+		log.Warnln("No authorized keys, accepting any client key at localhost in developer mode.")
+	}
+
+	cancellationCtx, cancelBackground := context.WithCancel(context.Background())
+	defer cancelBackground()
+	startMemoryWatchdog(cancellationCtx)
+	startJanitor(cancellationCtx)
 
 	// An SSH server is represented by a ServerConfig, which holds
 	// certificate details and handles authentication of ServerConns.
 	config := &ssh.ServerConfig{
 		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-			if authorizedKeysMap[string(pubKey.Marshal())] {
-				return &ssh.Permissions{
-					// Record the public key used for authentication.
-					Extensions: map[string]string{
-						"pubkey-fp": ssh.FingerprintSHA256(pubKey),
-					},
-				}, nil
+			if key, ok := authorizedKeys.Load().(map[string]authorizedKey)[string(pubKey.Marshal())]; acceptAnyKey || ok {
+				return key.permissions(ssh.FingerprintSHA256(pubKey)), nil
 			}
 			return nil, fmt.Errorf("unknown public key for session %q", c.SessionID())
 		},
+		BannerCallback: execBanner,
 	}
-	var privateBytes []byte
-	if os.Getenv("ssh_host_key_enc") != "" {
-		privateBytes, err = base64.StdEncoding.DecodeString(os.Getenv("ssh_host_key_enc"))
+	if config.Ciphers, err = parseSSHAlgorithms(*sshCiphersPtr, sshSupportedCiphers); err != nil {
+		log.Fatalf("Invalid --sshCiphers: %s", err)
 	}
+	if config.MACs, err = parseSSHAlgorithms(*sshMACsPtr, sshSupportedMACs); err != nil {
+		log.Fatalf("Invalid --sshMACs: %s", err)
+	}
+	if config.KeyExchanges, err = parseSSHAlgorithms(*sshKexAlgorithmsPtr, sshSupportedKexAlgorithms); err != nil {
+		log.Fatalf("Invalid --sshKexAlgorithms: %s", err)
+	}
+	privateBytes, err := loadSecret(hostKeyFile, hostKeyEnv)
 	if err != nil {
 		log.Fatal("Failed to load private key: ", err)
 	}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
+	var private ssh.Signer
+	if privateBytes == nil && devMode {
+		private, err = newDevHostKey()
+		log.Printf("Generated a throwaway host key %s", ssh.FingerprintSHA256(private.PublicKey()))
+	} else {
+		private, err = ssh.ParsePrivateKey(privateBytes)
+	}
 	if err != nil {
 		log.Fatal("Failed to parse private key: ", err)
 	}
@@ -149,16 +548,60 @@ func main() {
 
 	// Once a ServerConfig has been configured, connections can be
 	// accepted.
-	sshLocalListener, err := net.Listen("tcp", ":"+strconv.Itoa(sshPort))
+	if err := loadSystemdListeners(); err != nil {
+		log.Fatalf("An error occured taking the systemd sockets: %s", err)
+	}
+	sshHost := ""
+	if acceptAnyKey {
+		sshHost = "localhost"
+	}
+	sshLocalListener, err := listen(systemdSSHSocket, net.JoinHostPort(sshHost, strconv.Itoa(sshPort)))
 	if err != nil {
 		log.Fatal("failed to listen for connection: ", err)
 	}
 
-	log.Println("Listening for SSH connections at", ":"+strconv.Itoa(sshPort))
+	log.Println("Listening for SSH connections at", sshLocalListener.Addr())
+
+	if devMode {
+		if err := serveDevHTTPS(devHTTPSPort, httpBindPorts[0]); err != nil {
+			log.Fatalf("failed to listen for https connections: %s", err)
+		}
+	}
+
+	if *httpSocketPtr != "" {
+		mode, err := strconv.ParseUint(*httpSocketModePtr, 8, 32)
+		if err != nil {
+			log.Fatalf("Invalid httpSocketMode %s.", *httpSocketModePtr)
+		}
+		if err := listenUnixHTTP(*httpSocketPtr, os.FileMode(mode)); err != nil {
+			log.Fatalf("failed to listen for http connections at %s: %s", *httpSocketPtr, err)
+		}
+		log.Println("Listening for http connections at", *httpSocketPtr)
+	}
+
+	if *userPtr != "" {
+		// Bind everything that may need privileges before dropping them
+		if err := prebindHTTPListeners(); err != nil {
+			log.Fatalf("failed to listen for http connections: %s", err)
+		}
+		if err := dropPrivileges(*userPtr); err != nil {
+			log.Fatalf("An error occured dropping privileges to user %s: %s", *userPtr, err)
+		}
+		log.Printf("Running as user %s", *userPtr)
+	}
 	// Wait for interrupt signal to gracefully shut down the server
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
+	// Reload the configuration without dropping SSH sessions or tunnels
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig(*configPtr, cmdlineFlags)
+		}
+	}()
+
 	// Accept incoming SSH connections
 	var tempDelay time.Duration
 	go func() {
@@ -188,11 +631,84 @@ func main() {
 				}
 			}
 
+			ip, ok := sshConnections.Acquire(conn.RemoteAddr())
+			if !ok {
+				log.Printf("Too many SSH connections, rejecting connection from %s", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+
 			// Handle incoming requests concurrently.
-			go handleIncomingSSHConn(conn, config, cancellationCtx)
+			go func() {
+				defer sshConnections.Release(ip)
+				handleIncomingSSHConn(conn, config, cancellationCtx)
+			}()
 		}
 	}()
 
+	if *dnsProviderPtr != "" {
+		var ips []net.IP
+		for _, s := range strings.Split(*dnsPublicIPPtr, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				log.Fatalf("Invalid dnsPublicIP %s.", s)
+			}
+			ips = append(ips, ip)
+		}
+		provider, err := newDNSProvider(*dnsProviderPtr, *dnsZonePtr)
+		if err != nil {
+			log.Fatalf("%s.", err)
+		}
+		ctx, cancel := context.WithTimeout(cancellationCtx, 2*time.Minute)
+		err = ensureDomainRecords(ctx, provider, domainURIs, ips)
+		cancel()
+		if err != nil {
+			log.Fatalf("An error occured creating the DNS records: %s", err)
+		}
+		watchDomainRecords(cancellationCtx, provider, domainURIs, ips)
+	}
+
+	if *ingressClassPtr != "" {
+		if *ingressResyncPtr < time.Second {
+			log.Fatalf("ingressResync must be at least 1s.")
+		}
+		if err := watchIngresses(cancellationCtx, *ingressClassPtr, *ingressResyncPtr); err != nil {
+			log.Fatalf("An error occured watching the Kubernetes Ingresses: %s", err)
+		}
+	}
+
+	var clusterSrv *http.Server
+	if *clusterAddrPtr != "" || *clusterPeersPtr != "" {
+		if clusterSecret == "" {
+			log.Fatalln("The cluster mode requires --clusterSecret.")
+		}
+		for _, peer := range strings.Split(*clusterPeersPtr, ",") {
+			if peer = strings.TrimSpace(peer); peer == "" {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(peer); err != nil {
+				log.Fatalf("Invalid cluster peer %s: %s", peer, err)
+			}
+			clusterPeers = append(clusterPeers, peer)
+		}
+		// Visitors may reach any node, which relays the requests for the tunnels of the others
+		for _, port := range httpBindPorts {
+			if _, err := listenHTTP(":"+strconv.Itoa(port), cancellationCtx); err != nil {
+				log.Fatalf("failed to listen for http connections: %s", err)
+			}
+		}
+		go syncPeerTunnels(cancellationCtx)
+	}
+	if *clusterAddrPtr != "" {
+		clusterListener, err := net.Listen("tcp", *clusterAddrPtr)
+		if err != nil {
+			log.Fatalf("An error occured listening for the cluster at %s: %s", *clusterAddrPtr, err)
+		}
+		clusterSrv = &http.Server{Handler: newClusterHandler(), ReadHeaderTimeout: 10 * time.Second}
+		log.Infof("Listening for cluster nodes at %s...", clusterListener.Addr())
+		go clusterSrv.Serve(clusterListener)
+	}
+
 	// Did we specify pprof port?
 	var srv *http.Server
 	if pprofPtr != nil && *pprofPtr > 0 {
@@ -212,6 +728,9 @@ func main() {
 	if srv != nil {
 		srv.Close()
 	}
+	if clusterSrv != nil {
+		clusterSrv.Close()
+	}
 	sshLocalListener.Close()
 	log.Println("Shutting down server...")
 
@@ -228,6 +747,16 @@ func main() {
 	}
 	sshTunnelListenersLock.Unlock()
 
+	if accessLogs != nil {
+		accessLogs.Close()
+	}
+	if auditLogs != nil {
+		auditLogs.Close()
+	}
+	if logShipping != nil {
+		logShipping.Close()
+	}
+
 	log.Infoln("Server exiting")
 }
 
@@ -244,6 +773,8 @@ func handleIncomingSSHConn(nConn net.Conn, config *ssh.ServerConfig, cancellatio
 	log.Printf("logged in with key %s and session %s", conn.Permissions.Extensions["pubkey-fp"], hex.EncodeToString(conn.SessionID()))
 
 	serverConnection := newSSHConnection(conn, cancellationCtx)
+	// Deferred first to run last, once the tunnels of the connection were cleaned up
+	defer serverConnection.MarkClosed()
 
 	// Signaled when the "exec" request is handled
 	// Because "session" channel can come in async along with port forward global request, we need a sync mechanism.
@@ -258,10 +789,14 @@ func handleIncomingSSHConn(nConn net.Conn, config *ssh.ServerConfig, cancellatio
 				cacheKey := net.JoinHostPort(forwardRequest.BindAddr, strconv.Itoa(int(forwardRequest.BindPort))) + *subdomain
 
 				sshTunnelListenersLock.Lock()
-				s, ok := sshTunnelListeners[cacheKey]
-				if ok && s.sessionID == hex.EncodeToString(conn.SessionID()) {
-					delete(sshTunnelListeners, cacheKey)
-					log.Printf("Purged cache for HTTP session %s\n", s.sessionID)
+				for _, alias := range serverConnection.GetTunnelAliases() {
+					cacheKey := net.JoinHostPort(forwardRequest.BindAddr, strconv.Itoa(int(forwardRequest.BindPort))) + alias
+					removeTunnelAlias(cacheKey, hex.EncodeToString(conn.SessionID()))
+				}
+				if removeTunnelListener(cacheKey, hex.EncodeToString(conn.SessionID())) {
+					log.Printf("Purged cache for HTTP session %s\n", hex.EncodeToString(conn.SessionID()))
+					addr := net.JoinHostPort(forwardRequest.BindAddr, strconv.Itoa(int(forwardRequest.BindPort)))
+					reservations.Close(httpReservationKey(addr, *subdomain), serverConnection.Fingerprint())
 				}
 				sshTunnelListenersLock.Unlock()
 			}
@@ -277,6 +812,7 @@ func handleIncomingSSHConn(nConn net.Conn, config *ssh.ServerConfig, cancellatio
 				delete(forwards, cacheKey)
 				o.listener.Close()
 				log.Printf("Purged cache for TCP session %s\n", o.sessionID)
+				reservations.Close(tcpReservationKey(cacheKey), o.fingerprint)
 			}
 		}
 		forwardsLock.Unlock()
@@ -290,13 +826,19 @@ func handleIncomingSSHConn(nConn net.Conn, config *ssh.ServerConfig, cancellatio
 	go func() {
 		// Keepalive
 		// Send to client keepalive SSH requests
-		missingReplies := 0
-		ticker := time.NewTicker(clientKeepaliveInterval)
+		interval, maxCount := serverConnection.Keepalive()
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				if missingReplies >= clientKeepaliveMaxCount {
+				// The client may have changed them in its exec request
+				var i time.Duration
+				if i, maxCount = serverConnection.Keepalive(); i != interval {
+					interval = i
+					ticker.Reset(interval)
+				}
+				if serverConnection.missingKeepalives.Load() >= int32(maxCount) {
 					log.Printf("Did not receive keepalive replies, closing session %s", hex.EncodeToString(conn.SessionID()))
 					err := conn.Close()
 					if err != nil {
@@ -304,13 +846,12 @@ func handleIncomingSSHConn(nConn net.Conn, config *ssh.ServerConfig, cancellatio
 					}
 					return
 				}
-				missingReplies = missingReplies + 1
+				serverConnection.missingKeepalives.Add(1)
 				go func() {
 					// SendRequest is synchronous we don't wait on it since it can take a long time.
-					_, _, err := conn.SendRequest("keepalive@domain.io", true, nil)
+					_, _, err := conn.SendRequest(serverKeepaliveRequestType, true, nil)
 					if err == nil {
-						// Reset count
-						missingReplies = 0
+						serverConnection.ClientAlive()
 					}
 				}()
 
@@ -318,7 +859,7 @@ func handleIncomingSSHConn(nConn net.Conn, config *ssh.ServerConfig, cancellatio
 		}
 	}()
 
-	channelAlreadyHandled := false
+	sessionChannels := 0
 	// Service the incoming Channel channels (eg session, x11, etc). See 4.9.1.  Connection Protocol Channel Types https://www.ietf.org/rfc/rfc4250.txt
 	for newChannel := range chans {
 
@@ -329,13 +870,14 @@ func handleIncomingSSHConn(nConn net.Conn, config *ssh.ServerConfig, cancellatio
 		if newChannel.ChannelType() != "session" {
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
-		} else if channelAlreadyHandled {
-			newChannel.Reject(ssh.UnknownChannelType, "another session channel type already exists")
+		} else if sessionChannels >= maxSessionChannels {
+			newChannel.Reject(ssh.ResourceShortage, "too many session channels")
 			continue
 		} else {
-			channelAlreadyHandled = true
-			// We accept a single "Session" channel because otherwise there is no easy way to link a channel to the portforward global request.
-			go sessionChannelHandler(newChannel, conn, execRequestCompleted, cancellationCtx)
+			sessionChannels++
+			// We accept the exec request of a single "Session" channel because otherwise there is no easy way to link a channel to the portforward global request.
+			// The other session channels serve the tunnel-control subsystem and session commands.
+			go sessionChannelHandler(newChannel, serverConnection, sessionChannels == 1, execRequestCompleted, cancellationCtx)
 		}
 	}
 
@@ -347,18 +889,28 @@ func handleGlobalRequests(reqs <-chan *ssh.Request, conn *sshConnection, execReq
 		if req.Type == forwardTCPRequestType {
 			ret, payload := forwardHandler(conn, req, execRequestCompleted, cancellationCtx)
 			req.Reply(ret, payload)
+			if probe := conn.TakeTunnelProbe(); probe != nil {
+				// The client accepts the channels of the tunnel once it has the reply
+				go probe()
+			}
 		} else if req.Type == cancelForwardTCPRequestType {
 			ret, payload := cancelForwardHandler(conn, req, cancellationCtx)
 			req.Reply(ret, payload)
+		} else if containsString(clientKeepaliveRequestTypes, req.Type) {
+			// The client is alive as much as if it replied to our keepalive
+			conn.ClientAlive()
+			req.Reply(true, nil)
 		} else {
-			// Keepalive requests et al
+			// Other requests et al
 			req.Reply(false, nil)
 			continue
 		}
 	}
 }
 
-func sessionChannelHandler(sshChannel ssh.NewChannel, conn *ssh.ServerConn, execRequestCompleted chan<- execRequestCompletedData, cancellationCtx context.Context) {
+// sessionChannelHandler serves a "session" channel. Only the tunnel channel (the first one of the connection) can carry
+// the exec request of the tunnel.
+func sessionChannelHandler(sshChannel ssh.NewChannel, conn *sshConnection, tunnelChannel bool, execRequestCompleted chan<- execRequestCompletedData, cancellationCtx context.Context) {
 	// "session" channel handler
 	// Each SSH channel has multiple requests (eg exec, env). See 4.9.3.  Connection Protocol Channel Request Names  https://www.ietf.org/rfc/rfc4250.txt
 	channel, requests, err := sshChannel.Accept()
@@ -374,31 +926,104 @@ func sessionChannelHandler(sshChannel ssh.NewChannel, conn *ssh.ServerConn, exec
 
 	// Close channel when handler finishes processing all requests or cancelled/error
 	defer channel.Close()
+	if tunnelChannel {
+		conn.MarkSessionOpened()
+	}
 
 	//  Here we handle only the "exec" request only and once.
+	// A "shell" request (no command) is handled like the exec request of an HTTP tunnel with the default options.
+	// Either shows the terminal UI after a "pty-req" request.
+	// A "subsystem" request for tunnel-control takes the place of the exec request (see serveTunnelControl).
 	requestHandled := false
 	var execRequest string
+	var pty *ptyRequest
+	var tui *sessionTUI
 	func(in <-chan *ssh.Request) {
 		for req := range in {
-			if req.Type == "exec" && !requestHandled {
-				var payload = struct{ Value string }{}
-				err := ssh.Unmarshal(req.Payload, &payload)
-				if err != nil {
-					log.Printf("error parsing exec payload for session %s: %s", hex.EncodeToString(conn.SessionID()), err)
+			if req.Type == "pty-req" && !requestHandled {
+				pty = &ptyRequest{}
+				if err := ssh.Unmarshal(req.Payload, pty); err != nil {
+					log.Printf("error parsing pty-req payload for session %s: %s", hex.EncodeToString(conn.SessionID()), err)
+				}
+				req.Reply(true, nil)
+			} else if req.Type == "window-change" && tui != nil {
+				var size windowChangeRequest
+				if err := ssh.Unmarshal(req.Payload, &size); err == nil {
+					tui.Resize(size.Columns, size.Rows)
+				}
+				req.Reply(true, nil)
+			} else if req.Type == "subsystem" && !requestHandled {
+				var payload = struct{ Name string }{}
+				if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != tunnelControlSubsystem {
 					req.Reply(false, nil)
+					continue
+				}
+				requestHandled = true
+				if tunnelChannel {
+					conn.MarkNoExecRequest()
+				}
+				req.Reply(true, nil)
+				go func() {
+					defer channel.Close()
+					serveTunnelControl(conn, channel)
+				}()
+			} else if (req.Type == "exec" || req.Type == "shell") && !requestHandled {
+				var payload = struct{ Value string }{}
+				if req.Type == "exec" {
+					err := ssh.Unmarshal(req.Payload, &payload)
+					if err != nil {
+						log.Printf("error parsing exec payload for session %s: %s", hex.EncodeToString(conn.SessionID()), err)
+						req.Reply(false, nil)
+					}
+				} else {
+					payload.Value = tuiDefaultRequest
 				}
 				execRequest = payload.Value
 				// We only accept one exec request per session
 				requestHandled = true
 
-				// Signal SSH handler completion and pass channel for communication with client
-				execRequestCompleted <- execRequestCompletedData{channel: channel, request: execRequest}
+				if command, args, ok := findSessionCommand(execRequest); ok {
+					if tunnelChannel {
+						conn.MarkNoExecRequest()
+					}
+					req.Reply(true, nil)
+					go runSessionCommand(command, args, conn.ServerConn, channel)
+					continue
+				}
+				if !tunnelChannel {
+					// The port forward is linked to the exec request of the first session channel
+					req.Reply(false, nil)
+					continue
+				}
+
+				session := execRequestCompletedData{channel: channel, request: execRequest}
+				if pty != nil {
+					tui = newSessionTUI(channel, *pty, func() {
+						var exitStatus = struct{ Status uint32 }{0}
+						channel.SendRequest("exit-status", false, ssh.Marshal(&exitStatus))
+						conn.Close()
+					})
+					session.channel, session.tui = tui, tui
+					go tui.Run()
+				}
 
-				req.Reply(true, nil)
+				// Signal SSH handler completion and pass channel for communication with client, unless the tunnel
+				// already opened with the default options (see execRequestWait)
+				select {
+				case execRequestCompleted <- session:
+					req.Reply(true, nil)
+				case <-conn.ExecWaitOver():
+					fmt.Fprintln(channel, "The tunnel was opened with the default options as its options came too late.")
+					req.Reply(false, nil)
+				}
 			} else {
 				req.Reply(false, nil)
 			}
 		}
 	}(requests)
 
+	if tunnelChannel {
+		// The channel closed, either after the exec request was taken or without one
+		conn.MarkNoExecRequest()
+	}
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"expvar"
+)
+
+// Bytes of the relay and header buffers held by connections (bufPool and largeBufPools), and the public connections
+// turned away because of them, published at /debug/vars of the pprof port.
+var (
+	bufferedBytes        = expvar.NewInt("bufferedBytes")
+	memoryBudgetRejected = expvar.NewInt("memoryBudgetRejected")
+)
+
+// Bytes of buffers beyond which new public connections are turned away and buffers stop growing. 0 is unlimited.
+// This is set from a command line flag.
+var maxBufferedBytes int64
+
+// overMemoryBudget returns true if a new public connection must be turned away because the buffers of the
+// connections in flight reached maxBufferedBytes or memory is close to memoryLimit. Connections already accepted
+// keep their buffers.
+func overMemoryBudget() bool {
+	if !underMemoryPressure.Load() && (maxBufferedBytes <= 0 || bufferedBytes.Value() < maxBufferedBytes) {
+		return false
+	}
+	memoryBudgetRejected.Add(1)
+	return true
+}
+
+// memoryBudgetAllows returns true if size more bytes of buffers fit in maxBufferedBytes and memory is not close to
+// memoryLimit.
+func memoryBudgetAllows(size int) bool {
+	if underMemoryPressure.Load() {
+		return false
+	}
+	return maxBufferedBytes <= 0 || bufferedBytes.Value()+int64(size) <= maxBufferedBytes
+}
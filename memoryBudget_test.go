@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("memory budget", func() {
+	var max int64
+	BeforeEach(func() {
+		max = maxBufferedBytes
+	})
+	AfterEach(func() {
+		maxBufferedBytes = max
+	})
+
+	It("should count the buffers taken from the pools", func() {
+		before := bufferedBytes.Value()
+		buf := getBuffer()
+		Expect(bufferedBytes.Value()).To(Equal(before + int64(bufferSize)))
+		putBuffer(buf)
+		Expect(bufferedBytes.Value()).To(Equal(before))
+	})
+
+	It("should turn away connections once the budget is used", func() {
+		maxBufferedBytes = 0
+		Expect(overMemoryBudget()).To(BeFalse())
+
+		maxBufferedBytes = bufferedBytes.Value() + int64(bufferSize)
+		Expect(overMemoryBudget()).To(BeFalse())
+		buf := getBuffer()
+		rejected := memoryBudgetRejected.Value()
+		Expect(overMemoryBudget()).To(BeTrue())
+		Expect(memoryBudgetRejected.Value()).To(Equal(rejected + 1))
+		putBuffer(buf)
+		Expect(overMemoryBudget()).To(BeFalse())
+	})
+
+	It("should not grow buffers beyond the budget", func() {
+		defer func(max int) { maxBufferSize = max }(maxBufferSize)
+		maxBufferSize = bufferSize * 4
+		maxBufferedBytes = bufferedBytes.Value() + int64(bufferSize)*2
+
+		before := bufferedBytes.Value()
+		dst := &writeSizes{}
+		_, err := copyConn(dst, io.LimitReader(zeroReader{}, int64(bufferSize)*100), make([]byte, bufferSize))
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(dst.sizes[len(dst.sizes)-2]).To(Equal(bufferSize * 2))
+		Expect(bufferedBytes.Value()).To(Equal(before))
+	})
+})
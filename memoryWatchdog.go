@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Soft limit in bytes of the memory of the server. The garbage collector works harder as memory approaches it (see
+// GOMEMLIMIT), and above memoryShedRatio of it the server sheds load rather than wait for the OOM killer. 0 takes
+// GOMEMLIMIT if set, otherwise it is disabled.
+// This is set from a command line flag.
+var memoryLimit int64
+
+const (
+	// Fractions of memoryLimit above which load is shed and below which it stops
+	memoryShedRatio     = 0.9
+	memoryRecoverRatio  = 0.8
+	memoryWatchInterval = time.Second
+	// Connections without traffic for this long are closed while shedding load
+	memoryShedIdle = 10 * time.Second
+)
+
+// Times memory came close to memoryLimit and connections closed to shed load, published at /debug/vars of the
+// pprof port.
+var (
+	memoryPressureEvents  = expvar.NewInt("memoryPressureEvents")
+	memoryShedConnections = expvar.NewInt("memoryShedConnections")
+)
+
+// Set while load is shed: new public connections are turned away (see overMemoryBudget), buffers do not grow and
+// channel pools are not refilled.
+var underMemoryPressure atomic.Bool
+
+// startMemoryWatchdog applies memoryLimit to the Go runtime, or takes it from GOMEMLIMIT, and watches memory until
+// ctx is done.
+func startMemoryWatchdog(ctx context.Context) {
+	if memoryLimit > 0 {
+		debug.SetMemoryLimit(memoryLimit)
+	} else if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		memoryLimit = limit
+	}
+	if memoryLimit <= 0 {
+		return
+	}
+	log.Printf("Shedding load above %d bytes of memory", int64(float64(memoryLimit)*memoryShedRatio))
+	go func() {
+		ticker := time.NewTicker(memoryWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			checkMemory(memoryInUse())
+		}
+	}()
+}
+
+// memoryInUse returns the bytes of memory that the Go runtime holds from the OS, which is what its limit counts.
+func memoryInUse() int64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.Sys - stats.HeapReleased)
+}
+
+// checkMemory starts or stops shedding load for used bytes of memory, and sheds more for as long as it is high.
+func checkMemory(used int64) {
+	shed := float64(used) >= float64(memoryLimit)*memoryShedRatio
+	if !underMemoryPressure.Load() {
+		if !shed {
+			return
+		}
+		underMemoryPressure.Store(true)
+		memoryPressureEvents.Add(1)
+		log.Warnf("Memory use of %d bytes is close to the limit of %d bytes, shedding load", used, memoryLimit)
+	} else if float64(used) < float64(memoryLimit)*memoryRecoverRatio {
+		underMemoryPressure.Store(false)
+		log.Warnf("Memory use is down to %d bytes, accepting connections again", used)
+		return
+	}
+	shedLoad()
+}
+
+// shedLoad closes idle public connections and pre-opened channels and returns the memory freed to the OS.
+func shedLoad() {
+	if n := closeIdleConnections(memoryShedIdle); n > 0 {
+		memoryShedConnections.Add(int64(n))
+		log.Printf("Closed %d idle connections to shed load", n)
+	}
+	drainChannelPools()
+	debug.FreeOSMemory()
+}
+
+// drainChannelPools closes the idle channels of the pools of every tunnel.
+func drainChannelPools() {
+	sshTunnelListenersLock.Lock()
+	defer sshTunnelListenersLock.Unlock()
+	for _, tunnel := range sshTunnelListeners {
+		members := []sshTunnelsListenerData{tunnel}
+		if tunnel.group != nil {
+			tunnel.group.Lock()
+			members = append([]sshTunnelsListenerData{}, tunnel.group.members...)
+			tunnel.group.Unlock()
+		}
+		for _, m := range members {
+			m.channels.Drain()
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("memory watchdog", func() {
+	var limit int64
+	BeforeEach(func() {
+		limit = memoryLimit
+	})
+	AfterEach(func() {
+		memoryLimit = limit
+		underMemoryPressure.Store(false)
+	})
+
+	It("should shed load close to the limit until memory is down again", func() {
+		memoryLimit = 1000
+		events := memoryPressureEvents.Value()
+		checkMemory(850)
+		Expect(underMemoryPressure.Load()).To(BeFalse())
+		Expect(overMemoryBudget()).To(BeFalse())
+
+		checkMemory(950)
+		Expect(underMemoryPressure.Load()).To(BeTrue())
+		Expect(memoryPressureEvents.Value()).To(Equal(events + 1))
+		Expect(overMemoryBudget()).To(BeTrue())
+		Expect(memoryBudgetAllows(1)).To(BeFalse())
+
+		checkMemory(850)
+		Expect(underMemoryPressure.Load()).To(BeTrue())
+		checkMemory(700)
+		Expect(underMemoryPressure.Load()).To(BeFalse())
+		Expect(memoryPressureEvents.Value()).To(Equal(events + 1))
+	})
+
+	It("should drain channel pools and not refill them", func() {
+		var opened int32
+		channel := &fakeChannel{}
+		p := newChannelPool(1, func() (ssh.Channel, <-chan struct{}, error) {
+			atomic.AddInt32(&opened, 1)
+			return &fakeChannel{}, make(chan struct{}), nil
+		})
+		defer p.Close()
+		p.idle = []*pooledChannel{{channel: channel, opened: time.Now(), closed: make(chan struct{})}}
+		underMemoryPressure.Store(true)
+		p.Drain()
+		Expect(atomic.LoadInt32(&channel.closed)).To(Equal(int32(1)))
+		_, ok := p.Get()
+		Expect(ok).To(BeFalse())
+		Consistently(func() int32 { return atomic.LoadInt32(&opened) }, 50*time.Millisecond).Should(Equal(int32(0)))
+	})
+})
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Largest request (headers and body) mirrored to a shadow tunnel; larger requests are only sent to the tunnel.
+const mirrorMaxBytes = 1 << 20
+
+// Mirrored requests in flight at once; requests beyond it are not mirrored so that a slow shadow tunnel does not
+// hold memory nor slow down the server.
+const mirrorMaxInFlight = 64
+
+var mirrorSlots = make(chan struct{}, mirrorMaxInFlight)
+
+// Requests sent to shadow tunnels (mirror=) and those that could not be, published at /debug/vars of the pprof port.
+var (
+	mirroredRequests       = expvar.NewInt("mirroredRequests")
+	mirroredRequestsFailed = expvar.NewInt("mirroredRequestsFailed")
+)
+
+// mirrorRequest sends a copy of a request of the tunnel of fingerprint, as sent to its client, to the shadow tunnel
+// at cacheKey (see sshTunnelListeners) in the background and discards the response. The shadow tunnel must be held
+// by the same key, so that visitor traffic never reaches another user.
+func mirrorRequest(cacheKey string, fingerprint string, method string, raw []byte) {
+	select {
+	case mirrorSlots <- struct{}{}:
+	default:
+		mirroredRequestsFailed.Add(1)
+		return
+	}
+	go func() {
+		defer func() { <-mirrorSlots }()
+		if err := sendMirroredRequest(cacheKey, fingerprint, method, raw); err != nil {
+			log.Debugf("error mirroring request to %s: %s", cacheKey, err)
+			mirroredRequestsFailed.Add(1)
+			return
+		}
+		mirroredRequests.Add(1)
+	}()
+}
+
+func sendMirroredRequest(cacheKey string, fingerprint string, method string, raw []byte) error {
+	sshTunnelListenersLock.Lock()
+	shadow, ok := sshTunnelListeners[cacheKey]
+	sshTunnelListenersLock.Unlock()
+	if !ok {
+		return fmt.Errorf("shadow tunnel is not connected")
+	}
+	if fingerprint == "" || shadow.conn.Fingerprint() != fingerprint {
+		return fmt.Errorf("shadow tunnel is held by another key")
+	}
+
+	sshChannelConn, err := openTunnelChannel(shadow, "127.0.0.1", 0)
+	if err != nil {
+		return fmt.Errorf("error opening %s channel: %s", forwardedTCPChannelType, err)
+	}
+	defer sshChannelConn.Close()
+	timer := time.AfterFunc(replayTimeout, func() {
+		sshChannelConn.Close()
+	})
+	defer timer.Stop()
+
+	if _, err := sshChannelConn.Write(raw); err != nil {
+		return fmt.Errorf("error writing request: %s", err)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	responseHttpProcessor := getHttpProcessor(&eofReader{r: sshChannelConn}, *buf)
+	defer putHttpProcessor(responseHttpProcessor)
+	responseHttpProcessor.requestMethod = method
+	if err := responseHttpProcessor.ReadHeadersIfNeeded(); err != nil {
+		return fmt.Errorf("error reading response: %s", err)
+	}
+	if _, err := io.Copy(io.Discard, responseHttpProcessor.GetReader()); err != nil {
+		return fmt.Errorf("error reading response: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("request mirroring", func() {
+	var listener net.Listener
+	var client *ssh.Client
+	var channels <-chan ssh.NewChannel
+	BeforeEach(func() {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		signer, _ := ssh.NewSignerFromKey(key)
+		config := &ssh.ServerConfig{NoClientAuth: true}
+		config.AddHostKey(signer)
+		var err error
+		listener, err = net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		serverConn := make(chan *sshConnection, 1)
+		go func(listener net.Listener, serverConn chan *sshConnection) {
+			nConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				for newChannel := range chans {
+					newChannel.Reject(ssh.Prohibited, "")
+				}
+			}()
+			serverConn <- newSSHConnection(conn, context.Background())
+		}(listener, serverConn)
+		client, err = ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		Expect(err).To(Not(HaveOccurred()))
+		channels = client.HandleChannelOpen(forwardedTCPChannelType)
+		conn := <-serverConn
+		conn.Permissions = authorizedKey{}.permissions("SHA256:key")
+		sshTunnelListenersLock.Lock()
+		sshTunnelListeners[":8080shadow"] = sshTunnelsListenerData{conn: conn, connectionType: "http",
+			reqPayload: &remoteForwardRequest{BindPort: 8080}}
+		sshTunnelListenersLock.Unlock()
+	})
+	AfterEach(func() {
+		sshTunnelListenersLock.Lock()
+		delete(sshTunnelListeners, ":8080shadow")
+		sshTunnelListenersLock.Unlock()
+		client.Close()
+		listener.Close()
+	})
+
+	It("should send a copy of the request to the shadow tunnel of the same key", func() {
+		bodies := make(chan string, 1)
+		go func() {
+			channel, reqs, err := (<-channels).Accept()
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			defer channel.Close()
+			request, err := http.ReadRequest(bufio.NewReader(channel))
+			if err != nil {
+				return
+			}
+			body, _ := io.ReadAll(request.Body)
+			bodies <- request.Method + " " + request.URL.Path + " " + string(body)
+			channel.Write([]byte("HTTP/1.1 500 Internal Server Error\r\nContent-Length: 4\r\n\r\noops"))
+		}()
+		raw := []byte("POST /orders HTTP/1.1\r\nHost: demo.domain.io\r\nContent-Length: 7\r\n\r\n{\"a\":1}")
+		Expect(sendMirroredRequest(":8080shadow", "SHA256:key", http.MethodPost, raw)).To(Succeed())
+		Expect(<-bodies).To(Equal(`POST /orders {"a":1}`))
+	})
+
+	It("should not mirror requests to tunnels of other keys", func() {
+		raw := []byte("GET / HTTP/1.1\r\nHost: demo.domain.io\r\n\r\n")
+		Expect(sendMirroredRequest(":8080shadow", "SHA256:other", http.MethodGet, raw)).To(MatchError("shadow tunnel is held by another key"))
+		Expect(sendMirroredRequest(":8080shadow", "", http.MethodGet, raw)).To(MatchError("shadow tunnel is held by another key"))
+		Expect(sendMirroredRequest(":8080gone", "SHA256:key", http.MethodGet, raw)).To(MatchError("shadow tunnel is not connected"))
+
+		failed := mirroredRequestsFailed.Value()
+		mirrorRequest(":8080gone", "SHA256:key", http.MethodGet, raw)
+		Eventually(mirroredRequestsFailed.Value).Should(Equal(failed + 1))
+	})
+
+	It("should parse the mirror option", func() {
+		options, err := parseTunnelOptions("type=http,tunnelName=demo,mirror=Demo-Next")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.mirror).To(Equal("demo-next"))
+	})
+})
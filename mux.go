@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Clients that send mux=true get the HTTP requests of their tunnel multiplexed over one long-lived forwarded-tcpip
+// channel instead of a new channel per request, which saves the round trip of opening a channel. Each request is a
+// stream of the channel and every frame starts with a header:
+//
+//	type (1 byte) | stream id (4 bytes) | length (4 bytes)
+//
+// followed by length bytes of payload for muxData frames. Streams are opened by the server and have odd ids; the
+// server resets those opened by the client. Each side may
+// send up to muxWindow bytes of a stream that the other side has not read yet; the reader grants more with
+// muxWindowUpdate frames whose length is the number of bytes read.
+const (
+	muxOpen         byte = iota // Opens a stream
+	muxData                     // Payload of a stream
+	muxWindowUpdate             // Length more bytes can be sent
+	muxClose                    // The sender will not send more data on the stream
+	muxReset                    // The stream is aborted in both directions
+)
+
+const (
+	muxHeaderSize   = 9
+	muxWindow       = 256 << 10
+	muxMaxFrameSize = 32 << 10
+)
+
+var errMuxClosed = errors.New("mux session closed")
+
+// muxSession multiplexes streams over conn, usually an SSH channel.
+type muxSession struct {
+	conn    io.ReadWriteCloser
+	writeMu sync.Mutex // Serializes frames
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	server  bool  // Streams are only opened by the server, which resets those opened by the client
+	err     error // Set once the session is closed
+	accept  chan *muxStream
+	closed  chan struct{}
+}
+
+// newMuxSession starts a session over conn. The server opens streams and clients accept them.
+func newMuxSession(conn io.ReadWriteCloser, server bool) *muxSession {
+	s := &muxSession{
+		conn:    conn,
+		streams: map[uint32]*muxStream{},
+		nextID:  2,
+		server:  server,
+		accept:  make(chan *muxStream, 16),
+		closed:  make(chan struct{}),
+	}
+	if server {
+		s.nextID = 1
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open opens a new stream.
+func (s *muxSession) Open() (net.Conn, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	stream := newMuxStream(s, s.nextID)
+	s.streams[stream.id] = stream
+	s.nextID += 2
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxOpen, stream.id, nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for a stream opened by the other side.
+func (s *muxSession) Accept() (net.Conn, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.closed:
+		return nil, s.err
+	}
+}
+
+// Close closes the session and all of its streams.
+func (s *muxSession) Close() error {
+	s.shutdown(errMuxClosed)
+	return nil
+}
+
+// Closed returns true once the session is closed, for instance because its channel was closed.
+func (s *muxSession) Closed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *muxSession) shutdown(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = map[uint32]*muxStream{}
+	close(s.closed)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, stream := range streams {
+		stream.abort(err)
+	}
+}
+
+func (s *muxSession) writeFrame(frameType byte, id uint32, payload []byte) error {
+	var header [muxHeaderSize]byte
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(payload)))
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err := s.conn.Write(header[:]); err != nil {
+		s.shutdown(err)
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := s.conn.Write(payload); err != nil {
+			s.shutdown(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// writeWindowUpdate grants the other side delta more bytes of stream id.
+func (s *muxSession) writeWindowUpdate(id uint32, delta uint32) error {
+	var header [muxHeaderSize]byte
+	header[0] = muxWindowUpdate
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint32(header[5:9], delta)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err := s.conn.Write(header[:]); err != nil {
+		s.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+func (s *muxSession) recvLoop() {
+	var header [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+			s.shutdown(err)
+			return
+		}
+		frameType, id, length := header[0], binary.BigEndian.Uint32(header[1:5]), binary.BigEndian.Uint32(header[5:9])
+
+		s.mu.Lock()
+		stream := s.streams[id]
+		s.mu.Unlock()
+
+		switch frameType {
+		case muxOpen:
+			if s.server {
+				// Nothing accepts streams on the server, where they would hold up the session once accept is full
+				s.writeFrame(muxReset, id, nil)
+				continue
+			}
+			if stream != nil {
+				s.shutdown(fmt.Errorf("mux stream %d opened twice", id))
+				return
+			}
+			stream = newMuxStream(s, id)
+			s.mu.Lock()
+			s.streams[id] = stream
+			s.mu.Unlock()
+			select {
+			case s.accept <- stream:
+			case <-s.closed:
+				return
+			}
+		case muxData:
+			if length > muxMaxFrameSize {
+				s.shutdown(fmt.Errorf("mux frame of %d bytes too large", length))
+				return
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				s.shutdown(err)
+				return
+			}
+			if stream != nil {
+				discarded, err := stream.receive(payload)
+				if err != nil {
+					s.shutdown(err)
+					return
+				}
+				if discarded {
+					// Closed streams do not read, so the sender would wait for a window update forever
+					s.writeWindowUpdate(id, length)
+				}
+			}
+		case muxWindowUpdate:
+			if stream != nil {
+				stream.grant(length)
+			}
+		case muxClose:
+			if stream != nil {
+				stream.remoteClose()
+			}
+		case muxReset:
+			if stream != nil {
+				stream.abort(io.ErrClosedPipe)
+				s.remove(id)
+			}
+		default:
+			s.shutdown(fmt.Errorf("unknown mux frame type %d", frameType))
+			return
+		}
+	}
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// muxStream is a stream of a muxSession. Deadlines are not supported.
+type muxStream struct {
+	id      uint32
+	session *muxSession
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	recv         bytes.Buffer
+	unacked      uint32 // Bytes read and not granted back to the other side yet
+	sendWindow   uint32
+	remoteClosed bool  // The other side sent muxClose
+	writeClosed  bool  // muxClose was sent
+	localClosed  bool  // Close was called
+	err          error // Set when the stream is aborted
+}
+
+func newMuxStream(session *muxSession, id uint32) *muxStream {
+	stream := &muxStream{id: id, session: session, sendWindow: muxWindow}
+	stream.cond = sync.NewCond(&stream.mu)
+	return stream
+}
+
+// receive buffers payload until it is read. It returns true if payload is discarded because the stream is closed.
+func (c *muxStream) receive(payload []byte) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.recv.Len()+len(payload) > muxWindow {
+		return false, fmt.Errorf("mux stream %d exceeded its window", c.id)
+	}
+	if c.localClosed {
+		return true, nil
+	}
+	c.recv.Write(payload)
+	c.cond.Broadcast()
+	return false, nil
+}
+
+func (c *muxStream) grant(delta uint32) {
+	c.mu.Lock()
+	c.sendWindow += delta
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+func (c *muxStream) remoteClose() {
+	c.mu.Lock()
+	c.remoteClosed = true
+	done := c.localClosed
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	if done {
+		c.session.remove(c.id)
+	}
+}
+
+func (c *muxStream) abort(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+func (c *muxStream) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	for c.recv.Len() == 0 && !c.remoteClosed && c.err == nil && !c.localClosed {
+		c.cond.Wait()
+	}
+	if c.recv.Len() == 0 {
+		defer c.mu.Unlock()
+		if c.remoteClosed {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		return 0, io.ErrClosedPipe
+	}
+	n, _ := c.recv.Read(b)
+	c.unacked += uint32(n)
+	var delta uint32
+	if c.unacked >= muxWindow/2 || c.recv.Len() == 0 {
+		delta, c.unacked = c.unacked, 0
+	}
+	c.mu.Unlock()
+
+	if delta > 0 {
+		c.session.writeWindowUpdate(c.id, delta)
+	}
+	return n, nil
+}
+
+func (c *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		c.mu.Lock()
+		for c.sendWindow == 0 && c.err == nil && !c.writeClosed {
+			c.cond.Wait()
+		}
+		if c.err != nil || c.writeClosed {
+			err := c.err
+			c.mu.Unlock()
+			if err == nil {
+				err = io.ErrClosedPipe
+			}
+			return written, err
+		}
+		n := len(b) - written
+		if n > muxMaxFrameSize {
+			n = muxMaxFrameSize
+		}
+		if uint32(n) > c.sendWindow {
+			n = int(c.sendWindow)
+		}
+		c.sendWindow -= uint32(n)
+		c.mu.Unlock()
+
+		if err := c.session.writeFrame(muxData, c.id, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite tells the other side that no more data will be sent, which it reads as EOF.
+func (c *muxStream) CloseWrite() error {
+	c.mu.Lock()
+	if c.writeClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.writeClosed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return c.session.writeFrame(muxClose, c.id, nil)
+}
+
+// Close closes the stream for writing and discards the data not read yet.
+func (c *muxStream) Close() error {
+	c.mu.Lock()
+	if c.localClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.localClosed = true
+	c.recv.Reset()
+	done := c.remoteClosed || c.err != nil
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if done {
+		c.session.remove(c.id)
+	}
+	return c.CloseWrite()
+}
+
+func (c *muxStream) LocalAddr() net.Addr                { return nil }
+func (c *muxStream) RemoteAddr() net.Addr               { return nil }
+func (c *muxStream) SetDeadline(t time.Time) error      { return nil }
+func (c *muxStream) SetReadDeadline(t time.Time) error  { return nil }
+func (c *muxStream) SetWriteDeadline(t time.Time) error { return nil }
+
+// tunnelMux is the mux session of a tunnel, opened with the first request and again if its channel is closed.
+type tunnelMux struct {
+	mu      sync.Mutex
+	session *muxSession
+}
+
+// Open opens a stream for a request to sshClient. The channel is opened with the origin of the first request.
+func (m *tunnelMux) Open(sshClient sshTunnelsListenerData, originAddr string, originPort int) (net.Conn, error) {
+	m.mu.Lock()
+	if m.session == nil || m.session.Closed() {
+		sshChannel, _, err := openForwardedChannel(sshClient, originAddr, originPort)
+		if err != nil {
+			m.mu.Unlock()
+			return nil, err
+		}
+		m.session = newMuxSession(sshChannel, true)
+	}
+	session := m.session
+	m.mu.Unlock()
+	return session.Open()
+}
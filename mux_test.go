@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("mux", func() {
+	var server, client *muxSession
+
+	BeforeEach(func() {
+		serverConn, clientConn := net.Pipe()
+		server = newMuxSession(serverConn, true)
+		client = newMuxSession(clientConn, false)
+
+		// Echo every stream back until the server closes it
+		go func(client *muxSession) {
+			for {
+				stream, err := client.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					io.Copy(stream, stream)
+				}()
+			}
+		}(client)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		client.Close()
+	})
+
+	It("should relay concurrent streams larger than the window", func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				stream, err := server.Open()
+				Expect(err).To(Not(HaveOccurred()))
+				payload := bytes.Repeat([]byte{byte('a' + i)}, muxWindow*3)
+				go stream.Write(payload)
+
+				echo := make([]byte, len(payload))
+				_, err = io.ReadFull(stream, echo)
+				Expect(err).To(Not(HaveOccurred()))
+				Expect(echo).To(Equal(payload))
+				stream.Close()
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	It("should end the stream of the other side on Close", func() {
+		stream, err := server.Open()
+		Expect(err).To(Not(HaveOccurred()))
+		stream.Write([]byte("ping"))
+		echo := make([]byte, 4)
+		_, err = io.ReadFull(stream, echo)
+		Expect(err).To(Not(HaveOccurred()))
+
+		// The echo ends once the client reads EOF and closes its side
+		Expect(stream.(*muxStream).CloseWrite()).To(Succeed())
+		_, err = stream.Read(echo)
+		Expect(err).To(Equal(io.EOF))
+	})
+
+	It("should reset the streams opened by the client", func() {
+		for i := 0; i < 32; i++ {
+			stream, err := client.Open()
+			Expect(err).To(Not(HaveOccurred()))
+			_, err = stream.Read(make([]byte, 1))
+			Expect(err).To(Equal(io.ErrClosedPipe))
+		}
+
+		// The session still serves the streams of the server
+		stream, err := server.Open()
+		Expect(err).To(Not(HaveOccurred()))
+		stream.Write([]byte("ping"))
+		echo := make([]byte, 4)
+		_, err = io.ReadFull(stream, echo)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(echo)).To(Equal("ping"))
+	})
+
+	It("should fail the streams when the session closes", func() {
+		stream, err := server.Open()
+		Expect(err).To(Not(HaveOccurred()))
+		client.Close()
+		_, err = stream.Read(make([]byte, 1))
+		Expect(err).To(HaveOccurred())
+		_, err = server.Open()
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// File of the regular expressions of the tunnel names that nobody gets, set from a command line flag. Empty disables
+// it.
+var nameDenylistFile string
+
+// Whether tunnel names containing profanity are refused, set from a command line flag.
+var profanityFilter = true
+
+// Compiled expressions of nameDenylistFile. Replaced as a whole when the file is reloaded.
+var nameDenylist atomic.Value
+
+// Words refused by the profanity filter wherever they appear in a tunnel name since the public URL carries the domain
+// of the server. Short words that are part of common words (eg ass in class or cock in peacock) are left to the
+// denylist.
+var profanity = regexp.MustCompile(`fuck|shit|cunt|bitch|whore|slut|nigger|nigga|faggot|porn|pussy|wank|twat|bastard`)
+
+// leetReplacer undoes the common substitutions of letters by digits (eg sh1t) before names are matched.
+var leetReplacer = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "8", "b")
+
+// loadNameDenylist reads nameDenylistFile: one regular expression per line matched against the lowercase tunnel name,
+// anywhere in it unless anchored with ^ and $. Lines starting with # are comments, eg
+//
+//	# Impersonation
+//	^(login|signin|account)s?$
+//	paypal
+func loadNameDenylist() ([]*regexp.Regexp, error) {
+	var denylist []*regexp.Regexp
+	if nameDenylistFile == "" {
+		return denylist, nil
+	}
+	b, err := os.ReadFile(nameDenylistFile)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		expr := strings.TrimSpace(scanner.Text())
+		if expr == "" || strings.HasPrefix(expr, "#") {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression at line %d of %s: %s", line, nameDenylistFile, err)
+		}
+		denylist = append(denylist, re)
+	}
+	return denylist, scanner.Err()
+}
+
+// tunnelNameDenied returns true if name, or name with digits read as the letters they stand for, contains profanity
+// or matches the denylist.
+func tunnelNameDenied(name string) bool {
+	name = strings.ToLower(name)
+	denylist, _ := nameDenylist.Load().([]*regexp.Regexp)
+	for _, candidate := range []string{name, leetReplacer.Replace(name)} {
+		if profanityFilter && profanity.MatchString(candidate) {
+			return true
+		}
+		for _, re := range denylist {
+			if re.MatchString(candidate) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("name denylist", func() {
+	var dir string
+	var previous []*regexp.Regexp
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "nameDenylist")
+		Expect(err).To(Not(HaveOccurred()))
+		nameDenylistFile = filepath.Join(dir, "name_denylist")
+		previous, _ = nameDenylist.Load().([]*regexp.Regexp)
+	})
+	AfterEach(func() {
+		nameDenylistFile = ""
+		profanityFilter = true
+		nameDenylist.Store(previous)
+		os.RemoveAll(dir)
+	})
+
+	It("should deny profanity unless the filter is off", func() {
+		Expect(tunnelNameDenied("myshitapp")).To(BeTrue())
+		Expect(tunnelNameDenied("My-Sh1t-App")).To(BeTrue())
+		Expect(tunnelNameDenied("peacock")).To(BeFalse())
+		Expect(tunnelNameDenied("myapp")).To(BeFalse())
+		profanityFilter = false
+		Expect(tunnelNameDenied("myshitapp")).To(BeFalse())
+	})
+
+	It("should deny the names matching the denylist", func() {
+		os.WriteFile(nameDenylistFile, []byte("# Impersonation\n^(login|signin)s?$\n  paypal  \n\n"), 0o600)
+		denylist, err := loadNameDenylist()
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(denylist).To(HaveLen(2))
+		nameDenylist.Store(denylist)
+
+		Expect(tunnelNameDenied("Login")).To(BeTrue())
+		Expect(tunnelNameDenied("signins")).To(BeTrue())
+		Expect(tunnelNameDenied("login-app")).To(BeFalse())
+		Expect(tunnelNameDenied("my-paypal")).To(BeTrue())
+		Expect(tunnelNameDenied("p4ypal")).To(BeTrue())
+
+		os.WriteFile(nameDenylistFile, []byte("paypal\n(login\n"), 0o600)
+		_, err = loadNameDenylist()
+		Expect(err).To(MatchError(ContainSubstring("invalid expression at line 2")))
+	})
+})
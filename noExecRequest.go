@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long a tcpip-forward request waits for a session channel before the tunnel opens with the default options, as
+// for clients that open none (eg ssh -N -R 80:localhost:3000 domain.io).
+const execRequestWait = 3 * time.Second
+
+// How long a tcpip-forward request waits for the exec request once a session channel is open, which leaves slow links
+// time to send it while a session that never sends one still gets its tunnel.
+const execRequestSessionWait = 30 * time.Second
+
+// defaultExecRequest returns the options of a tunnel whose client sent no exec request: an HTTP tunnel named
+// tunnelName (see defaultTunnelName) at the HTTP ports and the ports HTTP tunnels are served at (httpPort), or else a
+// TCP tunnel.
+func defaultExecRequest(httpPort bool, tunnelName string) string {
+	if !httpPort {
+		return "type=tcp"
+	}
+	return "type=http,tunnelName=" + tunnelName
+}
+
+// defaultTunnelName returns the name of the HTTP tunnel of a client that sends no exec request: the SSH user when it
+// is a valid tunnel name (eg myapp for ssh -N myapp@domain.io), or else a name derived from the session ID. Both are
+// known before the client authenticates, so that the SSH banner tells it its URL (see execBanner).
+func defaultTunnelName(user string, sessionID []byte) string {
+	if user = strings.ToLower(user); tunnelNameValid(user) {
+		return user
+	}
+	tunnelName := make([]rune, tunnelNameLength)
+	sum := sessionID
+	for {
+		hash := sha256.Sum256(sum)
+		sum = hash[:]
+		for i := range tunnelName {
+			tunnelName[i] = charMap[int(sum[i])%36]
+		}
+		if reservedNameAllowed(string(tunnelName), "") && !tunnelNameDenied(string(tunnelName)) {
+			return string(tunnelName)
+		}
+	}
+}
+
+// execBanner returns the SSH banner, which OpenSSH prints on stderr. It holds the URL of the HTTP tunnel opened for
+// clients that send no exec request, as they have no session to be told in. The tunnel gets another name should this
+// one be taken.
+func execBanner(conn ssh.ConnMetadata) string {
+	var port uint32
+	if len(httpBindPorts) > 0 {
+		port = uint32(httpBindPorts[0])
+	}
+	return fmt.Sprintf("Without a command, the HTTP tunnel opens at %s\n", tunnelURL(domainURI, defaultTunnelName(conn.User(), conn.SessionID()), port))
+}
+
+// noSessionChannel stands in for the session channel of a client that sent no exec request. What the server tells the
+// client, such as the tunnel URL, is logged instead; the client learns its URL from the SSH banner (see execBanner).
+type noSessionChannel struct {
+	sessionID string
+}
+
+func newNoSessionChannel(conn *sshConnection) *noSessionChannel {
+	return &noSessionChannel{sessionID: hex.EncodeToString(conn.SessionID())}
+}
+
+func (c *noSessionChannel) Read(data []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *noSessionChannel) Write(data []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		log.Printf("Session %s without exec request: %s", c.sessionID, line)
+	}
+	return len(data), nil
+}
+
+func (c *noSessionChannel) Close() error {
+	return nil
+}
+
+func (c *noSessionChannel) CloseWrite() error {
+	return nil
+}
+
+func (c *noSessionChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, errors.New("no session channel")
+}
+
+func (c *noSessionChannel) Stderr() io.ReadWriter {
+	return c
+}
+
+var _ ssh.Channel = (*noSessionChannel)(nil)
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+// bannerConn stands in for the metadata of a connection that has yet to authenticate.
+type bannerConn struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c bannerConn) User() string {
+	return c.user
+}
+
+func (c bannerConn) SessionID() []byte {
+	return []byte("session")
+}
+
+var _ = Describe("tunnels without an exec request", func() {
+	It("should open HTTP tunnels at the HTTP ports and TCP tunnels elsewhere", func() {
+		Expect(defaultExecRequest(true, "myapp")).To(Equal("type=http,tunnelName=myapp"))
+		Expect(defaultExecRequest(false, "myapp")).To(Equal("type=tcp"))
+	})
+
+	It("should name HTTP tunnels after the SSH user", func() {
+		Expect(defaultTunnelName("MyApp", []byte("session"))).To(Equal("myapp"))
+		Expect(defaultTunnelName("dev.acme", []byte("session"))).To(Equal("dev.acme"))
+	})
+
+	It("should derive the name of HTTP tunnels from the session ID when the SSH user is not a tunnel name", func() {
+		for _, user := range []string{"", "a,type=tcp", "john_doe"} {
+			tunnelName := defaultTunnelName(user, []byte("session"))
+			Expect(tunnelName).To(HaveLen(tunnelNameLength))
+			Expect(tunnelNameValid(tunnelName)).To(BeTrue())
+			Expect(tunnelName).To(Equal(defaultTunnelName("", []byte("session"))))
+		}
+		Expect(defaultTunnelName("", []byte("other session"))).To(Not(Equal(defaultTunnelName("", []byte("session")))))
+	})
+
+	It("should tell the URL of the default HTTP tunnel in the SSH banner", func() {
+		u, _ := url.Parse("https://domain.io")
+		domainURI = *u
+		defer func() { domainURI = url.URL{} }()
+		Expect(execBanner(bannerConn{user: "myapp"})).To(Equal("Without a command, the HTTP tunnel opens at https://myapp.domain.io\n"))
+	})
+
+	It("should stand in for the session channel", func() {
+		channel := &noSessionChannel{sessionID: "abc"}
+		n, err := channel.Write([]byte("https://demo.domain.io\n"))
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(n).To(Equal(23))
+		_, err = channel.Read(make([]byte, 1))
+		Expect(err).To(HaveOccurred())
+		_, err = channel.SendRequest("exit-status", false, nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should end the wait for the exec request once", func() {
+		conn := newSSHConnection(&ssh.ServerConn{}, nil)
+		Expect(conn.ExecWaitOver()).To(Not(BeClosed()))
+		conn.EndExecWait()
+		conn.EndExecWait()
+		Expect(conn.ExecWaitOver()).To(BeClosed())
+
+		// Connections made without newSSHConnection have nothing to close
+		(&sshConnection{}).EndExecWait()
+	})
+
+	It("should tell once that the session channel opened", func() {
+		conn := newSSHConnection(&ssh.ServerConn{}, nil)
+		Expect(conn.SessionOpened()).To(Not(BeClosed()))
+		conn.MarkSessionOpened()
+		conn.MarkSessionOpened()
+		Expect(conn.SessionOpened()).To(BeClosed())
+		(&sshConnection{}).MarkSessionOpened()
+	})
+
+	It("should tell once that the session channel carries no exec request", func() {
+		conn := newSSHConnection(&ssh.ServerConn{}, nil)
+		Expect(conn.NoExecRequest()).To(Not(BeClosed()))
+		conn.MarkNoExecRequest()
+		conn.MarkNoExecRequest()
+		Expect(conn.NoExecRequest()).To(BeClosed())
+		(&sshConnection{}).MarkNoExecRequest()
+	})
+})
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Served at /robots.txt of tunnels created with noindex=true so that crawlers skip temporary URLs.
+const robotsTxt = "User-agent: *\nDisallow: /\n"
+
+// Added to the responses of tunnels created with noindex=true for crawlers that do not honor robots.txt.
+const robotsTag = "noindex, nofollow"
+
+// isRobotsTxtRequest returns true if the request asks for /robots.txt.
+func isRobotsTxtRequest(method string, requestURL string) bool {
+	if method != "GET" && method != "HEAD" {
+		return false
+	}
+	u, err := url.ParseRequestURI(requestURL)
+	return err == nil && u.Path == "/robots.txt"
+}
+
+// writeRobotsTxt writes a robots.txt response disallowing all crawlers.
+func writeRobotsTxt(w io.Writer, method string, server string, requestID string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nX-Robots-Tag: %s\r\nX-Request-Id: %s\r\n", len(robotsTxt), robotsTag, requestID)
+	if server != "" && server != serverHeaderHidden {
+		fmt.Fprintf(&b, "Server: %s\r\n", server)
+	}
+	b.WriteString("\r\n")
+	if method != "HEAD" {
+		b.WriteString(robotsTxt)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("noindex", func() {
+
+	It("should only match GET and HEAD requests for /robots.txt", func() {
+		Expect(isRobotsTxtRequest("GET", "/robots.txt")).To(BeTrue())
+		Expect(isRobotsTxtRequest("HEAD", "/robots.txt?x=1")).To(BeTrue())
+		Expect(isRobotsTxtRequest("POST", "/robots.txt")).To(BeFalse())
+		Expect(isRobotsTxtRequest("GET", "/app/robots.txt")).To(BeFalse())
+	})
+
+	It("should write a robots.txt disallowing all crawlers", func() {
+		var b strings.Builder
+		Expect(writeRobotsTxt(&b, "GET", "", "abc")).To(Succeed())
+		Expect(b.String()).To(HavePrefix("HTTP/1.1 200 OK\r\n"))
+		Expect(b.String()).To(ContainSubstring("\r\nX-Robots-Tag: noindex, nofollow\r\n"))
+		Expect(b.String()).To(HaveSuffix("\r\n\r\n" + robotsTxt))
+
+		b.Reset()
+		Expect(writeRobotsTxt(&b, "HEAD", "", "abc")).To(Succeed())
+		Expect(b.String()).To(HaveSuffix("\r\n\r\n"))
+	})
+})
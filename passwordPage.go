@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Path, under the tunnel URL, to which the password form of tunnels created with password= is posted.
+const passwordPagePath = "/.tunnel/password"
+
+// Cookie letting a visitor in once the password was entered, signed with shareLinkSecret.
+const passwordCookieName = "tunnel_password"
+
+// How long visitors stay in after entering the password.
+const passwordCookieMaxAge = 7 * 24 * time.Hour
+
+// Largest form posted to passwordPagePath.
+const passwordFormMaxBytes = 4096
+
+// passwordPage protects an HTTP tunnel with a password form (password=SECRET), friendlier than HTTP Basic
+// authentication for reviewers of a demo. The password can be a bcrypt hash as for basicAuth.
+type passwordPage struct {
+	password string // Empty with a hash
+	hash     []byte
+}
+
+// parsePasswordPage parses the value of the password option, a password or a bcrypt hash.
+func parsePasswordPage(value string) (*passwordPage, error) {
+	if value == "" {
+		return nil, errors.New("invalid password value, expected a password or a bcrypt hash")
+	}
+	if strings.HasPrefix(value, "$2a$") || strings.HasPrefix(value, "$2b$") || strings.HasPrefix(value, "$2y$") {
+		if _, err := bcrypt.Cost([]byte(value)); err != nil {
+			// The value is not logged as it may be a password
+			return nil, errors.New("invalid password value, the bcrypt hash is malformed")
+		}
+		return &passwordPage{hash: []byte(value)}, nil
+	}
+	return &passwordPage{password: value}, nil
+}
+
+// Allowed returns true if password is the password of the tunnel.
+func (p *passwordPage) Allowed(password string) bool {
+	if p.hash != nil {
+		return bcrypt.CompareHashAndPassword(p.hash, []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(p.password)) == 1
+}
+
+// signature signs the expiry of a cookie of the tunnel tunnelName. Changing the password signs out its visitors.
+func (p *passwordPage) signature(tunnelName string, expiry string) string {
+	mac := hmac.New(sha256.New, []byte(shareLinkSecret))
+	io.WriteString(mac, tunnelName+"\n"+expiry+"\n"+p.password+string(p.hash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Cookie returns the Set-Cookie value letting a visitor in the tunnel tunnelName, for the URLs under path.
+func (p *passwordPage) Cookie(tunnelName string, path string, now time.Time) string {
+	expires := now.Add(passwordCookieMaxAge)
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	value := expiry + "." + p.signature(tunnelName, expiry)
+	return (&http.Cookie{Name: passwordCookieName, Value: value, Path: path, Expires: expires, HttpOnly: true, SameSite: http.SameSiteLaxMode}).String()
+}
+
+// CookieValid returns true if cookies hold an unexpired cookie of the tunnel tunnelName.
+func (p *passwordPage) CookieValid(tunnelName string, cookies []string, now time.Time) bool {
+	request := http.Request{Header: http.Header{"Cookie": cookies}}
+	cookie, err := request.Cookie(passwordCookieName)
+	if err != nil {
+		return false
+	}
+	expiry, signature, found := cut(cookie.Value, ".")
+	if !found {
+		return false
+	}
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || !now.Before(time.Unix(seconds, 0)) {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(p.signature(tunnelName, expiry)))
+}
+
+// passwordRedirect returns where a visitor who entered the password goes: next if it is a path of the tunnel under
+// prefix, or else the tunnel root.
+func passwordRedirect(next string, prefix string) string {
+	if !strings.HasPrefix(next, prefix+"/") || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+		return prefix + "/"
+	}
+	return next
+}
+
+// writePasswordPage writes the password form posting to passwordPagePath under prefix, which leads back to next.
+func writePasswordPage(w io.Writer, server string, requestID string, status string, prefix string, next string, failed bool) error {
+	message := ""
+	if failed {
+		message = "<p style=\"color:#b00\">Wrong password, try again.</p>"
+	}
+	body := fmt.Sprintf(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><meta name="robots" content="noindex"><title>Password required</title></head>
+<body style="font-family:sans-serif;max-width:24em;margin:4em auto">
+<h1>Password required</h1>
+%s<form method="post" action="%s">
+<input type="hidden" name="next" value="%s">
+<input type="password" name="password" autofocus required style="width:100%%;padding:.5em">
+<p><button type="submit">Continue</button></p>
+</form>
+</body></html>
+`, message, html.EscapeString(prefix+passwordPagePath), html.EscapeString(next))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 %s\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nCache-Control: no-store\r\nConnection: close\r\nX-Request-Id: %s\r\n", status, len(body), requestID)
+	if server != "" && server != serverHeaderHidden {
+		fmt.Fprintf(&b, "Server: %s\r\n", server)
+	}
+	b.WriteString("\r\n" + body)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// readPasswordForm returns the password and next fields of a form posted to passwordPagePath.
+func readPasswordForm(request *httpProcessor) (password string, next string, err error) {
+	reader := request.GetReader()
+	// The reader starts with the headers
+	if _, err := io.CopyN(io.Discard, reader, int64(request.bodyStartsIndex)); err != nil {
+		return "", "", err
+	}
+	form, err := io.ReadAll(io.LimitReader(reader, passwordFormMaxBytes))
+	if err != nil {
+		return "", "", err
+	}
+	values, err := url.ParseQuery(string(form))
+	if err != nil {
+		return "", "", err
+	}
+	return values.Get("password"), values.Get("next"), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ = Describe("password page", func() {
+	BeforeEach(func() {
+		shareLinkSecret = "s3cret"
+	})
+
+	It("should parse passwords and bcrypt hashes", func() {
+		p, err := parsePasswordPage("hunter2")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(p.Allowed("hunter2")).To(BeTrue())
+		Expect(p.Allowed("hunter")).To(BeFalse())
+
+		hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+		p, err = parsePasswordPage(string(hash))
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(p.Allowed("hunter2")).To(BeTrue())
+		Expect(p.Allowed("hunter")).To(BeFalse())
+
+		_, err = parsePasswordPage("$2y$05$short")
+		Expect(err).To(MatchError("invalid password value, the bcrypt hash is malformed"))
+		_, err = parseTunnelOptions("type=http,password=")
+		Expect(err).To(MatchError("invalid password value, expected a password or a bcrypt hash"))
+	})
+
+	It("should only accept unexpired cookies of the tunnel and its password", func() {
+		p, _ := parsePasswordPage("hunter2")
+		now := time.Unix(1700000000, 0)
+		setCookie := p.Cookie("demo", "/", now)
+		Expect(setCookie).To(HavePrefix("tunnel_password=1700604800."))
+		Expect(setCookie).To(HaveSuffix("; Path=/; Expires=Tue, 21 Nov 2023 22:13:20 GMT; HttpOnly; SameSite=Lax"))
+		cookie := strings.Split(setCookie, ";")[0]
+
+		Expect(p.CookieValid("demo", []string{"a=b; " + cookie}, now)).To(BeTrue())
+		Expect(p.CookieValid("demo", []string{cookie}, now.Add(passwordCookieMaxAge))).To(BeFalse())
+		Expect(p.CookieValid("other", []string{cookie}, now)).To(BeFalse())
+		Expect(p.CookieValid("demo", nil, now)).To(BeFalse())
+		changed, _ := parsePasswordPage("hunter3")
+		Expect(changed.CookieValid("demo", []string{cookie}, now)).To(BeFalse())
+	})
+
+	It("should only redirect within the tunnel", func() {
+		Expect(passwordRedirect("/page?a=1", "")).To(Equal("/page?a=1"))
+		Expect(passwordRedirect("//evil.com/", "")).To(Equal("/"))
+		Expect(passwordRedirect("https://evil.com/", "")).To(Equal("/"))
+		Expect(passwordRedirect("/myapp/page", "/myapp")).To(Equal("/myapp/page"))
+		Expect(passwordRedirect("/other/page", "/myapp")).To(Equal("/myapp/"))
+	})
+
+	It("should read the posted form", func() {
+		form := "next=%2Fpage&password=p%40ss"
+		request := newHttpProcessor(strings.NewReader("POST /.tunnel/password HTTP/1.1\r\nHost: demo.domain.io\r\n"+
+			"Content-Type: application/x-www-form-urlencoded\r\nContent-Length: 28\r\n\r\n"+form), make([]byte, 4096))
+		request.expectRequest = true
+		password, next, err := readPasswordForm(request)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(password).To(Equal("p@ss"))
+		Expect(next).To(Equal("/page"))
+	})
+})
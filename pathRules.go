@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pathRules limit the URL paths a tunnel exposes using glob patterns where * matches any characters, including /,
+// and ? matches a single character (eg /webhooks/*).
+// A path matching a deny rule is blocked. When there are allow rules, a path must also match one of them.
+type pathRules struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// parsePathGlob compiles glob into an anchored regexp.
+func parsePathGlob(glob string) (*regexp.Regexp, error) {
+	if !strings.HasPrefix(glob, "/") && !strings.HasPrefix(glob, "*") {
+		return nil, fmt.Errorf("invalid path rule %q, expected a path starting with /", glob)
+	}
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	return regexp.Compile("^" + pattern + "$")
+}
+
+// Add adds an allow or deny rule for glob.
+func (r *pathRules) Add(glob string, allow bool) error {
+	pattern, err := parsePathGlob(glob)
+	if err != nil {
+		return err
+	}
+	if allow {
+		r.allow = append(r.allow, pattern)
+	} else {
+		r.deny = append(r.deny, pattern)
+	}
+	return nil
+}
+
+// Empty returns true if every path is allowed.
+func (r pathRules) Empty() bool {
+	return len(r.allow) == 0 && len(r.deny) == 0
+}
+
+// AllowedURL returns true if the rules expose the path of requestURL.
+func (r pathRules) AllowedURL(requestURL string) bool {
+	if r.Empty() {
+		return true
+	}
+	u, err := url.ParseRequestURI(requestURL)
+	if err != nil {
+		return false
+	}
+	return r.Allowed(u.Path)
+}
+
+// Allowed returns true if the rules expose urlPath.
+// The path is cleaned first so that dot segments cannot be used to escape an allowed prefix.
+func (r pathRules) Allowed(urlPath string) bool {
+	if len(r.allow) == 0 && len(r.deny) == 0 {
+		return true
+	}
+	cleaned := path.Clean("/" + urlPath)
+	if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	for _, pattern := range r.deny {
+		if pattern.MatchString(cleaned) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, pattern := range r.allow {
+		if pattern.MatchString(cleaned) {
+			return true
+		}
+	}
+	return false
+}
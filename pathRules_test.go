@@ -0,0 +1,35 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pathRules", func() {
+
+	It("should allow every path without rules", func() {
+		Expect(pathRules{}.Allowed("/anything")).To(BeTrue())
+	})
+
+	It("should only allow paths matching an allow rule", func() {
+		var rules pathRules
+		Expect(rules.Add("/webhooks/*", true)).To(Succeed())
+		Expect(rules.Allowed("/webhooks/github/push")).To(BeTrue())
+		Expect(rules.Allowed("/admin")).To(BeFalse())
+		Expect(rules.Allowed("/webhooks/../admin")).To(BeFalse())
+	})
+
+	It("should block paths matching a deny rule even if allowed", func() {
+		var rules pathRules
+		Expect(rules.Add("/*", true)).To(Succeed())
+		Expect(rules.Add("/admin*", false)).To(Succeed())
+		Expect(rules.Allowed("/admin/users")).To(BeFalse())
+		Expect(rules.Allowed("//admin")).To(BeFalse())
+		Expect(rules.Allowed("/index.html")).To(BeTrue())
+	})
+
+	It("should reject rules that are not paths", func() {
+		var rules pathRules
+		Expect(rules.Add("webhooks", true)).To(HaveOccurred())
+	})
+})
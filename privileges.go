@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Ports below privilegedPortLimit need root or the CAP_NET_BIND_SERVICE capability. When the server lacks it,
+// it listens at the port plus privilegedPortOffset instead (eg 8080 for 80). 0 disables the fallback.
+// This is set from a command line flag.
+var privilegedPortOffset = 8000
+
+const privilegedPortLimit = 1024
+
+// listenTCP listens at addr falling back to a high port when a privileged port cannot be bound.
+func listenTCP(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err == nil || !errors.Is(err, os.ErrPermission) || privilegedPortOffset == 0 {
+		return ln, err
+	}
+	host, portStr, splitErr := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	if splitErr != nil || port == 0 || port >= privilegedPortLimit {
+		return nil, err
+	}
+
+	fallbackAddr := net.JoinHostPort(host, strconv.Itoa(port+privilegedPortOffset))
+	ln, fallbackErr := net.Listen("tcp", fallbackAddr)
+	if fallbackErr != nil {
+		return nil, err
+	}
+	log.Printf("Permission denied listening at %s, listening at %s instead. To listen at port %d, grant the capability with "+
+		"`sudo setcap cap_net_bind_service=+ep tunnel`, start the server as root with --user, use systemd socket activation, "+
+		"or forward port %d to %d.", addr, fallbackAddr, port, port, port+privilegedPortOffset)
+	return ln, nil
+}
+
+// listenUnixHTTP listens at the unix socket path instead of the default HTTP port (eg for a reverse proxy on the
+// same host). A socket file left over by a previous run is replaced.
+func listenUnixHTTP(path string, mode os.FileMode) error {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return err
+	}
+	inheritedListenersLock.Lock()
+	inheritedListeners[systemdHTTPSocket+":"+strconv.Itoa(httpBindPorts[0])] = ln
+	inheritedListenersLock.Unlock()
+	return nil
+}
+
+// prebindHTTPListeners listens at the HTTP ports on all interfaces ahead of the first tunnel, so that the
+// listeners exist before privileges are dropped.
+func prebindHTTPListeners() error {
+	for _, port := range httpBindPorts {
+		name := systemdHTTPSocket + ":" + strconv.Itoa(port)
+		inheritedListenersLock.Lock()
+		_, ok := inheritedListeners[name]
+		inheritedListenersLock.Unlock()
+		if ok {
+			continue
+		}
+		ln, err := listen(systemdHTTPSocket, ":"+strconv.Itoa(port))
+		if err != nil {
+			return err
+		}
+		inheritedListenersLock.Lock()
+		inheritedListeners[name] = ln
+		inheritedListenersLock.Unlock()
+	}
+	return nil
+}
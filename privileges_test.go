@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("privileges", func() {
+	It("should listen for http connections at a unix socket", func() {
+		dir, err := os.MkdirTemp("", "httpSocket")
+		Expect(err).To(Not(HaveOccurred()))
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "http.sock")
+
+		// Left over by a previous run
+		stale, err := net.Listen("unix", path)
+		Expect(err).To(Not(HaveOccurred()))
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		Expect(listenUnixHTTP(path, 0o660)).To(Succeed())
+		ln, err := listen(systemdHTTPSocket, "localhost:80")
+		Expect(err).To(Not(HaveOccurred()))
+		defer ln.Close()
+		Expect(ln.Addr().Network()).To(Equal("unix"))
+
+		info, err := os.Stat(path)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0o660)))
+	})
+})
@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// dropPrivileges is not supported on Windows.
+func dropPrivileges(username string) error {
+	return errors.New("--user is not supported on Windows")
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -17,18 +21,36 @@ import (
 )
 
 const (
-	httpBindPort            = 80
 	forwardedTCPChannelType = "forwarded-tcpip"
+	// Added to requests and responses relayed through HTTP tunnels as required of intermediaries.
+	viaHeader = "1.1 tunnel"
 )
 
-const bufferSize = 32 << 10 // 32 kB buffer.
+// Size of the buffers of bufPool, which also bounds the headers of http requests and responses.
+// This is set from a command line flag before the first buffer is taken.
+var bufferSize = 32 << 10 // 32 kB buffer.
 var bufPool = sync.Pool{
 	New: func() interface{} {
+		bufPoolAllocated.Add(1)
 		buffer := make([]byte, bufferSize)
 		return &buffer
 	},
 }
 
+// getBuffer returns a buffer from bufPool. It must be returned with putBuffer.
+func getBuffer() *[]byte {
+	bufPoolInUse.Add(1)
+	buf := bufPool.Get().(*[]byte)
+	bufferedBytes.Add(int64(len(*buf)))
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	bufPoolInUse.Add(-1)
+	bufferedBytes.Add(-int64(len(*buf)))
+	bufPool.Put(buf)
+}
+
 func forwardHandler(conn *sshConnection, req *ssh.Request, execRequestCompleted chan execRequestCompletedData, cancellationCtx context.Context) (bool, []byte) {
 	var reqPayload remoteForwardRequest
 	if err := ssh.Unmarshal(req.Payload, &reqPayload); err != nil {
@@ -39,53 +61,59 @@ func forwardHandler(conn *sshConnection, req *ssh.Request, execRequestCompleted
 	log.Printf("Session %s started", hex.EncodeToString(conn.SessionID()))
 
 	// Wait for SSH session handler to finish or connection close
-	session := <-execRequestCompleted
+	// Clients such as ssh -N send no exec request: the tunnel gets the default options and what the client would be
+	// told is logged, as it learns its URL from the SSH banner
+	defaultSession := func(reason string) execRequestCompletedData {
+		log.Printf("%s for session %s, opening the tunnel with the default options", reason, hex.EncodeToString(conn.SessionID()))
+		return execRequestCompletedData{channel: newNoSessionChannel(conn), request: defaultExecRequest(isHTTPBindPort(reqPayload.BindPort) ||
+			httpListening(net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))), defaultTunnelName(conn.User(), conn.SessionID()))}
+	}
+	var session execRequestCompletedData
+	select {
+	case session = <-execRequestCompleted:
+	case <-conn.SessionOpened():
+		// The session channel may carry no exec request, such as a tunnel-control subsystem or a session command
+		select {
+		case session = <-execRequestCompleted:
+		case <-conn.NoExecRequest():
+			session = defaultSession("No exec request in the session channel")
+		case <-time.After(execRequestSessionWait):
+			session = defaultSession("No exec request in time")
+		}
+	case <-time.After(execRequestWait):
+		session = defaultSession("No session channel")
+	}
+	conn.EndExecWait()
 	if session.channel == nil {
 		log.Printf("Session %s channel is nil", hex.EncodeToString(conn.SessionID()))
 		return false, []byte{}
 	}
-
 	// Cache channel for communication with client upon receiving HTTP requests
 	conn.SetSessionChannel(&session.channel)
 
 	// For retaining the same tunnelName name in case of an SHH client interruption,
 	// Firstly, the tunnelName must not be taken.
 	// The client must send its tunnelName name via a channel along with an id (id=dhskjdshf24343,tunnelName=tunnel)
-	// TODO: Move to another func
-	cmdParts := strings.Split(session.request, ",")
-	clientID := ""
-	tunnelName := ""
-	header := ""
-	connectionType := ""
-	headerSpecified := false
-
-	for _, p := range cmdParts {
-		p = strings.ToLower(strings.TrimSpace(p))
-		idIndex := strings.Index(p, "id=")
-		tunnelNameIndex := strings.Index(p, "tunnelname=")
-		connTypeIndex := strings.Index(p, "type=")
-		headerIndex := strings.Index(p, "header=")
-
-		if idIndex == 0 {
-			// Found id
-			clientID = p[idIndex+len("id="):]
-		} else if tunnelNameIndex == 0 {
-			// Found tunnelName
-			tunnelName = p[tunnelNameIndex+len("tunnelname="):]
-		} else if connTypeIndex == 0 {
-			// Found connectio type
-			connectionType = p[connTypeIndex+len("type="):]
-
-			if connectionType != "https" && connectionType != "http" && connectionType != "tcp" {
-				log.Printf("invalid connectionType %s", connectionType)
-				return false, []byte(fmt.Sprintf("invalid connectionType %s", connectionType))
-			}
-		} else if headerIndex == 0 {
-			// Found header
-			header = p[headerIndex+len("header="):]
-			headerSpecified = true
+	options, err := parseTunnelOptions(session.request)
+	reply := &sessionReplier{w: session.channel, json: options.json}
+	conn.SetSessionReplier(reply)
+	if err != nil {
+		log.Printf("%s", err)
+		reply.Fail(err.Error())
+		return false, []byte(err.Error())
+	}
+	conn.SetKeepalive(options.keepaliveInterval, options.keepaliveMaxCount)
+	if session.tui != nil && options.sessionLog.format == "" && len(options.sessionLog.fields) == 0 {
+		// The terminal UI lists the requests with their outcome
+		for _, field := range []string{sessionLogMethod, sessionLogPath, sessionLogStatus, sessionLogDuration} {
+			options.sessionLog.AddField(field)
 		}
 	}
+	clientID := options.clientID
+	tunnelName := options.tunnelName
+	header := options.header
+	connectionType := options.connectionType
+	headerSpecified := options.headerSpecified
 
 	if clientID == "" {
 		log.Printf("id empty setting equal to session id %s", hex.EncodeToString(conn.SessionID()))
@@ -100,28 +128,103 @@ func forwardHandler(conn *sshConnection, req *ssh.Request, execRequestCompleted
 
 	// TCP or HTTP?
 	// For TCP, the connection is one-to-one meaning the local listener is exclusively for this SSH client.
-	// For HTTP (port 80/httpBindPort), the connection is shared and thus many-to-one meaning the local listener on server is shared across many HTTP Clients.
+	// For HTTP (port 80/httpBindPorts), the connection is shared and thus many-to-one meaning the local listener on server is shared across many HTTP Clients.
 	if connectionType == "http" || connectionType == "https" {
-		// Mimic ^[a-zA-Z0-9](?!.*--)[a-zA-Z0-9-]+[a-zA-Z0-9]$ as Go does not support lookarounds
+		domain := domainURI
+		if options.domain != "" {
+			var ok bool
+			if domain, ok = findDomain(options.domain); !ok {
+				log.Printf("Domain %s not served", options.domain)
+				reply.Fail(fmt.Sprintf("Domain %s is not served.", options.domain))
+				return false, []byte{}
+			}
+		}
+		if httpBindPortsSet && !isHTTPBindPort(reqPayload.BindPort) {
+			log.Printf("HTTP port %d not served", reqPayload.BindPort)
+			reply.Fail(fmt.Sprintf("HTTP port %d is not served. Use one of %v.", reqPayload.BindPort, httpBindPorts))
+			return false, []byte{}
+		}
+
+		// Initially, I tried using the Go built-in http server instead of peeking through TCP data.
+		// However, that opened a can of wormholes. The default http implementation got in the way, so
+		// I had to hijack the connection which ended up being the same result. In both cases, the TCP connection
+		// is not being re-used. Actually, in the TCP mode (not http/hijacking), it is possible to re-use the connection,
+		// but it requires a decent amount of work to figure out when the request body ended.
+
+		// The shared listener is opened before the tunnel is registered so that a failure only refuses this client
+		httpListener, err := listenHTTP(addr, cancellationCtx)
+		if err != nil {
+			log.Printf("error listening for address %s: %s", addr, err)
+			reply.Fail(fmt.Sprintf("HTTP port %d is unavailable on the server.", reqPayload.BindPort))
+			return false, []byte{}
+		}
+
+		// The path segment of a tunnel routed by path is its tunnel name, so path= gets the same checks as tunnelName=
+		nameOption := "tunnelName"
+		if options.path != "" {
+			if routing == routingSubdomain {
+				reply.Warn("The path option is ignored as tunnels are routed by subdomain")
+			} else {
+				tunnelName, nameOption = options.path, "path"
+			}
+		}
+
+		mirrorValid := options.mirror == "" || tunnelNameValid(options.mirror)
+		// Mimic ^[a-zA-Z0-9](?!.*--)[a-zA-Z0-9-]+[a-zA-Z0-9]$ as Go does not support lookarounds, for each label of
+		// nested names
 		tunnelNameValid := tunnelNameValid(tunnelName)
+		if tunnelNameValid && !tunnelNameServedOn(tunnelName, domain) {
+			tunnelNameValid = false
+		}
 
 		if tunnelName != "" && !tunnelNameValid {
-			log.Printf("Specified tunnelName '%s' not valid", tunnelName)
-			io.WriteString(session.channel, fmt.Sprintf("Specified tunnelName '%s' not valid\n", tunnelName))
+			log.Printf("Specified %s '%s' not valid", nameOption, tunnelName)
+			reply.Warn(fmt.Sprintf("Specified %s '%s' not valid", nameOption, tunnelName))
 		}
 
-		var err error
 		tunnelNameTakenOrInvalid := false
+		// Existing group of clients sharing the tunnel name to join
+		var group *tunnelGroup
+		// Tunnel of the same client id taken over by this connection (see takeOverTunnel)
+		var replaced sshTunnelsListenerData
+		takeover := false
+		// Serve the tunnel of another client once it disconnects (standby=true)
+		standby := false
+		fingerprint := conn.Fingerprint()
 
 		sshTunnelListenersLock.Lock()
+		unavailable := ""
 		if tunnelNameValid {
+			unavailable = tunnelNameUnavailable(addr, tunnelName, clientID, fingerprint)
+		}
+		if unavailable != "" {
+			log.Printf("Specified %s '%s' %s", nameOption, tunnelName, unavailable)
+			tunnelNameTakenOrInvalid = true
+			reply.Warn(fmt.Sprintf("Specified %s '%s' %s", nameOption, tunnelName, unavailable))
+		} else if tunnelNameValid {
 			s, ok := sshTunnelListeners[addr+tunnelName]
 			if ok && s.clientID == clientID {
 				log.Printf("Discarding existing tunnelName cache for same client id %s", clientID)
 				tunnelNameTakenOrInvalid = false
+				group = s.group
+				replaced, takeover = s, s.group == nil
+			} else if ok && s.group != nil && s.group.shared && options.shared {
+				log.Printf("Joining shared tunnelName %s", tunnelName)
+				group = s.group
+			} else if ok && options.standby && s.conn.Fingerprint() == fingerprint {
+				log.Printf("Standing by for tunnelName %s", tunnelName)
+				standby = true
+				group = s.group
+				if group == nil {
+					group = newTunnelGroup(stickyNone)
+					s.group = group
+					group.Add(s)
+					sshTunnelListeners[addr+tunnelName] = s
+				}
+				reply.Warn(fmt.Sprintf("Standing by for %s '%s' until its client disconnects", nameOption, tunnelName))
 			} else if ok && s.clientID != clientID {
 				tunnelNameTakenOrInvalid = true
-				io.WriteString(session.channel, fmt.Sprintf("Specified tunnelName '%s' already taken\n", tunnelName))
+				reply.Warn(fmt.Sprintf("Specified %s '%s' already taken", nameOption, tunnelName))
 			}
 		} else {
 			tunnelNameTakenOrInvalid = true
@@ -135,6 +238,8 @@ func forwardHandler(conn *sshConnection, req *ssh.Request, execRequestCompleted
 					return false, []byte("error generating tunnelName")
 				}
 				_, tunnelNameTakenOrInvalid = sshTunnelListeners[addr+tunnelName]
+				tunnelNameTakenOrInvalid = tunnelNameTakenOrInvalid || clusterTunnelName(tunnelName) || !reservations.Allowed(httpReservationKey(addr, tunnelName), fingerprint) ||
+					peerTunnelHeld(addr+tunnelName, "")
 			} else {
 				break
 			}
@@ -144,6 +249,7 @@ func forwardHandler(conn *sshConnection, req *ssh.Request, execRequestCompleted
 		log.Printf("using tunnelName %s", tunnelName)
 
 		conn.SetTunnelName(tunnelName)
+		current := settings()
 		sshListenerData := sshTunnelsListenerData{
 			conn:           conn,
 			reqPayload:     &reqPayload,
@@ -151,127 +257,212 @@ func forwardHandler(conn *sshConnection, req *ssh.Request, execRequestCompleted
 			clientID:       clientID,
 			hostHeader:     nil,
 			connectionType: connectionType,
+			breaker:        newCircuitBreaker(current.breakerThreshold, current.breakerCooldown),
+			stats:          newTunnelStats(options.maxConns),
+			rewriteRules:   options.rewriteRules,
+			pathRules:      options.pathRules,
+			basicAuth:      options.basicAuth,
+			passwordPage:   options.passwordPage,
+			allowIPs:       options.allowIPs,
+			private:        options.private,
+			internal:       options.internal,
+			shareLink:      options.shareLink > 0,
+			serverHeader:   current.serverHeader,
+			noindex:        options.noindex,
+			har:            options.har,
+			sessionLog:     options.sessionLog,
+			domain:         domain,
+			standby:        standby,
+			weight:         defaultTunnelWeight,
+
+			preserveHeaderCase: options.preserveHeaderCase,
+		}
+		if options.cache {
+			sshListenerData.cache = newResponseCache()
+		}
+		if options.healthCheck != "" {
+			sshListenerData.health = newTunnelHealth(options.healthCheck)
+		}
+		if options.mux {
+			sshListenerData.mux = &tunnelMux{}
+		} else if channelPoolSize > 0 {
+			listenerData := sshListenerData
+			sshListenerData.channels = newChannelPool(channelPoolSize, func() (ssh.Channel, <-chan struct{}, error) {
+				return openForwardedChannel(listenerData, "127.0.0.1", int(listenerData.reqPayload.BindPort))
+			})
+		}
+		if options.serverSpecified {
+			sshListenerData.serverHeader = options.server
+		}
+		if options.weightSpecified {
+			sshListenerData.weight = options.weight
+		}
+		if options.mirror != "" && (!mirrorValid || options.mirror == tunnelName) {
+			reply.Warn(fmt.Sprintf("Specified mirror '%s' not valid", options.mirror))
+		} else if options.mirror != "" {
+			sshListenerData.mirror = options.mirror
+			reply.Warn(fmt.Sprintf("Requests are mirrored to %s while it is open with the same key", tunnelURL(domain, options.mirror, reqPayload.BindPort)))
 		}
 		if headerSpecified {
 			sshListenerData.hostHeader = &header
 		}
 
-		sshTunnelListeners[addr+tunnelName] = sshListenerData
-
-		sshTunnelListenersLock.Unlock()
-
-		if domainPath {
-			io.WriteString(session.channel, fmt.Sprintf("%s/%s\n", domainURL, tunnelName))
+		if group == nil && options.shared {
+			group = newTunnelGroup(options.sticky)
+			group.shared = true
+		}
+		if group != nil {
+			sshListenerData.group = group
+			replaced, takeover = group.Add(sshListenerData)
+			sshTunnelListeners[addr+tunnelName], _ = group.Primary()
 		} else {
-			io.WriteString(session.channel, fmt.Sprintf("%s://%s.%s\n", domainURI.Scheme, tunnelName, domainURI.Hostname()))
+			sshTunnelListeners[addr+tunnelName] = sshListenerData
 		}
-
-		log.Printf("Received tcpip-forward for session %s started", hex.EncodeToString(conn.SessionID()))
-
-		// Initially, I tried using the Go built-in http server instead of peeking through TCP data.
-		// However, that opened a can of wormholes. The default http implementation got in the way, so
-		// I had to hijack the connection which ended up being the same result. In both cases, the TCP connection
-		// is not being re-used. Actually, in the TCP mode (not http/hijacking), it is possible to re-use the connection,
-		// but it requires a decent amount of work to figure out when the request body ended.
-
-		// Does the single HTTP listener already exist?
-		forwardsLock.Lock()
-		var httpListener net.Listener
-		httpListenerObject, ok := forwards[addr]
-		if !ok {
-			var err error
-			httpListener, err = net.Listen("tcp", addr)
-			if err != nil {
-				forwardsLock.Unlock()
-				log.Fatalf("error listening for address %s: %s", addr, err)
-				return false, []byte{}
+		reservations.Open(httpReservationKey(addr, tunnelName), fingerprint)
+		if takeover && replaced.conn != nil && replaced.conn != conn {
+			// Requests now go to this connection, including those for the other names of the old one
+			for _, alias := range replaced.conn.GetTunnelAliases() {
+				removeTunnelAlias(addr+alias, replaced.sessionID)
 			}
-			// Add this SSH client to the listeners list of HTTP
-			// Keep http listener available until app shuts down.
-			forwards[addr] = forwardsListenerData{listener: httpListener, conType: HTTPConnectionType}
-		} else {
-			httpListener = httpListenerObject.listener
+			replaced.channels.Close()
+			go takeOverTunnel(replaced.conn, replaced.stats)
 		}
-		forwardsLock.Unlock()
+		activity.Publish(&activityEvent{Type: eventTunnelOpen, TunnelName: tunnelName, ConnectionType: connectionType})
 
-		// Only execute this the first time we open an HTTP listener
-		if !ok {
-			go func() {
-				for {
-					// Accept new connections from HTTP here
-					httpConnection, err := httpListener.Accept()
-					if err != nil {
-						select {
-						case <-cancellationCtx.Done():
-							log.Println("Http listener: Cancellation requested")
-							return
-						default:
-						}
-						log.Printf("error accepting new HTTP connections at %s: %s", httpListener.Addr(), err)
-						continue
-					}
+		sshTunnelListenersLock.Unlock()
 
-					go handleHttpConnection(httpConnection, addr)
-				}
-			}()
+		fallbackURL := ""
+		if routing == routingBoth {
+			fallbackURL = tunnelPathURL(domain, tunnelName, reqPayload.BindPort)
 		}
+		reply.OpenedHTTP(connectionType, tunnelURL(domain, tunnelName, reqPayload.BindPort), fallbackURL, tunnelName, reqPayload.BindPort)
+		if session.tui != nil {
+			session.tui.Opened(tunnelURL(domain, tunnelName, reqPayload.BindPort), sshListenerData.stats)
+		}
+		if options.internal {
+			reply.Warn(privateTunnelNotice())
+		}
+		if options.shareLink > 0 {
+			reply.Warn(fmt.Sprintf("Visitors need the share link, valid for %s: %s", options.shareLink,
+				shareLinkURL(tunnelURL(domain, tunnelName, reqPayload.BindPort), tunnelName, fingerprint, options.shareLink)))
+		}
+		if options.idleTimeout > 0 {
+			go closeIdleTunnel(conn, sshListenerData.stats, options.idleTimeout, reply)
+		}
+		if maxAge := conn.MaxTunnelAge(); maxAge > 0 {
+			reply.Warn(fmt.Sprintf("The tunnel closes after %s.", maxAge))
+			go closeExpiredTunnel(conn, maxAge, reply)
+		}
+		if options.probe {
+			tunnel := sshListenerData
+			conn.SetTunnelProbe(func() { probeTunnel(tunnel, reply) })
+		}
+		if sshListenerData.health != nil {
+			go runHealthChecks(sshListenerData, session.channel)
+		}
+
+		log.Printf("Received tcpip-forward for session %s started", hex.EncodeToString(conn.SessionID()))
 
 		// Local listening address on server (eg localhost:80)
 		_, destPortStr, _ := net.SplitHostPort(httpListener.Addr().String())
 		destPort, _ := strconv.Atoi(destPortStr)
+		if destPort == 0 {
+			// Unix socket
+			destPort = int(reqPayload.BindPort)
+		}
 
 		return true, ssh.Marshal(&remoteForwardSuccess{uint32(destPort)})
 	} else {
 
 		var ln net.Listener
 		var err error
+		var stats *tunnelStats
 		forwardsLock.Lock()
-		// If port already taken and is the same client, take over.
+		// If port already taken and is the same client, take over. Otherwise the client is told why the port is
+		// unavailable, unless it asked for a free port instead (port 0 or port-fallback=true).
 		requestBindPort := int(reqPayload.BindPort)
-
-		// 0 means allocate a random port
-		if requestBindPort == 0 {
-			// Find the 1st available port above 1000
-			for p := 1000; p <= 1<<16; p++ {
-				addr = net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(p))
-				if _, ok := forwards[addr]; !ok {
-					requestBindPort = p
-					reqPayload.BindPort = uint32(p)
-					break
-				}
-			}
-		}
+		// Port of the channels to the client, which only knows the port it asked for unless it asked for port 0
+		channelPort := requestBindPort
 
 		o, ok := forwards[addr]
-		if !ok || o.clientID == clientID {
-			// Port not taken by taken same client
+		switch {
+		case requestBindPort == 0:
+			// 0 means allocate a free port
+			err = errTCPPortTaken
+		case isHTTPBindPort(uint32(requestBindPort)) || ok && o.conType == HTTPConnectionType:
+			err = fmt.Errorf("TCP port %d is reserved for HTTP tunnels", requestBindPort)
+		case ok && o.clientID != clientID:
+			err = errTCPPortTaken
+		case !ok && !reservations.Allowed(tcpReservationKey(addr), conn.Fingerprint()):
+			err = errTCPPortReserved
+		default:
+			// Port not taken or taken by the same client
 			// create a new listener
-			if o.clientID == clientID {
+			if ok {
 				log.Printf("Discarding existing tunnelName cache for same client id %s", clientID)
 				o.listener.Close()
+				if o.conn != nil && o.conn != conn {
+					go takeOverTunnel(o.conn, o.stats)
+				}
 			}
-
 			ln, err = net.Listen("tcp", addr)
-			if err != nil {
-				log.Printf("error listening for TCP address %s: %s", addr, err)
-				forwardsLock.Unlock()
-				return false, []byte{}
+		}
+		if err != nil && (requestBindPort == 0 || options.portFallback) {
+			if requestBindPort != 0 {
+				log.Printf("TCP port %d is unavailable (%s), falling back to a free port", requestBindPort, err)
 			}
-			forwards[addr] = forwardsListenerData{listener: ln, clientID: clientID, sessionID: hex.EncodeToString(conn.SessionID()), conType: TCPConnectionType}
-		} else {
-			// Port taken
-			io.WriteString(session.channel, fmt.Sprintf("TCP port %d is already taken.\n", reqPayload.BindPort))
+			if freeLn, port, freeErr := listenFreeTCPPort(reqPayload.BindAddr, requestBindPort+1); freeErr == nil {
+				ln, err = freeLn, nil
+				if requestBindPort == 0 {
+					channelPort = port
+				}
+				requestBindPort = port
+				reqPayload.BindPort = uint32(port)
+				addr = net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(port))
+			} else if requestBindPort == 0 {
+				err = freeErr
+			}
+		}
+		if err != nil {
+			log.Printf("error listening for TCP address %s: %s", addr, err)
+			reply.Fail(tcpPortUnavailable(reqPayload.BindAddr, requestBindPort, err))
 			forwardsLock.Unlock()
+			// The client exits with an error instead of waiting without a tunnel
+			go exitTunnelSession(conn, 1)
 			return false, []byte{}
 		}
+
+		forwards[addr] = forwardsListenerData{listener: ln, clientID: clientID, sessionID: hex.EncodeToString(conn.SessionID()), conType: TCPConnectionType,
+			fingerprint: conn.Fingerprint(), stats: newTunnelStats(options.maxConns), conn: conn}
+		stats = forwards[addr].stats
+		reservations.Open(tcpReservationKey(addr), forwards[addr].fingerprint)
+		activity.Publish(&activityEvent{Type: eventTunnelOpen, TunnelName: addr, ConnectionType: string(TCPConnectionType)})
 		forwardsLock.Unlock()
 
 		// Write server host:port to the SSH client.
-		io.WriteString(session.channel, fmt.Sprintf("%s:%d\n", domainURI.Hostname(), requestBindPort))
+		reply.OpenedTCP(domainURI.Hostname(), requestBindPort)
+		if session.tui != nil {
+			session.tui.Opened(fmt.Sprintf("tcp://%s", net.JoinHostPort(domainURI.Hostname(), strconv.Itoa(requestBindPort))), stats)
+		}
+		if options.internal {
+			reply.Warn(privateTunnelNotice())
+		}
+		if options.idleTimeout > 0 {
+			go closeIdleTunnel(conn, stats, options.idleTimeout, reply)
+		}
+		if maxAge := conn.MaxTunnelAge(); maxAge > 0 {
+			reply.Warn(fmt.Sprintf("The tunnel closes after %s.", maxAge))
+			go closeExpiredTunnel(conn, maxAge, reply)
+		}
+		if options.probe {
+			tunnel := sshTunnelsListenerData{conn: conn, sessionID: hex.EncodeToString(conn.SessionID()), connectionType: string(TCPConnectionType),
+				reqPayload: &remoteForwardRequest{BindAddr: reqPayload.BindAddr, BindPort: uint32(channelPort)}}
+			conn.SetTunnelProbe(func() { probeTunnel(tunnel, reply) })
+		}
 
 		go func() {
 			for {
-				// Listen to local port N (ie other than httpBindPort)
+				// Listen to local port N (ie other than httpBindPorts)
 				tcpConnection, err := ln.Accept()
 				if err != nil {
 					select {
@@ -283,27 +474,76 @@ func forwardHandler(conn *sshConnection, req *ssh.Request, execRequestCompleted
 					log.Printf("error accepting new TCP connection at %s: %s", ln.Addr(), err)
 					break
 				}
-				_, destPortStr, _ := net.SplitHostPort(ln.Addr().String())
-				destPort, _ := strconv.Atoi(destPortStr)
+				if tcpTunnelPaused(ln.Addr().(*net.TCPAddr).Port) {
+					log.Printf("Rejecting TCP connection from %s to paused TCP tunnel %s", tcpConnection.RemoteAddr(), addr)
+					tcpConnection.Close()
+					continue
+				}
+				if options.internal && !internalVisitor(tcpConnection.RemoteAddr()) {
+					log.Printf("Visitor %s is not internal for private TCP tunnel %s", tcpConnection.RemoteAddr(), addr)
+					privateTunnelVisitorsRejected.Add(1)
+					tcpConnection.Close()
+					continue
+				}
+				if !options.allowIPs.Allowed(tcpConnection.RemoteAddr()) {
+					log.Printf("Visitor %s is not allowed by TCP tunnel %s", tcpConnection.RemoteAddr(), addr)
+					tcpConnection.Close()
+					continue
+				}
+				if overMemoryBudget() {
+					log.Printf("Memory budget exceeded, rejecting TCP connection from %s", tcpConnection.RemoteAddr())
+					tcpConnection.Close()
+					continue
+				}
+				if !publicConnections.Acquire() {
+					log.Printf("Too many connections, rejecting TCP connection from %s", tcpConnection.RemoteAddr())
+					tcpConnection.Close()
+					continue
+				}
+				if !stats.AcquireConnection() {
+					log.Printf("Too many connections to TCP tunnel %s, rejecting connection from %s", addr, tcpConnection.RemoteAddr())
+					tcpConnection.Close()
+					publicConnections.Release()
+					continue
+				}
+				// Abandoned connections are closed
+				tcpConnection = trackIdle(tcpConnection, connectionIdleTimeout)
 
 				originAddr, orignPortStr, _ := net.SplitHostPort(tcpConnection.RemoteAddr().String())
 				originPort, _ := strconv.Atoi(orignPortStr)
 				payload := ssh.Marshal(&remoteForwardChannelData{
 					DestAddr:   reqPayload.BindAddr,
-					DestPort:   uint32(destPort),
+					DestPort:   uint32(channelPort),
 					OriginAddr: originAddr,
 					OriginPort: uint32(originPort),
 				})
 
 				go func() {
-					io.WriteString(session.channel, fmt.Sprintf("Received tcp request from %s\n", tcpConnection.RemoteAddr().String()))
+					if line := options.sessionLog.ReceivedTCP(tcpConnection.RemoteAddr().String()); line != "" {
+						io.WriteString(session.channel, line)
+					}
 					ch, reqs, err := conn.OpenChannel(forwardedTCPChannelType, payload)
 					if err != nil {
 						log.Printf("error opening %s SSH channel: %s", forwardedTCPChannelType, err)
 						tcpConnection.Close()
+						stats.ReleaseConnection()
+						publicConnections.Release()
 						return
 					}
 					go ssh.DiscardRequests(reqs)
+					stats.Begin()
+					var wg sync.WaitGroup
+					var bytesIn, bytesOut int64
+					wg.Add(2)
+					go func() {
+						wg.Wait()
+						ch.Close()
+						tcpConnection.Close()
+						stats.End(bytesIn, bytesOut)
+						stats.ReleaseConnection()
+						publicConnections.Release()
+					}()
+					// Each direction is half-closed when it ends so that the other one goes on (see copyHalf)
 					go func() {
 						defer func() {
 							if r := recover(); r != nil {
@@ -311,11 +551,10 @@ func forwardHandler(conn *sshConnection, req *ssh.Request, execRequestCompleted
 							}
 						}()
 
-						defer ch.Close()
-						defer tcpConnection.Close()
-						buf := bufPool.Get().(*[]byte)
-						defer bufPool.Put(buf)
-						io.CopyBuffer(ch, tcpConnection, *buf)
+						defer wg.Done()
+						buf := getBuffer()
+						defer putBuffer(buf)
+						bytesIn = copyHalf(ch, tcpConnection, *buf)
 					}()
 					go func() {
 						defer func() {
@@ -324,21 +563,23 @@ func forwardHandler(conn *sshConnection, req *ssh.Request, execRequestCompleted
 							}
 						}()
 
-						defer ch.Close()
-						defer tcpConnection.Close()
-						buf := bufPool.Get().(*[]byte)
-						defer bufPool.Put(buf)
-						io.CopyBuffer(tcpConnection, ch, *buf)
+						defer wg.Done()
+						buf := getBuffer()
+						defer putBuffer(buf)
+						bytesOut = copyHalf(tcpConnection, ch, *buf)
 					}()
 				}()
 			}
 
+			activity.Publish(&activityEvent{Type: eventTunnelClose, TunnelName: addr, ConnectionType: string(TCPConnectionType)})
+
 			forwardsLock.Lock()
 			o, ok := forwards[addr]
 			if ok && o.sessionID == hex.EncodeToString(conn.SessionID()) {
 				log.Printf("Closing TCP listener for session %s", hex.EncodeToString(conn.SessionID()))
 				delete(forwards, addr)
 				o.listener.Close()
+				reservations.Close(tcpReservationKey(addr), o.fingerprint)
 			}
 			forwardsLock.Unlock()
 		}()
@@ -350,8 +591,11 @@ func forwardHandler(conn *sshConnection, req *ssh.Request, execRequestCompleted
 }
 
 func handleHttpConnection(httpConnection net.Conn, addr string) {
-	httpBuf := bufPool.Get().(*[]byte)
-	defer bufPool.Put(httpBuf)
+	// Abandoned connections are closed
+	idleHttpConnection := trackIdle(httpConnection, connectionIdleTimeout)
+	httpConnection = idleHttpConnection
+	httpBuf := getBuffer()
+	defer putBuffer(httpBuf)
 	defer httpConnection.Close()
 	hadPreviousRequests := false
 
@@ -361,18 +605,37 @@ func handleHttpConnection(httpConnection net.Conn, addr string) {
 		}
 	}()
 
+	// Reused across the requests on the TCP connection
+	httpProcessor := getHttpProcessor(httpConnection, *httpBuf)
+	defer putHttpProcessor(httpProcessor)
+	// Requests are read through deadline so that slow clients are dropped
+	deadline := &requestDeadline{conn: httpConnection}
+
+	// The connection counts against the tunnel of its last request (see tunnelStats.AcquireConnection)
+	var tunnelConnection *tunnelStats
+	defer func() {
+		if tunnelConnection != nil {
+			tunnelConnection.ReleaseConnection()
+		}
+	}()
+
 	for {
 		log.Printf("Waiting for a new http request on TCP connection")
 
-		// TODO: Reuse httpProcessor across multiple requests on the same TCP connection
-		httpProcessor := newHttpProcessor(httpConnection, *httpBuf)
+		// Correlates the request across the server logs, the client and error pages
+		requestID := newRequestID()
+		requestLog := log.WithField("requestID", requestID)
+
+		deadline.Wait(!hadPreviousRequests)
+		httpProcessor.Reset(deadline, *httpBuf)
+		httpProcessor.expectRequest = true
 
 		// Extract http request headers to get tunnelName
 		var tunnelName string
 		var host string
 		var path string
 		var err error
-		if domainPath {
+		if routing == routingPath {
 			path, err = httpProcessor.GetURLPath()
 		} else {
 			host, err = httpProcessor.GetHost()
@@ -380,37 +643,82 @@ func handleHttpConnection(httpConnection net.Conn, addr string) {
 		if err != nil && hadPreviousRequests && (err == io.EOF || strings.HasSuffix(err.Error(), ": EOF") ||
 			strings.Contains(err.Error(), "use of closed network connection")) {
 			// Expected error client only wanted one request
-			log.Printf("Request TCP connection terminated")
+			requestLog.Printf("Request TCP connection terminated")
+			return
+		}
+		if isTimeout(err) {
+			if httpProcessor.bufWritePos > 0 {
+				requestLog.Printf("rejecting http request: headers not received within %s", headerTimeout)
+				writeErrorResponse(httpConnection, settings().serverHeader, requestID, "408 Request Timeout", "The request headers took too long.")
+			} else {
+				requestLog.Printf("Request TCP connection idle, closing it")
+			}
+			return
+		}
+		deadline.Done()
+		requestLog.Printf("Http request started")
+		// In both mode, requests for a subdomain are routed by host and the others by path.
+		pathRouted := routing == routingPath
+		if routing == routingBoth && (err == nil || errors.Is(err, errMissingHost)) {
+			domain := requestDomain(host)
+			if _, subdomainErr := extractSubdomain(host, domain.Hostname()); err != nil || subdomainErr != nil {
+				pathRouted = true
+				path, err = httpProcessor.GetURLPath()
+			}
+		}
+		useDefaultTunnel := false
+		if !pathRouted && errors.Is(err, errMissingHost) && settings().defaultTunnelName != "" {
+			useDefaultTunnel, err = true, nil
+		}
+		if errors.Is(err, errHeadersTooLarge) {
+			requestLog.Printf("rejecting http request: %s", err)
+			writeErrorResponse(httpConnection, settings().serverHeader, requestID, "431 Request Header Fields Too Large", "Request headers are too large.")
+			httpConnection.Close()
+
+			return
+		}
+		if errors.Is(err, errMalformedRequest) {
+			requestLog.Printf("rejecting http request: %s", err)
+			writeErrorResponse(httpConnection, settings().serverHeader, requestID, "400 Bad Request", "Malformed request.")
+			httpConnection.Close()
+
 			return
 		}
-		log.Printf("Http request started")
 		if err != nil {
-			if domainPath {
-				log.Printf("could not find URL path: %s", err)
-				io.WriteString(httpConnection, "HTTP/1.1 400 Bad Request\r\nContent-Type:text/html\r\n\r\nCould not find a valid URL path.")
+			if pathRouted {
+				requestLog.Printf("could not find URL path: %s", err)
+				writeErrorResponse(httpConnection, settings().serverHeader, requestID, "400 Bad Request", "Could not find a valid URL path.")
 
 			} else {
-				log.Printf("could not find Host header: %s", err)
-				io.WriteString(httpConnection, "HTTP/1.1 400 Bad Request\r\nContent-Type:text/html\r\n\r\nCould not find a valid Host.")
+				requestLog.Printf("could not find Host header: %s", err)
+				writeErrorResponse(httpConnection, settings().serverHeader, requestID, "400 Bad Request", "Could not find a valid Host.")
 			}
 			httpConnection.Close()
 
 			return
 		}
-		if domainPath {
-			tunnelName, err = extractTunnelNameFromURLPath(path, domainURI)
+		// Domain the request arrived on
+		if pathRouted {
+			host, _ = httpProcessor.GetHost()
+		}
+		domain := requestDomain(host)
+		if pathRouted {
+			tunnelName, err = extractTunnelNameFromURLPath(path, domain)
 
+		} else if useDefaultTunnel {
+			requestLog.Printf("No Host in http request, using default tunnelName %q", settings().defaultTunnelName)
+			tunnelName = settings().defaultTunnelName
 		} else {
-			tunnelName, err = extractSubdomain(host, domainURI.Host)
+			tunnelName, err = extractSubdomain(host, domain.Hostname())
 		}
 		if err != nil {
-			if domainPath {
-				log.Printf("could not find URL path: %s", err)
-				io.WriteString(httpConnection, "HTTP/1.1 400 Bad Request\r\nContent-Type:text/html\r\n\r\nCould not find a valid URL path.")
+			if pathRouted {
+				requestLog.Printf("could not find URL path: %s", err)
+				writeErrorResponse(httpConnection, settings().serverHeader, requestID, "400 Bad Request", "Could not find a valid URL path.")
 
 			} else {
-				log.Printf("could not find Host header: %s", err)
-				io.WriteString(httpConnection, "HTTP/1.1 400 Bad Request\r\nContent-Type:text/html\r\n\r\nCould not find a valid Host.")
+				requestLog.Printf("could not find Host header: %s", err)
+				writeErrorResponse(httpConnection, settings().serverHeader, requestID, "400 Bad Request", "Could not find a valid Host.")
 			}
 			httpConnection.Close()
 
@@ -420,140 +728,584 @@ func handleHttpConnection(httpConnection net.Conn, addr string) {
 		hadPreviousRequests = true
 		if _, ok := httpProcessor.GetContentLength(); !ok {
 			// Invalid content-length
-			io.WriteString(httpConnection, "HTTP/1.1 400 Bad Request\r\nContent-Type:text/html\r\n\r\nInvalid Content-Length header.")
+			writeErrorResponse(httpConnection, settings().serverHeader, requestID, "400 Bad Request", "Invalid Content-Length header.")
 			httpConnection.Close()
 
 			return
 		}
 
-		log.Printf("Incoming http request from %s", httpConnection.RemoteAddr())
+		// Requests relayed by another node of the cluster come from the visitor and are not relayed again
+		visitor, relayed := clusterRelayedRequest(httpProcessor)
+		if relayed {
+			httpConnection = newRelayedConn(httpConnection, visitor)
+		}
+
+		requestLog.Printf("Incoming http request from %s", httpConnection.RemoteAddr())
 
-		log.Printf("Found tunnelName %q in http request", tunnelName)
+		requestLog.Printf("Found tunnelName %q in http request", tunnelName)
 
+		sshTunnelListenersLock.Lock()
 		sshClient, ok := sshTunnelListeners[addr+tunnelName]
+		sshTunnelListenersLock.Unlock()
+		if ok && !useDefaultTunnel && sshClient.domain.Hostname() != domain.Hostname() {
+			// Tunnels are only served on their own domain
+			ok = false
+		}
+		if target, isCluster := clusterTunnelTarget(tunnelName); !ok && isCluster {
+			requestLog.Printf("Relaying http request for tunnelName %s to service %s", tunnelName, target)
+			// The relay copies from the underlying connection, where the activity cannot be seen
+			idleHttpConnection.Stop()
+			if err := relayToCluster(idleHttpConnection.Conn, httpProcessor, target); err != nil {
+				requestLog.Printf("error relaying to service %s: %s", target, err)
+				writeErrorResponse(httpConnection, settings().serverHeader, requestID, "502 Bad Gateway", "The service is not responding.")
+			}
+			return
+		}
+		if target, isPeer := peerTunnelTarget(addr+tunnelName, addr); !ok && !relayed && isPeer {
+			requestLog.Printf("Relaying http request for tunnelName %s to cluster node %s", tunnelName, target)
+			idleHttpConnection.Stop()
+			if err := relayToPeer(idleHttpConnection.Conn, httpProcessor, target, httpConnection.RemoteAddr().String()); err != nil {
+				requestLog.Printf("error relaying to cluster node %s: %s", target, err)
+				writeErrorResponse(httpConnection, settings().serverHeader, requestID, "502 Bad Gateway", "The tunnel is not responding.")
+			}
+			return
+		}
+		if !ok && reservations.Reconnecting(httpReservationKey(addr, tunnelName)) {
+			// The name is still held for its key, whose client is likely on its way back
+			requestLog.Printf("tunnelName %s is reconnecting", tunnelName)
+			writeErrorResponse(httpConnection, settings().serverHeader, requestID, "503 Service Unavailable", "This tunnel is reconnecting, try again in a few seconds.",
+				fmt.Sprintf("Retry-After: %d", reconnectingRetryAfter))
+			httpConnection.Close()
+
+			return
+		}
 		if !ok {
-			log.Printf("no listeners found for the tunnelName %s", tunnelName)
-			io.WriteString(httpConnection, "HTTP/1.1 400 Bad Request\r\nContent-Type:text/html\r\n\r\nNo listeners found.")
+			requestLog.Printf("no listeners found for the tunnelName %s", tunnelName)
+			writeErrorResponse(httpConnection, settings().serverHeader, requestID, "400 Bad Request", "No listeners found.")
 			httpConnection.Close()
 
 			return
 		}
+		requestStart := time.Now()
+		visitorURI := httpProcessor.requestRawURI
+		// Pick the client that serves this visitor when the tunnel is shared.
+		var affinityCookie string
+		if sshClient.group != nil {
+			visitorIP, _, _ := net.SplitHostPort(httpConnection.RemoteAddr().String())
+			if sshClient, affinityCookie, ok = sshClient.group.Pick(visitorIP, httpProcessor.headerValues("Cookie")); !ok {
+				requestLog.Printf("No client left for tunnelName %s", tunnelName)
+				writeErrorResponse(httpConnection, settings().serverHeader, requestID, "503 Service Unavailable", "The tunnel has no client left, try again in a few seconds.",
+					fmt.Sprintf("Retry-After: %d", reconnectingRetryAfter))
+				httpConnection.Close()
+
+				return
+			}
+		}
+		if sshClient.stats != tunnelConnection {
+			if tunnelConnection != nil {
+				tunnelConnection.ReleaseConnection()
+				tunnelConnection = nil
+			}
+			if !sshClient.stats.AcquireConnection() {
+				requestLog.Printf("Too many connections to tunnelName %s", tunnelName)
+				writeErrorResponse(httpConnection, sshClient.serverHeader, requestID, "503 Service Unavailable", "The tunnel has too many connections.", "Retry-After: 1")
+				return
+			}
+			tunnelConnection = sshClient.stats
+		}
 		sessionChannel := sshClient.conn.GetSessionChannel()
-		if sessionChannel != nil {
-			io.WriteString(*sessionChannel, fmt.Sprintf("Received http request from %s\n", httpConnection.RemoteAddr().String()))
+		if line := sshClient.sessionLog.Received(requestID, httpConnection.RemoteAddr().String()); sessionChannel != nil && line != "" {
+			io.WriteString(*sessionChannel, line)
 		}
 		sshReqPayload := sshClient.reqPayload
 		if sshReqPayload == nil {
-			log.Printf("no SSH clients found for the tunnelName %s", tunnelName)
-			io.WriteString(httpConnection, "HTTP/1.1 400 Bad Request\r\nContent-Type:text/html\r\n\r\nNo SSH client found.")
+			requestLog.Printf("no SSH clients found for the tunnelName %s", tunnelName)
+			writeErrorResponse(httpConnection, sshClient.serverHeader, requestID, "400 Bad Request", "No SSH client found.")
 			httpConnection.Close()
 
 			return
 		}
 		conn := sshClient.conn
 
+		if name := conn.GetTunnelName(); tunnelPaused(tunnelName) || (name != nil && tunnelPaused(*name)) {
+			requestLog.Printf("Request to paused tunnelName %s", tunnelName)
+			writeErrorResponse(httpConnection, sshClient.serverHeader, requestID, "503 Service Unavailable", "This tunnel is paused by the administrator.")
+			httpConnection.Close()
+
+			return
+		}
+		if sshClient.internal && !internalVisitor(httpConnection.RemoteAddr()) {
+			// Same response as an unknown tunnel so that public visitors do not learn of it
+			requestLog.Printf("Visitor %s is not internal for private tunnelName %s", httpConnection.RemoteAddr(), tunnelName)
+			privateTunnelVisitorsRejected.Add(1)
+			writeErrorResponse(httpConnection, settings().serverHeader, requestID, "400 Bad Request", "No listeners found.")
+			httpConnection.Close()
+
+			return
+		}
+		if !sshClient.allowIPs.Allowed(httpConnection.RemoteAddr()) {
+			requestLog.Printf("Visitor %s is not allowed by tunnelName %s", httpConnection.RemoteAddr(), tunnelName)
+			writeErrorResponse(httpConnection, sshClient.serverHeader, requestID, "403 Forbidden", "Your IP address is not allowed to use this tunnel.")
+			httpConnection.Close()
+
+			return
+		}
+		if sshClient.basicAuth != nil {
+			if authorization, _ := httpProcessor.header("Authorization"); !sshClient.basicAuth.Allowed(authorization) {
+				requestLog.Printf("Unauthorized request to tunnelName %s", tunnelName)
+				writeErrorResponse(httpConnection, sshClient.serverHeader, requestID, "401 Unauthorized", "This tunnel requires a user name and password.", basicAuthChallenge)
+				httpConnection.Close()
+
+				return
+			}
+			// The credentials are for the tunnel, not the local server
+			httpProcessor.RemoveHeader("Authorization")
+		}
+		// Path prefix of requests routed by path (eg /myapp for domain.io/myapp), stripped from the request URL and
+		// given to the backend in X-Forwarded-Prefix so that it can build its links
+		pathPrefix := ""
+		if pathRouted {
+			pathPrefix = strings.TrimSuffix(domain.Path, "/") + "/" + tunnelName
+			httpProcessor.RemoveHeader("X-Forwarded-Prefix")
+			httpProcessor.AddHeader("X-Forwarded-Prefix", pathPrefix)
+		}
+		if sshClient.passwordPage != nil && !sshClient.passwordPage.CookieValid(tunnelName, httpProcessor.headerValues("Cookie"), time.Now()) {
+			// Visitors get the password form until they enter the password, which sets a cookie letting them in
+			status, next, failed := "401 Unauthorized", httpProcessor.requestRawURI, false
+			if path, _, _ := cut(httpProcessor.requestRawURI, "?"); httpProcessor.requestMethod == "POST" && path == pathPrefix+passwordPagePath {
+				password, formNext, err := readPasswordForm(httpProcessor)
+				next = passwordRedirect(formNext, pathPrefix)
+				if err == nil && sshClient.passwordPage.Allowed(password) {
+					requestLog.Printf("Password entered for tunnelName %s", tunnelName)
+					writeErrorResponse(httpConnection, sshClient.serverHeader, requestID, "303 See Other", "",
+						"Location: "+next, "Set-Cookie: "+sshClient.passwordPage.Cookie(tunnelName, pathPrefix+"/", time.Now()))
+					httpConnection.Close()
+
+					return
+				}
+				failed = true
+			}
+			requestLog.Printf("Request without the password to tunnelName %s", tunnelName)
+			writePasswordPage(httpConnection, sshClient.serverHeader, requestID, status, pathPrefix, next, failed)
+			httpConnection.Close()
+
+			return
+		}
+		// Set-Cookie keeping the token of a share link the visitor just followed
+		var shareCookie string
+		if sshClient.shareLink {
+			token, requestURI, fromQuery := shareLinkRequestToken(httpProcessor.requestRawURI, httpProcessor.headerValues("Cookie"))
+			// The link is signed for the key of the client that shared it, any of them when the tunnel is shared
+			owners := []sshTunnelsListenerData{sshClient}
+			if sshClient.group != nil {
+				owners = sshClient.group.Members()
+			}
+			var expires time.Time
+			ok := false
+			for _, owner := range owners {
+				if expires, ok = shareLinkExpiry(tunnelName, owner.conn.Fingerprint(), token, time.Now()); ok {
+					break
+				}
+			}
+			if !ok {
+				requestLog.Printf("Request without a valid share link to tunnelName %s", tunnelName)
+				writeErrorResponse(httpConnection, sshClient.serverHeader, requestID, "403 Forbidden", "This link has expired or is not valid.")
+				httpConnection.Close()
+
+				return
+			}
+			if fromQuery {
+				// The token is for the tunnel, not the local server
+				httpProcessor.replaceHttpRequestURL(requestURI)
+				shareCookie = shareLinkCookie(token, expires, pathPrefix+"/")
+			}
+		}
+
+		if sshClient.preserveHeaderCase {
+			httpProcessor.PreserveHeaderCase()
+		}
 		if sshClient.hostHeader != nil {
-			log.Printf("Setting Host header to %q", *sshClient.hostHeader)
+			requestLog.Printf("Setting Host header to %q", *sshClient.hostHeader)
 			httpProcessor.SetHostHeader(*sshClient.hostHeader)
 		}
 
 		httpProcessor.ReadHeadersIfNeeded()
-		if httpProcessor.request {
+		// Requests of tunnels that rewrite nothing are relayed with their request line as is
+		passThrough := sshClient.hostHeader == nil && !pathRouted && len(sshClient.rewriteRules) == 0 && !sshClient.noindex &&
+			sshClient.pathRules.Empty() && !httpProcessor.isAbsoluteForm()
+		if httpProcessor.request && !passThrough {
+
+			newURL, _ := replaceRequestURL(httpProcessor.requestRawURI, sshClient.hostHeader, pathPrefix)
+			if !sshClient.pathRules.AllowedURL(newURL) {
+				if !sshClient.private {
+					requestLog.Printf("Path %q is not exposed by tunnelName %s", httpProcessor.requestRawURI, tunnelName)
+				}
+				writeErrorResponse(httpConnection, sshClient.serverHeader, requestID, "403 Forbidden", "This path is not exposed by the tunnel.")
+				httpConnection.Close()
 
-			newURL, _ := replaceRequestURL(httpProcessor.requestRawURI, sshClient.hostHeader, domainURI.Path+"/"+tunnelName)
+				return
+			}
+			if sshClient.noindex && isRobotsTxtRequest(httpProcessor.requestMethod, newURL) {
+				requestLog.Debugf("Serving robots.txt for tunnelName %s", tunnelName)
+				io.Copy(io.Discard, httpProcessor.GetReader())
+				if err := writeRobotsTxt(httpConnection, httpProcessor.requestMethod, sshClient.serverHeader, requestID); err != nil {
+					requestLog.Debugf("error writing robots.txt: %s", err)
+					return
+				}
+				httpProcessor.Close()
+				continue
+			}
+			if len(sshClient.rewriteRules) > 0 {
+				newURL, _ = rewriteRequestURL(newURL, sshClient.rewriteRules)
+			}
+			if httpProcessor.isAbsoluteForm() {
+				// Proxy-style request: send the origin-form to the client backend and carry the host in the Host header instead.
+				newURL = originForm(newURL)
+				if sshClient.hostHeader == nil {
+					if _, ok := httpProcessor.header("Host"); ok {
+						httpProcessor.replaceHeader("Host", httpProcessor.URL.Host)
+					} else {
+						httpProcessor.AddHeader("Host", httpProcessor.URL.Host)
+					}
+				}
+			}
 			if newURL != httpProcessor.requestRawURI {
-				log.Debugf("Adjusting http request URL from %q to %q", httpProcessor.requestRawURI, newURL)
+				requestLog.Debugf("Adjusting http request URL from %q to %q", httpProcessor.requestRawURI, newURL)
 				httpProcessor.replaceHttpRequestURL(newURL)
 			}
 		}
 
-		originAddr, orignPortStr, _ := net.SplitHostPort(httpConnection.RemoteAddr().String())
-		originPort, _ := strconv.Atoi(orignPortStr)
-		payload := ssh.Marshal(&remoteForwardChannelData{
-			DestAddr:   sshReqPayload.BindAddr,
-			DestPort:   uint32(httpBindPort),
-			OriginAddr: originAddr,
-			OriginPort: uint32(originPort),
-		})
+		httpProcessor.StripHopByHopHeaders()
+		httpProcessor.AddHeader("Via", viaHeader)
+		httpProcessor.RemoveHeader("X-Request-Id")
+		httpProcessor.AddHeader("X-Request-Id", requestID)
+
+		// Serve fresh GET/HEAD responses from the tunnel cache if enabled.
+		var cacheKey string
+		if sshClient.cache != nil && requestCacheable(httpProcessor) {
+			cacheKey = responseCacheKey(httpProcessor.requestMethod, httpProcessor.requestRawURI)
+			if cached, ok := sshClient.cache.Get(cacheKey); ok {
+				requestLog.Debugf("Serving %q from cache", cacheKey)
+				io.Copy(io.Discard, httpProcessor.GetReader())
+				if err := cached.Write(httpConnection, httpProcessor); err != nil {
+					requestLog.Debugf("error writing cached response: %s", err)
+					return
+				}
+				httpProcessor.Close()
+				continue
+			}
+		}
 
-		sshChannel, reqs, err := conn.OpenChannel(forwardedTCPChannelType, payload)
+		if !sshClient.health.Healthy() {
+			requestLog.Printf("Health checks failing for tunnelName %s", tunnelName)
+			writeErrorResponse(httpConnection, sshClient.serverHeader, requestID, "503 Service Unavailable", "The tunnel backend is unhealthy.", fmt.Sprintf("Retry-After: %d", retryAfterSeconds(healthCheckInterval)))
+			httpConnection.Close()
 
-		if err != nil {
+			return
+		}
+
+		if !sshClient.breaker.Allow() {
+			requestLog.Printf("Circuit breaker open for tunnelName %s", tunnelName)
+			writeErrorResponse(httpConnection, sshClient.serverHeader, requestID, "503 Service Unavailable", "The tunnel backend is not responding.", fmt.Sprintf("Retry-After: %d", int(settings().breakerCooldown.Seconds())))
 			httpConnection.Close()
 
-			log.Printf("error opening %s channel: %s", forwardedTCPChannelType, err)
 			return
 		}
 
-		// If the client specified "https", wrap the connection with tls.
-		// Need to wrap sshChannel with net.Conn methods.
-		var sshChannelConn net.Conn
+		originAddr, orignPortStr, _ := net.SplitHostPort(httpConnection.RemoteAddr().String())
+		originPort, _ := strconv.Atoi(orignPortStr)
 
-		if sshClient.connectionType == "https" {
-			// No need to verify TLS chain as the user manually requested it and to allow self-signed certificates to work.
-			// Also, this improves performance.
-			sshChannelConn = tls.Client(newSSHChannelConnection(&sshChannel, conn.cancellationCtx), &tls.Config{InsecureSkipVerify: true})
+		latency := latencyMetrics.Get(tunnelName)
+		channelOpenStart := time.Now()
+		sshChannelConn, err := openTunnelChannel(sshClient, originAddr, originPort)
+		latency.ChannelOpen.Observe(time.Since(channelOpenStart))
+		if err != nil {
+			requestLog.Printf("error opening %s channel: %s", forwardedTCPChannelType, err)
+			channelOpenFailures.Add(1)
+			recordUpstreamFailure(sshClient, tunnelName)
+			writeErrorResponse(httpConnection, sshClient.serverHeader, requestID, "502 Bad Gateway", "The tunnel client did not accept the request.")
+			httpConnection.Close()
 
-		} else {
-			// http
-			sshChannelConn = newSSHChannelConnection(&sshChannel, conn.cancellationCtx)
+			return
+		}
+		idleHttpConnection.CloseWith(sshChannelConn)
+
+		// Keep a copy of the request as sent to the client so that it can be replayed later.
+		requestReader := httpProcessor.GetReader()
+		var capture *captureBuffer
+		if requestCaptures != nil && !sshClient.private {
+			capture = &captureBuffer{max: captureMaxBytes}
+			requestReader = io.TeeReader(requestReader, capture)
+		}
+		// Copy of the request for the shadow tunnel, if small enough (see mirrorMaxBytes)
+		var mirror *captureBuffer
+		if sshClient.mirror != "" && !httpProcessor.IsUpgrade() {
+			mirror = &captureBuffer{max: mirrorMaxBytes}
+			requestReader = io.TeeReader(requestReader, mirror)
+		}
+		var harRequest, harResponse *captureBuffer
+		if sshClient.har {
+			limits := settings()
+			harRequest = &captureBuffer{max: limits.maxHeaderBytes + limits.harMaxBodyBytes}
+			harResponse = &captureBuffer{max: limits.maxHeaderBytes + limits.harMaxBodyBytes}
+			requestReader = io.TeeReader(requestReader, harRequest)
 		}
 
 		// Remote http connection underlying TCP socket closed remotely
 		remoteTCPConnectionClose := false
+		// Bytes of the request copied to the client, and the error of the visitor going away while sending it
+		var requestBytes int64
+		var requestErr error
+		// Bytes and status of the response copied back from the client, and the error reading its headers
+		var responseBytes int64
+		var responseStatus int
+		var responseErr error
+		// Time until the response headers arrived and whether the response is streamed (see slowRequestReasons)
+		var ttfb time.Duration
+		var streaming bool
+		var responseCapture *captureBuffer
+		if cacheKey != "" {
+			responseCapture = &captureBuffer{max: cacheMaxEntryBytes}
+		}
+		var continueResponder *continueResponder
+		if httpProcessor.ExpectsContinue() {
+			continueResponder = newContinueResponder(httpConnection, expectContinueTimeout)
+		}
+		sshClient.stats.Begin()
 		var wg sync.WaitGroup
 		wg.Add(2)
-		go ssh.DiscardRequests(reqs)
 		go func() {
 			defer func() {
 				if r := recover(); r != nil {
-					log.Debugf("Recovered from %s", r)
+					requestLog.Debugf("Recovered from %s", r)
 				}
 			}()
 
 			defer wg.Done()
-			buf := bufPool.Get().(*[]byte)
-			defer bufPool.Put(buf)
+			buf := getBuffer()
+			defer putBuffer(buf)
 
-			n, err := io.CopyBuffer(sshChannelConn, httpProcessor.GetReader(), *buf)
+			n, err := io.CopyBuffer(sshChannelConn, requestReader, *buf)
 			if err != nil {
-				log.Debugf("error copying to SSH channel: %s", err)
+				requestLog.Debugf("error copying to SSH channel: %s", err)
 			}
-			log.Debugf("Copied %v bytes from http request to SSH channel", n)
+			requestBytes, requestErr = n, err
+			requestLog.Debugf("Copied %v bytes from http request to SSH channel", n)
 
 		}()
 		go func() {
 			defer func() {
 				if r := recover(); r != nil {
-					log.Debugf("Recovered from %s", r)
+					requestLog.Debugf("Recovered from %s", r)
 				}
 			}()
 
 			defer wg.Done()
-			buf := bufPool.Get().(*[]byte)
-			defer bufPool.Put(buf)
-			buf2 := bufPool.Get().(*[]byte)
-			defer bufPool.Put(buf2)
+			buf := getBuffer()
+			defer putBuffer(buf)
+			buf2 := getBuffer()
+			defer putBuffer(buf2)
 
 			defer sshChannelConn.Close()
 			// Wrap sshChannel as well to avoid calling .Read multiple times. Otherwise, this will block.
 			sshChannelWrapper := &eofReader{r: sshChannelConn}
-			responseHttpProcessor := newHttpProcessor(sshChannelWrapper, *buf2)
+			responseHttpProcessor := getHttpProcessor(sshChannelWrapper, *buf2)
+			defer putHttpProcessor(responseHttpProcessor)
 			responseHttpProcessor.requestMethod = httpProcessor.requestMethod
-			n, err := io.CopyBuffer(httpConnection, responseHttpProcessor.GetReader(), *buf)
+			responseHttpProcessor.preserveHeaderCase = sshClient.preserveHeaderCase
+			err := responseHttpProcessor.ReadHeadersIfNeeded()
+			responseErr = err
+			continueResponder.Responded()
+			if err == nil {
+				ttfb = time.Since(requestStart)
+			}
+			if errors.Is(err, errHeadersTooLarge) {
+				// Drop the channel and the visitor connection since the rest of the response cannot be relayed.
+				requestLog.Printf("rejecting http response: %s", err)
+				writeErrorResponse(httpConnection, sshClient.serverHeader, requestID, "502 Bad Gateway", "The tunnel backend response headers are too large.")
+				remoteTCPConnectionClose = true
+				return
+			}
+
+			// Relay interim responses (eg 100 Continue) and wait for the final response on the same channel.
+			for responseHttpProcessor.IsInterimResponse() {
+				n, err := io.CopyBuffer(httpConnection, responseHttpProcessor.GetReader(), *buf)
+				responseBytes += n
+				if err != nil {
+					requestLog.Debugf("error copying interim response from SSH channel: %s", err)
+					break
+				}
+				unread := responseHttpProcessor.UnreadBuffer()
+				responseHttpProcessor.Reset(io.MultiReader(bytes.NewReader(unread), sshChannelWrapper), *buf2)
+				responseHttpProcessor.requestMethod = httpProcessor.requestMethod
+				responseHttpProcessor.preserveHeaderCase = sshClient.preserveHeaderCase
+				responseHttpProcessor.ReadHeadersIfNeeded()
+			}
+
+			responseHttpProcessor.StripHopByHopHeaders()
+			responseHttpProcessor.AddHeader("Via", viaHeader)
+			applyServerHeader(responseHttpProcessor, sshClient.serverHeader)
+			if location, _ := responseHttpProcessor.header("Location"); pathPrefix != "" && location != "" {
+				// Redirects of backends unaware of the path prefix stay within the tunnel
+				if prefixed := prefixLocation(location, pathPrefix, host); prefixed != location {
+					responseHttpProcessor.replaceHeader("Location", prefixed)
+				}
+			}
+			if sshClient.noindex {
+				responseHttpProcessor.AddHeader("X-Robots-Tag", robotsTag)
+			}
+			responseStatus = responseHttpProcessor.responseStatusCode
+			if responseStatus == http.StatusSwitchingProtocols {
+				idleHttpConnection.SetTimeout(websocketIdleTimeout)
+			}
+			if affinityCookie != "" {
+				responseHttpProcessor.AddHeader("Set-Cookie", (&http.Cookie{Name: affinityCookieName, Value: affinityCookie, Path: "/", HttpOnly: true}).String())
+			}
+			if shareCookie != "" {
+				responseHttpProcessor.AddHeader("Set-Cookie", shareCookie)
+			}
+			// Event streams and long-poll responses stay open for as long as the backend keeps writing.
+			// Never cut them off with a deadline nor hold them back for the cache; each Read is written out as it arrives.
+			if responseHttpProcessor.IsStreamingResponse() {
+				requestLog.Debugf("Streaming http response")
+				streaming = true
+				httpConnection.SetDeadline(time.Time{})
+				responseCapture = nil
+			}
+			responseReader := responseHttpProcessor.GetReader()
+			if responseCapture != nil {
+				responseReader = io.TeeReader(responseReader, responseCapture)
+			}
+			if harResponse != nil {
+				responseReader = io.TeeReader(responseReader, harResponse)
+			}
+			n, err := io.CopyBuffer(httpConnection, responseReader, *buf)
 			if err != nil {
-				log.Debugf("error copying from SSH channel: %s", err)
+				requestLog.Debugf("error copying from SSH channel: %s", err)
+			}
+			responseBytes += n
+
+			if responseCapture != nil && !responseCapture.truncated && n > 0 {
+				if ttl, ok := responseFreshness(responseHttpProcessor); ok {
+					cached := &cachedResponse{raw: responseCapture.Bytes(), expires: time.Now().Add(ttl)}
+					if etag, ok := responseHttpProcessor.header("Etag"); ok {
+						cached.etag = etag
+					}
+					sshClient.cache.Set(cacheKey, cached)
+				}
 			}
-			log.Debugf("Copied %v bytes from SSH channel to http response", n)
+			requestLog.Debugf("Copied %v bytes from SSH channel to http response", n)
 			remoteTCPConnectionClose = sshChannelWrapper.EOF
 			if remoteTCPConnectionClose {
-				log.Debugln("remote TCP connection closed")
+				requestLog.Debugln("remote TCP connection closed")
 			}
 
 		}()
 		wg.Wait()
+		idleHttpConnection.CloseWith(nil)
+		sshClient.stats.End(requestBytes, responseBytes)
+
+		// A backend that resets or closes the connection without responding, or that times out, counts as a failure.
+		// Visitors that go away before the response do not, so that they cannot trip the breaker of a healthy tunnel.
+		if responseErr == nil {
+			sshClient.breaker.Success()
+			if responseStatus >= 500 {
+				sshClient.stats.errors.Add(1)
+			}
+		} else if requestErr == nil {
+			recordUpstreamFailure(sshClient, tunnelName)
+		}
 
-		log.Printf("Http request ended")
+		if capture != nil {
+			requestCaptures.Add(&capturedRequest{
+				time:        time.Now(),
+				cacheKey:    addr + tunnelName,
+				tunnelName:  tunnelName,
+				fingerprint: conn.Permissions.Extensions["pubkey-fp"],
+				method:      httpProcessor.requestMethod,
+				uri:         httpProcessor.requestRawURI,
+				raw:         capture.Bytes(),
+				truncated:   capture.truncated,
+			})
+		}
+		if mirror != nil && !mirror.truncated && mirror.Len() > 0 {
+			mirrorRequest(addr+sshClient.mirror, conn.Fingerprint(), httpProcessor.requestMethod, mirror.Bytes())
+		} else if mirror != nil {
+			mirroredRequestsFailed.Add(1)
+		}
+
+		duration := time.Since(requestStart)
+		if ttfb > 0 {
+			latency.TTFB.Observe(ttfb)
+		}
+		latency.Duration.Observe(duration)
+		if reasons := slowRequestReasons(ttfb, duration, streaming); len(reasons) > 0 {
+			for _, reason := range reasons {
+				slowRequests.Add(reason, 1)
+			}
+			if !sshClient.private {
+				requestLog.Printf("Slow http request %s %s on tunnelName %s: time to first byte %s, duration %s",
+					httpProcessor.requestMethod, visitorURI, tunnelName, ttfb, duration)
+			}
+		}
+
+		if harRequest != nil {
+			harCaptures.Add(tunnelName, &harRecord{
+				started:  requestStart,
+				duration: time.Since(requestStart),
+				scheme:   domain.Scheme,
+				request:  harRequest.Bytes(),
+				response: harResponse.Bytes(),
+
+				truncated: harResponse.truncated,
+			})
+		}
+
+		// Private tunnels (inspect=false) only count their requests in the tunnel stats and aggregate metrics
+		if !sshClient.private {
+			activity.Publish(&activityEvent{
+				Type:       eventRequest,
+				TunnelName: tunnelName,
+				RequestID:  requestID,
+				Method:     httpProcessor.requestMethod,
+				URI:        visitorURI,
+				Status:     responseStatus,
+				BytesIn:    requestBytes,
+				BytesOut:   responseBytes,
+				DurationMs: time.Since(requestStart).Milliseconds(),
+			})
+
+			remoteAddr, _, _ := net.SplitHostPort(httpConnection.RemoteAddr().String())
+			referer, _ := httpProcessor.header("Referer")
+			userAgent, _ := httpProcessor.header("User-Agent")
+			entry := &accessLogEntry{
+				Time:       requestStart,
+				RequestID:  requestID,
+				TunnelName: tunnelName,
+				RemoteAddr: remoteAddr,
+				Method:     httpProcessor.requestMethod,
+				URI:        visitorURI,
+				Proto:      httpProcessor.requestProto,
+				Status:     responseStatus,
+				Bytes:      responseBytes,
+				Referer:    referer,
+				UserAgent:  userAgent,
+				Duration:   duration,
+			}
+			if line := sshClient.sessionLog.Ended(entry); sessionChannel != nil && line != "" {
+				io.WriteString(*sessionChannel, line)
+			}
+			if logShipping != nil {
+				logShipping.ShipAccessLog(entry)
+			}
+			if accessLogs != nil {
+				if err := accessLogs.Log(entry); err != nil {
+					requestLog.Printf("error writing access log: %s", err)
+				}
+			}
+		}
+
+		requestLog.Printf("Http request ended")
 
 		if remoteTCPConnectionClose {
 			// Do not wait for additional incoming HTTP requests by closing client/incoming TCP connection
@@ -564,34 +1316,265 @@ func handleHttpConnection(httpConnection net.Conn, addr string) {
 	}
 }
 
+// listenHTTP returns the listener of the public HTTP connections at addr, which is opened and served the first time
+// and kept open until the server shuts down.
+func listenHTTP(addr string, cancellationCtx context.Context) (net.Listener, error) {
+	forwardsLock.Lock()
+	var httpListener net.Listener
+	httpListenerObject, ok := forwards[addr]
+	if ok && httpListenerObject.conType != HTTPConnectionType {
+		forwardsLock.Unlock()
+		return nil, fmt.Errorf("%s is taken by a TCP tunnel", addr)
+	}
+	if !ok {
+		var err error
+		httpListener, err = listen(systemdHTTPSocket, addr)
+		if err != nil {
+			forwardsLock.Unlock()
+			return nil, err
+		}
+		// Add this SSH client to the listeners list of HTTP
+		// Keep http listener available until app shuts down.
+		forwards[addr] = forwardsListenerData{listener: httpListener, conType: HTTPConnectionType}
+	} else {
+		httpListener = httpListenerObject.listener
+	}
+	forwardsLock.Unlock()
+
+	// Only execute this the first time we open an HTTP listener
+	if !ok {
+		go func() {
+			for {
+				// Accept new connections from HTTP here
+				httpConnection, err := httpListener.Accept()
+				if err != nil {
+					select {
+					case <-cancellationCtx.Done():
+						log.Println("Http listener: Cancellation requested")
+						return
+					default:
+					}
+					if errors.Is(err, net.ErrClosed) {
+						log.Printf("HTTP listener %s closed", httpListener.Addr())
+						return
+					}
+					log.Printf("error accepting new HTTP connections at %s: %s", httpListener.Addr(), err)
+					continue
+				}
+
+				if overMemoryBudget() {
+					log.Printf("Memory budget exceeded, rejecting http connection from %s", httpConnection.RemoteAddr())
+					rejectHttpConnection(httpConnection)
+					continue
+				}
+				if !publicConnections.Acquire() {
+					log.Printf("Too many connections, rejecting http connection from %s", httpConnection.RemoteAddr())
+					rejectHttpConnection(httpConnection)
+					continue
+				}
+				go func() {
+					defer publicConnections.Release()
+					handleHttpConnection(httpConnection, addr)
+				}()
+			}
+		}()
+	}
+	return httpListener, nil
+}
+
+// httpListening returns true if HTTP tunnels are served at addr.
+func httpListening(addr string) bool {
+	forwardsLock.Lock()
+	defer forwardsLock.Unlock()
+	o, ok := forwards[addr]
+	return ok && o.conType == HTTPConnectionType
+}
+
+// removeTunnelListener removes the client with sessionID from the HTTP tunnel at cacheKey and returns true if it was found.
+// When the tunnel is shared, the next client in the group takes over the entry.
+// sshTunnelListenersLock must be held.
+func removeTunnelListener(cacheKey string, sessionID string) (removed bool) {
+	s, ok := sshTunnelListeners[cacheKey]
+	if !ok {
+		return false
+	}
+	if tunnelName := s.conn.GetTunnelName(); tunnelName != nil {
+		defer func() {
+			if removed {
+				latencyMetrics.Remove(*tunnelName)
+				activity.Publish(&activityEvent{Type: eventTunnelClose, TunnelName: *tunnelName, ConnectionType: s.connectionType})
+			}
+		}()
+	}
+	if s.group != nil {
+		if !s.group.Remove(sessionID) {
+			return false
+		}
+		if promoted, ok := s.group.Promote(); ok {
+			failOverTunnel(promoted)
+		}
+		if primary, ok := s.group.Primary(); ok {
+			sshTunnelListeners[cacheKey] = primary
+			return true
+		}
+	} else if s.sessionID != sessionID {
+		return false
+	}
+	s.channels.Close()
+	delete(sshTunnelListeners, cacheKey)
+	return true
+}
+
+// tunnelNameUnavailable returns why a client with clientID and fingerprint cannot claim tunnelName at addr (eg
+// localhost:80), or "" if it can. Whether another tunnel of this server holds the name is left to the caller, which
+// may take it over, join it or stand by for it. sshTunnelListenersLock must be held.
+func tunnelNameUnavailable(addr string, tunnelName string, clientID string, fingerprint string) string {
+	if tunnelNameDenied(tunnelName) {
+		return "not allowed"
+	}
+	if !reservedNameAllowed(tunnelName, fingerprint) || clusterTunnelName(tunnelName) {
+		return "is reserved"
+	}
+	if owner := nestedTunnelOwner(addr, tunnelName, clientID, fingerprint); owner != "" {
+		return fmt.Sprintf("is nested with '%s' of another client", owner)
+	}
+	// A name held by a tunnel of this server was reserved for its key when it opened
+	if _, held := sshTunnelListeners[addr+tunnelName]; held {
+		return ""
+	}
+	if peerTunnelHeld(addr+tunnelName, clientID) {
+		return "already taken"
+	}
+	if !reservations.Allowed(httpReservationKey(addr, tunnelName), fingerprint) {
+		return "is reserved for another key"
+	}
+	return ""
+}
+
+// nestedTunnelOwner returns the name of a tunnel at addr of another client id and key that tunnelName is nested under
+// (eg acme for dev.acme) or that is nested under tunnelName, as nested names share the cookies of the names they are
+// under. sshTunnelListenersLock must be held.
+func nestedTunnelOwner(addr string, tunnelName string, clientID string, fingerprint string) string {
+	for key, tunnel := range sshTunnelListeners {
+		if !strings.HasPrefix(key, addr) || tunnel.reqPayload == nil ||
+			net.JoinHostPort(tunnel.reqPayload.BindAddr, strconv.Itoa(int(tunnel.reqPayload.BindPort))) != addr {
+			continue
+		}
+		name := key[len(addr):]
+		if !strings.HasSuffix(name, "."+tunnelName) && !strings.HasSuffix(tunnelName, "."+name) {
+			continue
+		}
+		if tunnel.clientID != clientID && (fingerprint == "" || tunnel.conn == nil || tunnel.conn.Fingerprint() != fingerprint) {
+			return name
+		}
+	}
+	return ""
+}
+
+// recordUpstreamFailure counts a failed request in the tunnel stats and against the tunnel's circuit breaker and
+// lets the client know when the breaker trips.
+func recordUpstreamFailure(sshClient sshTunnelsListenerData, tunnelName string) {
+	sshClient.stats.errors.Add(1)
+	if !sshClient.breaker.Failure() {
+		return
+	}
+	log.Printf("Circuit breaker tripped for tunnelName %s", tunnelName)
+	if sessionChannel := sshClient.conn.GetSessionChannel(); sessionChannel != nil {
+		s := settings()
+		io.WriteString(*sessionChannel, fmt.Sprintf("Backend failed %d consecutive requests, serving 503 for %s\n", s.breakerThreshold, s.breakerCooldown))
+	}
+}
+
+// openTunnelChannel opens a new forwarded-tcpip channel to the client of an HTTP tunnel.
+// If the client specified "https", the channel is wrapped with tls.
+func openTunnelChannel(sshClient sshTunnelsListenerData, originAddr string, originPort int) (net.Conn, error) {
+	var conn net.Conn
+	if sshClient.mux != nil {
+		stream, err := sshClient.mux.Open(sshClient, originAddr, originPort)
+		if err != nil {
+			return nil, err
+		}
+		conn = stream
+	} else {
+		sshChannel, ok := sshClient.channels.Get()
+		if !ok {
+			var err error
+			sshChannel, _, err = openForwardedChannel(sshClient, originAddr, originPort)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// Need to wrap sshChannel with net.Conn methods.
+		conn = newSSHChannelConnection(&sshChannel, sshClient.conn.cancellationCtx)
+	}
+
+	if sshClient.connectionType == "https" {
+		// No need to verify TLS chain as the user manually requested it and to allow self-signed certificates to work.
+		// Also, this improves performance.
+		return tls.Client(conn, &tls.Config{InsecureSkipVerify: true}), nil
+	}
+	// http
+	return conn, nil
+}
+
+// openForwardedChannel opens a forwarded-tcpip channel to the client of a tunnel. The returned chan is closed once
+// the channel is closed.
+func openForwardedChannel(sshClient sshTunnelsListenerData, originAddr string, originPort int) (ssh.Channel, <-chan struct{}, error) {
+	payload := ssh.Marshal(&remoteForwardChannelData{
+		DestAddr:   sshClient.reqPayload.BindAddr,
+		DestPort:   sshClient.reqPayload.BindPort,
+		OriginAddr: originAddr,
+		OriginPort: uint32(originPort),
+	})
+
+	sshChannel, reqs, err := sshClient.conn.OpenChannel(forwardedTCPChannelType, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	closed := make(chan struct{})
+	go func() {
+		// The requests are closed along with the channel
+		ssh.DiscardRequests(reqs)
+		close(closed)
+	}()
+	return sshChannel, closed, nil
+}
+
 func cancelForwardHandler(conn *sshConnection, req *ssh.Request, ctx context.Context) (bool, []byte) {
 	var reqPayload remoteForwardCancelRequest
 	if err := ssh.Unmarshal(req.Payload, &reqPayload); err != nil {
 		log.Printf("error in cancel-tcpip-forward: %s", err)
 		return false, []byte{}
 	}
-	if reqPayload.BindPort == httpBindPort {
-		// We don't want to delete the only HTTP listener we have
+	addr := net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))
+	forwardsLock.Lock()
+	lnO, ok := forwards[addr]
+	forwardsLock.Unlock()
+	if !ok {
+		return true, nil
+	}
+	if lnO.conType == HTTPConnectionType {
+		// We don't want to delete the HTTP listener shared by the tunnels at the port
 		tunnelName := conn.GetTunnelName()
 		if tunnelName != nil {
-			cacheKey := net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort))) + *conn.GetTunnelName()
+			cacheKey := addr + *tunnelName
 
 			sshTunnelListenersLock.Lock()
-			s, ok := sshTunnelListeners[cacheKey]
-			if ok && s.sessionID == hex.EncodeToString(conn.SessionID()) {
-				delete(sshTunnelListeners, cacheKey)
-				log.Printf("Purged cache for session %s", s.sessionID)
+			// Names added with tunnel-control serve the same forward
+			for _, alias := range conn.GetTunnelAliases() {
+				removeTunnelAlias(addr+alias, hex.EncodeToString(conn.SessionID()))
+				conn.RemoveTunnelAlias(alias)
+			}
+			if removeTunnelListener(cacheKey, hex.EncodeToString(conn.SessionID())) {
+				log.Printf("Purged cache for session %s", hex.EncodeToString(conn.SessionID()))
+				reservations.Close(httpReservationKey(addr, *tunnelName), conn.Fingerprint())
 			}
 			sshTunnelListenersLock.Unlock()
 		}
 		return true, nil
 	}
-	// TCP only
-	addr := net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))
-	forwardsLock.Lock()
-	lnO, ok := forwards[addr]
-	forwardsLock.Unlock()
-	if ok {
+	// TCP only, and only the listener of this client
+	if lnO.sessionID == hex.EncodeToString(conn.SessionID()) {
 		lnO.listener.Close()
 	}
 	return true, nil
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+// replyRecorder stands in for the session channel of a client and keeps what it is told.
+type replyRecorder struct {
+	*noSessionChannel
+	out bytes.Buffer
+}
+
+func (r *replyRecorder) Write(data []byte) (int, error) {
+	return r.out.Write(data)
+}
+
+var _ = Describe("remote forward", func() {
+	var listener net.Listener
+	var client *ssh.Client
+	var conn *sshConnection
+	var ctx context.Context
+	var cancel context.CancelFunc
+	// sshTunnelListeners and forwards keys to remove after each test
+	var addrs []string
+	BeforeEach(func() {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		signer, _ := ssh.NewSignerFromKey(key)
+		config := &ssh.ServerConfig{NoClientAuth: true}
+		config.AddHostKey(signer)
+		var err error
+		listener, err = net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		ctx, cancel = context.WithCancel(context.Background())
+		serverConn := make(chan *sshConnection, 1)
+		go func(listener net.Listener, serverConn chan *sshConnection) {
+			nConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				for newChannel := range chans {
+					newChannel.Reject(ssh.Prohibited, "")
+				}
+			}()
+			serverConn <- newSSHConnection(conn, ctx)
+		}(listener, serverConn)
+		client, err = ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		Expect(err).To(Not(HaveOccurred()))
+		conn = <-serverConn
+		addrs = nil
+	})
+	AfterEach(func() {
+		cancel()
+		forwardsLock.Lock()
+		for _, addr := range addrs {
+			if forward, ok := forwards[addr]; ok {
+				forward.listener.Close()
+				delete(forwards, addr)
+			}
+		}
+		forwardsLock.Unlock()
+		sshTunnelListenersLock.Lock()
+		for key := range sshTunnelListeners {
+			for _, addr := range addrs {
+				if strings.HasPrefix(key, addr) {
+					delete(sshTunnelListeners, key)
+				}
+			}
+		}
+		sshTunnelListenersLock.Unlock()
+		client.Close()
+		listener.Close()
+	})
+
+	// forward sends a tcpip-forward request for port with the exec request and returns the reply and what the
+	// client is told.
+	forward := func(port int, request string) (bool, string) {
+		addrs = append(addrs, net.JoinHostPort("localhost", strconv.Itoa(port)))
+		recorder := &replyRecorder{noSessionChannel: newNoSessionChannel(conn)}
+		execRequestCompleted := make(chan execRequestCompletedData, 1)
+		execRequestCompleted <- execRequestCompletedData{channel: recorder, request: request}
+		req := &ssh.Request{Type: forwardTCPRequestType, Payload: ssh.Marshal(&remoteForwardRequest{BindAddr: "localhost", BindPort: uint32(port)})}
+		ok, _ := forwardHandler(conn, req, execRequestCompleted, ctx)
+		return ok, recorder.out.String()
+	}
+	freePort := func() int {
+		l, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer l.Close()
+		return l.Addr().(*net.TCPAddr).Port
+	}
+
+	It("should only refuse HTTP tunnels at other ports than --httpPorts when it is set", func() {
+		defer func(set bool) { httpBindPortsSet = set }(httpBindPortsSet)
+		httpBindPortsSet = false
+		port := freePort()
+		ok, _ := forward(port, "type=http,tunnelName=anyport")
+		Expect(ok).To(BeTrue())
+		forwardsLock.Lock()
+		_, listening := forwards[net.JoinHostPort("localhost", strconv.Itoa(port))]
+		forwardsLock.Unlock()
+		Expect(listening).To(BeTrue())
+
+		httpBindPortsSet = true
+		port = freePort()
+		ok, told := forward(port, "type=http,tunnelName=otherport")
+		Expect(ok).To(BeFalse())
+		Expect(told).To(ContainSubstring("HTTP port " + strconv.Itoa(port) + " is not served."))
+	})
+
+	It("should remove a cancelled HTTP tunnel and its names but keep the shared listener of its port", func() {
+		defer func(set bool) { httpBindPortsSet = set }(httpBindPortsSet)
+		httpBindPortsSet = false
+		port := freePort()
+		addr := net.JoinHostPort("localhost", strconv.Itoa(port))
+		ok, _ := forward(port, "type=http,tunnelName=cancelled")
+		Expect(ok).To(BeTrue())
+
+		req := &ssh.Request{Type: cancelForwardTCPRequestType, Payload: ssh.Marshal(&remoteForwardCancelRequest{BindAddr: "localhost", BindPort: uint32(port)})}
+		sshTunnelListenersLock.Lock()
+		sshTunnelListeners[addr+"alias"] = sshTunnelListeners[addr+"cancelled"]
+		sshTunnelListenersLock.Unlock()
+		conn.AddTunnelAlias("alias")
+		ok, _ = cancelForwardHandler(conn, req, ctx)
+		Expect(ok).To(BeTrue())
+		sshTunnelListenersLock.Lock()
+		_, registered := sshTunnelListeners[addr+"cancelled"]
+		_, aliasRegistered := sshTunnelListeners[addr+"alias"]
+		sshTunnelListenersLock.Unlock()
+		Expect(registered).To(BeFalse())
+		Expect(aliasRegistered).To(BeFalse())
+		Expect(conn.GetTunnelAliases()).To(BeEmpty())
+		forwardsLock.Lock()
+		_, listening := forwards[addr]
+		forwardsLock.Unlock()
+		Expect(listening).To(BeTrue())
+		httpConn, err := net.Dial("tcp", addr)
+		Expect(err).To(Not(HaveOccurred()))
+		httpConn.Close()
+	})
+
+	It("should not share a port between HTTP and TCP tunnels", func() {
+		defer func(set bool) { httpBindPortsSet = set }(httpBindPortsSet)
+		httpBindPortsSet = false
+		httpPort := freePort()
+		ok, _ := forward(httpPort, "type=http,tunnelName=shared")
+		Expect(ok).To(BeTrue())
+		ok, told := forward(httpPort, "type=tcp")
+		Expect(ok).To(BeFalse())
+		Expect(told).To(ContainSubstring("TCP port " + strconv.Itoa(httpPort) + " is reserved for HTTP tunnels."))
+		Expect(httpListening(net.JoinHostPort("localhost", strconv.Itoa(httpPort)))).To(BeTrue())
+
+		tcpPort := freePort()
+		ok, _ = forward(tcpPort, "type=tcp")
+		Expect(ok).To(BeTrue())
+		ok, told = forward(tcpPort, "type=http,tunnelName=ontcp")
+		Expect(ok).To(BeFalse())
+		Expect(told).To(ContainSubstring("HTTP port " + strconv.Itoa(tcpPort) + " is unavailable on the server."))
+		Expect(httpListening(net.JoinHostPort("localhost", strconv.Itoa(tcpPort)))).To(BeFalse())
+	})
+
+	It("should refuse the HTTP tunnel without registering it when the port cannot be listened at", func() {
+		defer func(set bool) { httpBindPortsSet = set }(httpBindPortsSet)
+		httpBindPortsSet = false
+		// Port taken by another process
+		taken, err := net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer taken.Close()
+		port := taken.Addr().(*net.TCPAddr).Port
+		addr := net.JoinHostPort("localhost", strconv.Itoa(port))
+
+		ok, told := forward(port, "type=http,tunnelName=unavailable")
+		Expect(ok).To(BeFalse())
+		Expect(told).To(ContainSubstring("HTTP port " + strconv.Itoa(port) + " is unavailable on the server."))
+		forwardsLock.Lock()
+		_, listening := forwards[addr]
+		forwardsLock.Unlock()
+		Expect(listening).To(BeFalse())
+		sshTunnelListenersLock.Lock()
+		_, registered := sshTunnelListeners[addr+"unavailable"]
+		sshTunnelListenersLock.Unlock()
+		Expect(registered).To(BeFalse())
+	})
+
+	It("should answer 502 when the tunnel client does not accept the channel", func() {
+		defer func(set bool) { httpBindPortsSet = set }(httpBindPortsSet)
+		httpBindPortsSet = false
+		u, _ := url.Parse("https://domain.io")
+		domainURIs = []url.URL{*u}
+		domainURI = *u
+		defer func() {
+			domainURIs = nil
+			domainURI = url.URL{}
+		}()
+		port := freePort()
+		ok, _ := forward(port, "type=http,tunnelName=rejecting")
+		Expect(ok).To(BeTrue())
+
+		// The client of the harness rejects every channel
+		failures := channelOpenFailures.Value()
+		httpConn, err := net.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+		Expect(err).To(Not(HaveOccurred()))
+		defer httpConn.Close()
+		httpConn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = httpConn.Write([]byte("GET / HTTP/1.1\r\nHost: rejecting.domain.io\r\n\r\n"))
+		Expect(err).To(Not(HaveOccurred()))
+		response, err := http.ReadResponse(bufio.NewReader(httpConn), nil)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(response.StatusCode).To(Equal(http.StatusBadGateway))
+		body, _ := io.ReadAll(response.Body)
+		Expect(string(body)).To(ContainSubstring("The tunnel client did not accept the request."))
+		Expect(channelOpenFailures.Value()).To(Equal(failures + 1))
+	})
+
+	It("should open the tunnel with the default options when the session channel carries no exec request", func() {
+		defer func(set bool) { httpBindPortsSet = set }(httpBindPortsSet)
+		httpBindPortsSet = false
+		port := freePort()
+		addr := net.JoinHostPort("localhost", strconv.Itoa(port))
+		ok, _ := forward(port, "type=http,tunnelName=listening")
+		Expect(ok).To(BeTrue())
+
+		// Such as a session channel with a tunnel-control subsystem request
+		conn.MarkSessionOpened()
+		conn.MarkNoExecRequest()
+		done := make(chan bool, 1)
+		go func() {
+			req := &ssh.Request{Type: forwardTCPRequestType, Payload: ssh.Marshal(&remoteForwardRequest{BindAddr: "localhost", BindPort: uint32(port)})}
+			ok, _ := forwardHandler(conn, req, make(chan execRequestCompletedData), ctx)
+			done <- ok
+		}()
+		Eventually(done, 5*time.Second).Should(Receive(BeTrue()))
+		Expect(conn.ExecWaitOver()).To(BeClosed())
+		sshTunnelListenersLock.Lock()
+		_, registered := sshTunnelListeners[addr+defaultTunnelName(conn.User(), conn.SessionID())]
+		sshTunnelListenersLock.Unlock()
+		Expect(registered).To(BeTrue())
+	})
+
+	It("should release the reservations of cancelled tunnels for other keys once they expire", func() {
+		defer func(set bool) { httpBindPortsSet = set }(httpBindPortsSet)
+		httpBindPortsSet = false
+		dir, err := os.MkdirTemp("", "reservations")
+		Expect(err).To(Not(HaveOccurred()))
+		defer os.RemoveAll(dir)
+		defer func(s *reservationStore) { reservations = s }(reservations)
+		reservations, err = newReservationStore(filepath.Join(dir, "reservations.json"), 100*time.Millisecond)
+		Expect(err).To(Not(HaveOccurred()))
+		conn.Permissions = &ssh.Permissions{Extensions: map[string]string{"pubkey-fp": "fp1"}}
+
+		httpPort := freePort()
+		httpAddr := net.JoinHostPort("localhost", strconv.Itoa(httpPort))
+		ok, _ := forward(httpPort, "type=http,tunnelName=released")
+		Expect(ok).To(BeTrue())
+		ok, _ = cancelForwardHandler(conn, &ssh.Request{Type: cancelForwardTCPRequestType, Payload: ssh.Marshal(&remoteForwardCancelRequest{BindAddr: "localhost", BindPort: uint32(httpPort)})}, ctx)
+		Expect(ok).To(BeTrue())
+
+		tcpPort := freePort()
+		tcpAddr := net.JoinHostPort("localhost", strconv.Itoa(tcpPort))
+		ok, _ = forward(tcpPort, "type=tcp")
+		Expect(ok).To(BeTrue())
+		ok, _ = cancelForwardHandler(conn, &ssh.Request{Type: cancelForwardTCPRequestType, Payload: ssh.Marshal(&remoteForwardCancelRequest{BindAddr: "localhost", BindPort: uint32(tcpPort)})}, ctx)
+		Expect(ok).To(BeTrue())
+		Eventually(func() bool {
+			forwardsLock.Lock()
+			defer forwardsLock.Unlock()
+			_, listening := forwards[tcpAddr]
+			return listening
+		}).Should(BeFalse())
+
+		// Held for the key while it may come back, then free for others
+		Expect(tunnelNameUnavailable(httpAddr, "released", "other", "fp2")).To(Not(BeEmpty()))
+		Expect(reservations.Allowed(tcpReservationKey(tcpAddr), "fp2")).To(BeFalse())
+		time.Sleep(150 * time.Millisecond)
+		Expect(tunnelNameUnavailable(httpAddr, "released", "other", "fp2")).To(BeEmpty())
+		Expect(reservations.Allowed(tcpReservationKey(tcpAddr), "fp2")).To(BeTrue())
+	})
+})
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tunnel names and TCP ports held for the key that last used them, kept in a file so that returning clients get
+// them back after a restart or a crash of the server before anyone else can take them.
+// nil when reservations are disabled.
+var reservations *reservationStore
+
+// Seconds after which visitors of a tunnel whose client is reconnecting are told to try again (Retry-After).
+const reconnectingRetryAfter = 5
+
+// reservation is what the store keeps of a tunnel name or TCP port.
+type reservation struct {
+	Fingerprint string    `json:"fingerprint"` // SHA256 fingerprint of the key of the client
+	Open        bool      `json:"open"`        // A tunnel of the key uses it
+	Seen        time.Time `json:"seen"`        // When it was last opened or closed
+}
+
+// reservationStore holds tunnel names and TCP ports for the keys that used them while they are open and for ttl
+// once closed. Every change is written to the file at path.
+type reservationStore struct {
+	sync.Mutex
+	path    string
+	ttl     time.Duration
+	entries map[string]*reservation
+}
+
+// httpReservationKey and tcpReservationKey identify a tunnel name on an HTTP bind address and a TCP bind address.
+func httpReservationKey(addr string, tunnelName string) string {
+	return "http " + addr + " " + tunnelName
+}
+
+func tcpReservationKey(addr string) string {
+	return "tcp " + addr
+}
+
+// newReservationStore loads the reservations kept at path, if any. Those that were open when the server stopped
+// are held for ttl from now since their clients had no chance to come back yet.
+func newReservationStore(path string, ttl time.Duration) (*reservationStore, error) {
+	s := &reservationStore{path: path, ttl: ttl, entries: make(map[string]*reservation)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.entries); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for key, r := range s.entries {
+		if r.Open {
+			r.Open, r.Seen = false, now
+		} else if now.Sub(r.Seen) > ttl {
+			delete(s.entries, key)
+		}
+	}
+	return s, nil
+}
+
+// Allowed returns false if key is held for another key than fingerprint.
+func (s *reservationStore) Allowed(key string, fingerprint string) bool {
+	if s == nil {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+	r := s.held(key)
+	return r == nil || r.Fingerprint == fingerprint
+}
+
+// Open reserves key for fingerprint while its tunnel is open, unless it is held for another key.
+func (s *reservationStore) Open(key string, fingerprint string) {
+	if s == nil || fingerprint == "" {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if r := s.held(key); r != nil && r.Fingerprint != fingerprint {
+		return
+	}
+	s.entries[key] = &reservation{Fingerprint: fingerprint, Open: true, Seen: time.Now()}
+	s.save()
+}
+
+// Close starts the ttl of the reservation of key once its tunnel of fingerprint closes.
+func (s *reservationStore) Close(key string, fingerprint string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.entries[key]
+	if !ok || r.Fingerprint != fingerprint {
+		return
+	}
+	r.Open, r.Seen = false, time.Now()
+	s.save()
+}
+
+// Reconnecting returns true if key is held for a key whose tunnel closed within reconnectingWindow, such as while its
+// client reconnects. Tunnels closed for longer are deemed closed on purpose.
+func (s *reservationStore) Reconnecting(key string) bool {
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	r := s.held(key)
+	return r != nil && !r.Open && time.Since(r.Seen) <= reconnectingWindow()
+}
+
+// reconnectingWindow returns how long a client whose tunnel closed is deemed to be reconnecting: as long as it would
+// take the server to notice that its connection dropped (see clientKeepaliveInterval).
+func reconnectingWindow() time.Duration {
+	return clientKeepaliveInterval * time.Duration(clientKeepaliveMaxCount)
+}
+
+// held returns the reservation of key unless it expired. s must be locked.
+func (s *reservationStore) held(key string) *reservation {
+	r, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if !r.Open && time.Since(r.Seen) > s.ttl {
+		delete(s.entries, key)
+		return nil
+	}
+	return r
+}
+
+// save writes the reservations that did not expire to the file (see writeFileAtomic). s must be locked.
+func (s *reservationStore) save() {
+	for key := range s.entries {
+		s.held(key)
+	}
+	b, _ := json.MarshalIndent(s.entries, "", "  ")
+	if err := writeFileAtomic(s.path, append(b, '\n')); err != nil {
+		log.Printf("error saving the reservations to %s: %s", s.path, err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("reservationStore", func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "reservations")
+		Expect(err).To(Not(HaveOccurred()))
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should allow everything when disabled", func() {
+		var s *reservationStore
+		s.Open(httpReservationKey("localhost:80", "abc"), "fp1")
+		Expect(s.Allowed(httpReservationKey("localhost:80", "abc"), "fp2")).To(BeTrue())
+		Expect(s.Reconnecting(httpReservationKey("localhost:80", "abc"))).To(BeFalse())
+	})
+
+	It("should hold names and ports for the key that used them", func() {
+		s, err := newReservationStore(filepath.Join(dir, "reservations.json"), time.Hour)
+		Expect(err).To(Not(HaveOccurred()))
+		name, port := httpReservationKey("localhost:80", "abc"), tcpReservationKey("localhost:5432")
+		s.Open(name, "fp1")
+		s.Open(port, "fp1")
+		Expect(s.Allowed(name, "fp1")).To(BeTrue())
+		Expect(s.Allowed(name, "fp2")).To(BeFalse())
+		Expect(s.Allowed(httpReservationKey("localhost:8080", "abc"), "fp2")).To(BeTrue())
+
+		// Others cannot take over a reservation, and only its key closes it
+		s.Open(name, "fp2")
+		s.Close(name, "fp2")
+		Expect(s.entries[name].Fingerprint).To(Equal("fp1"))
+		Expect(s.entries[name].Open).To(BeTrue())
+		Expect(s.Reconnecting(name)).To(BeFalse())
+		s.Close(name, "fp1")
+		Expect(s.Allowed(name, "fp2")).To(BeFalse())
+		Expect(s.Reconnecting(name)).To(BeTrue())
+		Expect(s.Reconnecting(httpReservationKey("localhost:80", "other"))).To(BeFalse())
+
+		// Once the client had time to reconnect, the tunnel is deemed closed on purpose but stays reserved
+		s.entries[name].Seen = time.Now().Add(-reconnectingWindow() - time.Second)
+		Expect(s.Reconnecting(name)).To(BeFalse())
+		Expect(s.Allowed(name, "fp2")).To(BeFalse())
+		s.entries[name].Seen = time.Now()
+
+		s.ttl = 0
+		Expect(s.Reconnecting(name)).To(BeFalse())
+		Expect(s.Allowed(name, "fp2")).To(BeTrue())
+		Expect(s.Allowed(port, "fp2")).To(BeFalse())
+	})
+
+	It("should keep the reservations across restarts", func() {
+		path := filepath.Join(dir, "reservations.json")
+		s, err := newReservationStore(path, time.Hour)
+		Expect(err).To(Not(HaveOccurred()))
+		s.Open(httpReservationKey("localhost:80", "open"), "fp1")
+		s.Open(httpReservationKey("localhost:80", "closed"), "fp1")
+		s.Close(httpReservationKey("localhost:80", "closed"), "fp1")
+		s.entries[httpReservationKey("localhost:80", "closed")].Seen = time.Now().Add(-2 * time.Hour)
+		s.Open(tcpReservationKey("localhost:5432"), "fp2")
+		files, _ := os.ReadDir(dir)
+		Expect(files).To(HaveLen(1))
+
+		// The server crashed while the tunnels were open
+		s, err = newReservationStore(path, time.Hour)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(s.Allowed(httpReservationKey("localhost:80", "open"), "fp2")).To(BeFalse())
+		Expect(s.entries[httpReservationKey("localhost:80", "open")].Open).To(BeFalse())
+		Expect(s.Allowed(httpReservationKey("localhost:80", "closed"), "fp2")).To(BeTrue())
+		Expect(s.Allowed(tcpReservationKey("localhost:5432"), "fp1")).To(BeFalse())
+
+		os.WriteFile(path, []byte("{"), 0o600)
+		_, err = newReservationStore(path, time.Hour)
+		Expect(err).To(HaveOccurred())
+	})
+})
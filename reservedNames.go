@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// File of the tunnel names set aside by the operator (eg www, api or the names of customers), set from a command
+// line flag. Empty disables them.
+var reservedNamesFile string
+
+// Tunnel names that random names never take and that only the keys listed for them can claim, mapped to the
+// SHA256 fingerprints of those keys. Replaced as a whole when the file is reloaded.
+var reservedNames atomic.Value
+
+// loadReservedNames reads reservedNamesFile: one name per line followed by the fingerprints of the keys allowed to
+// claim it, if any, separated by spaces. Lines starting with # are comments, eg
+//
+//	# Nobody gets these
+//	www
+//	admin
+//	acme SHA256:q5iXdG4IB9xSCyjcwJNWqicExf8hBnejgiHXMD/55WQ
+func loadReservedNames() (map[string][]string, error) {
+	names := map[string][]string{}
+	if reservedNamesFile == "" {
+		return names, nil
+	}
+	b, err := os.ReadFile(reservedNamesFile)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		if !tunnelNameValid(name) {
+			return nil, fmt.Errorf("invalid reserved name %s at line %d of %s", fields[0], line, reservedNamesFile)
+		}
+		for _, fingerprint := range fields[1:] {
+			if !strings.HasPrefix(fingerprint, "SHA256:") {
+				return nil, fmt.Errorf("invalid key fingerprint %s at line %d of %s, expected SHA256:...", fingerprint, line, reservedNamesFile)
+			}
+		}
+		names[name] = append(names[name], fields[1:]...)
+	}
+	return names, scanner.Err()
+}
+
+// reservedNameAllowed returns false if name, or a name it is nested under (eg acme for dev.acme), is reserved and the
+// key with fingerprint is not listed for it.
+func reservedNameAllowed(name string, fingerprint string) bool {
+	names, _ := reservedNames.Load().(map[string][]string)
+	for _, n := range append([]string{name}, tunnelNameParents(name)...) {
+		if fingerprints, reserved := names[n]; reserved && (fingerprint == "" || !containsString(fingerprints, fingerprint)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("reserved names", func() {
+	var dir string
+	var previous map[string][]string
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "reservedNames")
+		Expect(err).To(Not(HaveOccurred()))
+		reservedNamesFile = filepath.Join(dir, "reserved_names")
+		previous, _ = reservedNames.Load().(map[string][]string)
+	})
+	AfterEach(func() {
+		reservedNamesFile = ""
+		if previous == nil {
+			previous = map[string][]string{}
+		}
+		reservedNames.Store(previous)
+		os.RemoveAll(dir)
+	})
+
+	It("should only let the keys listed for a reserved name claim it", func() {
+		os.WriteFile(reservedNamesFile, []byte("# Nobody gets these\nwww\n  Admin  \n\nacme SHA256:key1 SHA256:key2\n"), 0o600)
+		names, err := loadReservedNames()
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(names).To(HaveLen(3))
+		reservedNames.Store(names)
+
+		Expect(reservedNameAllowed("www", "SHA256:key1")).To(BeFalse())
+		Expect(reservedNameAllowed("admin", "")).To(BeFalse())
+		Expect(reservedNameAllowed("acme", "SHA256:key2")).To(BeTrue())
+		Expect(reservedNameAllowed("acme", "SHA256:key3")).To(BeFalse())
+		Expect(reservedNameAllowed("acme", "")).To(BeFalse())
+		Expect(reservedNameAllowed("myapp", "")).To(BeTrue())
+
+		// Names nested under a reserved name are reserved too
+		Expect(reservedNameAllowed("dev.acme", "SHA256:key2")).To(BeTrue())
+		Expect(reservedNameAllowed("dev.acme", "SHA256:key3")).To(BeFalse())
+		Expect(reservedNameAllowed("acme.dev", "SHA256:key3")).To(BeTrue())
+	})
+
+	It("should reject invalid names and fingerprints", func() {
+		os.WriteFile(reservedNamesFile, []byte("www\na--b\n"), 0o600)
+		_, err := loadReservedNames()
+		Expect(err).To(MatchError(ContainSubstring("invalid reserved name a--b at line 2")))
+
+		os.WriteFile(reservedNamesFile, []byte("acme MD5:12:34\n"), 0o600)
+		_, err = loadReservedNames()
+		Expect(err).To(MatchError(ContainSubstring("invalid key fingerprint MD5:12:34 at line 1")))
+	})
+
+	It("should allow every name without a file", func() {
+		reservedNamesFile = ""
+		names, err := loadReservedNames()
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(names).To(BeEmpty())
+		reservedNames.Store(names)
+		Expect(reservedNameAllowed("www", "")).To(BeTrue())
+	})
+})
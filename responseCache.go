@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum size of a cached response (headers and body).
+var cacheMaxEntryBytes int
+
+// Maximum number of responses cached per tunnel.
+var cacheMaxEntries int
+
+type cachedResponse struct {
+	raw     []byte // Response as received from the client
+	etag    string
+	expires time.Time
+}
+
+// responseCache keeps fresh GET/HEAD responses of a tunnel so they can be served at the edge.
+// A nil cache means caching is disabled for the tunnel.
+type responseCache struct {
+	sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: make(map[string]*cachedResponse)}
+}
+
+func responseCacheKey(method string, requestURI string) string {
+	return method + " " + requestURI
+}
+
+// Get returns the cached response for key if it is still fresh.
+func (c *responseCache) Get(key string) (*cachedResponse, bool) {
+	c.Lock()
+	defer c.Unlock()
+	r, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(r.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return r, true
+}
+
+// Set caches r under key evicting expired responses, or the one closest to expiring, when the cache is full.
+func (c *responseCache) Set(key string, r *cachedResponse) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= cacheMaxEntries {
+		now := time.Now()
+		oldestKey := ""
+		for k, v := range c.entries {
+			if now.After(v.expires) {
+				delete(c.entries, k)
+			} else if oldestKey == "" || v.expires.Before(c.entries[oldestKey].expires) {
+				oldestKey = k
+			}
+		}
+		if len(c.entries) >= cacheMaxEntries {
+			delete(c.entries, oldestKey)
+		}
+	}
+	c.entries[key] = r
+}
+
+// Write writes the cached response to w as a response to the request h.
+// A conditional request matching the cached ETag gets a 304.
+func (r *cachedResponse) Write(w io.Writer, h *httpProcessor) error {
+	if r.etag != "" {
+		if ifNoneMatch, ok := h.header("If-None-Match"); ok && ifNoneMatch == r.etag {
+			_, err := io.WriteString(w, "HTTP/1.1 304 Not Modified\r\nETag: "+r.etag+"\r\nX-Tunnel-Cache: HIT\r\n\r\n")
+			return err
+		}
+	}
+
+	// Mark the response as served from the cache right after the status line.
+	statusLineEnd := bytes.Index(r.raw, []byte("\r\n")) + 2
+	if _, err := w.Write(r.raw[:statusLineEnd]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "X-Tunnel-Cache: HIT\r\n"); err != nil {
+		return err
+	}
+	_, err := w.Write(r.raw[statusLineEnd:])
+	return err
+}
+
+// requestCacheable returns true if the response to the request h can be served from a shared cache.
+func requestCacheable(h *httpProcessor) bool {
+	if !h.request || (h.requestMethod != "GET" && h.requestMethod != "HEAD") {
+		return false
+	}
+	headers, _ := h.GetHeaders()
+	if _, ok := headers["Authorization"]; ok {
+		return false
+	}
+	if _, ok := cacheControlDirectives(headers)["no-cache"]; ok {
+		return false
+	}
+	if _, ok := cacheControlDirectives(headers)["no-store"]; ok {
+		return false
+	}
+	if pragma, ok := headers["Pragma"]; ok && len(pragma) > 0 && strings.Contains(strings.ToLower(pragma[0]), "no-cache") {
+		return false
+	}
+	return true
+}
+
+// responseFreshness returns how long the response h can be served from a shared cache.
+// See https://www.rfc-editor.org/rfc/rfc9111.html
+func responseFreshness(h *httpProcessor) (time.Duration, bool) {
+	if h.responseStatusCode != 200 {
+		return 0, false
+	}
+	headers, _ := h.GetHeaders()
+	if _, ok := headers["Set-Cookie"]; ok {
+		return 0, false
+	}
+	// Responses varying on request headers would need the variant in the cache key.
+	if _, ok := headers["Vary"]; ok {
+		return 0, false
+	}
+	if v, ok := headers["Connection"]; ok && len(v) > 0 && strings.ToLower(v[0]) == "upgrade" {
+		return 0, false
+	}
+
+	directives := cacheControlDirectives(headers)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return 0, false
+		}
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[d]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if expires, ok := headers["Expires"]; ok && len(expires) > 0 {
+		t, err := http.ParseTime(expires[0])
+		if err != nil {
+			return 0, false
+		}
+		ttl := time.Until(t)
+		return ttl, ttl > 0
+	}
+	return 0, false
+}
+
+// cacheControlDirectives parses the Cache-Control header into lower-case directive names and their values.
+func cacheControlDirectives(headers map[string][]string) map[string]string {
+	directives := make(map[string]string)
+	for _, header := range headers["Cache-Control"] {
+		for _, d := range strings.Split(header, ",") {
+			name, value, _ := cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return directives
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("responseCache", func() {
+
+	newResponse := func(body string) *httpProcessor {
+		sut := newHttpProcessor(strings.NewReader(body), make([]byte, len(body)*2))
+		Expect(sut.ReadHeadersIfNeeded()).To(Succeed())
+		return sut
+	}
+
+	It("should use max-age for the freshness of a response", func() {
+		response := newResponse("HTTP/1.1 200 OK\r\nCache-Control: public, max-age=60\r\nContent-Length: 0\r\n\r\n")
+		ttl, ok := responseFreshness(response)
+		Expect(ok).To(BeTrue())
+		Expect(ttl).To(Equal(60 * time.Second))
+	})
+
+	It("should not cache private or uncacheable responses", func() {
+		for _, body := range []string{
+			"HTTP/1.1 200 OK\r\nCache-Control: private, max-age=60\r\nContent-Length: 0\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nCache-Control: no-store\r\nContent-Length: 0\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nCache-Control: max-age=60\r\nSet-Cookie: a=b\r\nContent-Length: 0\r\n\r\n",
+			"HTTP/1.1 404 Not Found\r\nCache-Control: max-age=60\r\nContent-Length: 0\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+		} {
+			_, ok := responseFreshness(newResponse(body))
+			Expect(ok).To(BeFalse(), body)
+		}
+	})
+
+	It("should not serve requests asking to bypass the cache", func() {
+		Expect(requestCacheable(newResponse("GET / HTTP/1.1\r\nHost: domain.io\r\n\r\n"))).To(BeTrue())
+		Expect(requestCacheable(newResponse("GET / HTTP/1.1\r\nCache-Control: no-cache\r\n\r\n"))).To(BeFalse())
+		Expect(requestCacheable(newResponse("GET / HTTP/1.1\r\nAuthorization: Basic YTpi\r\n\r\n"))).To(BeFalse())
+		Expect(requestCacheable(newResponse("POST / HTTP/1.1\r\nContent-Length: 0\r\n\r\n"))).To(BeFalse())
+	})
+
+	It("should expire entries", func() {
+		sut := newResponseCache()
+		cacheMaxEntries = 10
+		sut.Set("GET /a", &cachedResponse{raw: []byte("HTTP/1.1 200 OK\r\n\r\n"), expires: time.Now().Add(-time.Second)})
+		_, ok := sut.Get("GET /a")
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const rewriteSeparator = "->"
+
+// rewriteRule rewrites the URL path of requests sent to the client.
+// A prefix rule (eg /api/->/v2/) replaces the path prefix; use / as the prefix to add one to every path.
+// A regexp rule starts with ~ (eg ~^/api/(\w+)$->/v2/$1) and replaces the matches using regexp.Expand syntax.
+type rewriteRule struct {
+	prefix      string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// parseRewriteRule parses a rule in the format FROM->TO.
+func parseRewriteRule(value string) (rewriteRule, error) {
+	from, to, found := cut(value, rewriteSeparator)
+	if !found || from == "" {
+		return rewriteRule{}, fmt.Errorf("invalid rewrite rule %q, expected FROM%sTO", value, rewriteSeparator)
+	}
+
+	if strings.HasPrefix(from, "~") {
+		pattern, err := regexp.Compile(from[1:])
+		if err != nil {
+			return rewriteRule{}, fmt.Errorf("invalid rewrite rule %q: %s", value, err)
+		}
+		return rewriteRule{pattern: pattern, replacement: to}, nil
+	}
+
+	return rewriteRule{prefix: from, replacement: to}, nil
+}
+
+// Apply returns the rewritten path and true if the rule matches path.
+func (r rewriteRule) Apply(path string) (string, bool) {
+	if r.pattern != nil {
+		if !r.pattern.MatchString(path) {
+			return path, false
+		}
+		return r.pattern.ReplaceAllString(path, r.replacement), true
+	}
+	if !strings.HasPrefix(path, r.prefix) {
+		return path, false
+	}
+	return r.replacement + strings.TrimPrefix(path, r.prefix), true
+}
+
+// rewriteRequestURL applies the first matching rule to the path of requestURL leaving the rest of the URL intact.
+func rewriteRequestURL(requestURL string, rules []rewriteRule) (string, error) {
+	u, err := url.ParseRequestURI(requestURL)
+	if err != nil {
+		return requestURL, err
+	}
+
+	for _, rule := range rules {
+		if path, ok := rule.Apply(u.Path); ok {
+			// Ensure path starts with / if it is relative.
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+			u.Path = path
+			u.RawPath = ""
+			return u.String(), nil
+		}
+	}
+	return requestURL, nil
+}
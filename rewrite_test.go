@@ -0,0 +1,55 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rewrite", func() {
+
+	It("should reject rules without a separator", func() {
+		_, err := parseRewriteRule("/api/")
+		Expect(err).To(HaveOccurred())
+
+		_, err = parseRewriteRule("~(->/x")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should replace a path prefix and keep the query", func() {
+		rule, err := parseRewriteRule("/api/->/v2/")
+		Expect(err).To(Not(HaveOccurred()))
+
+		s, err := rewriteRequestURL("/api/users?id=1", []rewriteRule{rule})
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(s).To(Equal("/v2/users?id=1"))
+
+		s, err = rewriteRequestURL("/other", []rewriteRule{rule})
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(s).To(Equal("/other"))
+	})
+
+	It("should add a prefix to every path", func() {
+		rule, _ := parseRewriteRule("/->/app/")
+		s, err := rewriteRequestURL("/index.html", []rewriteRule{rule})
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(s).To(Equal("/app/index.html"))
+	})
+
+	It("should substitute regexp matches", func() {
+		rule, err := parseRewriteRule(`~^/users/(\d+)$->/v2/accounts/$1`)
+		Expect(err).To(Not(HaveOccurred()))
+
+		s, err := rewriteRequestURL("https://localhost:123/users/42", []rewriteRule{rule})
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(s).To(Equal("https://localhost:123/v2/accounts/42"))
+	})
+
+	It("should apply the first matching rule only", func() {
+		first, _ := parseRewriteRule("/api/->/v2/")
+		second, _ := parseRewriteRule("/->/v1/")
+		s, _ := rewriteRequestURL("/api/x", []rewriteRule{first, second})
+		Expect(s).To(Equal("/v2/x"))
+		s, _ = rewriteRequestURL("/x", []rewriteRule{first, second})
+		Expect(s).To(Equal("/v1/x"))
+	})
+})
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/joho/godotenv"
+)
+
+// Sources of the SSH keys. These are set from command line flags.
+var (
+	envFile            = "secrets.env" // Optional dotenv file, mainly for local development
+	authorizedKeysFile string          // authorized_keys file of the clients
+	hostKeyFile        string          // Private key file of the server
+)
+
+// Env variables holding the base64 encoded keys when no file is given.
+const (
+	authorizedKeysEnv = "authorized_keys_enc"
+	hostKeyEnv        = "ssh_host_key_enc"
+)
+
+// loadSecret returns a secret from the first of these sources that has it:
+//  1. The file at path as is.
+//  2. The env variable envName, base64 encoded.
+//  3. envName in envFile, base64 encoded. A missing envFile is skipped.
+//
+// It returns nil if none has the secret.
+func loadSecret(path string, envName string) ([]byte, error) {
+	if path != "" {
+		return os.ReadFile(path)
+	}
+
+	value, source := os.Getenv(envName), "env variable"
+	if value == "" && envFile != "" {
+		env, err := godotenv.Read(envFile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read %s: %w", envFile, err)
+		}
+		value, source = env[envName], envFile
+	}
+	if value == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s %s, err: %v", envName, source, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("secrets", func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "secrets")
+		Expect(err).To(Not(HaveOccurred()))
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+		envFile = "secrets.env"
+	})
+
+	It("should resolve a secret from the file, then the env variable, then the env file", func() {
+		envFile = filepath.Join(dir, "secrets.env")
+		Expect(os.WriteFile(envFile, []byte("test_secret_enc=ZG90ZW52\n"), 0o600)).To(Succeed())
+		Expect(loadSecret("", "test_secret_enc")).To(Equal([]byte("dotenv")))
+
+		os.Setenv("test_secret_enc", "ZW52")
+		defer os.Unsetenv("test_secret_enc")
+		Expect(loadSecret("", "test_secret_enc")).To(Equal([]byte("env")))
+
+		path := filepath.Join(dir, "secret")
+		Expect(os.WriteFile(path, []byte("file"), 0o600)).To(Succeed())
+		Expect(loadSecret(path, "test_secret_enc")).To(Equal([]byte("file")))
+	})
+
+	It("should skip a missing env file", func() {
+		envFile = filepath.Join(dir, "missing.env")
+		Expect(loadSecret("", "test_secret_enc")).To(BeNil())
+	})
+
+	It("should fail on a missing key file or an invalid value", func() {
+		_, err := loadSecret(filepath.Join(dir, "missing"), "test_secret_enc")
+		Expect(err).To(HaveOccurred())
+
+		os.Setenv("test_secret_enc", "%%%")
+		defer os.Unsetenv("test_secret_enc")
+		_, err = loadSecret("", "test_secret_enc")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// selfTest connects to a running server as a client, opens tunnels and sends traffic through its public listeners.
+type selfTest struct {
+	server   string // SSH address of the server (eg domain.io:5223)
+	user     string
+	signer   ssh.Signer
+	httpPort int    // Remote port of the HTTP tunnel
+	httpAddr string // Address of the HTTP listener if the tunnel URL does not resolve from here
+	tcpHost  string // Host of the TCP listener if the host printed by the server does not resolve from here
+	timeout  time.Duration
+}
+
+// runSelfTest runs `tunnel selftest` with args and returns the exit code: 0 if every check passes.
+func runSelfTest(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	fs.SetOutput(out)
+	server := fs.String("server", net.JoinHostPort("localhost", strconv.Itoa(sshPort)), "SSH address of the server to test.")
+	keyFile := fs.String("key", "", "Private key file of an authorized client.")
+	user := fs.String("user", "selftest", "SSH user name.")
+	httpPort := fs.Int("httpPort", 80, "Remote port of the HTTP tunnel, one of the server --httpPorts.")
+	httpAddr := fs.String("httpAddr", "", "Address to send HTTP requests to instead of the tunnel URL (eg localhost:80) when the domain does not resolve here.")
+	tcpHost := fs.String("tcpHost", "", "Host to connect to instead of the domain of the TCP tunnel.")
+	timeout := fs.Duration("timeout", 30*time.Second, "Timeout of each check.")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *keyFile == "" {
+		fmt.Fprintln(out, "selftest: --key is required")
+		return 2
+	}
+	signer, err := loadClientKey(*keyFile)
+	if err != nil {
+		fmt.Fprintf(out, "selftest: %s\n", err)
+		return 2
+	}
+
+	t := &selfTest{server: *server, user: *user, signer: signer, httpPort: *httpPort, httpAddr: *httpAddr, tcpHost: *tcpHost, timeout: *timeout}
+	checks := []struct {
+		name string
+		run  func(ctx context.Context) error
+	}{
+		{"http tunnel", func(ctx context.Context) error { return t.checkHTTP(ctx, false) }},
+		{"http tunnel (mux)", func(ctx context.Context) error { return t.checkHTTP(ctx, true) }},
+		{"tcp tunnel", t.checkTCP},
+	}
+	failed := 0
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+		start := time.Now()
+		err := c.run(ctx)
+		cancel()
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL %s: %s\n", c.name, err)
+			continue
+		}
+		fmt.Fprintf(out, "PASS %s (%s)\n", c.name, time.Since(start).Round(time.Millisecond))
+	}
+	if failed > 0 {
+		fmt.Fprintf(out, "%d of %d checks failed\n", failed, len(checks))
+		return 1
+	}
+	return 0
+}
+
+// loadClientKey reads the private key of a client from file.
+func loadClientKey(file string) (ssh.Signer, error) {
+	keyBytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: %w", err)
+	}
+	return signer, nil
+}
+
+// openTunnel connects to the server with the tunnel options and forwards the remote port to handle. It returns the
+// public address of the tunnel.
+func (t *selfTest) openTunnel(ctx context.Context, options string, port int, handle func(net.Conn)) (string, func(), error) {
+	tunnel, err := dialTunnel(ctx, t.server, &ssh.ClientConfig{
+		User:            t.user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(t.signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         t.timeout,
+	}, options, port, handle)
+	if err != nil {
+		return "", nil, err
+	}
+	return tunnel.address, func() { tunnel.client.Close() }, nil
+}
+
+// openedTunnel is a tunnel opened on a server by dialTunnel.
+type openedTunnel struct {
+	client  *ssh.Client
+	address string        // Public address of the tunnel, the first line written by the server
+	output  *bufio.Reader // Lines written by the server after the address (eg received requests)
+	session *ssh.Session
+	started <-chan error // Result of starting session
+}
+
+// Ended returns true if the server ended the session of the tunnel with exit status 0, which it does when it closes
+// the tunnel for good (eg idle-timeout). It must be called once output is drained.
+func (t *openedTunnel) Ended() bool {
+	if err := <-t.started; err != nil {
+		return false
+	}
+	return t.session.Wait() == nil
+}
+
+// dialTunnel connects to server with config, requests a tunnel with options and forwards the remote port to handle.
+// The connection is closed once ctx is done.
+func dialTunnel(ctx context.Context, server string, config *ssh.ClientConfig, options string, port int, handle func(net.Conn)) (*openedTunnel, error) {
+	client, err := ssh.Dial("tcp", server, config)
+	if err != nil {
+		return nil, err
+	}
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-closed:
+		}
+	}()
+
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	stdout, _ := session.StdoutPipe()
+	// The server waits for the port forward before replying to the exec request
+	started := make(chan error, 1)
+	go func() {
+		started <- session.Start(options)
+	}()
+
+	ln, err := client.Listen("tcp", net.JoinHostPort("0.0.0.0", strconv.Itoa(port)))
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("port forward rejected: %w", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	output := bufio.NewReader(stdout)
+	line, err := output.ReadString('\n')
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("reading tunnel address: %w", err)
+	}
+	return &openedTunnel{client: client, address: strings.TrimSpace(line), output: output, session: session, started: started}, nil
+}
+
+// checkHTTP sends a request through an HTTP tunnel, multiplexed over one channel if mux is true.
+func (t *selfTest) checkHTTP(ctx context.Context, mux bool) error {
+	token := newRequestID()
+	tunnelName := "selftest-" + token[:8]
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, token)
+	})
+	options := "type=http,tunnelName=" + tunnelName
+	if mux {
+		options += ",mux=true"
+	}
+	tunnelURL, closeTunnel, err := t.openTunnel(ctx, options, t.httpPort, serveTunnelHTTP(handler, mux))
+	if err != nil {
+		return err
+	}
+	defer closeTunnel()
+
+	u, transport, err := t.httpTransport(tunnelURL)
+	if err != nil {
+		return err
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK || string(body) != token {
+		return fmt.Errorf("GET %s: %s %q", u, resp.Status, body)
+	}
+	return nil
+}
+
+// serveTunnelHTTP returns a handler of the channels of an HTTP tunnel that serves their requests with handler.
+// With mux, the only channel carries the requests as streams.
+func serveTunnelHTTP(handler http.Handler, mux bool) func(net.Conn) {
+	serve := func(conn net.Conn) {
+		http.Serve(&singleConnListener{conn: conn}, handler)
+	}
+	if !mux {
+		return serve
+	}
+	return func(conn net.Conn) {
+		session := newMuxSession(conn, false)
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go serve(stream)
+		}
+	}
+}
+
+// httpTransport returns the URL to send requests to the tunnel at tunnelURL and a transport that reaches it,
+// through httpAddr if set.
+func (t *selfTest) httpTransport(tunnelURL string) (*url.URL, *http.Transport, error) {
+	u, err := url.Parse(tunnelURL)
+	if err != nil || u.Host == "" {
+		return nil, nil, fmt.Errorf("invalid tunnel URL %q", tunnelURL)
+	}
+	transport := &http.Transport{}
+	if t.httpAddr != "" {
+		// Plain http to the listener with the Host of the tunnel URL
+		u.Scheme = "http"
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, t.httpAddr)
+		}
+	}
+	return u, transport, nil
+}
+
+func (t *selfTest) checkTCP(ctx context.Context) error {
+	addr, closeTunnel, err := t.openTunnel(ctx, "type=tcp", 0, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+	if err != nil {
+		return err
+	}
+	defer closeTunnel()
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid tunnel address %q", addr)
+	}
+	if t.tcpHost != "" {
+		host = t.tcpHost
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	token := newRequestID()
+	if _, err := io.WriteString(conn, token); err != nil {
+		return err
+	}
+	echo := make([]byte, len(token))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		return fmt.Errorf("reading echo from %s: %w", conn.RemoteAddr(), err)
+	}
+	if string(echo) != token {
+		return fmt.Errorf("echo from %s: got %q, want %q", conn.RemoteAddr(), echo, token)
+	}
+	return nil
+}
+
+// singleConnListener is a net.Listener that accepts conn once, to serve a forwarded connection with net/http.
+type singleConnListener struct {
+	conn net.Conn
+	done bool
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if l.done {
+		return nil, errors.New("listener closed")
+	}
+	l.done = true
+	return l.conn, nil
+}
+
+func (l *singleConnListener) Close() error   { return nil }
+func (l *singleConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
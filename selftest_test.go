@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("selftest", func() {
+	It("should require a client key", func() {
+		var out bytes.Buffer
+		Expect(runSelfTest([]string{"--server=localhost:1"}, &out)).To(Equal(2))
+		Expect(out.String()).To(ContainSubstring("--key is required"))
+	})
+
+	It("should accept a forwarded connection once", func() {
+		client, server := net.Pipe()
+		defer client.Close()
+		ln := &singleConnListener{conn: server}
+		conn, err := ln.Accept()
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(conn).To(BeIdenticalTo(server))
+		_, err = ln.Accept()
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Server header value that removes the header instead of overriding it.
+const serverHeaderHidden = "none"
+
+// applyServerHeader hides or overrides the Server header of a relayed response according to value.
+func applyServerHeader(h *httpProcessor, value string) {
+	switch value {
+	case "":
+	case serverHeaderHidden:
+		h.RemoveHeader("Server")
+	default:
+		h.RemoveHeader("Server")
+		h.AddHeader("Server", value)
+	}
+}
+
+// writeErrorResponse writes a response generated by the server itself (eg 400 Bad Request) to the visitor.
+// server is the Server header value as in applyServerHeader and headers are extra header lines (eg Retry-After: 30).
+// The request ID is echoed in a header and in the body so that visitors can report it.
+func writeErrorResponse(w io.Writer, server string, requestID string, status string, body string, headers ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 %s\r\nContent-Type:text/html\r\nX-Request-Id: %s\r\n", status, requestID)
+	if server != "" && server != serverHeaderHidden {
+		fmt.Fprintf(&b, "Server: %s\r\n", server)
+	}
+	for _, header := range headers {
+		b.WriteString(header + "\r\n")
+	}
+	fmt.Fprintf(&b, "\r\n%s Request ID: %s", body, requestID)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
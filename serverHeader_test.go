@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("serverHeader", func() {
+	response := "HTTP/1.1 200 OK\r\nServer: Kestrel\r\nContent-Length: 2\r\n\r\nok"
+
+	relay := func(value string) string {
+		sut := newHttpProcessor(strings.NewReader(response), make([]byte, len(response)))
+		applyServerHeader(sut, value)
+		p, err := io.ReadAll(sut.GetReader())
+		Expect(err).To(Not(HaveOccurred()))
+		return string(p)
+	}
+
+	It("should keep the Server header of the backend by default", func() {
+		Expect(relay("")).To(Equal(response))
+	})
+
+	It("should hide the Server header", func() {
+		Expect(relay(serverHeaderHidden)).To(Equal("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	})
+
+	It("should override the Server header", func() {
+		Expect(relay("tunnel")).To(Equal("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nServer: tunnel\r\n\r\nok"))
+	})
+
+	It("should add the Server header to generated responses only when overridden", func() {
+		var b strings.Builder
+		Expect(writeErrorResponse(&b, "", "abc", "403 Forbidden", "No.")).To(Succeed())
+		Expect(b.String()).To(Equal("HTTP/1.1 403 Forbidden\r\nContent-Type:text/html\r\nX-Request-Id: abc\r\n\r\nNo. Request ID: abc"))
+
+		b.Reset()
+		Expect(writeErrorResponse(&b, "tunnel", "abc", "503 Service Unavailable", "No.", "Retry-After: 30")).To(Succeed())
+		Expect(b.String()).To(Equal("HTTP/1.1 503 Service Unavailable\r\nContent-Type:text/html\r\nX-Request-Id: abc\r\nServer: tunnel\r\nRetry-After: 30\r\n\r\nNo. Request ID: abc"))
+	})
+})
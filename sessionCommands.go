@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Commands that can be sent in the exec request instead of the tunnel options (eg `ssh -p 5223 domain.io replay 3`).
+// These run without a port forward and close the session channel once they finish.
+var sessionCommands map[string]func(session *commandSession, args []string) error
+
+func init() {
+	sessionCommands = map[string]func(session *commandSession, args []string) error{
+		"replay": replayCommand,
+		"stats":  statsCommand,
+		"list":   listCommand,
+		"close":  closeCommand,
+	}
+}
+
+type commandSession struct {
+	conn        *ssh.ServerConn
+	channel     ssh.Channel
+	fingerprint string // Public key fingerprint of the caller
+}
+
+// findSessionCommand returns the command and its arguments if the exec request is a session command.
+func findSessionCommand(execRequest string) (func(session *commandSession, args []string) error, []string, bool) {
+	fields := strings.Fields(execRequest)
+	if len(fields) == 0 {
+		return nil, nil, false
+	}
+	command, ok := sessionCommands[strings.ToLower(fields[0])]
+	return command, fields[1:], ok
+}
+
+// runSessionCommand runs the command, reports its exit status to the client and closes the channel.
+func runSessionCommand(command func(session *commandSession, args []string) error, args []string, conn *ssh.ServerConn, channel ssh.Channel) {
+	defer channel.Close()
+
+	session := &commandSession{
+		conn:        conn,
+		channel:     channel,
+		fingerprint: conn.Permissions.Extensions["pubkey-fp"],
+	}
+
+	var exitStatus = struct{ Status uint32 }{0}
+	if err := command(session, args); err != nil {
+		log.Printf("error running command for session %s: %s", hex.EncodeToString(conn.SessionID()), err)
+		fmt.Fprintf(channel.Stderr(), "%s\n", err)
+		exitStatus.Status = 1
+	}
+	channel.SendRequest("exit-status", false, ssh.Marshal(&exitStatus))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Formats of the request lines written to the SSH session of a tunnel client (log=).
+const (
+	sessionLogPlain = "plain"
+	sessionLogJSON  = "json"
+	sessionLogOff   = "off" // Silences the request lines
+)
+
+// Request details that a client can add to its request lines with log-field=.
+const (
+	sessionLogMethod   = "method"
+	sessionLogPath     = "path"
+	sessionLogStatus   = "status"
+	sessionLogDuration = "duration"
+	sessionLogBytes    = "bytes"
+)
+
+// sessionLog formats the request lines of a tunnel client. The zero value writes a plain line when a request is
+// received. With fields or the json format, the line is written when the request ends instead so that it can include
+// the status, duration and bytes of the response.
+type sessionLog struct {
+	format string
+	fields []string
+}
+
+// SetFormat sets the format of the request lines to plain, json or off.
+func (l *sessionLog) SetFormat(format string) error {
+	format = strings.ToLower(format)
+	if format != sessionLogPlain && format != sessionLogJSON && format != sessionLogOff {
+		return fmt.Errorf("invalid log value %s", format)
+	}
+	l.format = format
+	return nil
+}
+
+// AddField adds a request detail to the request lines. Fields are written in the order they are added.
+func (l *sessionLog) AddField(field string) error {
+	field = strings.ToLower(field)
+	switch field {
+	case sessionLogMethod, sessionLogPath, sessionLogStatus, sessionLogDuration, sessionLogBytes:
+		l.fields = append(l.fields, field)
+		return nil
+	}
+	return fmt.Errorf("invalid log-field value %s", field)
+}
+
+// Silent returns true if no lines should be written.
+func (l sessionLog) Silent() bool {
+	return l.format == sessionLogOff
+}
+
+// atEnd returns true if the line of a request is written when the request ends.
+func (l sessionLog) atEnd() bool {
+	return len(l.fields) > 0 || l.format == sessionLogJSON
+}
+
+// Received returns the line written when a request is received or an empty string.
+func (l sessionLog) Received(requestID string, remoteAddr string) string {
+	if l.Silent() || l.atEnd() {
+		return ""
+	}
+	return fmt.Sprintf("Received http request %s from %s\n", requestID, remoteAddr)
+}
+
+// ReceivedTCP returns the line written when a TCP tunnel receives a connection or an empty string.
+func (l sessionLog) ReceivedTCP(remoteAddr string) string {
+	if l.Silent() {
+		return ""
+	}
+	if l.format == sessionLogJSON {
+		b, _ := json.Marshal(map[string]string{"remoteAddr": remoteAddr})
+		return string(b) + "\n"
+	}
+	return fmt.Sprintf("Received tcp request from %s\n", remoteAddr)
+}
+
+// Ended returns the line written when the request of e ends or an empty string.
+func (l sessionLog) Ended(e *accessLogEntry) string {
+	if l.Silent() || !l.atEnd() {
+		return ""
+	}
+
+	if l.format == sessionLogJSON {
+		line := map[string]interface{}{"requestId": e.RequestID, "remoteAddr": e.RemoteAddr}
+		for _, field := range l.fields {
+			switch field {
+			case sessionLogMethod:
+				line["method"] = e.Method
+			case sessionLogPath:
+				line["path"] = e.URI
+			case sessionLogStatus:
+				line["status"] = e.Status
+			case sessionLogDuration:
+				line["durationMs"] = e.Duration.Milliseconds()
+			case sessionLogBytes:
+				line["bytes"] = e.Bytes
+			}
+		}
+		b, _ := json.Marshal(line)
+		return string(b) + "\n"
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Http request %s from %s", e.RequestID, e.RemoteAddr)
+	for _, field := range l.fields {
+		switch field {
+		case sessionLogMethod:
+			sb.WriteString(" " + e.Method)
+		case sessionLogPath:
+			sb.WriteString(" " + e.URI)
+		case sessionLogStatus:
+			fmt.Fprintf(&sb, " %d", e.Status)
+		case sessionLogDuration:
+			fmt.Fprintf(&sb, " %s", e.Duration.Round(time.Millisecond))
+		case sessionLogBytes:
+			fmt.Fprintf(&sb, " %dB", e.Bytes)
+		}
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sessionLog", func() {
+	entry := &accessLogEntry{
+		RequestID:  "abc",
+		RemoteAddr: "10.0.0.1",
+		Method:     "GET",
+		URI:        "/index.html",
+		Status:     200,
+		Bytes:      512,
+		Duration:   1500 * time.Microsecond,
+	}
+
+	It("should write the received line by default", func() {
+		var l sessionLog
+		Expect(l.Received("abc", "10.0.0.1:5000")).To(Equal("Received http request abc from 10.0.0.1:5000\n"))
+		Expect(l.Ended(entry)).To(BeEmpty())
+	})
+
+	It("should write the fields when the request ends", func() {
+		var l sessionLog
+		for _, field := range []string{"method", "path", "status", "duration", "bytes"} {
+			Expect(l.AddField(field)).To(Succeed())
+		}
+		Expect(l.Received("abc", "10.0.0.1:5000")).To(BeEmpty())
+		Expect(l.Ended(entry)).To(Equal("Http request abc from 10.0.0.1 GET /index.html 200 2ms 512B\n"))
+	})
+
+	It("should write json lines", func() {
+		var l sessionLog
+		Expect(l.SetFormat("json")).To(Succeed())
+		Expect(l.AddField("status")).To(Succeed())
+		Expect(l.Ended(entry)).To(MatchJSON(`{"requestId":"abc","remoteAddr":"10.0.0.1","status":200}`))
+		Expect(l.ReceivedTCP("10.0.0.1:5000")).To(MatchJSON(`{"remoteAddr":"10.0.0.1:5000"}`))
+	})
+
+	It("should write the line of TCP connections", func() {
+		var l sessionLog
+		Expect(l.ReceivedTCP("10.0.0.1:5000")).To(Equal("Received tcp request from 10.0.0.1:5000\n"))
+		Expect(l.SetFormat("off")).To(Succeed())
+		Expect(l.ReceivedTCP("10.0.0.1:5000")).To(BeEmpty())
+	})
+
+	It("should be silenced", func() {
+		var l sessionLog
+		Expect(l.SetFormat("off")).To(Succeed())
+		Expect(l.AddField("status")).To(Succeed())
+		Expect(l.Received("abc", "10.0.0.1:5000")).To(BeEmpty())
+		Expect(l.Ended(entry)).To(BeEmpty())
+	})
+
+	It("should be silenced for private tunnels whatever the other options", func() {
+		options, err := parseTunnelOptions("type=http,inspect=false,har=true,log=json,log-field=status")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.private).To(BeTrue())
+		Expect(options.har).To(BeFalse())
+		Expect(options.sessionLog.Received("abc", "10.0.0.1:5000")).To(BeEmpty())
+		Expect(options.sessionLog.Ended(entry)).To(BeEmpty())
+
+		options, err = parseTunnelOptions(`{"version":1,"type":"http","inspect":false}`)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.private).To(BeTrue())
+		Expect(options.sessionLog.Ended(entry)).To(BeEmpty())
+
+		_, err = parseTunnelOptions("type=http,inspect=maybe")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject unknown formats and fields", func() {
+		var l sessionLog
+		Expect(l.SetFormat("xml")).To(Not(Succeed()))
+		Expect(l.AddField("cookies")).To(Not(Succeed()))
+	})
+})
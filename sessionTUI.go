@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Interval between redraws of the terminal UI.
+const tuiRefreshInterval = 500 * time.Millisecond
+
+// Session lines kept by the terminal UI.
+const tuiMaxLines = 500
+
+// Exec request of interactive sessions without a command (eg ssh -R 80:localhost:3000 domain.io).
+const tuiDefaultRequest = "type=http"
+
+// Terminal size when the client does not send one.
+const (
+	tuiDefaultColumns = 80
+	tuiDefaultRows    = 24
+)
+
+// Escape sequences of the terminal UI.
+const (
+	tuiEnter     = "\x1b[?1049h\x1b[?25l" // Alternate screen, hidden cursor
+	tuiLeave     = "\x1b[?25h\x1b[?1049l"
+	tuiHome      = "\x1b[H"
+	tuiClearLine = "\x1b[K"
+	tuiClearDown = "\x1b[J"
+)
+
+// ptyRequest is the payload of a pty-req request. See RFC 4254 6.2.
+type ptyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+// windowChangeRequest is the payload of a window-change request. See RFC 4254 6.7.
+type windowChangeRequest struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// sessionTUI is the terminal UI of the sessions that request a PTY (ssh -t, or no command). It wraps the session
+// channel: the lines written to the session (the tunnel URL, warnings and request lines) are kept and redrawn below
+// a header with the URL of the tunnel, its rates and errors.
+type sessionTUI struct {
+	ssh.Channel
+	quit func() // Closes the session when the user presses q or Ctrl+C
+
+	mu      sync.Mutex
+	columns int
+	rows    int
+	url     string
+	stats   *tunnelStats
+	lines   []string
+	partial []byte // Start of the next line until its \n is written
+	// Counters of stats at the previous redraw, and the rates per second since then
+	sampled      time.Time
+	requests     int64
+	bytesIn      int64
+	bytesOut     int64
+	requestRate  float64
+	bytesInRate  float64
+	bytesOutRate float64
+}
+
+func newSessionTUI(channel ssh.Channel, pty ptyRequest, quit func()) *sessionTUI {
+	t := &sessionTUI{Channel: channel, quit: quit}
+	t.Resize(pty.Columns, pty.Rows)
+	return t
+}
+
+// Write keeps the lines written to the session for the next redraw instead of writing them to the channel.
+func (t *sessionTUI) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.lines = append(t.lines, strings.TrimRight(string(t.partial[:i]), "\r"))
+		t.partial = append(t.partial[:0], t.partial[i+1:]...)
+	}
+	if len(t.lines) > tuiMaxLines {
+		t.lines = append([]string{}, t.lines[len(t.lines)-tuiMaxLines:]...)
+	}
+	return len(p), nil
+}
+
+// Opened shows the URL and the traffic of the tunnel once it is open.
+func (t *sessionTUI) Opened(url string, stats *tunnelStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.url, t.stats = url, stats
+}
+
+// Resize sets the size of the terminal, eg after a window-change request.
+func (t *sessionTUI) Resize(columns uint32, rows uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.columns, t.rows = int(columns), int(rows)
+	if t.columns <= 0 {
+		t.columns = tuiDefaultColumns
+	}
+	if t.rows <= 0 {
+		t.rows = tuiDefaultRows
+	}
+}
+
+// Run redraws the UI until the session ends or the user presses q or Ctrl+C.
+func (t *sessionTUI) Run() {
+	// Closed once the user presses a key that quits; the end of the input (eg ssh -n) does not quit
+	keys := make(chan struct{})
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := t.Channel.Read(buf)
+			if bytes.ContainsAny(buf[:n], "qQ\x03") {
+				close(keys)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	io.WriteString(t.Channel, tuiEnter)
+	ticker := time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+	for {
+		t.mu.Lock()
+		t.sample(time.Now())
+		screen := t.render()
+		t.mu.Unlock()
+		if _, err := io.WriteString(t.Channel, screen); err != nil {
+			return
+		}
+
+		select {
+		case <-keys:
+			io.WriteString(t.Channel, tuiLeave)
+			t.quit()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample updates the rates with the counters of the tunnel at now.
+func (t *sessionTUI) sample(now time.Time) {
+	if t.stats == nil {
+		return
+	}
+	requests, bytesIn, bytesOut := t.stats.requests.Load(), t.stats.bytesIn.Load(), t.stats.bytesOut.Load()
+	if !t.sampled.IsZero() {
+		if seconds := now.Sub(t.sampled).Seconds(); seconds > 0 {
+			t.requestRate = float64(requests-t.requests) / seconds
+			t.bytesInRate = float64(bytesIn-t.bytesIn) / seconds
+			t.bytesOutRate = float64(bytesOut-t.bytesOut) / seconds
+		}
+	}
+	t.sampled, t.requests, t.bytesIn, t.bytesOut = now, requests, bytesIn, bytesOut
+}
+
+// render returns the escape sequences that draw the screen over the previous one.
+func (t *sessionTUI) render() string {
+	header := []string{"tunnel - press q or Ctrl+C to close the tunnel", ""}
+	if t.stats == nil {
+		header = append(header, fmt.Sprintf("%-12s%s", "URL", "opening..."))
+	} else {
+		header = append(header,
+			fmt.Sprintf("%-12s%s", "URL", t.url),
+			fmt.Sprintf("%-12s%d (%.1f/s), %d in progress", "Requests", t.requests, t.requestRate, t.stats.connections.Load()),
+			fmt.Sprintf("%-12s%d", "Errors", t.stats.errors.Load()),
+			fmt.Sprintf("%-12sin %s (%s/s), out %s (%s/s)", "Traffic", formatBytes(float64(t.bytesIn)),
+				formatBytes(t.bytesInRate), formatBytes(float64(t.bytesOut)), formatBytes(t.bytesOutRate)))
+	}
+	header = append(header, "")
+
+	lines := t.lines
+	if n := t.rows - len(header); n <= 0 {
+		lines = nil
+	} else if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	var b strings.Builder
+	b.WriteString(tuiHome)
+	for i, line := range append(header, lines...) {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(truncateColumns(line, t.columns))
+		b.WriteString(tuiClearLine)
+	}
+	b.WriteString(tuiClearDown)
+	return b.String()
+}
+
+// truncateColumns cuts s to the width of the terminal.
+func truncateColumns(s string, columns int) string {
+	if utf8.RuneCountInString(s) <= columns {
+		return s
+	}
+	return string([]rune(s)[:columns])
+}
+
+// formatBytes formats n bytes with a binary unit (eg 1.5 KB).
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	i := 0
+	for ; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sessionTUI", func() {
+	// screenLines returns the lines of a rendered screen without escape sequences
+	screenLines := func(screen string) []string {
+		for _, sequence := range []string{tuiHome, tuiClearLine, tuiClearDown} {
+			screen = strings.ReplaceAll(screen, sequence, "")
+		}
+		return strings.Split(screen, "\r\n")
+	}
+
+	It("should keep the lines written to the session", func() {
+		t := newSessionTUI(nil, ptyRequest{}, func() {})
+		io.WriteString(t, "https://abc.domain.io\nReceived http ")
+		Expect(t.lines).To(Equal([]string{"https://abc.domain.io"}))
+		io.WriteString(t, "request abc from 10.0.0.1:5000\r\n")
+		Expect(t.lines).To(Equal([]string{"https://abc.domain.io", "Received http request abc from 10.0.0.1:5000"}))
+
+		for i := 0; i < tuiMaxLines; i++ {
+			io.WriteString(t, "line\n")
+		}
+		Expect(t.lines).To(HaveLen(tuiMaxLines))
+	})
+
+	It("should draw the tunnel and the last lines that fit the terminal", func() {
+		t := newSessionTUI(nil, ptyRequest{Columns: 30, Rows: 10}, func() {})
+		Expect(screenLines(t.render())).To(ContainElement("URL         opening..."))
+
+		stats := newTunnelStats(0)
+		t.Opened("https://abc.domain.io", stats)
+		for _, line := range []string{"first", "second", "third", strings.Repeat("x", 40)} {
+			io.WriteString(t, line+"\n")
+		}
+		stats.Begin()
+		stats.End(100, 2048)
+		stats.errors.Add(1)
+		start := time.Now()
+		t.sample(start)
+		stats.Begin()
+		stats.End(100, 2048)
+		t.sample(start.Add(2 * time.Second))
+
+		lines := screenLines(t.render())
+		Expect(lines).To(HaveLen(10))
+		Expect(lines[2]).To(Equal("URL         https://abc.domain"))
+		Expect(lines[3]).To(Equal("Requests    2 (0.5/s), 0 in pr"))
+		Expect(lines[4]).To(Equal("Errors      1"))
+		Expect(lines[5]).To(Equal("Traffic     in 200 B (50 B/s),"))
+		Expect(lines[7:]).To(Equal([]string{"second", "third", strings.Repeat("x", 30)}))
+
+		t.Resize(0, 0)
+		Expect(t.columns).To(Equal(tuiDefaultColumns))
+		Expect(t.rows).To(Equal(tuiDefaultRows))
+	})
+
+	It("should format bytes", func() {
+		Expect(formatBytes(512)).To(Equal("512 B"))
+		Expect(formatBytes(1536)).To(Equal("1.5 KB"))
+		Expect(formatBytes(3 << 30)).To(Equal("3.0 GB"))
+	})
+})
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameter of share links (eg https://demo.domain.io/?t=TOKEN), removed before the request reaches the client.
+const shareLinkParam = "t"
+
+// Cookie that keeps the token of a share link so that the links and assets of the shared page work without it.
+const shareLinkCookieName = "tunnel_share"
+
+// Secret signing the tokens of share links (share-link=) and the cookies of password pages; see --shareLinkSecret.
+var shareLinkSecret string
+
+// newShareLinkSecret returns a random secret for servers not given one, whose share links stop working on restart.
+func newShareLinkSecret() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, randomBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+// shareLinkToken returns the token letting visitors in the tunnel tunnelName of the key with fingerprint until
+// expires: the expiry in Unix seconds and its HMAC-SHA256 with the tunnel name and the fingerprint. The link does not
+// let visitors in the tunnel of another key that takes the name later.
+func shareLinkToken(tunnelName string, fingerprint string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + shareLinkSignature(tunnelName, fingerprint, expiry)
+}
+
+func shareLinkSignature(tunnelName string, fingerprint string, expiry string) string {
+	mac := hmac.New(sha256.New, []byte(shareLinkSecret))
+	io.WriteString(mac, tunnelName+"\n"+fingerprint+"\n"+expiry)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareLinkExpiry returns when token expires if it was signed for tunnelName of the key with fingerprint and has not
+// expired yet.
+func shareLinkExpiry(tunnelName string, fingerprint string, token string, now time.Time) (time.Time, bool) {
+	expiry, signature, found := cut(token, ".")
+	if !found {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || !now.Before(time.Unix(seconds, 0)) {
+		return time.Time{}, false
+	}
+	if !hmac.Equal([]byte(signature), []byte(shareLinkSignature(tunnelName, fingerprint, expiry))) {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// shareLinkURL returns tunnelURL with a token valid for ttl.
+func shareLinkURL(tunnelURL string, tunnelName string, fingerprint string, ttl time.Duration) string {
+	return strings.TrimSuffix(tunnelURL, "/") + "/?" + shareLinkParam + "=" + shareLinkToken(tunnelName, fingerprint, time.Now().Add(ttl))
+}
+
+// shareLinkRequestToken returns the token of a request, from the query of requestURI or else from the cookie, and
+// requestURI without the token.
+func shareLinkRequestToken(requestURI string, cookies []string) (token string, uri string, fromQuery bool) {
+	if path, rawQuery, found := cut(requestURI, "?"); found {
+		query, err := url.ParseQuery(rawQuery)
+		if err == nil && query.Get(shareLinkParam) != "" {
+			token = query.Get(shareLinkParam)
+			query.Del(shareLinkParam)
+			if encoded := query.Encode(); encoded != "" {
+				path += "?" + encoded
+			}
+			return token, path, true
+		}
+	}
+	request := http.Request{Header: http.Header{"Cookie": cookies}}
+	if cookie, err := request.Cookie(shareLinkCookieName); err == nil {
+		token = cookie.Value
+	}
+	return token, requestURI, false
+}
+
+// shareLinkCookie returns the Set-Cookie value keeping token for the URLs under path until expires.
+func shareLinkCookie(token string, expires time.Time, path string) string {
+	return (&http.Cookie{Name: shareLinkCookieName, Value: token, Path: path, Expires: expires, HttpOnly: true, SameSite: http.SameSiteLaxMode}).String()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("share links", func() {
+	BeforeEach(func() {
+		shareLinkSecret = "s3cret"
+	})
+
+	It("should only accept unexpired tokens of the tunnel and its key", func() {
+		now := time.Unix(1700000000, 0)
+		token := shareLinkToken("demo", "SHA256:key", now.Add(time.Hour))
+		Expect(token).To(HavePrefix("1700003600."))
+
+		expires, ok := shareLinkExpiry("demo", "SHA256:key", token, now)
+		Expect(ok).To(BeTrue())
+		Expect(expires).To(Equal(now.Add(time.Hour)))
+		_, ok = shareLinkExpiry("demo", "SHA256:key", token, now.Add(time.Hour))
+		Expect(ok).To(BeFalse())
+		_, ok = shareLinkExpiry("other", "SHA256:key", token, now)
+		Expect(ok).To(BeFalse())
+		_, ok = shareLinkExpiry("demo", "SHA256:other", token, now)
+		Expect(ok).To(BeFalse())
+		_, ok = shareLinkExpiry("demo", "SHA256:key", strings.Replace(token, "1700003600", "1700007200", 1), now)
+		Expect(ok).To(BeFalse())
+		_, ok = shareLinkExpiry("demo", "SHA256:key", "", now)
+		Expect(ok).To(BeFalse())
+
+		shareLinkSecret = "other"
+		_, ok = shareLinkExpiry("demo", "SHA256:key", token, now)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should take the token from the query or else the cookie", func() {
+		token, uri, fromQuery := shareLinkRequestToken("/page?a=1&t=123.abc", nil)
+		Expect([]interface{}{token, uri, fromQuery}).To(Equal([]interface{}{"123.abc", "/page?a=1", true}))
+		token, uri, fromQuery = shareLinkRequestToken("/?t=123.abc", nil)
+		Expect([]interface{}{token, uri, fromQuery}).To(Equal([]interface{}{"123.abc", "/", true}))
+		token, uri, fromQuery = shareLinkRequestToken("/app.js", []string{"a=b; tunnel_share=123.abc"})
+		Expect([]interface{}{token, uri, fromQuery}).To(Equal([]interface{}{"123.abc", "/app.js", false}))
+		token, _, _ = shareLinkRequestToken("/app.js?v=2", nil)
+		Expect(token).To(BeEmpty())
+	})
+
+	It("should build the share link and its cookie", func() {
+		link := shareLinkURL("https://demo.domain.io", "demo", "SHA256:key", time.Hour)
+		Expect(link).To(HavePrefix("https://demo.domain.io/?t="))
+		_, ok := shareLinkExpiry("demo", "SHA256:key", strings.TrimPrefix(link, "https://demo.domain.io/?t="), time.Now())
+		Expect(ok).To(BeTrue())
+		Expect(shareLinkCookie("123.abc", time.Unix(1700003600, 0), "/demo")).To(Equal(
+			"tunnel_share=123.abc; Path=/demo; Expires=Tue, 14 Nov 2023 23:13:20 GMT; HttpOnly; SameSite=Lax"))
+	})
+
+	It("should parse the share-link option", func() {
+		options, err := parseTunnelOptions("type=http,share-link=1h")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.shareLink).To(Equal(time.Hour))
+		_, err = parseTunnelOptions("share-link=0s")
+		Expect(err).To(MatchError("invalid share-link value 0s"))
+	})
+})
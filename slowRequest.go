@@ -0,0 +1,29 @@
+package main
+
+import (
+	"expvar"
+	"time"
+)
+
+// Slow requests since start by reason (ttfb or duration), published at /debug/vars of the pprof port.
+var slowRequests = expvar.NewMap("slowRequests")
+
+const (
+	slowReasonTTFB     = "ttfb"
+	slowReasonDuration = "duration"
+)
+
+// slowRequestReasons returns the thresholds exceeded by a request that took ttfb to get the first response byte
+// and duration in total. ttfb is 0 when the backend did not respond. The duration of streaming responses is not
+// checked since they stay open by design.
+func slowRequestReasons(ttfb, duration time.Duration, streaming bool) []string {
+	var reasons []string
+	thresholds := settings()
+	if thresholds.slowRequestTTFB > 0 && ttfb > thresholds.slowRequestTTFB {
+		reasons = append(reasons, slowReasonTTFB)
+	}
+	if thresholds.slowRequestDuration > 0 && !streaming && duration > thresholds.slowRequestDuration {
+		reasons = append(reasons, slowReasonDuration)
+	}
+	return reasons
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("slowRequest", func() {
+	var previous *runtimeSettings
+	BeforeEach(func() {
+		previous = settings()
+		updateSettings(func(s *runtimeSettings) {
+			s.slowRequestTTFB = time.Second
+			s.slowRequestDuration = 5 * time.Second
+		})
+	})
+	AfterEach(func() {
+		currentSettings.Store(previous)
+	})
+
+	It("should not report requests within the thresholds", func() {
+		Expect(slowRequestReasons(500*time.Millisecond, 2*time.Second, false)).To(BeEmpty())
+	})
+
+	It("should report each exceeded threshold", func() {
+		Expect(slowRequestReasons(2*time.Second, 2*time.Second, false)).To(Equal([]string{slowReasonTTFB}))
+		Expect(slowRequestReasons(2*time.Second, 10*time.Second, false)).To(Equal([]string{slowReasonTTFB, slowReasonDuration}))
+	})
+
+	It("should not check the duration of streaming responses", func() {
+		Expect(slowRequestReasons(0, time.Minute, true)).To(BeEmpty())
+	})
+
+	It("should ignore disabled thresholds", func() {
+		updateSettings(func(s *runtimeSettings) {
+			s.slowRequestTTFB = 0
+			s.slowRequestDuration = 0
+		})
+		Expect(slowRequestReasons(time.Minute, time.Hour, false)).To(BeEmpty())
+	})
+})
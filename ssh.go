@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -14,6 +16,67 @@ type sshConnection struct {
 	reqPayload      *remoteForwardRequest
 	sshChannel      *ssh.Channel
 	cancellationCtx context.Context
+	tunnelAliases   []string // Other names of the HTTP tunnel, added with the tunnel-control subsystem
+	replier         *sessionReplier
+	probe           func() // Probe of the tunnel run once the client has the reply to its tcpip-forward request
+	// Set once the connection closed and its tunnels were cleaned up (see sweepOrphanedTunnels)
+	closed atomic.Bool
+	// Closed once the tcpip-forward request no longer waits for the exec request (see execRequestWait)
+	execWaitOver     chan struct{}
+	execWaitOverOnce sync.Once
+	// Closed once the client opened the session channel whose exec request carries the options of the tunnel
+	sessionOpened     chan struct{}
+	sessionOpenedOnce sync.Once
+	// Closed once the session channel of the tunnel is known to carry no exec request (eg a subsystem request)
+	noExecRequest     chan struct{}
+	noExecRequestOnce sync.Once
+	// Keepalive requests sent to the client without a reply since it was last known alive
+	missingKeepalives atomic.Int32
+	// Keepalive settings of the client (keepalive-interval= and keepalive-count=); 0 for the server defaults
+	keepaliveInterval atomic.Int64
+	keepaliveMaxCount atomic.Int32
+}
+
+// SetKeepalive overrides the keepalive settings of the server for this client. 0 keeps the server default.
+func (c *sshConnection) SetKeepalive(interval time.Duration, maxCount int) {
+	c.keepaliveInterval.Store(int64(interval))
+	c.keepaliveMaxCount.Store(int32(maxCount))
+}
+
+// Keepalive returns the time between keepalive requests sent to the client and how many it may leave unanswered.
+func (c *sshConnection) Keepalive() (time.Duration, int) {
+	interval, maxCount := clientKeepaliveInterval, clientKeepaliveMaxCount
+	if i := c.keepaliveInterval.Load(); i > 0 {
+		interval = time.Duration(i)
+	}
+	if n := c.keepaliveMaxCount.Load(); n > 0 {
+		maxCount = int(n)
+	}
+	return interval, maxCount
+}
+
+// Fingerprint returns the SHA256 fingerprint of the key of the client, empty if it did not use one.
+func (c *sshConnection) Fingerprint() string {
+	if c.Permissions == nil {
+		return ""
+	}
+	return c.Permissions.Extensions["pubkey-fp"]
+}
+
+// MaxTunnelAge returns the age at which the tunnels of the connection are closed: the max-tunnel-age option of its
+// key if any, or else the maxTunnelAge setting. 0 means no maximum age.
+func (c *sshConnection) MaxTunnelAge() time.Duration {
+	if c.Permissions != nil {
+		if age, err := time.ParseDuration(c.Permissions.Extensions["max-tunnel-age"]); err == nil {
+			return age
+		}
+	}
+	return settings().maxTunnelAge
+}
+
+// ClientAlive records that the client replied to a keepalive or sent one.
+func (c *sshConnection) ClientAlive() {
+	c.missingKeepalives.Store(0)
 }
 
 func (c *sshConnection) SetRequestForwardPayload(r *remoteForwardRequest) {
@@ -40,6 +103,59 @@ func (c *sshConnection) GetTunnelName() *string {
 	return c.tunnelName
 }
 
+func (c *sshConnection) AddTunnelAlias(s string) {
+	c.Lock()
+	defer c.Unlock()
+	c.tunnelAliases = append(c.tunnelAliases, s)
+}
+
+// RemoveTunnelAlias removes s from the aliases and returns true if it was one.
+func (c *sshConnection) RemoveTunnelAlias(s string) bool {
+	c.Lock()
+	defer c.Unlock()
+	for i, alias := range c.tunnelAliases {
+		if alias == s {
+			c.tunnelAliases = append(c.tunnelAliases[:i], c.tunnelAliases[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *sshConnection) GetTunnelAliases() []string {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string{}, c.tunnelAliases...)
+}
+
+// GetSessionReplier returns the replier of the exec request of the tunnel, nil until it is parsed.
+func (c *sshConnection) GetSessionReplier() *sessionReplier {
+	c.Lock()
+	defer c.Unlock()
+	return c.replier
+}
+
+func (c *sshConnection) SetTunnelProbe(probe func()) {
+	c.Lock()
+	defer c.Unlock()
+	c.probe = probe
+}
+
+// TakeTunnelProbe returns the probe of the tunnel, nil if there is none or it was already taken.
+func (c *sshConnection) TakeTunnelProbe() func() {
+	c.Lock()
+	defer c.Unlock()
+	probe := c.probe
+	c.probe = nil
+	return probe
+}
+
+func (c *sshConnection) SetSessionReplier(r *sessionReplier) {
+	c.Lock()
+	defer c.Unlock()
+	c.replier = r
+}
+
 func (c *sshConnection) GetSessionChannel() *ssh.Channel {
 	c.Lock()
 	defer c.Unlock()
@@ -52,6 +168,60 @@ func (c *sshConnection) SetSessionChannel(s *ssh.Channel) {
 	c.sshChannel = s
 }
 
+// MarkClosed records that the connection closed and that its tunnels were cleaned up.
+func (c *sshConnection) MarkClosed() {
+	c.closed.Store(true)
+}
+
+// Closed returns true once the connection closed and its tunnels were cleaned up.
+func (c *sshConnection) Closed() bool {
+	return c.closed.Load()
+}
+
+// ExecWaitOver returns a channel closed once no tcpip-forward request waits for the exec request anymore.
+func (c *sshConnection) ExecWaitOver() <-chan struct{} {
+	return c.execWaitOver
+}
+
+// EndExecWait tells the session channel that the exec request is no longer waited for.
+func (c *sshConnection) EndExecWait() {
+	c.execWaitOverOnce.Do(func() {
+		if c.execWaitOver != nil {
+			close(c.execWaitOver)
+		}
+	})
+}
+
+// SessionOpened returns a channel closed once the client opened the session channel of the tunnel.
+func (c *sshConnection) SessionOpened() <-chan struct{} {
+	return c.sessionOpened
+}
+
+// MarkSessionOpened tells the tcpip-forward request to wait for the exec request of the session channel.
+func (c *sshConnection) MarkSessionOpened() {
+	c.sessionOpenedOnce.Do(func() {
+		if c.sessionOpened != nil {
+			close(c.sessionOpened)
+		}
+	})
+}
+
+// NoExecRequest returns a channel closed once the session channel of the tunnel is known to carry no exec request.
+func (c *sshConnection) NoExecRequest() <-chan struct{} {
+	return c.noExecRequest
+}
+
+// MarkNoExecRequest tells the tcpip-forward request to open the tunnel with the default options as the session channel
+// carries no exec request.
+func (c *sshConnection) MarkNoExecRequest() {
+	c.noExecRequestOnce.Do(func() {
+		if c.noExecRequest != nil {
+			close(c.noExecRequest)
+		}
+	})
+}
+
 func newSSHConnection(conn *ssh.ServerConn, cancellationCtx context.Context) *sshConnection {
-	return &sshConnection{conn, &sync.Mutex{}, nil, nil, nil, cancellationCtx}
+	return &sshConnection{ServerConn: conn, Mutex: &sync.Mutex{}, cancellationCtx: cancellationCtx,
+		execWaitOver: make(chan struct{}), sessionOpened: make(chan struct{}), noExecRequest: make(chan struct{})}
 }
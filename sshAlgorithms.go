@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Algorithms that golang.org/x/crypto/ssh implements on the server side. The library does not export them, so
+// they are listed here to catch typos in flags before clients fail to negotiate.
+var (
+	sshSupportedCiphers = []string{
+		"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"arcfour256", "arcfour128", "arcfour",
+		"aes128-cbc", "3des-cbc",
+	}
+	sshSupportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+	}
+	sshSupportedKexAlgorithms = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	}
+)
+
+// parseSSHAlgorithms returns the comma separated algorithms of list in order (most preferred first), or nil for
+// an empty list, which keeps the defaults of the ssh library. Every algorithm must be in supported.
+func parseSSHAlgorithms(list string, supported []string) ([]string, error) {
+	var algorithms []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		if !containsString(supported, name) {
+			return nil, fmt.Errorf("unsupported algorithm %s (supported: %s)", name, strings.Join(supported, ","))
+		}
+		seen[name] = true
+		algorithms = append(algorithms, name)
+	}
+	return algorithms, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("parseSSHAlgorithms", func() {
+	It("should keep the order and drop duplicates", func() {
+		algorithms, err := parseSSHAlgorithms(" chacha20-poly1305@openssh.com, aes128-gcm@openssh.com,chacha20-poly1305@openssh.com,", sshSupportedCiphers)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(algorithms).To(Equal([]string{"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com"}))
+	})
+
+	It("should keep the defaults for an empty list", func() {
+		algorithms, err := parseSSHAlgorithms("", sshSupportedMACs)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(algorithms).To(BeNil())
+	})
+
+	It("should reject unsupported algorithms", func() {
+		_, err := parseSSHAlgorithms("aes128-gcm@openssh.com,blowfish-cbc", sshSupportedCiphers)
+		Expect(err).To(HaveOccurred())
+		_, err = parseSSHAlgorithms("diffie-hellman-group-exchange-sha256", sshSupportedKexAlgorithms)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should only negotiate the configured algorithms", func() {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		signer, _ := ssh.NewSignerFromKey(key)
+		config := &ssh.ServerConfig{NoClientAuth: true}
+		config.AddHostKey(signer)
+		config.Ciphers, _ = parseSSHAlgorithms("chacha20-poly1305@openssh.com", sshSupportedCiphers)
+
+		handshake := func(ciphers []string) error {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).To(Not(HaveOccurred()))
+			defer listener.Close()
+			go func() {
+				server, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer server.Close()
+				ssh.NewServerConn(server, config)
+			}()
+			client, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).To(Not(HaveOccurred()))
+			defer client.Close()
+			clientConfig := &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+			clientConfig.Ciphers = ciphers
+			conn, _, _, err := ssh.NewClientConn(client, "", clientConfig)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+		Expect(handshake([]string{"aes128-gcm@openssh.com"})).To(HaveOccurred())
+		Expect(handshake([]string{"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com"})).To(Succeed())
+	})
+})
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync"
+)
+
+// SSH connections being handled, and those turned away since start by reason (total or ip), published at
+// /debug/vars of the pprof port.
+var (
+	sshConnectionsActive   = expvar.NewInt("sshConnectionsActive")
+	sshConnectionsRejected = expvar.NewMap("sshConnectionsRejected")
+)
+
+const (
+	sshRejectTotal = "total"
+	sshRejectIP    = "ip"
+)
+
+// Limits the SSH connections handled at once. Its limits are set from command line flags and reloaded with SIGHUP
+// (see applyRuntimeFlags).
+var sshConnections = newSSHConnLimiter(0, 0)
+
+// sshConnLimiter caps the SSH connections handled at once, in total and from one source IP, so that a misbehaving
+// client or a scanner cannot exhaust the server before authenticating. Lowering its limits only turns away further
+// connections.
+type sshConnLimiter struct {
+	max      int // 0 is unlimited
+	maxPerIP int // 0 is unlimited
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newSSHConnLimiter(max, maxPerIP int) *sshConnLimiter {
+	return &sshConnLimiter{max: max, maxPerIP: maxPerIP, perIP: map[string]int{}}
+}
+
+// SetLimits replaces the limits of l. 0 is unlimited.
+func (l *sshConnLimiter) SetLimits(max, maxPerIP int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max, l.maxPerIP = max, maxPerIP
+}
+
+// Acquire takes a slot for a new connection from addr and returns its source IP for Release, or false if the
+// connection must be turned away.
+func (l *sshConnLimiter) Acquire(addr net.Addr) (string, bool) {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		sshConnectionsRejected.Add(sshRejectTotal, 1)
+		return "", false
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		sshConnectionsRejected.Add(sshRejectIP, 1)
+		return "", false
+	}
+	l.total++
+	l.perIP[ip]++
+	sshConnectionsActive.Add(1)
+	return ip, true
+}
+
+// Release frees the slot of a connection from ip once it is closed.
+func (l *sshConnLimiter) Release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	sshConnectionsActive.Add(-1)
+}
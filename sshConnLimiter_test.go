@@ -0,0 +1,72 @@
+package main
+
+import (
+	"expvar"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sshConnLimiter", func() {
+	addr := func(s string) net.Addr {
+		a, _ := net.ResolveTCPAddr("tcp", s)
+		return a
+	}
+	rejected := func(reason string) int64 {
+		if v, ok := sshConnectionsRejected.Get(reason).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+
+	It("should cap the connections from one IP", func() {
+		l := newSSHConnLimiter(0, 2)
+		before := rejected(sshRejectIP)
+		ip, ok := l.Acquire(addr("192.0.2.1:1000"))
+		Expect(ok).To(BeTrue())
+		Expect(ip).To(Equal("192.0.2.1"))
+		_, ok = l.Acquire(addr("192.0.2.1:1001"))
+		Expect(ok).To(BeTrue())
+		_, ok = l.Acquire(addr("192.0.2.1:1002"))
+		Expect(ok).To(BeFalse())
+		Expect(rejected(sshRejectIP)).To(Equal(before + 1))
+		_, ok = l.Acquire(addr("[2001:db8::1]:1000"))
+		Expect(ok).To(BeTrue())
+
+		l.Release(ip)
+		_, ok = l.Acquire(addr("192.0.2.1:1003"))
+		Expect(ok).To(BeTrue())
+	})
+
+	It("should cap the connections in total", func() {
+		l := newSSHConnLimiter(2, 0)
+		before := rejected(sshRejectTotal)
+		a, _ := l.Acquire(addr("192.0.2.1:1000"))
+		_, ok := l.Acquire(addr("192.0.2.2:1000"))
+		Expect(ok).To(BeTrue())
+		_, ok = l.Acquire(addr("192.0.2.3:1000"))
+		Expect(ok).To(BeFalse())
+		Expect(rejected(sshRejectTotal)).To(Equal(before + 1))
+		l.Release(a)
+		Expect(l.perIP).To(Not(HaveKey("192.0.2.1")))
+		_, ok = l.Acquire(addr("192.0.2.3:1000"))
+		Expect(ok).To(BeTrue())
+	})
+
+	It("should apply new limits to the connections it already let in", func() {
+		l := newSSHConnLimiter(0, 0)
+		_, ok := l.Acquire(addr("192.0.2.1:1000"))
+		Expect(ok).To(BeTrue())
+		_, ok = l.Acquire(addr("192.0.2.1:1001"))
+		Expect(ok).To(BeTrue())
+		l.SetLimits(0, 2)
+		_, ok = l.Acquire(addr("192.0.2.1:1002"))
+		Expect(ok).To(BeFalse())
+		l.SetLimits(3, 0)
+		_, ok = l.Acquire(addr("192.0.2.1:1003"))
+		Expect(ok).To(BeTrue())
+		_, ok = l.Acquire(addr("192.0.2.2:1000"))
+		Expect(ok).To(BeFalse())
+	})
+})
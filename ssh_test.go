@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("global requests", func() {
+	var listener net.Listener
+	var client *ssh.Client
+	var conn *sshConnection
+	BeforeEach(func() {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		signer, _ := ssh.NewSignerFromKey(key)
+		config := &ssh.ServerConfig{NoClientAuth: true}
+		config.AddHostKey(signer)
+		var err error
+		listener, err = net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		serverConn := make(chan *sshConnection, 1)
+		go func(listener net.Listener, serverConn chan *sshConnection) {
+			nConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+			if err != nil {
+				return
+			}
+			go func() {
+				for newChannel := range chans {
+					newChannel.Reject(ssh.Prohibited, "")
+				}
+			}()
+			c := newSSHConnection(conn, context.Background())
+			go handleGlobalRequests(reqs, c, nil, context.Background())
+			serverConn <- c
+		}(listener, serverConn)
+		client, err = ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		Expect(err).To(Not(HaveOccurred()))
+		conn = <-serverConn
+	})
+	AfterEach(func() {
+		client.Close()
+		listener.Close()
+	})
+
+	It("should reply success to the keepalives of the client and count them as replies", func() {
+		conn.missingKeepalives.Store(int32(clientKeepaliveMaxCount))
+		ok, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(ok).To(BeTrue())
+		Expect(conn.missingKeepalives.Load()).To(BeEquivalentTo(0))
+
+		ok, _, err = client.SendRequest("no-more-sessions@openssh.com", true, nil)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should use the keepalive settings of the client over those of the server", func() {
+		interval, maxCount := conn.Keepalive()
+		Expect(interval).To(Equal(clientKeepaliveInterval))
+		Expect(maxCount).To(Equal(clientKeepaliveMaxCount))
+
+		options, err := parseTunnelOptions("type=http,keepalive-interval=30s,keepalive-count=6")
+		Expect(err).To(Not(HaveOccurred()))
+		conn.SetKeepalive(options.keepaliveInterval, options.keepaliveMaxCount)
+		interval, maxCount = conn.Keepalive()
+		Expect(interval).To(Equal(30 * time.Second))
+		Expect(maxCount).To(Equal(6))
+
+		conn.SetKeepalive(0, 0)
+		interval, _ = conn.Keepalive()
+		Expect(interval).To(Equal(clientKeepaliveInterval))
+	})
+
+	It("should reject keepalive settings beyond the limits", func() {
+		for _, request := range []string{"keepalive-interval=100ms", "keepalive-interval=1h", "keepalive-interval=soon",
+			"keepalive-count=0", "keepalive-count=11"} {
+			_, err := parseTunnelOptions("type=http," + request)
+			Expect(err).To(HaveOccurred())
+		}
+		options, err := parseTunnelOptions(`{"version":1,"type":"http","keepalive-interval":"1m","keepalive-count":3}`)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.keepaliveInterval).To(Equal(time.Minute))
+		Expect(options.keepaliveMaxCount).To(Equal(3))
+	})
+})
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelStats counts the traffic of a tunnel. It is shared by all the copies of the tunnel's listener data.
+type tunnelStats struct {
+	requests    atomic.Int64 // HTTP requests or TCP connections served
+	bytesIn     atomic.Int64 // From visitors to the client
+	bytesOut    atomic.Int64 // From the client to visitors
+	connections atomic.Int64 // HTTP requests or TCP connections in progress
+	errors      atomic.Int64 // HTTP requests the backend failed or answered with a 5xx
+	// Public connections open, which HTTP connections join with their first request, up to maxConnections
+	// (0 is unlimited). This is set from the max-conns option of the client, or later with tunnel-control.
+	openConnections atomic.Int64
+	maxConnections  atomic.Int64
+	// Unix nanoseconds of the last start or end of a request or connection, or of the tunnel
+	lastActivity atomic.Int64
+}
+
+func newTunnelStats(maxConnections int) *tunnelStats {
+	s := &tunnelStats{}
+	s.maxConnections.Store(int64(maxConnections))
+	s.lastActivity.Store(time.Now().UnixNano())
+	return s
+}
+
+// Begin records the start of a request or connection.
+func (s *tunnelStats) Begin() {
+	s.requests.Add(1)
+	s.connections.Add(1)
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// End records the end of a request or connection and the bytes it transferred.
+func (s *tunnelStats) End(bytesIn int64, bytesOut int64) {
+	s.connections.Add(-1)
+	s.bytesIn.Add(bytesIn)
+	s.bytesOut.Add(bytesOut)
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// Idle returns how long the tunnel has been without requests or connections in progress.
+func (s *tunnelStats) Idle() time.Duration {
+	if s.connections.Load() > 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, s.lastActivity.Load()))
+}
+
+// AcquireConnection counts a new public connection of the tunnel and returns false if the connection must be
+// turned away because maxConnections are open.
+func (s *tunnelStats) AcquireConnection() bool {
+	for {
+		n := s.openConnections.Load()
+		if limit := s.maxConnections.Load(); limit > 0 && n >= limit {
+			return false
+		}
+		if s.openConnections.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// ReleaseConnection records that a public connection counted by AcquireConnection is closed.
+func (s *tunnelStats) ReleaseConnection() {
+	s.openConnections.Add(-1)
+}
+
+type tunnelStatsLine struct {
+	name           string
+	connectionType string
+	url            string
+	stats          *tunnelStats
+	conn           *sshConnection
+}
+
+// callerTunnels returns the active tunnels created with the key of fingerprint, from any session, sorted by name.
+func callerTunnels(fingerprint string) []tunnelStatsLine {
+	var lines []tunnelStatsLine
+	// Names added with tunnel-control share the stats of their tunnel
+	seen := make(map[*tunnelStats]bool)
+
+	sshTunnelListenersLock.Lock()
+	groups := make(map[*tunnelGroup]bool)
+	for _, tunnel := range sshTunnelListeners {
+		members := []sshTunnelsListenerData{tunnel}
+		if tunnel.group != nil {
+			if groups[tunnel.group] {
+				continue
+			}
+			groups[tunnel.group] = true
+			tunnel.group.Lock()
+			members = append([]sshTunnelsListenerData{}, tunnel.group.members...)
+			tunnel.group.Unlock()
+		}
+		for _, m := range members {
+			if m.stats == nil || seen[m.stats] || m.conn.Permissions.Extensions["pubkey-fp"] != fingerprint {
+				continue
+			}
+			seen[m.stats] = true
+			name := ""
+			if tunnelName := m.conn.GetTunnelName(); tunnelName != nil {
+				name = *tunnelName
+			}
+			lines = append(lines, tunnelStatsLine{name: name, connectionType: m.connectionType,
+				url: tunnelURL(m.domain, name, m.reqPayload.BindPort), stats: m.stats, conn: m.conn})
+		}
+	}
+	sshTunnelListenersLock.Unlock()
+
+	forwardsLock.Lock()
+	for addr, forward := range forwards {
+		if forward.stats == nil || forward.fingerprint != fingerprint {
+			continue
+		}
+		_, port, _ := net.SplitHostPort(addr)
+		lines = append(lines, tunnelStatsLine{name: addr, connectionType: string(forward.conType),
+			url: "tcp://" + net.JoinHostPort(domainURI.Hostname(), port), stats: forward.stats, conn: forward.conn})
+	}
+	forwardsLock.Unlock()
+
+	sort.Slice(lines, func(i, j int) bool { return lines[i].name < lines[j].name })
+	return lines
+}
+
+// statsCommand lists the active tunnels of the caller with their traffic.
+// Usage: stats
+func statsCommand(session *commandSession, args []string) error {
+	lines := callerTunnels(session.fingerprint)
+	fmt.Fprintf(session.channel, "%-25s %-6s %10s %14s %14s %11s %12s\n", "TUNNEL", "TYPE", "REQUESTS", "BYTES_IN", "BYTES_OUT", "CONNECTIONS", "PUBLIC_CONNS")
+	for _, l := range lines {
+		// Open connections out of the limit if any (eg 3/10)
+		open := strconv.FormatInt(l.stats.openConnections.Load(), 10)
+		if limit := l.stats.maxConnections.Load(); limit > 0 {
+			open += "/" + strconv.FormatInt(limit, 10)
+		}
+		fmt.Fprintf(session.channel, "%-25s %-6s %10d %14d %14d %11d %12s\n", l.name, l.connectionType,
+			l.stats.requests.Load(), l.stats.bytesIn.Load(), l.stats.bytesOut.Load(), l.stats.connections.Load(), open)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tunnelStats", func() {
+
+	It("should count requests, bytes and connections in progress", func() {
+		var sut tunnelStats
+		sut.Begin()
+		sut.Begin()
+		Expect(sut.requests.Load()).To(BeEquivalentTo(2))
+		Expect(sut.connections.Load()).To(BeEquivalentTo(2))
+
+		sut.End(10, 200)
+		Expect(sut.connections.Load()).To(BeEquivalentTo(1))
+		Expect(sut.bytesIn.Load()).To(BeEquivalentTo(10))
+		Expect(sut.bytesOut.Load()).To(BeEquivalentTo(200))
+	})
+
+	It("should turn away public connections beyond max-conns", func() {
+		sut := newTunnelStats(2)
+		Expect(sut.AcquireConnection()).To(BeTrue())
+		Expect(sut.AcquireConnection()).To(BeTrue())
+		Expect(sut.AcquireConnection()).To(BeFalse())
+		Expect(sut.openConnections.Load()).To(BeEquivalentTo(2))
+
+		sut.ReleaseConnection()
+		Expect(sut.AcquireConnection()).To(BeTrue())
+
+		options, err := parseTunnelOptions("type=tcp,max-conns=2")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.maxConns).To(Equal(2))
+		_, err = parseTunnelOptions("type=tcp,max-conns=-1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should not limit public connections without max-conns", func() {
+		var sut tunnelStats
+		for i := 0; i < 100; i++ {
+			Expect(sut.AcquireConnection()).To(BeTrue())
+		}
+	})
+})
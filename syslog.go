@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syslogFacility is the daemon facility of RFC 5424.
+const syslogFacility = 3
+
+// syslogHook copies log entries to a syslog endpoint in the RFC 5424 format. Messages are framed
+// with octet counting (RFC 6587) over tcp and tls, and sent one per datagram over udp and unix sockets.
+type syslogHook struct {
+	sync.Mutex
+	network   string
+	addr      string
+	tlsConfig *tls.Config // tls only
+	conn      net.Conn
+	hostname  string
+	appName   string
+}
+
+// newSyslogHook returns a hook for endpoint, which is a URL such as udp://host:514, tcp://host:514,
+// tls://host:6514 or unix:///dev/log. appName identifies the server in the messages.
+func newSyslogHook(endpoint string, appName string) (*syslogHook, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	h := &syslogHook{network: u.Scheme, addr: u.Host, appName: appName}
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "tls":
+		h.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	case "unix", "unixgram":
+		h.addr = u.Path
+	default:
+		return nil, fmt.Errorf("invalid syslog endpoint %s: the scheme must be udp, tcp, tls or unix", endpoint)
+	}
+	if h.addr == "" {
+		return nil, fmt.Errorf("invalid syslog endpoint %s: missing address", endpoint)
+	}
+	if h.hostname, err = os.Hostname(); err != nil {
+		h.hostname = "-"
+	}
+	if err := h.dial(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *syslogHook) dial() error {
+	var err error
+	switch h.network {
+	case "tls":
+		h.conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", h.addr, h.tlsConfig)
+	case "unix", "unixgram":
+		// /dev/log is usually a datagram socket
+		h.conn, err = net.DialTimeout("unixgram", h.addr, 5*time.Second)
+		if err != nil {
+			h.conn, err = net.DialTimeout("unix", h.addr, 5*time.Second)
+		}
+	default:
+		h.conn, err = net.DialTimeout(h.network, h.addr, 5*time.Second)
+	}
+	return err
+}
+
+func (h *syslogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire sends e to the endpoint reconnecting once if the connection was lost.
+func (h *syslogHook) Fire(e *log.Entry) error {
+	msg := h.format(e)
+	if h.network == "tcp" || h.network == "tls" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.conn != nil {
+		h.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := h.conn.Write([]byte(msg)); err == nil {
+			return nil
+		}
+		h.conn.Close()
+		h.conn = nil
+	}
+	if err := h.dial(); err != nil {
+		return err
+	}
+	h.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := h.conn.Write([]byte(msg))
+	return err
+}
+
+// Close closes the connection to the endpoint.
+func (h *syslogHook) Close() {
+	h.Lock()
+	defer h.Unlock()
+	if h.conn != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+}
+
+// format returns e as an RFC 5424 message: <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+// The fields of e are appended to the message as key=value.
+func (h *syslogHook) format(e *log.Entry) string {
+	var sb strings.Builder
+	sb.WriteString(e.Message)
+	keys := make([]string, 0, len(e.Data))
+	for k := range e.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&sb, " %s=%v", k, e.Data[k])
+	}
+
+	return fmt.Sprintf("<%d>1 %s %s %s %d - - %s\n", syslogFacility*8+syslogSeverity(e.Level), e.Time.UTC().Format(time.RFC3339Nano),
+		h.hostname, h.appName, os.Getpid(), strings.TrimRight(sb.String(), "\n"))
+}
+
+// syslogSeverity maps a log level to an RFC 5424 severity.
+func syslogSeverity(level log.Level) int {
+	switch level {
+	case log.PanicLevel:
+		return 0 // Emergency
+	case log.FatalLevel:
+		return 2 // Critical
+	case log.ErrorLevel:
+		return 3
+	case log.WarnLevel:
+		return 4
+	case log.InfoLevel:
+		return 6
+	default:
+		return 7 // Debug
+	}
+}
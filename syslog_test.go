@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("syslog", func() {
+	It("should send RFC 5424 messages over udp", func() {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer pc.Close()
+
+		hook, err := newSyslogHook("udp://"+pc.LocalAddr().String(), "tunnel")
+		Expect(err).To(Not(HaveOccurred()))
+		defer hook.Close()
+		hook.hostname = "host"
+
+		entry := &log.Entry{
+			Time:    time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC),
+			Level:   log.WarnLevel,
+			Message: "Http request ended",
+			Data:    log.Fields{"requestID": "abc"},
+		}
+		Expect(hook.Fire(entry)).To(Succeed())
+
+		buf := make([]byte, 1024)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(buf[:n])).To(MatchRegexp(`^<28>1 2024-03-04T05:06:07Z host tunnel \d+ - - Http request ended requestID=abc\n$`))
+	})
+
+	It("should reject unknown endpoints", func() {
+		_, err := newSyslogHook("http://localhost:514", "tunnel")
+		Expect(err).To(HaveOccurred())
+	})
+})
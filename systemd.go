@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// First file descriptor passed by systemd socket activation. See sd_listen_fds(3).
+const systemdListenFdsStart = 3
+
+// Names of the sockets that can be passed by systemd (FileDescriptorName= of the .socket unit).
+// Unnamed sockets are taken in this order.
+const (
+	systemdSSHSocket  = "ssh"
+	systemdHTTPSocket = "http"
+)
+
+// Listeners passed by systemd and not used yet, by socket name.
+var (
+	inheritedListeners     = map[string]net.Listener{}
+	inheritedListenersLock sync.Mutex
+)
+
+// systemdSocketNames returns the names of the sockets passed to the process with pid according to the
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES env variables, or nil if there are none.
+func systemdSocketNames(pid int, listenPid string, listenFds string, listenFdNames string) ([]string, error) {
+	if listenPid == "" || listenFds == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(listenPid); err != nil || p != pid {
+		// Meant for another process
+		return nil, nil
+	}
+	n, err := strconv.Atoi(listenFds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %s", listenFds)
+	}
+
+	defaults := []string{systemdSSHSocket, systemdHTTPSocket}
+	var fdNames []string
+	if listenFdNames != "" {
+		fdNames = strings.Split(listenFdNames, ":")
+	}
+	names := make([]string, n)
+	for i := range names {
+		if i < len(fdNames) && fdNames[i] != "" && fdNames[i] != "unknown" {
+			names[i] = fdNames[i]
+		} else if i < len(defaults) {
+			names[i] = defaults[i]
+		} else {
+			return nil, fmt.Errorf("unnamed socket %d: set FileDescriptorName= to %s or %s", i+systemdListenFdsStart, systemdSSHSocket, systemdHTTPSocket)
+		}
+	}
+	return names, nil
+}
+
+// loadSystemdListeners takes the sockets passed by systemd socket activation so that the server can run
+// unprivileged while systemd binds the ports, and so that restarts do not race on the ports.
+func loadSystemdListeners() error {
+	names, err := systemdSocketNames(os.Getpid(), os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+	if err != nil {
+		return err
+	}
+	// Do not pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	inheritedListenersLock.Lock()
+	defer inheritedListenersLock.Unlock()
+	for i, name := range names {
+		f := os.NewFile(uintptr(systemdListenFdsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("socket %s: %s", name, err)
+		}
+		inheritedListeners[name] = ln
+	}
+	return nil
+}
+
+// listen returns the listener bound ahead of time for the port of addr (see prebindHTTPListeners) or passed by
+// systemd as socketName if any, or else listens at addr. Such listeners are returned once.
+func listen(socketName string, addr string) (net.Listener, error) {
+	names := []string{socketName}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		names = []string{socketName + ":" + port, socketName}
+	}
+	inheritedListenersLock.Lock()
+	for _, name := range names {
+		if ln, ok := inheritedListeners[name]; ok {
+			delete(inheritedListeners, name)
+			inheritedListenersLock.Unlock()
+			return ln, nil
+		}
+	}
+	inheritedListenersLock.Unlock()
+	return listenTCP(addr)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("systemd", func() {
+	It("should ignore sockets meant for another process", func() {
+		Expect(systemdSocketNames(10, "", "", "")).To(BeNil())
+		Expect(systemdSocketNames(10, "11", "2", "")).To(BeNil())
+	})
+
+	It("should name the sockets", func() {
+		Expect(systemdSocketNames(10, "10", "2", "")).To(Equal([]string{"ssh", "http"}))
+		Expect(systemdSocketNames(10, "10", "2", "http:ssh")).To(Equal([]string{"http", "ssh"}))
+		Expect(systemdSocketNames(10, "10", "1", "unknown")).To(Equal([]string{"ssh"}))
+	})
+
+	It("should reject invalid values", func() {
+		_, err := systemdSocketNames(10, "10", "x", "")
+		Expect(err).To(HaveOccurred())
+		_, err = systemdSocketNames(10, "10", "3", "")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should return an inherited listener once", func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer ln.Close()
+		inheritedListeners["test"] = ln
+
+		got, err := listen("test", "127.0.0.1:0")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(got).To(BeIdenticalTo(ln))
+
+		got, err = listen("test", "127.0.0.1:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer got.Close()
+		Expect(got).To(Not(BeIdenticalTo(ln)))
+	})
+
+	It("should return the listener bound ahead of time for a port", func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(Not(HaveOccurred()))
+		defer ln.Close()
+		inheritedListeners["test:80"] = ln
+
+		got, err := listen("test", "localhost:80")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(got).To(BeIdenticalTo(ln))
+	})
+})
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// Ports of TCP tunnels picked by the server, for port 0 and port-fallback=true.
+const (
+	firstFreeTCPPort = 1000
+	lastFreeTCPPort  = 65535
+)
+
+// errTCPPortTaken is the error of a TCP port listened at by the tunnel of another client.
+var errTCPPortTaken = errors.New("TCP port taken by another tunnel")
+
+// errTCPPortReserved is the error of a TCP port reserved for the key that last used it (see reservationStore).
+var errTCPPortReserved = errors.New("TCP port reserved for another key")
+
+// listenFreeTCPPort listens at the first port from port onwards that is neither taken by a tunnel nor reserved
+// for HTTP tunnels or a key and that the server can bind. forwardsLock must be held.
+func listenFreeTCPPort(bindAddr string, port int) (net.Listener, int, error) {
+	if port < firstFreeTCPPort {
+		port = firstFreeTCPPort
+	}
+	for ; port <= lastFreeTCPPort; port++ {
+		addr := net.JoinHostPort(bindAddr, strconv.Itoa(port))
+		if _, ok := forwards[addr]; ok || isHTTPBindPort(uint32(port)) || !reservations.Allowed(tcpReservationKey(addr), "") {
+			continue
+		}
+		if ln, err := net.Listen("tcp", addr); err == nil {
+			return ln, port, nil
+		}
+	}
+	return nil, 0, errors.New("no TCP port is available")
+}
+
+// tcpPortUnavailable tells the client why a TCP tunnel cannot have its port and suggests a free one.
+// forwardsLock must be held.
+func tcpPortUnavailable(bindAddr string, port int, err error) string {
+	if port == 0 {
+		return "No TCP port is available on the server."
+	}
+	var reason string
+	o, ok := forwards[net.JoinHostPort(bindAddr, strconv.Itoa(port))]
+	switch {
+	case isHTTPBindPort(uint32(port)) || ok && o.conType == HTTPConnectionType:
+		reason = fmt.Sprintf("TCP port %d is reserved for HTTP tunnels.", port)
+	case errors.Is(err, errTCPPortTaken):
+		reason = fmt.Sprintf("TCP port %d is already taken.", port)
+	case errors.Is(err, errTCPPortReserved):
+		reason = fmt.Sprintf("TCP port %d is reserved for another key.", port)
+	case errors.Is(err, syscall.EADDRINUSE):
+		reason = fmt.Sprintf("TCP port %d is in use on the server.", port)
+	case errors.Is(err, os.ErrPermission):
+		reason = fmt.Sprintf("TCP port %d is privileged and the server is not allowed to listen on it.", port)
+	default:
+		reason = fmt.Sprintf("TCP port %d cannot be opened: %s.", port, err)
+	}
+
+	ln, free, err := listenFreeTCPPort(bindAddr, port+1)
+	if err != nil {
+		return reason
+	}
+	ln.Close()
+	return fmt.Sprintf("%s Port %d is free, or use port-fallback=true to get a free port.", reason, free)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tcpPorts", func() {
+	var taken net.Listener
+	var port int
+	BeforeEach(func() {
+		var err error
+		taken, err = net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		port = taken.Addr().(*net.TCPAddr).Port
+	})
+	AfterEach(func() {
+		taken.Close()
+		forwardsLock.Lock()
+		delete(forwards, net.JoinHostPort("localhost", strconv.Itoa(port+1)))
+		forwardsLock.Unlock()
+	})
+
+	It("should listen at a free port skipping those of tunnels and the server", func() {
+		forwardsLock.Lock()
+		forwards[net.JoinHostPort("localhost", strconv.Itoa(port+1))] = forwardsListenerData{clientID: "other"}
+		ln, free, err := listenFreeTCPPort("localhost", port)
+		forwardsLock.Unlock()
+		Expect(err).To(Not(HaveOccurred()))
+		defer ln.Close()
+		Expect(free).To(BeNumerically(">", port+1))
+		Expect(ln.Addr().(*net.TCPAddr).Port).To(Equal(free))
+	})
+
+	It("should tell why a port is unavailable and suggest a free one", func() {
+		_, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+		Expect(err).To(HaveOccurred())
+		forwardsLock.Lock()
+		defer forwardsLock.Unlock()
+		message := tcpPortUnavailable("localhost", port, err)
+		Expect(message).To(HavePrefix(fmt.Sprintf("TCP port %d is in use on the server. Port ", port)))
+		Expect(message).To(HaveSuffix("is free, or use port-fallback=true to get a free port."))
+
+		Expect(tcpPortUnavailable("localhost", port, errTCPPortTaken)).To(HavePrefix(fmt.Sprintf("TCP port %d is already taken.", port)))
+		Expect(tcpPortUnavailable("localhost", httpBindPorts[0], nil)).To(HavePrefix(fmt.Sprintf("TCP port %d is reserved for HTTP tunnels.", httpBindPorts[0])))
+		Expect(tcpPortUnavailable("localhost", 0, fmt.Errorf("no TCP port is available"))).To(Equal("No TCP port is available on the server."))
+	})
+
+	It("should parse the port-fallback option", func() {
+		options, err := parseTunnelOptions("type=tcp,port-fallback=true")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.portFallback).To(BeTrue())
+		_, err = parseTunnelOptions("type=tcp,port-fallback=maybe")
+		Expect(err).To(HaveOccurred())
+	})
+})
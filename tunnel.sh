@@ -7,9 +7,39 @@
 # The SSH server takes the following arguments in the format key=value separated by a comma (eg tunnelName=abc,id=19417814394)
 # The values are:
 #           tunnelName: Optional. The tunnel Name (eg subdomain) to use if available. If not specified, the server will use a random name. (HTTP only)
+#           path:       Optional. Path segment of the tunnel URL (eg myapp for domain.io/myapp) when the server routes tunnels by path (HTTP only)
 #           header:     Optional. Overrides the HOST header name when executing the HTTP request (HTTP only)
 #           id:         Optional. Random string to identify the client session. This is useful for reclaiming the tunnelName in case of transient
 #                       network errors. Otherwise, when the SSH client reconnects, it will use a different tunnelName.
+#           cache:      Optional. true to cache GET/HEAD responses at the server according to their Cache-Control headers (HTTP only)
+#           rewrite:    Optional. URL path rewrite rule FROM->TO, may be repeated. FROM is a path prefix or a regexp starting with ~ (HTTP only)
+#           allow-paths: Optional. Glob of URL paths to expose (eg /webhooks/*), may be repeated. Other paths get 403 (HTTP only)
+#           deny-paths: Optional. Glob of URL paths to block with 403, may be repeated (HTTP only)
+#           auth:       Optional. user:password or user:bcrypt hash visitors must send with HTTP Basic authentication (HTTP only)
+#           password:   Optional. Password or bcrypt hash visitors enter in a form, once per browser (HTTP only)
+#           allow-ips:  Optional. Comma separated IP addresses and CIDR ranges of the visitors allowed to use the tunnel
+#           visibility: Optional. private to only let in visitors from the internal networks of the server (--internalCIDRs)
+#           share-link: Optional. Duration (eg 1h) of the signed share link that visitors need, printed once the tunnel opens (HTTP only)
+#           idle-timeout: Optional. Duration (eg 30m) without public traffic after which the server closes the tunnel
+#           keepalive-interval: Optional. Time between the keepalive requests of the server (1s to 5m)
+#           keepalive-count: Optional. Unanswered keepalive requests in a row after which the server drops the client (1 to 10)
+#           health-check: Optional. Path of the local server checked periodically; the tunnel serves 503s while the checks fail (HTTP only)
+#           probe:      Optional. true to check that the local server answers once the tunnel is open, with a warning if not
+#           port-fallback: Optional. true to open the TCP tunnel on a free port when the requested one is unavailable (TCP only)
+#           inspect:    Optional. false to keep requests out of captures, logs and the request lines, only counting their bytes
+#           noindex:    Optional. true to serve a robots.txt disallowing crawlers and add X-Robots-Tag: noindex to responses (HTTP only)
+#           domain:     Optional. Base domain of the tunnel URL when the server serves several domains (HTTP only)
+#           log:        Optional. Format of the request lines printed by this script: plain, json or off to silence them
+#           log-field:  Optional. Adds method, path, status, duration or bytes to the request lines, may be repeated (HTTP only)
+#           har:        Optional. true to keep recent requests and responses downloadable as a HAR file from the server admin port (HTTP only)
+#           server:     Optional. Server header of responses: none hides it, other values override it (HTTP only)
+#           shared:     Optional. true to share the tunnelName with other clients that also specify shared=true (HTTP only)
+#           sticky:     Optional. cookie or ip to keep a visitor on the same client of a shared tunnel (HTTP only)
+#           weight:     Optional. Share of the requests of a shared tunnel relative to the other clients, 100 by default (eg 10 for a canary) (HTTP only)
+#           mirror:     Optional. tunnelName of a tunnel of the same key that gets a copy of each request, whose responses are discarded (HTTP only)
+#           standby:    Optional. true to stand by for the tunnelName of another client of the same key and serve it once that client disconnects (HTTP only)
+#           preserveHeaderCase: Optional. true to relay header names exactly as written for backends that require it (HTTP only)
+#           max-conns:  Optional. Number of public connections served at once. Others get 503 (HTTP) or are closed (TCP)
 
 # Adjust the following values to match the server's
 sshPort=5223              # server's SSH listening port
@@ -40,8 +70,39 @@ printHelp () {
   
   printf "  %-25s Specifies the name of the HTTP tunnelName to take.\n"  "-n, --tunnelName NAME"
   printf "  %-25s Use this if you expect to keep the same tunnelName after network disconnects.\n"
+  printf "  %-25s Uses PATH for the tunnel URL (eg mydomain.io/PATH) when the server routes tunnels by path.\n"  "--path PATH"
   printf "  %-25s Overrides the HOST header with the specified value.\n"  "-h, --host HOST"
   printf "  %-25s Uses the specified PORT to listen at on the server side. Defaults to 80 for HTTP.\n"  "-p, --remote-port PORT"
+  printf "  %-25s Caches GET/HEAD responses at the server according to their Cache-Control headers.\n"  "--cache"
+  printf "  %-25s Rewrites the URL path prefix FROM to TO (eg /api/->/v2/), or a regexp if FROM starts with ~.\n"  "-r, --rewrite FROM->TO"
+  printf "  %-25s May be repeated; the first matching rule applies.\n"
+  printf "  %-25s Only exposes URL paths matching GLOB (eg /webhooks/*). May be repeated.\n"  "--allow-path GLOB"
+  printf "  %-25s Blocks URL paths matching GLOB with 403. May be repeated.\n"  "--deny-path GLOB"
+  printf "  %-25s Asks visitors for USER and PASSWORD (or a bcrypt hash of it) with HTTP Basic authentication.\n"  "--auth USER:PASSWORD"
+  printf "  %-25s Asks visitors for PASSWORD (or a bcrypt hash of it) in a form, once per browser.\n"  "--password PASSWORD"
+  printf "  %-25s Only lets in visitors from the comma separated IP addresses and CIDR ranges.\n"  "--allow-ips LIST"
+  printf "  %-25s Only lets in visitors from the internal networks of the server and the server host.\n"  "--private"
+  printf "  %-25s Only lets in visitors of the printed share link, which stops working after DURATION (eg 1h).\n"  "--share-link DURATION"
+  printf "  %-25s Closes the tunnel after DURATION (eg 30m) without public traffic.\n"  "--idle-timeout DURATION"
+  printf "  %-25s Time between the keepalive requests of the server (1s to 5m).\n"  "--keepalive-interval DURATION"
+  printf "  %-25s Unanswered keepalive requests in a row after which the server drops the tunnel (1 to 10).\n"  "--keepalive-count N"
+  printf "  %-25s Keeps requests out of captures, logs and the printed requests; only their bytes are counted.\n"  "--no-inspect"
+  printf "  %-25s Serves 503s while GET requests for PATH to the local server fail, checked periodically.\n"  "--health-check PATH"
+  printf "  %-25s Warns if the local server does not answer through the tunnel once it is open.\n"  "--probe"
+  printf "  %-25s Opens the TCP tunnel on a free port when the remote port is unavailable.\n"  "--port-fallback"
+  printf "  %-25s Keeps search engines away with a robots.txt and X-Robots-Tag: noindex.\n"  "--noindex"
+  printf "  %-25s Uses DOMAIN for the tunnel URL when the server serves several domains.\n"  "-d, --domain DOMAIN"
+  printf "  %-25s Prints the received requests as plain text or json lines, or silences them with off.\n"  "--log plain|json|off"
+  printf "  %-25s Adds method, path, status, duration or bytes to the printed requests. May be repeated.\n"  "--log-field FIELD"
+  printf "  %-25s Captures recent requests and responses at the server for download as a HAR file.\n"  "--har"
+  printf "  %-25s Overrides the Server header of responses, or hides it with none.\n"  "--server VALUE"
+  printf "  %-25s Shares the tunnelName with other clients started with --shared.\n"  "--shared"
+  printf "  %-25s Keeps a visitor on the same client of a shared tunnel using a cookie or the visitor IP.\n"  "--sticky cookie|ip"
+  printf "  %-25s Share of the requests of a shared tunnel relative to the other clients (100 by default).\n"  "--weight N"
+  printf "  %-25s Sends a copy of each request to the tunnelName NAME of the same key and discards its responses.\n"  "--mirror NAME"
+  printf "  %-25s Stands by for the tunnelName of another client of the same key and serves it once that client disconnects.\n"  "--standby"
+  printf "  %-25s Relays header names exactly as written for local servers that require exact casing.\n"  "--preserve-header-case"
+  printf "  %-25s Serves at most N public connections at once and turns away the others.\n"  "--max-conns N"
 
   printf "  %-25s Display this help and exit\n"  "-help, --help"
 }
@@ -52,6 +113,32 @@ remotePort=$serverHttpBindingPort # remote port specified by client
 type="http"           # default tunnel type is HTTP
 overrideHeaderHost= # override host header with 'localhost:XXX' by default
 key=""
+cache=false
+rewrites=""
+pathRules=""
+auth=""
+password=""
+allowIPs=""
+private=false
+shareLink=""
+idleTimeout=""
+keepaliveInterval=""
+keepaliveCount=""
+portFallback=false
+probe=false
+healthCheck=""
+server=""
+noindex=false
+har=false
+sessionLog=""
+domain=""
+shared=false
+sticky=""
+weight=""
+mirror=""
+standby=false
+preserveHeaderCase=false
+maxConns=""
 
 # Parse arguments
 while [ "$1" != "" ]; do
@@ -67,6 +154,9 @@ while [ "$1" != "" ]; do
                                 ;;  
         -k | --key)             shift
                                 key=$1
+                                ;;
+        -r | --rewrite)         shift
+                                rewrites="$rewrites,rewrite=$1"
                                 ;;                                                               
         http | --http)          type="http"
                                 ;;
@@ -74,6 +164,83 @@ while [ "$1" != "" ]; do
                                 ;;
         tcp | --tcp)            type="tcp"
                                 ;;
+            --allow-path)       shift
+                                pathRules="$pathRules,allow-paths=$1"
+                                ;;
+            --deny-path)        shift
+                                pathRules="$pathRules,deny-paths=$1"
+                                ;;
+            --path)             shift
+                                path=$1
+                                ;;
+            --auth)             shift
+                                auth=$1
+                                ;;
+            --password)         shift
+                                password=$1
+                                ;;
+            --allow-ips)        shift
+                                allowIPs=$1
+                                ;;
+            --private)          private=true
+                                ;;
+            --share-link)       shift
+                                shareLink=$1
+                                ;;
+            --idle-timeout)     shift
+                                idleTimeout=$1
+                                ;;
+            --keepalive-interval) shift
+                                keepaliveInterval=$1
+                                ;;
+            --keepalive-count)  shift
+                                keepaliveCount=$1
+                                ;;
+            --no-inspect)       noInspect=true
+                                ;;
+            --port-fallback)    portFallback=true
+                                ;;
+            --probe)            probe=true
+                                ;;
+            --health-check)     shift
+                                healthCheck=$1
+                                ;;
+            --cache)            cache=true
+                                ;;
+            --noindex)          noindex=true
+                                ;;
+        -d | --domain)          shift
+                                domain=$1
+                                ;;
+            --log)              shift
+                                sessionLog="$sessionLog,log=$1"
+                                ;;
+            --log-field)        shift
+                                sessionLog="$sessionLog,log-field=$1"
+                                ;;
+            --har)              har=true
+                                ;;
+            --server)           shift
+                                server=$1
+                                ;;
+            --shared)           shared=true
+                                ;;
+            --sticky)           shift
+                                sticky=$1
+                                ;;
+            --weight)           shift
+                                weight=$1
+                                ;;
+            --mirror)           shift
+                                mirror=$1
+                                ;;
+            --standby)          standby=true
+                                ;;
+            --preserve-header-case) preserveHeaderCase=true
+                                ;;
+            --max-conns)        shift
+                                maxConns=$1
+                                ;;
             --debug)            debug=true
                                 ;;                                
         -help | --help )        printHelp
@@ -96,6 +263,11 @@ if [[ ! $localHostPort ]]; then
   exit 1
 fi
 
+if [[ "$auth$password${rewrites//,rewrite=/}" == *,* ]]; then
+  echo 'Values of --auth, --password and --rewrite cannot contain a comma. Send the options as JSON instead.'
+  exit 1
+fi
+
 if echo "$localHostPort" | grep -qE '^[0-9]+$'; then
   # If port is just a number, prepend 'localhost:'
   localHostPort="localhost:$localHostPort"
@@ -136,6 +308,107 @@ fi
 # Default arguments to pass to SSH server. The default tunnelName is the current user name. Override the host header with 'localhost'
 sshServerArgs="tunnelName=$tunnelName,type=$type,header=$overrideHeaderHost,id=`cat /proc/sys/kernel/random/uuid`"
 
+if [[ "$cache" = true ]]; then
+  sshServerArgs="$sshServerArgs,cache=true"
+fi
+sshServerArgs="$sshServerArgs$rewrites$pathRules$sessionLog"
+
+if [[ "$noindex" = true ]]; then
+  sshServerArgs="$sshServerArgs,noindex=true"
+fi
+
+if [[ $domain ]]; then
+  sshServerArgs="$sshServerArgs,domain=$domain"
+fi
+
+if [[ "$har" = true ]]; then
+  sshServerArgs="$sshServerArgs,har=true"
+fi
+
+if [[ $server ]]; then
+  sshServerArgs="$sshServerArgs,server=$server"
+fi
+
+if [[ "$shared" = true ]]; then
+  sshServerArgs="$sshServerArgs,shared=true"
+fi
+
+if [[ $sticky ]]; then
+  sshServerArgs="$sshServerArgs,sticky=$sticky"
+fi
+
+if [[ $weight ]]; then
+  sshServerArgs="$sshServerArgs,weight=$weight"
+fi
+
+if [[ $mirror ]]; then
+  sshServerArgs="$sshServerArgs,mirror=$mirror"
+fi
+
+if [[ "$standby" = true ]]; then
+  sshServerArgs="$sshServerArgs,standby=true"
+fi
+
+if [[ "$preserveHeaderCase" = true ]]; then
+  sshServerArgs="$sshServerArgs,preserveHeaderCase=true"
+fi
+
+if [[ $maxConns ]]; then
+  sshServerArgs="$sshServerArgs,max-conns=$maxConns"
+fi
+
+if [[ $path ]]; then
+  sshServerArgs="$sshServerArgs,path=$path"
+fi
+
+if [[ $auth ]]; then
+  sshServerArgs="$sshServerArgs,auth=$auth"
+fi
+
+if [[ $password ]]; then
+  sshServerArgs="$sshServerArgs,password=$password"
+fi
+
+if [[ $allowIPs ]]; then
+  sshServerArgs="$sshServerArgs,allow-ips=$allowIPs"
+fi
+
+if [[ "$private" = true ]]; then
+  sshServerArgs="$sshServerArgs,visibility=private"
+fi
+
+if [[ $shareLink ]]; then
+  sshServerArgs="$sshServerArgs,share-link=$shareLink"
+fi
+
+if [[ $idleTimeout ]]; then
+  sshServerArgs="$sshServerArgs,idle-timeout=$idleTimeout"
+fi
+
+if [[ $keepaliveInterval ]]; then
+  sshServerArgs="$sshServerArgs,keepalive-interval=$keepaliveInterval"
+fi
+
+if [[ $keepaliveCount ]]; then
+  sshServerArgs="$sshServerArgs,keepalive-count=$keepaliveCount"
+fi
+
+if [[ "$noInspect" = true ]]; then
+  sshServerArgs="$sshServerArgs,inspect=false"
+fi
+
+if [[ "$portFallback" = true ]]; then
+  sshServerArgs="$sshServerArgs,port-fallback=true"
+fi
+
+if [[ "$probe" = true ]]; then
+  sshServerArgs="$sshServerArgs,probe=true"
+fi
+
+if [[ $healthCheck ]]; then
+  sshServerArgs="$sshServerArgs,health-check=$healthCheck"
+fi
+
 # Extra args to pass to SSH cli
 sshCliArgs=" -o ConnectionAttempts=$((10**4))  -o ServerAliveInterval=20 -o ServerAliveCountMax=2"
 
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listCommand lists the active tunnels of the caller from all its sessions, to find stale ones to close.
+// Usage: list
+func listCommand(session *commandSession, args []string) error {
+	fmt.Fprintf(session.channel, "%-25s %-6s %-16s %s\n", "TUNNEL", "TYPE", "SESSION", "URL")
+	for _, l := range callerTunnels(session.fingerprint) {
+		fmt.Fprintf(session.channel, "%-25s %-6s %-16s %s\n", l.name, l.connectionType, shortSessionID(l.conn), l.url)
+	}
+	return nil
+}
+
+// closeCommand closes the tunnels of the caller with a name (or TCP address) as listed by listCommand, ending their
+// sessions so that the name can be taken again.
+// Usage: close NAME
+func closeCommand(session *commandSession, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: close NAME")
+	}
+	closed := 0
+	for _, l := range callerTunnels(session.fingerprint) {
+		if l.name != args[0] || l.conn == nil {
+			continue
+		}
+		log.Printf("Closing tunnel %s of session %s at the request of session %s", l.name,
+			hex.EncodeToString(l.conn.SessionID()), hex.EncodeToString(session.conn.SessionID()))
+		closeTunnelSession(l.conn, l.conn.GetSessionReplier(), "Tunnel closed by the close command of another session.")
+		fmt.Fprintf(session.channel, "Closed tunnel %s of session %s\n", l.name, shortSessionID(l.conn))
+		closed++
+	}
+	if closed == 0 {
+		return fmt.Errorf("tunnel %s not found", args[0])
+	}
+	return nil
+}
+
+// shortSessionID returns the start of the session id of conn, enough to tell sessions apart.
+func shortSessionID(conn *sshConnection) string {
+	if conn == nil {
+		return ""
+	}
+	return hex.EncodeToString(conn.SessionID())[:16]
+}
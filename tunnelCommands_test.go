@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+// bufferChannel is an ssh.Channel that keeps what is written to it.
+type bufferChannel struct {
+	ssh.Channel
+	out bytes.Buffer
+}
+
+func (c *bufferChannel) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+var _ = Describe("list and close commands", func() {
+	var listener net.Listener
+	var clients []*ssh.Client
+	var conns map[string]*sshConnection
+	const addr = "localhost:18998"
+	BeforeEach(func() {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		signer, _ := ssh.NewSignerFromKey(key)
+		config := &ssh.ServerConfig{NoClientAuth: true}
+		config.AddHostKey(signer)
+		var err error
+		listener, err = net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		serverConns := make(chan *sshConnection, 2)
+		go func(listener net.Listener, serverConns chan *sshConnection) {
+			for {
+				nConn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					for newChannel := range chans {
+						newChannel.Reject(ssh.Prohibited, "")
+					}
+				}()
+				serverConns <- newSSHConnection(conn, context.Background())
+			}
+		}(listener, serverConns)
+
+		// Tunnel mine of the caller, and theirs of another key
+		conns = make(map[string]*sshConnection)
+		clients = nil
+		for _, t := range []struct{ name, fingerprint string }{{"mine", "fp1"}, {"theirs", "fp2"}} {
+			client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+			Expect(err).To(Not(HaveOccurred()))
+			clients = append(clients, client)
+			conn := <-serverConns
+			conn.Permissions = &ssh.Permissions{Extensions: map[string]string{"pubkey-fp": t.fingerprint}}
+			conn.SetTunnelName(t.name)
+			conns[t.name] = conn
+			sshTunnelListenersLock.Lock()
+			sshTunnelListeners[addr+t.name] = sshTunnelsListenerData{conn: conn, sessionID: hex.EncodeToString(conn.SessionID()),
+				connectionType: "http", stats: newTunnelStats(0), domain: domainURI,
+				reqPayload: &remoteForwardRequest{BindAddr: "localhost", BindPort: 18998}}
+			sshTunnelListenersLock.Unlock()
+		}
+	})
+	AfterEach(func() {
+		sshTunnelListenersLock.Lock()
+		delete(sshTunnelListeners, addr+"mine")
+		delete(sshTunnelListeners, addr+"theirs")
+		sshTunnelListenersLock.Unlock()
+		for _, client := range clients {
+			client.Close()
+		}
+		listener.Close()
+	})
+
+	It("should list the tunnels of the caller from other sessions", func() {
+		channel := &bufferChannel{}
+		Expect(listCommand(&commandSession{channel: channel, fingerprint: "fp1"}, nil)).To(Succeed())
+		Expect(channel.out.String()).To(ContainSubstring(tunnelURL(domainURI, "mine", 18998)))
+		Expect(channel.out.String()).To(ContainSubstring(shortSessionID(conns["mine"])))
+		Expect(channel.out.String()).To(Not(ContainSubstring("theirs")))
+	})
+
+	It("should only close the tunnels of the caller", func() {
+		channel := &bufferChannel{}
+		session := &commandSession{conn: conns["theirs"].ServerConn, channel: channel, fingerprint: "fp1"}
+		Expect(closeCommand(session, []string{"theirs"})).To(Not(Succeed()))
+		Expect(closeCommand(session, nil)).To(Not(Succeed()))
+
+		Expect(closeCommand(session, []string{"mine"})).To(Succeed())
+		Expect(channel.out.String()).To(ContainSubstring("Closed tunnel mine"))
+		closed := make(chan error, 1)
+		go func(client *ssh.Client) {
+			closed <- client.Wait()
+		}(clients[0])
+		Eventually(closed, 5*time.Second).Should(Receive())
+	})
+})
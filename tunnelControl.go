@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the SSH subsystem that changes the tunnel of its connection at runtime, on a session channel other than
+// the one of the exec request (eg ssh -s domain.io tunnel-control).
+const tunnelControlSubsystem = "tunnel-control"
+
+// Session channels accepted per SSH connection: the one of the tunnel and those of the tunnel-control subsystem.
+const maxSessionChannels = 4
+
+// Size of the longest tunnel-control request.
+const tunnelControlMaxRequest = 64 << 10
+
+// JSON-RPC 2.0 error codes.
+const (
+	jsonRPCParseError     = -32700
+	jsonRPCInvalidRequest = -32600
+	jsonRPCMethodNotFound = -32601
+	jsonRPCInvalidParams  = -32602
+	jsonRPCServerError    = -32000 // The method could not be applied, eg the tunnel name is taken
+)
+
+// Options that the set method changes, for the next requests of an HTTP tunnel. An empty value removes the option.
+var tunnelControlOptions = []string{"header", "auth", "allow-ips", "max-conns", "noindex", "weight"}
+
+var errNoHTTPTunnel = errors.New("the connection has no HTTP tunnel")
+
+// Methods of the tunnel-control subsystem:
+//
+//	{"jsonrpc":"2.0","id":1,"method":"stats"}
+//	{"jsonrpc":"2.0","id":2,"method":"set","params":{"auth":"alice:s3cret","max-conns":10}}
+//	{"jsonrpc":"2.0","id":3,"method":"add","params":{"tunnelName":"other"}}
+//	{"jsonrpc":"2.0","id":4,"method":"remove","params":{"tunnelName":"other"}}
+//
+// Each returns the tunnel of the connection as a controlTunnel.
+var tunnelControlMethods map[string]func(conn *sshConnection, params json.RawMessage) (controlTunnel, error)
+
+func init() {
+	tunnelControlMethods = map[string]func(conn *sshConnection, params json.RawMessage) (controlTunnel, error){
+		"stats":  controlStats,
+		"set":    controlSet,
+		"add":    controlAdd,
+		"remove": controlRemove,
+	}
+}
+
+type controlRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type controlResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  *controlTunnel  `json:"result,omitempty"`
+	Error   *controlError   `json:"error,omitempty"`
+}
+
+type controlError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *controlError) Error() string {
+	return e.Message
+}
+
+// controlTunnel is the tunnel of the connection with its traffic.
+type controlTunnel struct {
+	Type              string   `json:"type"`
+	URL               string   `json:"url"`
+	TunnelName        string   `json:"tunnelName,omitempty"` // HTTP tunnels only
+	Aliases           []string `json:"aliases,omitempty"`    // Names added with the add method
+	Weight            *int     `json:"weight,omitempty"`     // Shared tunnels only
+	Requests          int64    `json:"requests"`
+	BytesIn           int64    `json:"bytesIn"`
+	BytesOut          int64    `json:"bytesOut"`
+	Connections       int64    `json:"connections"`
+	PublicConnections int64    `json:"publicConnections"`
+	MaxConns          int64    `json:"maxConns"`
+	Errors            int64    `json:"errors"`
+}
+
+// serveTunnelControl answers the JSON-RPC requests of the tunnel-control subsystem, one per line, until the client
+// closes the channel.
+func serveTunnelControl(conn *sshConnection, channel io.ReadWriter) {
+	scanner := bufio.NewScanner(channel)
+	scanner.Buffer(make([]byte, 4096), tunnelControlMaxRequest)
+	encoder := json.NewEncoder(channel)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		response, ok := callTunnelControl(conn, line)
+		if !ok {
+			// Notifications are not answered
+			continue
+		}
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("error reading tunnel-control requests of session %s: %s", hex.EncodeToString(conn.SessionID()), err)
+	}
+}
+
+// callTunnelControl calls the method of a JSON-RPC request and returns the response, or false for a notification.
+func callTunnelControl(conn *sshConnection, line []byte) (controlResponse, bool) {
+	response := controlResponse{JSONRPC: "2.0"}
+	var request controlRequest
+	if err := json.Unmarshal(line, &request); err != nil {
+		response.Error = &controlError{Code: jsonRPCParseError, Message: "Parse error"}
+		return response, true
+	}
+	response.ID = request.ID
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		response.Error = &controlError{Code: jsonRPCInvalidRequest, Message: "Invalid Request"}
+		return response, true
+	}
+
+	method, ok := tunnelControlMethods[request.Method]
+	if !ok {
+		response.Error = &controlError{Code: jsonRPCMethodNotFound, Message: fmt.Sprintf("Method %s not found", request.Method)}
+		return response, len(request.ID) > 0
+	}
+	result, err := method(conn, request.Params)
+	var callError *controlError
+	if errors.As(err, &callError) {
+		response.Error = callError
+	} else if err != nil {
+		response.Error = &controlError{Code: jsonRPCServerError, Message: err.Error()}
+	} else {
+		response.Result = &result
+	}
+	if err != nil {
+		log.Printf("tunnel-control %s for session %s failed: %s", request.Method, hex.EncodeToString(conn.SessionID()), err)
+	}
+	return response, len(request.ID) > 0
+}
+
+func invalidParams(format string, a ...interface{}) *controlError {
+	return &controlError{Code: jsonRPCInvalidParams, Message: fmt.Sprintf(format, a...)}
+}
+
+// decodeControlParams decodes params as an object, keeping numbers as in jsonOptionValue.
+func decodeControlParams(params json.RawMessage) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if len(params) == 0 {
+		return fields, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, invalidParams("params must be an object")
+	}
+	return fields, nil
+}
+
+// controlStats returns the tunnel of the connection.
+func controlStats(conn *sshConnection, params json.RawMessage) (controlTunnel, error) {
+	return describeTunnel(conn)
+}
+
+// controlSet changes the tunnelControlOptions of the HTTP tunnel, eg {"header":"localhost:3000","max-conns":10}.
+func controlSet(conn *sshConnection, params json.RawMessage) (controlTunnel, error) {
+	fields, err := decodeControlParams(params)
+	if err != nil {
+		return controlTunnel{}, err
+	}
+	if len(fields) == 0 {
+		return controlTunnel{}, invalidParams("no option to set, expected %s", strings.Join(tunnelControlOptions, ", "))
+	}
+
+	// All values are checked before any is applied
+	var options tunnelOptions
+	keys := make([]string, 0, len(fields))
+	for key, v := range fields {
+		key = strings.ToLower(key)
+		if !containsString(tunnelControlOptions, key) {
+			return controlTunnel{}, invalidParams("option %s cannot be set, expected %s", key, strings.Join(tunnelControlOptions, ", "))
+		}
+		// A list sets its key once per value as in setJSON (eg "allow-ips":["10.0.0.0/8","203.0.113.5"])
+		values, ok := v.([]interface{})
+		if !ok {
+			values = []interface{}{v}
+		}
+		for _, v := range values {
+			value, err := jsonOptionValue(key, v)
+			if err != nil {
+				return controlTunnel{}, invalidParams("%s", err)
+			}
+			if value != "" {
+				if err := options.set(key, value); err != nil {
+					return controlTunnel{}, invalidParams("%s", err)
+				}
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	err = updateConnectionTunnel(conn, func(t *sshTunnelsListenerData) {
+		for _, key := range keys {
+			switch key {
+			case "header":
+				t.hostHeader = nil
+				if options.headerSpecified {
+					header := options.header
+					t.hostHeader = &header
+				}
+			case "auth":
+				t.basicAuth = options.basicAuth
+			case "allow-ips":
+				t.allowIPs = options.allowIPs
+			case "noindex":
+				t.noindex = options.noindex
+			case "max-conns":
+				t.stats.maxConnections.Store(int64(options.maxConns))
+			case "weight":
+				t.weight = defaultTunnelWeight
+				if options.weightSpecified {
+					t.weight = options.weight
+				}
+			}
+		}
+	})
+	if err != nil {
+		return controlTunnel{}, err
+	}
+	log.Printf("tunnel-control set %s for session %s", strings.Join(keys, ", "), hex.EncodeToString(conn.SessionID()))
+	return describeTunnel(conn)
+}
+
+// controlAdd serves the HTTP tunnel under another name too, eg {"tunnelName":"other"}.
+func controlAdd(conn *sshConnection, params json.RawMessage) (controlTunnel, error) {
+	name, err := controlTunnelName(params)
+	if err != nil {
+		return controlTunnel{}, err
+	}
+	if !tunnelNameValid(name) {
+		return controlTunnel{}, invalidParams("tunnelName '%s' not valid", name)
+	}
+
+	sshTunnelListenersLock.Lock()
+	addr, primaryName, ok := connectionTunnelAddr(conn)
+	if !ok {
+		sshTunnelListenersLock.Unlock()
+		return controlTunnel{}, errNoHTTPTunnel
+	}
+	tunnel, ok := sshTunnelListeners[addr+primaryName]
+	if !ok || tunnel.sessionID != hex.EncodeToString(conn.SessionID()) {
+		sshTunnelListenersLock.Unlock()
+		return controlTunnel{}, errNoHTTPTunnel
+	}
+	if tunnel.group != nil {
+		sshTunnelListenersLock.Unlock()
+		return controlTunnel{}, errors.New("shared tunnels and tunnels with standbys cannot have other names")
+	}
+	if !tunnelNameServedOn(name, tunnel.domain) {
+		sshTunnelListenersLock.Unlock()
+		return controlTunnel{}, invalidParams("tunnelName '%s' not valid", name)
+	}
+	// Other names get the same checks as the name given when the tunnel is opened
+	if unavailable := tunnelNameUnavailable(addr, name, tunnel.clientID, conn.Fingerprint()); unavailable != "" {
+		sshTunnelListenersLock.Unlock()
+		return controlTunnel{}, fmt.Errorf("tunnelName '%s' %s", name, unavailable)
+	}
+	if _, taken := sshTunnelListeners[addr+name]; taken {
+		sshTunnelListenersLock.Unlock()
+		return controlTunnel{}, fmt.Errorf("tunnelName '%s' already taken", name)
+	}
+	sshTunnelListeners[addr+name] = tunnel
+	conn.AddTunnelAlias(name)
+	sshTunnelListenersLock.Unlock()
+
+	activity.Publish(&activityEvent{Type: eventTunnelOpen, TunnelName: name, ConnectionType: tunnel.connectionType})
+	log.Printf("tunnel-control added tunnelName %s for session %s", name, hex.EncodeToString(conn.SessionID()))
+	return describeTunnel(conn)
+}
+
+// controlRemove stops serving the HTTP tunnel under a name added with controlAdd, eg {"tunnelName":"other"}.
+func controlRemove(conn *sshConnection, params json.RawMessage) (controlTunnel, error) {
+	name, err := controlTunnelName(params)
+	if err != nil {
+		return controlTunnel{}, err
+	}
+
+	sshTunnelListenersLock.Lock()
+	addr, _, ok := connectionTunnelAddr(conn)
+	if !ok {
+		sshTunnelListenersLock.Unlock()
+		return controlTunnel{}, errNoHTTPTunnel
+	}
+	if !conn.RemoveTunnelAlias(name) {
+		sshTunnelListenersLock.Unlock()
+		return controlTunnel{}, invalidParams("tunnelName '%s' was not added to the tunnel", name)
+	}
+	removeTunnelAlias(addr+name, hex.EncodeToString(conn.SessionID()))
+	sshTunnelListenersLock.Unlock()
+
+	activity.Publish(&activityEvent{Type: eventTunnelClose, TunnelName: name, ConnectionType: string(HTTPConnectionType)})
+	log.Printf("tunnel-control removed tunnelName %s for session %s", name, hex.EncodeToString(conn.SessionID()))
+	return describeTunnel(conn)
+}
+
+func controlTunnelName(params json.RawMessage) (string, error) {
+	fields, err := decodeControlParams(params)
+	if err != nil {
+		return "", err
+	}
+	name, _ := fields["tunnelName"].(string)
+	if name == "" {
+		return "", invalidParams("tunnelName is required")
+	}
+	return strings.ToLower(name), nil
+}
+
+// connectionTunnelAddr returns the listening address and the name of the HTTP tunnel of conn.
+func connectionTunnelAddr(conn *sshConnection) (string, string, bool) {
+	payload, name := conn.GetRequestForwardPayload(), conn.GetTunnelName()
+	if payload == nil || name == nil {
+		return "", "", false
+	}
+	return net.JoinHostPort(payload.BindAddr, strconv.Itoa(int(payload.BindPort))), *name, true
+}
+
+// updateConnectionTunnel applies update to the listener data of the HTTP tunnel of conn under all its names.
+func updateConnectionTunnel(conn *sshConnection, update func(t *sshTunnelsListenerData)) error {
+	sshTunnelListenersLock.Lock()
+	defer sshTunnelListenersLock.Unlock()
+	addr, name, ok := connectionTunnelAddr(conn)
+	if !ok {
+		return errNoHTTPTunnel
+	}
+	sessionID := hex.EncodeToString(conn.SessionID())
+	updated := false
+	for _, n := range append([]string{name}, conn.GetTunnelAliases()...) {
+		t, ok := sshTunnelListeners[addr+n]
+		if !ok {
+			continue
+		}
+		if t.group != nil {
+			if t.group.Update(sessionID, update) {
+				sshTunnelListeners[addr+n], _ = t.group.Primary()
+				updated = true
+			}
+		} else if t.sessionID == sessionID {
+			update(&t)
+			sshTunnelListeners[addr+n] = t
+			updated = true
+		}
+	}
+	if !updated {
+		return errNoHTTPTunnel
+	}
+	return nil
+}
+
+// describeTunnel returns the HTTP or TCP tunnel of conn.
+func describeTunnel(conn *sshConnection) (controlTunnel, error) {
+	payload := conn.GetRequestForwardPayload()
+	if payload == nil {
+		return controlTunnel{}, errors.New("the connection has no tunnel")
+	}
+	sessionID := hex.EncodeToString(conn.SessionID())
+	var tunnel controlTunnel
+	var stats *tunnelStats
+
+	sshTunnelListenersLock.Lock()
+	if addr, name, ok := connectionTunnelAddr(conn); ok {
+		if t, ok := sshTunnelListeners[addr+name]; ok {
+			if t.group != nil {
+				t, _ = t.group.Member(sessionID)
+			}
+			stats = t.stats
+			tunnel = controlTunnel{Type: t.connectionType, URL: tunnelURL(t.domain, name, payload.BindPort), TunnelName: name,
+				Aliases: conn.GetTunnelAliases()}
+			if t.group != nil && t.group.shared {
+				weight := t.weight
+				tunnel.Weight = &weight
+			}
+			sort.Strings(tunnel.Aliases)
+		}
+	}
+	sshTunnelListenersLock.Unlock()
+
+	if stats == nil {
+		forwardsLock.Lock()
+		addr := net.JoinHostPort(payload.BindAddr, strconv.Itoa(int(payload.BindPort)))
+		if forward, ok := forwards[addr]; ok && forward.sessionID == sessionID && forward.stats != nil {
+			stats = forward.stats
+			tunnel = controlTunnel{Type: string(TCPConnectionType),
+				URL: "tcp://" + net.JoinHostPort(domainURI.Hostname(), strconv.Itoa(int(payload.BindPort)))}
+		}
+		forwardsLock.Unlock()
+	}
+	if stats == nil {
+		return controlTunnel{}, errors.New("the connection has no tunnel")
+	}
+
+	tunnel.Requests = stats.requests.Load()
+	tunnel.BytesIn = stats.bytesIn.Load()
+	tunnel.BytesOut = stats.bytesOut.Load()
+	tunnel.Connections = stats.connections.Load()
+	tunnel.PublicConnections = stats.openConnections.Load()
+	tunnel.MaxConns = stats.maxConnections.Load()
+	tunnel.Errors = stats.errors.Load()
+	return tunnel, nil
+}
+
+// removeTunnelAlias removes a name of an HTTP tunnel added with the tunnel-control subsystem.
+// Unlike removeTunnelListener, the channels of the tunnel are left open for its other names.
+// sshTunnelListenersLock must be held.
+func removeTunnelAlias(cacheKey string, sessionID string) bool {
+	if t, ok := sshTunnelListeners[cacheKey]; ok && t.group == nil && t.sessionID == sessionID {
+		delete(sshTunnelListeners, cacheKey)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("tunnel-control", func() {
+	var listener net.Listener
+	var client *ssh.Client
+	var conn *sshConnection
+	const addr = "localhost:18999"
+	BeforeEach(func() {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		signer, _ := ssh.NewSignerFromKey(key)
+		config := &ssh.ServerConfig{NoClientAuth: true}
+		config.AddHostKey(signer)
+		var err error
+		listener, err = net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		serverConn := make(chan *sshConnection, 1)
+		go func(listener net.Listener, serverConn chan *sshConnection) {
+			nConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				for newChannel := range chans {
+					newChannel.Reject(ssh.Prohibited, "")
+				}
+			}()
+			serverConn <- newSSHConnection(conn, context.Background())
+		}(listener, serverConn)
+		client, err = ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		Expect(err).To(Not(HaveOccurred()))
+		conn = <-serverConn
+
+		conn.SetRequestForwardPayload(&remoteForwardRequest{BindAddr: "localhost", BindPort: 18999})
+		conn.SetTunnelName("ctl")
+		sshTunnelListenersLock.Lock()
+		sshTunnelListeners[addr+"ctl"] = sshTunnelsListenerData{conn: conn, sessionID: hex.EncodeToString(conn.SessionID()),
+			connectionType: "http", stats: newTunnelStats(0), domain: domainURI}
+		sshTunnelListenersLock.Unlock()
+	})
+	AfterEach(func() {
+		sshTunnelListenersLock.Lock()
+		for _, name := range []string{"ctl", "other", "taken"} {
+			delete(sshTunnelListeners, addr+name)
+		}
+		sshTunnelListenersLock.Unlock()
+		client.Close()
+		listener.Close()
+	})
+
+	call := func(request string) controlResponse {
+		response, ok := callTunnelControl(conn, []byte(request))
+		Expect(ok).To(BeTrue())
+		return response
+	}
+	tunnel := func() sshTunnelsListenerData {
+		sshTunnelListenersLock.Lock()
+		defer sshTunnelListenersLock.Unlock()
+		return sshTunnelListeners[addr+"ctl"]
+	}
+
+	It("should return the tunnel of the connection", func() {
+		tunnel().stats.Begin()
+		response := call(`{"jsonrpc":"2.0","id":1,"method":"stats"}`)
+		Expect(response.Error).To(BeNil())
+		Expect(string(response.ID)).To(Equal("1"))
+		Expect(response.Result.TunnelName).To(Equal("ctl"))
+		Expect(response.Result.Type).To(Equal("http"))
+		Expect(response.Result.URL).To(Equal(tunnelURL(domainURI, "ctl", 18999)))
+		Expect(response.Result.Requests).To(BeEquivalentTo(1))
+	})
+
+	It("should change the options of the tunnel", func() {
+		response := call(`{"jsonrpc":"2.0","id":"a","method":"set","params":{"header":"localhost:3000","auth":"alice:s3cret","max-conns":2,"allow-ips":["10.0.0.0/8"]}}`)
+		Expect(response.Error).To(BeNil())
+		Expect(response.Result.MaxConns).To(BeEquivalentTo(2))
+		Expect(*tunnel().hostHeader).To(Equal("localhost:3000"))
+		Expect(tunnel().basicAuth).To(Not(BeNil()))
+		Expect(tunnel().allowIPs).To(HaveLen(1))
+
+		response = call(`{"jsonrpc":"2.0","id":"b","method":"set","params":{"header":"","auth":""}}`)
+		Expect(response.Error).To(BeNil())
+		Expect(tunnel().hostHeader).To(BeNil())
+		Expect(tunnel().basicAuth).To(BeNil())
+		Expect(tunnel().allowIPs).To(HaveLen(1))
+
+		for _, params := range []string{`{"cache":true}`, `{"max-conns":-1}`, `{}`, `[1]`} {
+			response = call(`{"jsonrpc":"2.0","id":3,"method":"set","params":` + params + `}`)
+			Expect(response.Error).To(Not(BeNil()))
+			Expect(response.Error.Code).To(Equal(jsonRPCInvalidParams))
+		}
+		Expect(tunnel().stats.maxConnections.Load()).To(BeEquivalentTo(2))
+	})
+
+	It("should add and remove other names of the tunnel", func() {
+		sshTunnelListenersLock.Lock()
+		sshTunnelListeners[addr+"taken"] = sshTunnelsListenerData{sessionID: "someone else"}
+		sshTunnelListenersLock.Unlock()
+
+		response := call(`{"jsonrpc":"2.0","id":1,"method":"add","params":{"tunnelName":"Other"}}`)
+		Expect(response.Error).To(BeNil())
+		Expect(response.Result.Aliases).To(Equal([]string{"other"}))
+		Expect(call(`{"jsonrpc":"2.0","id":2,"method":"add","params":{"tunnelName":"taken"}}`).Error.Code).To(Equal(jsonRPCServerError))
+		Expect(call(`{"jsonrpc":"2.0","id":3,"method":"add","params":{"tunnelName":"a--b"}}`).Error.Code).To(Equal(jsonRPCInvalidParams))
+
+		// The other name follows the changes of the tunnel
+		call(`{"jsonrpc":"2.0","id":4,"method":"set","params":{"noindex":true}}`)
+		sshTunnelListenersLock.Lock()
+		Expect(sshTunnelListeners[addr+"other"].noindex).To(BeTrue())
+		sshTunnelListenersLock.Unlock()
+
+		Expect(call(`{"jsonrpc":"2.0","id":5,"method":"remove","params":{"tunnelName":"ctl"}}`).Error.Code).To(Equal(jsonRPCInvalidParams))
+		response = call(`{"jsonrpc":"2.0","id":6,"method":"remove","params":{"tunnelName":"other"}}`)
+		Expect(response.Error).To(BeNil())
+		Expect(response.Result.Aliases).To(BeEmpty())
+		sshTunnelListenersLock.Lock()
+		_, ok := sshTunnelListeners[addr+"other"]
+		sshTunnelListenersLock.Unlock()
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should refuse the names the tunnel could not be opened with", func() {
+		previous, _ := nameDenylist.Load().([]*regexp.Regexp)
+		defer nameDenylist.Store(previous)
+		nameDenylist.Store([]*regexp.Regexp{regexp.MustCompile("paypal")})
+		sshTunnelListenersLock.Lock()
+		sshTunnelListeners[addr+"taken"] = sshTunnelsListenerData{sessionID: "someone else", clientID: "someone else",
+			reqPayload: &remoteForwardRequest{BindAddr: "localhost", BindPort: 18999}}
+		sshTunnelListenersLock.Unlock()
+
+		response := call(`{"jsonrpc":"2.0","id":1,"method":"add","params":{"tunnelName":"paypal"}}`)
+		Expect(response.Error.Message).To(Equal("tunnelName 'paypal' not allowed"))
+		response = call(`{"jsonrpc":"2.0","id":2,"method":"add","params":{"tunnelName":"dev.taken"}}`)
+		Expect(response.Error.Message).To(Equal("tunnelName 'dev.taken' is nested with 'taken' of another client"))
+
+		// Names held by another node of the cluster
+		peerTunnelsLock.Lock()
+		peerTunnels["10.0.0.2:7946"] = map[string]string{addr + "elsewhere": clusterClientHash("someone else")}
+		peerTunnelsLock.Unlock()
+		defer func() {
+			peerTunnelsLock.Lock()
+			delete(peerTunnels, "10.0.0.2:7946")
+			peerTunnelsLock.Unlock()
+		}()
+		response = call(`{"jsonrpc":"2.0","id":3,"method":"add","params":{"tunnelName":"elsewhere"}}`)
+		Expect(response.Error.Message).To(Equal("tunnelName 'elsewhere' already taken"))
+
+		// Names held for the key of a client that has yet to come back
+		dir, err := os.MkdirTemp("", "reservations")
+		Expect(err).To(Not(HaveOccurred()))
+		defer os.RemoveAll(dir)
+		defer func(store *reservationStore) { reservations = store }(reservations)
+		reservations, err = newReservationStore(filepath.Join(dir, "reservations.json"), time.Hour)
+		Expect(err).To(Not(HaveOccurred()))
+		reservations.Open(httpReservationKey(addr, "other"), "SHA256:someone-else")
+		reservations.Close(httpReservationKey(addr, "other"), "SHA256:someone-else")
+		response = call(`{"jsonrpc":"2.0","id":3,"method":"add","params":{"tunnelName":"other"}}`)
+		Expect(response.Error.Message).To(Equal("tunnelName 'other' is reserved for another key"))
+		Expect(conn.GetTunnelAliases()).To(BeEmpty())
+	})
+
+	It("should answer invalid requests with JSON-RPC errors", func() {
+		Expect(call(`{"jsonrpc":`).Error.Code).To(Equal(jsonRPCParseError))
+		Expect(call(`{"id":1,"method":"stats"}`).Error.Code).To(Equal(jsonRPCInvalidRequest))
+		Expect(call(`{"jsonrpc":"2.0","id":1,"method":"restart"}`).Error.Code).To(Equal(jsonRPCMethodNotFound))
+
+		_, ok := callTunnelControl(conn, []byte(`{"jsonrpc":"2.0","method":"set","params":{"noindex":true}}`))
+		Expect(ok).To(BeFalse())
+		Expect(tunnel().noindex).To(BeTrue())
+	})
+
+	It("should answer a request per line", func() {
+		var out bytes.Buffer
+		in := strings.NewReader("{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"stats\"}\n\n{\"jsonrpc\":\"2.0\",\"method\":\"stats\"}\n{\"jsonrpc\":\"2.0\",\"id\":2,\"method\":\"stats\"}\n")
+		serveTunnelControl(conn, struct {
+			io.Reader
+			io.Writer
+		}{in, &out})
+
+		decoder := json.NewDecoder(&out)
+		var ids []string
+		for decoder.More() {
+			var response controlResponse
+			Expect(decoder.Decode(&response)).To(Succeed())
+			ids = append(ids, string(response.ID))
+		}
+		Expect(ids).To(Equal([]string{"1", "2"}))
+	})
+})
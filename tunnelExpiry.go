@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tunnels closed once they reached their maximum age, published at /debug/vars of the pprof port.
+var expiredTunnelsClosed = expvar.NewInt("expiredTunnelsClosed")
+
+// closeExpiredTunnel closes the SSH connection of a tunnel once it is maxAge old, see closeTunnelSession. It returns
+// when conn closes.
+func closeExpiredTunnel(conn *sshConnection, maxAge time.Duration, reply *sessionReplier) {
+	closed := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(closed)
+	}()
+
+	timer := time.NewTimer(maxAge)
+	defer timer.Stop()
+	select {
+	case <-closed:
+		return
+	case <-timer.C:
+	}
+
+	log.Printf("Closing tunnel of session %s after its maximum age of %s", hex.EncodeToString(conn.SessionID()), maxAge)
+	expiredTunnelsClosed.Add(1)
+	closeTunnelSession(conn, reply, fmt.Sprintf("Tunnel closed after reaching its maximum age of %s.", maxAge))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("tunnel expiry", func() {
+	It("should take the maximum age of the key over the default", func() {
+		key, err := parseAuthorizedKeyOptions([]string{`from="10.0.0.1"`, `max-tunnel-age="2h"`})
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(key.hasMaxTunnelAge).To(BeTrue())
+		Expect(key.maxTunnelAge).To(Equal(2 * time.Hour))
+		_, err = parseAuthorizedKeyOptions([]string{`max-tunnel-age="soon"`})
+		Expect(err).To(MatchError(`invalid max-tunnel-age value "soon"`))
+
+		defer currentSettings.Store(settings())
+		updateSettings(func(s *runtimeSettings) { s.maxTunnelAge = 24 * time.Hour })
+		conn := &sshConnection{ServerConn: &ssh.ServerConn{}}
+		Expect(conn.MaxTunnelAge()).To(Equal(24 * time.Hour))
+		conn.Permissions = key.permissions("SHA256:key")
+		Expect(conn.Fingerprint()).To(Equal("SHA256:key"))
+		Expect(conn.MaxTunnelAge()).To(Equal(2 * time.Hour))
+
+		// A key without a maximum age keeps the default, and max-tunnel-age="0" lifts it
+		conn.Permissions = authorizedKey{}.permissions("SHA256:key")
+		Expect(conn.MaxTunnelAge()).To(Equal(24 * time.Hour))
+		key, _ = parseAuthorizedKeyOptions([]string{`max-tunnel-age="0"`})
+		conn.Permissions = key.permissions("SHA256:key")
+		Expect(conn.MaxTunnelAge()).To(BeZero())
+	})
+
+	Context("with a client", func() {
+		var listener net.Listener
+		var serverConn chan *sshConnection
+		BeforeEach(func() {
+			_, key, _ := ed25519.GenerateKey(rand.Reader)
+			signer, _ := ssh.NewSignerFromKey(key)
+			config := &ssh.ServerConfig{NoClientAuth: true}
+			config.AddHostKey(signer)
+			var err error
+			listener, err = net.Listen("tcp", "localhost:0")
+			Expect(err).To(Not(HaveOccurred()))
+			serverConn = make(chan *sshConnection, 1)
+			go func(listener net.Listener, serverConn chan *sshConnection) {
+				nConn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				channel, requests, err := (<-chans).Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					for req := range requests {
+						req.Reply(req.Type == "exec", nil)
+					}
+				}()
+				c := newSSHConnection(conn, context.Background())
+				c.SetSessionChannel(&channel)
+				serverConn <- c
+			}(listener, serverConn)
+		})
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("should close the tunnel with exit status 0 once it reaches its maximum age", func() {
+			client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+			Expect(err).To(Not(HaveOccurred()))
+			defer client.Close()
+			session, err := client.NewSession()
+			Expect(err).To(Not(HaveOccurred()))
+			stdout, _ := session.StdoutPipe()
+			Expect(session.Start("type=http")).To(Succeed())
+			conn := <-serverConn
+			closed := expiredTunnelsClosed.Value()
+
+			start := time.Now()
+			go closeExpiredTunnel(conn, 100*time.Millisecond, &sessionReplier{w: *conn.GetSessionChannel()})
+
+			output, err := io.ReadAll(stdout)
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(string(output)).To(Equal("Tunnel closed after reaching its maximum age of 100ms.\n"))
+			Expect(time.Since(start)).To(BeNumerically(">=", 100*time.Millisecond))
+			Expect(session.Wait()).To(Succeed())
+			Expect(expiredTunnelsClosed.Value()).To(Equal(closed + 1))
+		})
+	})
+})
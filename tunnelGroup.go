@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"sync"
+)
+
+// Name of the cookie that pins a visitor to a client of a shared tunnel.
+const affinityCookieName = "tunnel_backend"
+
+// Weight of the clients of a shared tunnel that do not ask for another one with weight=.
+const defaultTunnelWeight = 100
+
+const (
+	stickyNone   = ""
+	stickyCookie = "cookie"
+	stickyIP     = "ip"
+)
+
+// tunnelGroup is the set of clients sharing the same HTTP tunnel name (shared=true) or standing by for it
+// (standby=true). Each member holds a pointer to the group, and the sshTunnelListeners entry is always the primary
+// member.
+type tunnelGroup struct {
+	sync.Mutex
+	members []sshTunnelsListenerData
+	// Clients with shared=true can join. Groups of a tunnel that is not shared only take standbys.
+	shared bool
+	// How visitors are pinned to a member: stickyNone, stickyCookie or stickyIP.
+	sticky string
+	// Current weights by session id of the smooth weighted round-robin spreading requests without stickiness
+	current map[string]int
+}
+
+func newTunnelGroup(sticky string) *tunnelGroup {
+	return &tunnelGroup{sticky: sticky, current: map[string]int{}}
+}
+
+// Add adds m to the group replacing the member of a reconnecting client with the same client id, which it returns.
+func (g *tunnelGroup) Add(m sshTunnelsListenerData) (replaced sshTunnelsListenerData, ok bool) {
+	g.Lock()
+	defer g.Unlock()
+	for i, member := range g.members {
+		if member.clientID == m.clientID {
+			g.members[i] = m
+			return member, true
+		}
+	}
+	g.members = append(g.members, m)
+	return replaced, false
+}
+
+// Remove removes the member with sessionID and returns true if it was found.
+func (g *tunnelGroup) Remove(sessionID string) bool {
+	g.Lock()
+	defer g.Unlock()
+	for i, member := range g.members {
+		if member.sessionID == sessionID {
+			member.channels.Close()
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			delete(g.current, sessionID)
+			return true
+		}
+	}
+	return false
+}
+
+// Update applies update to the member with sessionID and returns true if it was found.
+func (g *tunnelGroup) Update(sessionID string, update func(m *sshTunnelsListenerData)) bool {
+	g.Lock()
+	defer g.Unlock()
+	for i := range g.members {
+		if g.members[i].sessionID == sessionID {
+			update(&g.members[i])
+			return true
+		}
+	}
+	return false
+}
+
+// Member returns the member with sessionID if any.
+func (g *tunnelGroup) Member(sessionID string) (sshTunnelsListenerData, bool) {
+	g.Lock()
+	defer g.Unlock()
+	for _, member := range g.members {
+		if member.sessionID == sessionID {
+			return member, true
+		}
+	}
+	return sshTunnelsListenerData{}, false
+}
+
+// Members returns the members of the group, oldest first.
+func (g *tunnelGroup) Members() []sshTunnelsListenerData {
+	g.Lock()
+	defer g.Unlock()
+	return append([]sshTunnelsListenerData{}, g.members...)
+}
+
+// Primary returns the oldest member of the group that is not standing by, or else the oldest standby, if any.
+func (g *tunnelGroup) Primary() (sshTunnelsListenerData, bool) {
+	g.Lock()
+	defer g.Unlock()
+	for _, member := range g.members {
+		if !member.standby {
+			return member, true
+		}
+	}
+	if len(g.members) == 0 {
+		return sshTunnelsListenerData{}, false
+	}
+	return g.members[0], true
+}
+
+// Promote turns the oldest standby into a serving member when no other member serves, and returns it.
+func (g *tunnelGroup) Promote() (sshTunnelsListenerData, bool) {
+	g.Lock()
+	defer g.Unlock()
+	for _, member := range g.members {
+		if !member.standby {
+			return sshTunnelsListenerData{}, false
+		}
+	}
+	if len(g.members) == 0 {
+		return sshTunnelsListenerData{}, false
+	}
+	g.members[0].standby = false
+	return g.members[0], true
+}
+
+// Pick selects the member that serves a request of a visitor among the healthy ones (see tunnelHealth) that are not
+// standing by, or else among the healthy standbys, or else among all of them. Members get a share of the visitors
+// or requests in proportion to their weight (eg 90 and 10 for a canary), and without stickiness they serve the
+// requests in turn (smooth weighted round-robin).
+// It returns the value of the affinity cookie to set on the response, if any, and false if the group has no member
+// left, as the last one may leave between the lookup of the tunnel and the pick.
+func (g *tunnelGroup) Pick(visitorIP string, cookies []string) (sshTunnelsListenerData, string, bool) {
+	g.Lock()
+	defer g.Unlock()
+	if len(g.members) == 0 {
+		return sshTunnelsListenerData{}, "", false
+	}
+
+	members := make([]sshTunnelsListenerData, 0, len(g.members))
+	for _, standby := range []bool{false, true} {
+		for _, member := range g.members {
+			if member.standby == standby && member.health.Healthy() {
+				members = append(members, member)
+			}
+		}
+		if len(members) > 0 {
+			break
+		}
+	}
+	if len(members) == 0 {
+		members = g.members
+	}
+
+	if g.sticky == stickyCookie {
+		request := http.Request{Header: http.Header{"Cookie": cookies}}
+		if cookie, err := request.Cookie(affinityCookieName); err == nil {
+			for _, member := range members {
+				if member.backendID() == cookie.Value {
+					return member, "", true
+				}
+			}
+		}
+		member := weightedMember(members, ipHash(visitorIP))
+		return member, member.backendID(), true
+	}
+
+	if g.sticky == stickyIP {
+		return weightedMember(members, ipHash(visitorIP)), "", true
+	}
+
+	weights, total := memberWeights(members)
+	picked := 0
+	for i, member := range members {
+		g.current[member.sessionID] += weights[i]
+		if g.current[member.sessionID] > g.current[members[picked].sessionID] {
+			picked = i
+		}
+	}
+	g.current[members[picked].sessionID] -= total
+	return members[picked], "", true
+}
+
+// memberWeights returns the weights of members and their sum. Members of weight 0 get no share unless all of
+// them have weight 0, in which case they get the same share.
+func memberWeights(members []sshTunnelsListenerData) ([]int, int) {
+	weights, total := make([]int, len(members)), 0
+	for i, member := range members {
+		weights[i] = member.weight
+		total += member.weight
+	}
+	if total == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		total = len(weights)
+	}
+	return weights, total
+}
+
+// weightedMember returns the member at hash when each member takes a range of hashes as wide as its weight.
+func weightedMember(members []sshTunnelsListenerData, hash uint32) sshTunnelsListenerData {
+	weights, total := memberWeights(members)
+	n := int(hash % uint32(total))
+	for i, weight := range weights {
+		if n < weight {
+			return members[i]
+		}
+		n -= weight
+	}
+	return members[len(members)-1]
+}
+
+// backendID identifies the client in affinity cookies without disclosing its client id.
+func (s sshTunnelsListenerData) backendID() string {
+	sum := sha256.Sum256([]byte(s.clientID))
+	return hex.EncodeToString(sum[:8])
+}
+
+func ipHash(ip string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(ip))
+	return h.Sum32()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tunnelGroup", func() {
+	It("should spread the requests over the members in turn", func() {
+		group := newTunnelGroup(stickyNone)
+		group.Add(sshTunnelsListenerData{clientID: "a", sessionID: "1"})
+		group.Add(sshTunnelsListenerData{clientID: "b", sessionID: "2"})
+		group.Add(sshTunnelsListenerData{clientID: "c", sessionID: "3"})
+
+		var picked []string
+		for i := 0; i < 6; i++ {
+			member, cookie, _ := group.Pick("10.0.0.1", nil)
+			Expect(cookie).To(BeEmpty())
+			picked = append(picked, member.sessionID)
+		}
+		Expect(picked).To(Equal([]string{"1", "2", "3", "1", "2", "3"}))
+
+		group.Remove("2")
+		counts := map[string]int{}
+		for i := 0; i < 10; i++ {
+			member, _, _ := group.Pick("10.0.0.1", nil)
+			counts[member.sessionID]++
+		}
+		Expect(counts).To(Equal(map[string]int{"1": 5, "3": 5}))
+	})
+
+	It("should spread the requests in proportion to the weights of the members", func() {
+		group := newTunnelGroup(stickyNone)
+		group.Add(sshTunnelsListenerData{clientID: "a", sessionID: "1", weight: 90})
+		group.Add(sshTunnelsListenerData{clientID: "b", sessionID: "2", weight: 10})
+		counts := map[string]int{}
+		for i := 0; i < 100; i++ {
+			member, _, _ := group.Pick("10.0.0.1", nil)
+			counts[member.sessionID]++
+		}
+		Expect(counts).To(Equal(map[string]int{"1": 90, "2": 10}))
+
+		// The requests of the canary are spread rather than sent in a row
+		var picked []string
+		for i := 0; i < 10; i++ {
+			member, _, _ := group.Pick("10.0.0.1", nil)
+			picked = append(picked, member.sessionID)
+		}
+		Expect(picked).To(ContainElement("2"))
+		Expect(picked[0]).To(Equal("1"))
+
+		// Members of weight 0 are drained
+		group.Update("2", func(m *sshTunnelsListenerData) { m.weight = 0 })
+		for i := 0; i < 20; i++ {
+			member, _, _ := group.Pick("10.0.0.1", nil)
+			Expect(member.sessionID).To(Equal("1"))
+		}
+
+		group = newTunnelGroup(stickyIP)
+		group.Add(sshTunnelsListenerData{clientID: "a", sessionID: "1", weight: 90})
+		group.Add(sshTunnelsListenerData{clientID: "b", sessionID: "2", weight: 10})
+		counts = map[string]int{}
+		for i := 0; i < 1000; i++ {
+			member, _, _ := group.Pick(fmt.Sprintf("10.0.%d.%d", i/256, i%256), nil)
+			counts[member.sessionID]++
+		}
+		Expect(counts["2"]).To(BeNumerically("~", 100, 40))
+	})
+
+	It("should parse the weight option", func() {
+		options, err := parseTunnelOptions("type=http,shared=true,weight=10")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.weight).To(Equal(10))
+		Expect(options.weightSpecified).To(BeTrue())
+		for _, value := range []string{"-1", "heavy", "10001"} {
+			_, err = parseTunnelOptions("type=http,weight=" + value)
+			Expect(err).To(MatchError("invalid weight value " + value))
+		}
+	})
+
+	It("should only send requests to standbys once no other member is left", func() {
+		group := newTunnelGroup(stickyNone)
+		group.Add(sshTunnelsListenerData{clientID: "a", sessionID: "1"})
+		group.Add(sshTunnelsListenerData{clientID: "b", sessionID: "2", standby: true})
+		group.Add(sshTunnelsListenerData{clientID: "c", sessionID: "3", standby: true})
+		_, promoted := group.Promote()
+		Expect(promoted).To(BeFalse())
+		for i := 0; i < 4; i++ {
+			member, _, _ := group.Pick("10.0.0.1", nil)
+			Expect(member.sessionID).To(Equal("1"))
+		}
+
+		group.Remove("1")
+		member, promoted := group.Promote()
+		Expect(promoted).To(BeTrue())
+		Expect(member.sessionID).To(Equal("2"))
+		primary, _ := group.Primary()
+		Expect(primary.sessionID).To(Equal("2"))
+		for i := 0; i < 4; i++ {
+			member, _, _ := group.Pick("10.0.0.1", nil)
+			Expect(member.sessionID).To(Equal("2"))
+		}
+
+		// A standby serves rather than an unhealthy member
+		sick := newTunnelHealth("/healthz")
+		for i := 0; i < healthCheckFailures; i++ {
+			sick.Record(errors.New("status 500"))
+		}
+		group.Update("2", func(m *sshTunnelsListenerData) { m.health = sick })
+		member, _, _ = group.Pick("10.0.0.1", nil)
+		Expect(member.sessionID).To(Equal("3"))
+	})
+
+	It("should parse the standby option", func() {
+		options, err := parseTunnelOptions("type=http,standby=true")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.standby).To(BeTrue())
+		_, err = parseTunnelOptions("type=http,standby=maybe")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should keep visitors on the same member when sticky", func() {
+		group := newTunnelGroup(stickyIP)
+		group.Add(sshTunnelsListenerData{clientID: "a", sessionID: "1"})
+		group.Add(sshTunnelsListenerData{clientID: "b", sessionID: "2"})
+		for i := 0; i < 10; i++ {
+			first, _, _ := group.Pick(fmt.Sprintf("10.0.0.%d", i), nil)
+			second, _, _ := group.Pick(fmt.Sprintf("10.0.0.%d", i), nil)
+			Expect(second.sessionID).To(Equal(first.sessionID))
+		}
+
+		group = newTunnelGroup(stickyCookie)
+		group.Add(sshTunnelsListenerData{clientID: "a", sessionID: "1"})
+		b := sshTunnelsListenerData{clientID: "b", sessionID: "2"}
+		group.Add(b)
+		member, cookie, _ := group.Pick("10.0.0.1", []string{affinityCookieName + "=" + b.backendID()})
+		Expect(member.sessionID).To(Equal("2"))
+		Expect(cookie).To(BeEmpty())
+		_, cookie, _ = group.Pick("10.0.0.1", nil)
+		Expect(cookie).To(Not(BeEmpty()))
+	})
+
+	It("should pick no member once the last one left", func() {
+		for _, sticky := range []string{stickyNone, stickyIP, stickyCookie} {
+			group := newTunnelGroup(sticky)
+			group.Add(sshTunnelsListenerData{clientID: "a", sessionID: "1"})
+			group.Remove("1")
+			_, _, ok := group.Pick("10.0.0.1", nil)
+			Expect(ok).To(BeFalse(), sticky)
+		}
+	})
+})
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Tunnels closed by their idle-timeout option, published at /debug/vars of the pprof port.
+var idleTunnelsClosed = expvar.NewInt("idleTunnelsClosed")
+
+// closeIdleTunnel closes the SSH connection of a tunnel once stats show no public traffic for timeout (idle-timeout
+// option), see closeTunnelSession. It returns when conn closes.
+func closeIdleTunnel(conn *sshConnection, stats *tunnelStats, timeout time.Duration, reply *sessionReplier) {
+	closed := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(closed)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-timer.C:
+		}
+		if idle := stats.Idle(); idle < timeout {
+			timer.Reset(timeout - idle)
+			continue
+		}
+
+		log.Printf("Closing idle tunnel of session %s after %s", hex.EncodeToString(conn.SessionID()), timeout)
+		idleTunnelsClosed.Add(1)
+		closeTunnelSession(conn, reply, fmt.Sprintf("Tunnel closed after %s without traffic.", timeout))
+		return
+	}
+}
+
+// closeTunnelSession tells the client of a tunnel why it is closed and closes its SSH connection. The session channel
+// ends with exit status 0 so that ssh exits without error and tunnel.sh or tunnel-client do not reconnect.
+func closeTunnelSession(conn *sshConnection, reply *sessionReplier, message string) {
+	if reply != nil {
+		reply.Closed(message)
+	}
+	exitTunnelSession(conn, 0)
+}
+
+// exitTunnelSession ends the session channel of a tunnel with the exit status and closes its SSH connection.
+func exitTunnelSession(conn *sshConnection, status uint32) {
+	if channel := conn.GetSessionChannel(); channel != nil {
+		(*channel).SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		(*channel).Close()
+	}
+	conn.Close()
+}
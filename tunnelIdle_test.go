@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("idle tunnels", func() {
+	var listener net.Listener
+	var serverConn chan *sshConnection
+	BeforeEach(func() {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		signer, _ := ssh.NewSignerFromKey(key)
+		config := &ssh.ServerConfig{NoClientAuth: true}
+		config.AddHostKey(signer)
+		var err error
+		listener, err = net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		serverConn = make(chan *sshConnection, 1)
+		go func(listener net.Listener, serverConn chan *sshConnection) {
+			nConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			channel, requests, err := (<-chans).Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for req := range requests {
+					req.Reply(req.Type == "exec", nil)
+				}
+			}()
+			c := newSSHConnection(conn, context.Background())
+			c.SetSessionChannel(&channel)
+			serverConn <- c
+		}(listener, serverConn)
+	})
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	dial := func() (*ssh.Client, *ssh.Session, io.Reader) {
+		client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		Expect(err).To(Not(HaveOccurred()))
+		session, err := client.NewSession()
+		Expect(err).To(Not(HaveOccurred()))
+		stdout, _ := session.StdoutPipe()
+		Expect(session.Start("type=http,idle-timeout=1m")).To(Succeed())
+		return client, session, stdout
+	}
+
+	It("should close the tunnel with exit status 0 after the timeout without traffic", func() {
+		client, session, stdout := dial()
+		defer client.Close()
+		conn := <-serverConn
+		stats := newTunnelStats(0)
+		closed := idleTunnelsClosed.Value()
+
+		stats.Begin()
+		start := time.Now()
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			stats.End(0, 0)
+		}()
+		go closeIdleTunnel(conn, stats, 100*time.Millisecond, &sessionReplier{w: *conn.GetSessionChannel()})
+
+		output, err := io.ReadAll(stdout)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(output)).To(Equal("Tunnel closed after 100ms without traffic.\n"))
+		// The request in progress kept the tunnel open
+		Expect(time.Since(start)).To(BeNumerically(">=", 300*time.Millisecond))
+		Expect(session.Wait()).To(Succeed())
+		Expect(idleTunnelsClosed.Value()).To(Equal(closed + 1))
+	})
+
+	It("should stop watching once the connection closes", func() {
+		client, _, _ := dial()
+		conn := <-serverConn
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			closeIdleTunnel(conn, newTunnelStats(0), time.Hour, &sessionReplier{w: io.Discard})
+		}()
+		client.Close()
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("should parse the idle-timeout option", func() {
+		options, err := parseTunnelOptions("type=http,idle-timeout=30m")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.idleTimeout).To(Equal(30 * time.Minute))
+		_, err = parseTunnelOptions("type=http,idle-timeout=0s")
+		Expect(err).To(HaveOccurred())
+		_, err = parseTunnelOptions("type=http,idle-timeout=soon")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// HTTP tunnels by tunnelName and TCP tunnels by port paused by an admin: public requests get a 503 and public TCP
+// connections are closed while the SSH sessions stay up. Pausing the name of a tunnel also pauses its aliases, and
+// tunnels stay paused when their clients reconnect.
+var pausedTunnels = struct {
+	sync.Mutex
+	names map[string]bool
+	ports map[int]bool
+}{names: map[string]bool{}, ports: map[int]bool{}}
+
+func init() {
+	// Served by the admin (pprof) port.
+	http.HandleFunc("/tunnels/pause", func(w http.ResponseWriter, r *http.Request) { servePauseTunnel(w, r, true) })
+	http.HandleFunc("/tunnels/resume", func(w http.ResponseWriter, r *http.Request) { servePauseTunnel(w, r, false) })
+}
+
+// tunnelPaused returns true if the HTTP tunnel tunnelName is paused.
+func tunnelPaused(tunnelName string) bool {
+	pausedTunnels.Lock()
+	defer pausedTunnels.Unlock()
+	return pausedTunnels.names[tunnelName]
+}
+
+// tcpTunnelPaused returns true if the TCP tunnel at port is paused.
+func tcpTunnelPaused(port int) bool {
+	pausedTunnels.Lock()
+	defer pausedTunnels.Unlock()
+	return pausedTunnels.ports[port]
+}
+
+// servePauseTunnel pauses or resumes the HTTP tunnel given with ?tunnel=NAME or the TCP tunnel given with ?port=N,
+// and lets its client know if it is connected.
+func servePauseTunnel(w http.ResponseWriter, r *http.Request, pause bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "tunnels are paused and resumed with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	tunnelName, portStr := r.URL.Query().Get("tunnel"), r.URL.Query().Get("port")
+	port, err := strconv.Atoi(portStr)
+	if (tunnelName == "") == (portStr == "") || (portStr != "" && (err != nil || port <= 0 || port > 65535)) {
+		http.Error(w, "expected a tunnel or port query parameter", http.StatusBadRequest)
+		return
+	}
+
+	target, action, message := tunnelName, "tunnel.resume", "The tunnel was resumed by the administrator."
+	if pause {
+		action, message = "tunnel.pause", "The tunnel was paused by the administrator, visitors get a 503 until it is resumed."
+	}
+	pausedTunnels.Lock()
+	switch {
+	case tunnelName != "" && pause:
+		pausedTunnels.names[tunnelName] = true
+	case tunnelName != "":
+		delete(pausedTunnels.names, tunnelName)
+	case pause:
+		pausedTunnels.ports[port] = true
+	default:
+		delete(pausedTunnels.ports, port)
+	}
+	pausedTunnels.Unlock()
+	if tunnelName == "" {
+		target = "port " + portStr
+	}
+
+	for _, conn := range pausedTunnelConnections(tunnelName, port) {
+		if reply := conn.GetSessionReplier(); reply != nil {
+			go reply.Warn(message)
+		}
+	}
+	audit(adminActor(r), action, target, "")
+	fmt.Fprintf(w, "%s %s\n", action, target)
+}
+
+// pausedTunnelConnections returns the SSH connections serving the HTTP tunnel tunnelName, by name or alias, or else
+// the TCP tunnel at port.
+func pausedTunnelConnections(tunnelName string, port int) []*sshConnection {
+	var conns []*sshConnection
+	if tunnelName != "" {
+		found := map[*sshConnection]bool{}
+		sshTunnelListenersLock.Lock()
+		defer sshTunnelListenersLock.Unlock()
+		for _, tunnel := range sshTunnelListeners {
+			if tunnel.conn == nil || found[tunnel.conn] {
+				continue
+			}
+			names := tunnel.conn.GetTunnelAliases()
+			if name := tunnel.conn.GetTunnelName(); name != nil {
+				names = append(names, *name)
+			}
+			for _, name := range names {
+				if name == tunnelName {
+					found[tunnel.conn] = true
+					conns = append(conns, tunnel.conn)
+					break
+				}
+			}
+		}
+		return conns
+	}
+	forwardsLock.Lock()
+	defer forwardsLock.Unlock()
+	for _, forward := range forwards {
+		if addr, ok := forward.listener.Addr().(*net.TCPAddr); ok && addr.Port == port && forward.conn != nil {
+			conns = append(conns, forward.conn)
+		}
+	}
+	return conns
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tunnel pause", func() {
+	serve := func(method string, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	It("should pause and resume tunnels by name or port", func() {
+		Expect(serve(http.MethodPost, "/tunnels/pause?tunnel=demo").Body.String()).To(Equal("tunnel.pause demo\n"))
+		Expect(tunnelPaused("demo")).To(BeTrue())
+		Expect(tunnelPaused("other")).To(BeFalse())
+		Expect(serve(http.MethodPost, "/tunnels/pause?port=2222").Body.String()).To(Equal("tunnel.pause port 2222\n"))
+		Expect(tcpTunnelPaused(2222)).To(BeTrue())
+		Expect(tcpTunnelPaused(2223)).To(BeFalse())
+
+		Expect(serve(http.MethodPost, "/tunnels/resume?tunnel=demo").Code).To(Equal(http.StatusOK))
+		Expect(tunnelPaused("demo")).To(BeFalse())
+		Expect(serve(http.MethodPost, "/tunnels/resume?port=2222").Code).To(Equal(http.StatusOK))
+		Expect(tcpTunnelPaused(2222)).To(BeFalse())
+	})
+
+	It("should refuse invalid requests", func() {
+		Expect(serve(http.MethodGet, "/tunnels/pause?tunnel=demo").Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(serve(http.MethodPost, "/tunnels/pause").Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(http.MethodPost, "/tunnels/pause?tunnel=demo&port=2222").Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(http.MethodPost, "/tunnels/pause?port=http").Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(http.MethodPost, "/tunnels/pause?port=70000").Code).To(Equal(http.StatusBadRequest))
+		Expect(tunnelPaused("demo")).To(BeFalse())
+	})
+})
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Tunnels whose local server did not answer the probe of the probe option, published at /debug/vars of the pprof port.
+var tunnelProbesFailed = expvar.NewInt("tunnelProbesFailed")
+
+// How long the local server of a tunnel has to answer the probe.
+const probeTimeout = 5 * time.Second
+
+// probeTunnel checks that the local server of a newly opened tunnel is reachable (probe option), through a channel
+// like those of visitors, and warns the client if not so that a wrong local port shows up before the first visitor.
+// The local server of an HTTP tunnel must also answer a HEAD / request, with any status. It must be called once the
+// client has the reply to its tcpip-forward request, or the client refuses the channel.
+func probeTunnel(tunnel sshTunnelsListenerData, reply *sessionReplier) {
+	if err := probeLocalServer(tunnel); err != nil {
+		log.Printf("Probe of the tunnel of session %s failed: %s", tunnel.sessionID, err)
+		tunnelProbesFailed.Add(1)
+		reply.Warn(fmt.Sprintf("The local server did not answer through the tunnel: %s. Check that it is running at the local port of the tunnel.", err))
+	}
+}
+
+func probeLocalServer(tunnel sshTunnelsListenerData) error {
+	if tunnel.connectionType == string(TCPConnectionType) {
+		channel, _, err := openForwardedChannel(tunnel, "127.0.0.1", 0)
+		if err != nil {
+			return probeChannelError(err)
+		}
+		channel.Close()
+		return nil
+	}
+
+	_, err := requestLocalServer(tunnel, http.MethodHead, "/", "tunnel-probe")
+	return err
+}
+
+// requestLocalServer sends a request without a body to the local server of an HTTP tunnel and returns the status of
+// the response, which it has probeTimeout to start.
+func requestLocalServer(tunnel sshTunnelsListenerData, method string, path string, userAgent string) (int, error) {
+	conn, err := openTunnelChannel(tunnel, "127.0.0.1", 0)
+	if err != nil {
+		return 0, probeChannelError(err)
+	}
+	defer conn.Close()
+	timer := time.AfterFunc(probeTimeout, func() { conn.Close() })
+	defer timer.Stop()
+
+	host := "localhost"
+	if tunnel.hostHeader != nil {
+		host = *tunnel.hostHeader
+	}
+	request, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		return 0, err
+	}
+	request.Host = host
+	request.Header.Set("User-Agent", userAgent)
+	request.Close = true
+	if err := request.Write(conn); err != nil {
+		return 0, fmt.Errorf("sending a request: %s", err)
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		if !timer.Stop() {
+			return 0, fmt.Errorf("no http response within %s", probeTimeout)
+		}
+		return 0, fmt.Errorf("no http response (%s)", err)
+	}
+	response.Body.Close()
+	return response.StatusCode, nil
+}
+
+// probeChannelError describes why the client could not open a channel of the tunnel, eg connect failed (Connection refused).
+func probeChannelError(err error) error {
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) && openErr.Message != "" {
+		return errors.New(openErr.Message)
+	}
+	return err
+}
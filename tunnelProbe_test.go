@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("tunnel probe", func() {
+	var listener net.Listener
+	var client *ssh.Client
+	var tunnel sshTunnelsListenerData
+	var channels <-chan ssh.NewChannel
+	BeforeEach(func() {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		signer, _ := ssh.NewSignerFromKey(key)
+		config := &ssh.ServerConfig{NoClientAuth: true}
+		config.AddHostKey(signer)
+		var err error
+		listener, err = net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		serverConn := make(chan *sshConnection, 1)
+		go func(listener net.Listener, serverConn chan *sshConnection) {
+			nConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				for newChannel := range chans {
+					newChannel.Reject(ssh.Prohibited, "")
+				}
+			}()
+			serverConn <- newSSHConnection(conn, context.Background())
+		}(listener, serverConn)
+		client, err = ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		Expect(err).To(Not(HaveOccurred()))
+		channels = client.HandleChannelOpen(forwardedTCPChannelType)
+		conn := <-serverConn
+		tunnel = sshTunnelsListenerData{conn: conn, connectionType: "http",
+			reqPayload: &remoteForwardRequest{BindAddr: "localhost", BindPort: 8080}}
+	})
+	AfterEach(func() {
+		client.Close()
+		listener.Close()
+	})
+
+	It("should report the reason the client could not reach its local server", func() {
+		go func() {
+			(<-channels).Reject(ssh.ConnectionFailed, "Connection refused")
+		}()
+		Expect(probeLocalServer(tunnel)).To(MatchError("Connection refused"))
+
+		var out bytes.Buffer
+		failed := tunnelProbesFailed.Value()
+		go func() {
+			(<-channels).Reject(ssh.ConnectionFailed, "Connection refused")
+		}()
+		probeTunnel(tunnel, &sessionReplier{w: &out})
+		Expect(out.String()).To(HavePrefix("The local server did not answer through the tunnel: Connection refused."))
+		Expect(tunnelProbesFailed.Value()).To(Equal(failed + 1))
+	})
+
+	It("should send a HEAD request to the local server of HTTP tunnels", func() {
+		header := "localhost:3000"
+		tunnel.hostHeader = &header
+		requests := make(chan *http.Request, 1)
+		go func() {
+			channel, reqs, err := (<-channels).Accept()
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			defer channel.Close()
+			request, err := http.ReadRequest(bufio.NewReader(channel))
+			if err != nil {
+				return
+			}
+			requests <- request
+			channel.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 9\r\n\r\n"))
+		}()
+		Expect(probeLocalServer(tunnel)).To(Succeed())
+		request := <-requests
+		Expect(request.Method).To(Equal(http.MethodHead))
+		Expect(request.Host).To(Equal("localhost:3000"))
+	})
+
+	It("should only open a channel to the local server of TCP tunnels", func() {
+		tunnel.connectionType = string(TCPConnectionType)
+		go func() {
+			channel, reqs, err := (<-channels).Accept()
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			channel.Close()
+		}()
+		Expect(probeLocalServer(tunnel)).To(Succeed())
+	})
+
+	It("should parse the probe option", func() {
+		options, err := parseTunnelOptions("type=http,probe=true")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.probe).To(BeTrue())
+		_, err = parseTunnelOptions("type=http,probe=sometimes")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"expvar"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Standbys that took over a tunnel after its client disconnected, published at /debug/vars of the pprof port.
+var tunnelFailovers = expvar.NewInt("tunnelFailovers")
+
+// failOverTunnel lets promoted, a standby (standby=true) that now serves the tunnel, know that the client it stood
+// by for is gone. sshTunnelListenersLock is held so the client is told in the background.
+func failOverTunnel(promoted sshTunnelsListenerData) {
+	tunnelFailovers.Add(1)
+	tunnelName := ""
+	if name := promoted.conn.GetTunnelName(); name != nil {
+		tunnelName = *name
+	}
+	log.Printf("Standby session %s now serves tunnelName %s", promoted.sessionID, tunnelName)
+	if reply := promoted.conn.GetSessionReplier(); reply != nil {
+		go reply.Warn("The client this one stood by for disconnected, serving the tunnel now.")
+	}
+}
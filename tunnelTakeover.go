@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/hex"
+	"expvar"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tunnels taken over by a new connection of the same client, published at /debug/vars of the pprof port.
+var tunnelTakeovers = expvar.NewInt("tunnelTakeovers")
+
+// How long the old connection of a tunnel taken over may finish its requests and TCP connections in progress,
+// and how often they are checked.
+const (
+	takeoverDrainTimeout  = 30 * time.Second
+	takeoverDrainInterval = 100 * time.Millisecond
+)
+
+// takeOverTunnel retires old, the connection of a tunnel that a new connection of the same client id took over.
+// New requests already go to the new connection: old is told, its requests and TCP connections in progress
+// (counted by stats) end within takeoverDrainTimeout and it is closed with exit status 0 so that its client does not
+// reconnect and take the tunnel back. It returns when old is closed.
+func takeOverTunnel(old *sshConnection, stats *tunnelStats) {
+	sessionID := hex.EncodeToString(old.SessionID())
+	log.Printf("Tunnel of session %s taken over by a new connection of the same client", sessionID)
+	tunnelTakeovers.Add(1)
+
+	reply := old.GetSessionReplier()
+	if reply != nil && stats.connections.Load() > 0 {
+		reply.Warn("Tunnel taken over by a new connection of the same client, closing once the requests in progress end.")
+	}
+
+	deadline := time.Now().Add(takeoverDrainTimeout)
+	for stats.connections.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(takeoverDrainInterval)
+	}
+	if n := stats.connections.Load(); n > 0 {
+		log.Printf("Closing session %s with %d requests in progress after %s", sessionID, n, takeoverDrainTimeout)
+	}
+	closeTunnelSession(old, reply, "Tunnel taken over by a new connection of the same client.")
+}
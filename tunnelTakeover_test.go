@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ = Describe("tunnel takeover", func() {
+	var listener net.Listener
+	var serverConn chan *sshConnection
+	BeforeEach(func() {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		signer, _ := ssh.NewSignerFromKey(key)
+		config := &ssh.ServerConfig{NoClientAuth: true}
+		config.AddHostKey(signer)
+		var err error
+		listener, err = net.Listen("tcp", "localhost:0")
+		Expect(err).To(Not(HaveOccurred()))
+		serverConn = make(chan *sshConnection, 1)
+		go func(listener net.Listener, serverConn chan *sshConnection) {
+			nConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			channel, requests, err := (<-chans).Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for req := range requests {
+					req.Reply(req.Type == "exec", nil)
+				}
+			}()
+			c := newSSHConnection(conn, context.Background())
+			c.SetSessionChannel(&channel)
+			c.SetSessionReplier(&sessionReplier{w: channel})
+			serverConn <- c
+		}(listener, serverConn)
+	})
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	It("should close the old connection with exit status 0 once its requests in progress end", func() {
+		client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		Expect(err).To(Not(HaveOccurred()))
+		defer client.Close()
+		session, err := client.NewSession()
+		Expect(err).To(Not(HaveOccurred()))
+		stdout, _ := session.StdoutPipe()
+		Expect(session.Start("type=http,id=abc")).To(Succeed())
+		conn := <-serverConn
+		stats := newTunnelStats(0)
+		takeovers := tunnelTakeovers.Value()
+
+		stats.Begin()
+		start := time.Now()
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			stats.End(0, 0)
+		}()
+		go takeOverTunnel(conn, stats)
+
+		output, err := io.ReadAll(stdout)
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(string(output)).To(Equal("Tunnel taken over by a new connection of the same client, closing once the requests in progress end.\n" +
+			"Tunnel taken over by a new connection of the same client.\n"))
+		Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+		Expect(session.Wait()).To(Succeed())
+		Expect(tunnelTakeovers.Value()).To(Equal(takeovers + 1))
+	})
+
+	It("should replace the member of a shared tunnel with the same client id", func() {
+		group := newTunnelGroup(stickyNone)
+		_, replaced := group.Add(sshTunnelsListenerData{clientID: "a", sessionID: "1"})
+		Expect(replaced).To(BeFalse())
+		group.Add(sshTunnelsListenerData{clientID: "b", sessionID: "2"})
+
+		old, replaced := group.Add(sshTunnelsListenerData{clientID: "a", sessionID: "3"})
+		Expect(replaced).To(BeTrue())
+		Expect(old.sessionID).To(Equal("1"))
+		_, ok := group.Member("1")
+		Expect(ok).To(BeFalse())
+		_, ok = group.Member("3")
+		Expect(ok).To(BeTrue())
+	})
+})
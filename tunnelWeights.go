@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// tunnelWeight is a client of a shared tunnel with its share of the requests (see tunnelGroup.Pick).
+type tunnelWeight struct {
+	Session string `json:"session"`
+	Port    int    `json:"port"`
+	Weight  int    `json:"weight"`
+	Standby bool   `json:"standby,omitempty"`
+}
+
+func init() {
+	// Served by the admin (pprof) port.
+	http.HandleFunc("/tunnels/weights", serveTunnelWeights)
+}
+
+// serveTunnelWeights lists the clients of the shared tunnel given with ?tunnel=NAME with their weights (GET) and
+// sets the weight of one of them (POST ?tunnel=NAME&session=ID&weight=N), eg to send 10% of the requests to a
+// canary client and then more of them.
+func serveTunnelWeights(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "weights are listed with GET and set with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	tunnelName := strings.ToLower(r.URL.Query().Get("tunnel"))
+	if tunnelName == "" {
+		http.Error(w, "missing tunnel query parameter", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodGet {
+		weights := sharedTunnelWeights(tunnelName)
+		if len(weights) == 0 {
+			http.Error(w, fmt.Sprintf("no shared tunnel %s", tunnelName), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(weights)
+		return
+	}
+
+	sessionID := r.URL.Query().Get("session")
+	weight, err := strconv.Atoi(r.URL.Query().Get("weight"))
+	if err != nil || weight < 0 || weight > 10000 {
+		http.Error(w, fmt.Sprintf("invalid weight value %s", r.URL.Query().Get("weight")), http.StatusBadRequest)
+		return
+	}
+	conn, ok := setSharedTunnelWeight(tunnelName, sessionID, weight)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no client with session %s in shared tunnel %s", sessionID, tunnelName), http.StatusNotFound)
+		return
+	}
+	if conn != nil {
+		if reply := conn.GetSessionReplier(); reply != nil {
+			go reply.Warn(fmt.Sprintf("The weight of this client was set to %d by the administrator.", weight))
+		}
+	}
+	audit(adminActor(r), "tunnel.weight", tunnelName, fmt.Sprintf("session=%s weight=%d", sessionID, weight))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sharedTunnelGroups calls f with the sshTunnelListeners key and the group of each shared tunnel named tunnelName,
+// one per HTTP port. sshTunnelListenersLock must be held.
+func sharedTunnelGroups(tunnelName string, f func(cacheKey string, group *tunnelGroup)) {
+	for key, tunnel := range sshTunnelListeners {
+		if tunnel.group == nil || !tunnel.group.shared || tunnel.reqPayload == nil {
+			continue
+		}
+		addr := net.JoinHostPort(tunnel.reqPayload.BindAddr, strconv.Itoa(int(tunnel.reqPayload.BindPort)))
+		if key == addr+tunnelName {
+			f(key, tunnel.group)
+		}
+	}
+}
+
+// sharedTunnelWeights returns the clients of the shared tunnels named tunnelName.
+func sharedTunnelWeights(tunnelName string) []tunnelWeight {
+	weights := []tunnelWeight{}
+	sshTunnelListenersLock.Lock()
+	defer sshTunnelListenersLock.Unlock()
+	sharedTunnelGroups(tunnelName, func(cacheKey string, group *tunnelGroup) {
+		for _, member := range group.Members() {
+			weights = append(weights, tunnelWeight{Session: member.sessionID, Port: int(member.reqPayload.BindPort),
+				Weight: member.weight, Standby: member.standby})
+		}
+	})
+	return weights
+}
+
+// setSharedTunnelWeight sets the weight of the client with sessionID in a shared tunnel named tunnelName and returns
+// its connection.
+func setSharedTunnelWeight(tunnelName string, sessionID string, weight int) (*sshConnection, bool) {
+	var conn *sshConnection
+	found := false
+	sshTunnelListenersLock.Lock()
+	defer sshTunnelListenersLock.Unlock()
+	sharedTunnelGroups(tunnelName, func(cacheKey string, group *tunnelGroup) {
+		if group.Update(sessionID, func(m *sshTunnelsListenerData) { m.weight, conn = weight, m.conn }) {
+			sshTunnelListeners[cacheKey], _ = group.Primary()
+			found = true
+		}
+	})
+	return conn, found
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tunnel weights", func() {
+	BeforeEach(func() {
+		group := newTunnelGroup(stickyNone)
+		group.shared = true
+		payload := &remoteForwardRequest{BindAddr: "", BindPort: 80}
+		for _, sessionID := range []string{"1", "2"} {
+			group.Add(sshTunnelsListenerData{clientID: sessionID, sessionID: sessionID, reqPayload: payload, group: group, weight: defaultTunnelWeight})
+		}
+		sshTunnelListenersLock.Lock()
+		sshTunnelListeners[":80canary"], _ = group.Primary()
+		sshTunnelListenersLock.Unlock()
+	})
+	AfterEach(func() {
+		sshTunnelListenersLock.Lock()
+		delete(sshTunnelListeners, ":80canary")
+		sshTunnelListenersLock.Unlock()
+	})
+
+	serve := func(method string, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	It("should list and set the weights of the clients of a shared tunnel", func() {
+		w := serve(http.MethodGet, "/tunnels/weights?tunnel=canary")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(MatchJSON(`[{"session":"1","port":80,"weight":100},{"session":"2","port":80,"weight":100}]`))
+
+		Expect(serve(http.MethodPost, "/tunnels/weights?tunnel=canary&session=2&weight=10").Code).To(Equal(http.StatusNoContent))
+		Expect(sharedTunnelWeights("canary")).To(Equal([]tunnelWeight{{Session: "1", Port: 80, Weight: 100}, {Session: "2", Port: 80, Weight: 10}}))
+		sshTunnelListenersLock.Lock()
+		primary := sshTunnelListeners[":80canary"]
+		sshTunnelListenersLock.Unlock()
+		Expect(primary.weight).To(Equal(100))
+	})
+
+	It("should refuse invalid requests", func() {
+		Expect(serve(http.MethodGet, "/tunnels/weights").Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(http.MethodGet, "/tunnels/weights?tunnel=other").Code).To(Equal(http.StatusNotFound))
+		Expect(serve(http.MethodPost, "/tunnels/weights?tunnel=canary&session=3&weight=10").Code).To(Equal(http.StatusNotFound))
+		Expect(serve(http.MethodPost, "/tunnels/weights?tunnel=canary&session=2&weight=-1").Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(http.MethodDelete, "/tunnels/weights?tunnel=canary").Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+})
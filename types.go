@@ -2,6 +2,7 @@ package main
 
 import (
 	"net"
+	"net/url"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -14,6 +15,31 @@ type sshTunnelsListenerData struct {
 	hostHeader *string
 	// Is the client TCP or http?
 	connectionType string
+	breaker        *circuitBreaker
+	health         *tunnelHealth  // nil unless the client asked for health checks
+	cache          *responseCache // nil unless the client enabled caching
+	rewriteRules   []rewriteRule
+	pathRules      pathRules
+	basicAuth      *basicAuth    // Visitors must authenticate if not nil
+	passwordPage   *passwordPage // Visitors must enter a password if not nil
+	allowIPs       ipAllowList   // Visitor addresses allowed to use the tunnel
+	private        bool          // Requests are only counted (inspect=false)
+	shareLink      bool          // Visitors need a share link (see shareLinkToken)
+	internal       bool          // Only visitors of internalCIDRs reach the tunnel (visibility=private)
+	serverHeader   string        // See applyServerHeader
+	noindex        bool          // Keep crawlers away with robots.txt and X-Robots-Tag
+	har            bool          // Capture requests and responses into harCaptures
+	mirror         string        // tunnelName of the shadow tunnel that gets a copy of each request (see mirrorRequest)
+	group          *tunnelGroup  // Clients sharing the tunnel name if shared=true or standing by for it
+	standby        bool          // Serves only when no client that is not standing by is left in the group
+	weight         int           // Share of the requests of the group relative to the other members (weight=)
+	stats          *tunnelStats
+	sessionLog     sessionLog // Request lines written to the SSH session
+	domain         url.URL    // Base domain on which the tunnel is served
+	// Keep header names as written for backends that require exact casing
+	preserveHeaderCase bool
+	mux                *tunnelMux   // Requests are streams of one channel if the client sent mux=true
+	channels           *channelPool // Pre-opened channels; nil if channelPoolSize is 0
 }
 
 type forwardsListenerData struct {
@@ -21,6 +47,10 @@ type forwardsListenerData struct {
 	clientID  string // TCP only: For reconnecting: allow client to re-use same subdomain
 	sessionID string // TCP only: ditto
 	conType   connectionType
+	// TCP only: public key fingerprint of the client, traffic of the tunnel and its SSH connection
+	fingerprint string
+	stats       *tunnelStats
+	conn        *sshConnection
 }
 
 type remoteForwardRequest struct {
@@ -47,6 +77,7 @@ type remoteForwardChannelData struct {
 type execRequestCompletedData struct {
 	channel ssh.Channel
 	request string
+	tui     *sessionTUI // Also channel if the client requested a PTY
 }
 
 type connectionType string
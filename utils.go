@@ -2,17 +2,117 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"io"
+	"net"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
-// tunnelNameValid returns true if tunnelName is valid
+// Ports of the HTTP listeners shared by all HTTP tunnels (eg 80 and 8080). Clients pick one with the port of
+// their remote forward and tunnels are routed by port and tunnelName. The first port is the default of clients.
+// This is set from a command line flag.
+var httpBindPorts = []int{80}
+
+// Whether httpBindPorts was set with --httpPorts. Otherwise HTTP tunnels are also accepted at other ports, each with a
+// listener of its own.
+var httpBindPortsSet bool
+
+// isHTTPBindPort returns true if port is one of httpBindPorts.
+func isHTTPBindPort(port uint32) bool {
+	for _, p := range httpBindPorts {
+		if uint32(p) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Base domains served (eg tun1.io and tun2.dev). The first one is domainURI, the default of tunnels.
+// Clients pick another one with domain=.
+var domainURIs []url.URL
+
+// findDomain returns the served domain whose host name is name.
+func findDomain(name string) (url.URL, bool) {
+	for _, d := range domainURIs {
+		if strings.EqualFold(d.Hostname(), name) {
+			return d, true
+		}
+	}
+	return url.URL{}, false
+}
+
+// requestDomain returns the served domain that host (eg abc.tun2.dev:80) is on, or domainURI if none matches.
+func requestDomain(host string) url.URL {
+	hostname := strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = h
+	}
+	match := domainURI
+	matchLength := -1
+	for _, d := range domainURIs {
+		name := strings.ToLower(d.Hostname())
+		if (hostname == name || strings.HasSuffix(hostname, "."+name)) && len(name) > matchLength {
+			match, matchLength = d, len(name)
+		}
+	}
+	return match
+}
+
+// tunnelURL returns the public URL of an HTTP tunnel on domain at port. The port of domain (if any) is kept for the
+// default port.
+func tunnelURL(domain url.URL, tunnelName string, port uint32) string {
+	return routedTunnelURL(domain, tunnelName, port, routing == routingPath)
+}
+
+// tunnelPathURL returns the public URL of an HTTP tunnel routed by path, such as the fallback URL of tunnels
+// routed both ways.
+func tunnelPathURL(domain url.URL, tunnelName string, port uint32) string {
+	return routedTunnelURL(domain, tunnelName, port, true)
+}
+
+func routedTunnelURL(domain url.URL, tunnelName string, port uint32, pathRouted bool) string {
+	var u url.URL
+	if pathRouted {
+		u = domain
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + tunnelName
+	} else {
+		u = url.URL{Scheme: domain.Scheme, Host: tunnelName + "." + domain.Host}
+	}
+	if len(httpBindPorts) > 0 && port != uint32(httpBindPorts[0]) {
+		u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(int(port)))
+	}
+	return u.String()
+}
+
+// tunnelNameValid returns true if tunnelName is valid. Names can be nested with dots (eg dev.acme for
+// dev.acme.domain.io), each label being valid on its own.
 func tunnelNameValid(tunnelName string) bool {
-	nameValid := len(tunnelName) < 50
+	if tunnelName == "" || len(tunnelName) >= 50 {
+		return false
+	}
+	for _, label := range strings.Split(tunnelName, ".") {
+		if !tunnelNameLabelValid(label) {
+			return false
+		}
+	}
+	return true
+}
 
-	if tunnelName == "" || !nameValid {
+// tunnelNameServedOn returns true if tunnelName is served on domain, ie it is not nested such that it would be served
+// on another domain (eg a.b on domain.io when b.domain.io is served too).
+func tunnelNameServedOn(tunnelName string, domain url.URL) bool {
+	served := requestDomain(tunnelName + "." + domain.Hostname())
+	return routing == routingPath || strings.EqualFold(served.Hostname(), domain.Hostname())
+}
+
+// tunnelNameLabelValid returns true if tunnelName is a valid label (ie part of a name between dots)
+func tunnelNameLabelValid(tunnelName string) bool {
+	nameValid := tunnelName != ""
+
+	if !nameValid {
 		return false
 	}
 	tunnelName = strings.ToLower(tunnelName)
@@ -43,19 +143,60 @@ func tunnelNameValid(tunnelName string) bool {
 }
 
 // Returns subdomain if found from host name, or domain, or an empty string
-// host must be valid.
+// host must be valid. Nested subdomains are returned whole (eg dev.acme for dev.acme.domain.io:8080).
 func extractSubdomain(host string, domainHost string) (string, error) {
-	// Find domain in host
-	domainIndex := strings.Index(host, domainHost)
-	if domainIndex <= 0 {
+	hostname := strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = h
+	}
+	subdomain := strings.TrimSuffix(hostname, "."+strings.ToLower(domainHost))
+	if subdomain == hostname || !tunnelNameValid(subdomain) {
 		return "", errors.New("could not find a valid subdomain in http request headers")
 	}
-	return strings.TrimSpace(host[:domainIndex-1]), nil
+	return subdomain, nil
+}
+
+// tunnelNameParents returns the names that a nested tunnel name is under, closest first (eg b.c and c for a.b.c).
+func tunnelNameParents(tunnelName string) []string {
+	var parents []string
+	for i := strings.Index(tunnelName, "."); i >= 0; i = strings.Index(tunnelName, ".") {
+		tunnelName = tunnelName[i+1:]
+		parents = append(parents, tunnelName)
+	}
+	return parents
 }
 
 // replaceRequestURL returns a new URL replacing requestURL with newHost and newURLPath.
 // If requestURL is absolute, then it replaces its domain with newHost if newHost is specified.
 // If stripPrefixPath is specified (not empty), then the final url path will have stripPrefixPath stripped (left trimmed).
+// originForm returns the path and query of an absolute request URL (eg http://a.domain.io/b?c becomes /b?c)
+// as expected by servers that are not proxies. Other request URLs are returned as is.
+func originForm(requestURL string) string {
+	u, err := url.ParseRequestURI(requestURL)
+	if err != nil || !u.IsAbs() {
+		return requestURL
+	}
+	return u.RequestURI()
+}
+
+// prefixLocation returns the Location header of a response to a request routed by path with the path prefix of the
+// tunnel (eg /myapp/login for /login at domain.io/myapp), if it is relative to the root or an absolute URL at host.
+// Other locations, and locations that already start with prefix, are returned as is.
+func prefixLocation(location string, prefix string, host string) string {
+	u, err := url.Parse(location)
+	if err != nil || prefix == "" || !strings.HasPrefix(u.Path, "/") || u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/") {
+		return location
+	}
+	if u.Host != "" && !strings.EqualFold(u.Host, host) {
+		return location
+	}
+	u.Path = prefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = prefix + u.RawPath
+	}
+	return u.String()
+}
+
 func replaceRequestURL(requestURL string, newHost *string, stripPrefixPath string) (string, error) {
 
 	requestUri, err := url.ParseRequestURI(requestURL)
@@ -158,20 +299,32 @@ func init() {
 	}
 }
 
+// newRequestID returns a random id that identifies an http request in the server logs, the client and error pages.
+func newRequestID() string {
+	randomBytes := make([]byte, 8)
+	io.ReadFull(rand.Reader, randomBytes)
+	return hex.EncodeToString(randomBytes)
+}
+
+// generateRandomTunnelName returns a random tunnel name that is neither reserved (see reservedNames) nor denied (see
+// tunnelNameDenied).
 func generateRandomTunnelName() (string, error) {
 
 	// As an alternative to this method, base64 can be used but both the padding and invalid characters
 	// must be removed (ie / and =).
 	randomBytes := make([]byte, tunnelNameLength)
-	if _, err := io.ReadFull(rand.Reader, randomBytes); err != nil {
-		return "", err
-	}
-
 	tunnelName := make([]rune, tunnelNameLength)
+	for {
+		if _, err := io.ReadFull(rand.Reader, randomBytes); err != nil {
+			return "", err
+		}
 
-	for i, b := range randomBytes {
-		tunnelName[i] = charMap[(int)(b)%36]
-	}
+		for i, b := range randomBytes {
+			tunnelName[i] = charMap[(int)(b)%36]
+		}
 
-	return string(tunnelName), nil
+		if reservedNameAllowed(string(tunnelName), "") && !tunnelNameDenied(string(tunnelName)) {
+			return string(tunnelName), nil
+		}
+	}
 }
@@ -40,12 +40,23 @@ var _ = Describe("utils", func() {
 		})
 
 		It("should invalidate subdomains with invalid chars", func() {
-			for _, subDomain := range []string{"a*bcd", "dsdsfs.fsdfd"} {
+			for _, subDomain := range []string{"a*bcd", "dsdsfs_fsdfd"} {
 				valid := tunnelNameValid(subDomain)
 				Expect(valid).To(BeFalse())
 			}
 		})
 
+		It("should validate nested subdomains", func() {
+			for _, subDomain := range []string{"dsdsfs.fsdfd", "dev.my-app.acme"} {
+				Expect(tunnelNameValid(subDomain)).To(BeTrue())
+			}
+			for _, subDomain := range []string{"a..b", ".ab", "ab.", "ab.-cd", "a--b.cd"} {
+				Expect(tunnelNameValid(subDomain)).To(BeFalse())
+			}
+			Expect(tunnelNameParents("dev.my-app.acme")).To(Equal([]string{"my-app.acme", "acme"}))
+			Expect(tunnelNameParents("acme")).To(BeEmpty())
+		})
+
 		It("should invalidate subdomains beginning or ending with a dash", func() {
 			for _, subDomain := range []string{"-a-b-c", "abc-d-r-"} {
 				valid := tunnelNameValid(subDomain)
@@ -80,6 +91,19 @@ var _ = Describe("utils", func() {
 				Expect(s).To(Equal("open-idc"))
 			}
 		})
+
+		It("should extract nested subdomains", func() {
+			domainURL := "domain.io"
+			for _, host := range []string{"dev.acme." + domainURL, "Dev.Acme.Domain.io:8080"} {
+				s, err := extractSubdomain(host, domainURL)
+				Expect(err).To(Not(HaveOccurred()))
+				Expect(s).To(Equal("dev.acme"))
+			}
+			for _, host := range []string{domainURL, "dev..domain.io", "domain.io.evil.com", "a_b.domain.io"} {
+				_, err := extractSubdomain(host, domainURL)
+				Expect(err).To(HaveOccurred())
+			}
+		})
 	})
 
 	Context("extractTunelNameFromURLPath from URL path", func() {
@@ -119,6 +143,18 @@ var _ = Describe("utils", func() {
 			}
 		})
 
+		It("should extract the path requested by the client", func() {
+			options, err := parseTunnelOptions("type=http,path=/MyApp/")
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(options.path).To(Equal("myapp"))
+			Expect(tunnelNameValid(options.path)).To(BeTrue())
+
+			domainURL, _ := url.Parse("https://domain.io/tunnels")
+			s, err := extractTunnelNameFromURLPath("/tunnels/myapp/index.html", *domainURL)
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(s).To(Equal(options.path))
+		})
+
 	})
 
 	Context("replaceRequestURL", func() {
@@ -202,4 +238,101 @@ var _ = Describe("utils", func() {
 
 	})
 
+	Context("originForm", func() {
+		It("should keep the path and query of an absolute request URL", func() {
+			Expect(originForm("http://abc.domain.io/x/y?z=1")).To(Equal("/x/y?z=1"))
+			Expect(originForm("http://abc.domain.io")).To(Equal("/"))
+		})
+
+		It("should not change an origin-form request URL", func() {
+			Expect(originForm("/x/y?z=1")).To(Equal("/x/y?z=1"))
+		})
+	})
+
+	Context("newRequestID", func() {
+		It("should generate distinct hex ids", func() {
+			first, second := newRequestID(), newRequestID()
+			Expect(first).To(MatchRegexp("^[0-9a-f]{16}$"))
+			Expect(first).To(Not(Equal(second)))
+		})
+	})
+
+	Context("tunnelURL", func() {
+		BeforeEach(func() {
+			u, _ := url.Parse("https://domain.io")
+			domainURI = *u
+			httpBindPorts = []int{80, 8080}
+		})
+		AfterEach(func() {
+			domainURI = url.URL{}
+			routing = routingSubdomain
+			httpBindPorts = []int{80}
+		})
+
+		It("should only accept the http ports", func() {
+			Expect(isHTTPBindPort(8080)).To(BeTrue())
+			Expect(isHTTPBindPort(8081)).To(BeFalse())
+		})
+
+		It("should add the port unless it is the default", func() {
+			Expect(tunnelURL(domainURI, "abc", 80)).To(Equal("https://abc.domain.io"))
+			Expect(tunnelURL(domainURI, "abc", 8080)).To(Equal("https://abc.domain.io:8080"))
+		})
+
+		It("should use the path in path mode", func() {
+			routing = routingPath
+			Expect(tunnelURL(domainURI, "abc", 80)).To(Equal("https://domain.io/abc"))
+			Expect(tunnelURL(domainURI, "abc", 8080)).To(Equal("https://domain.io:8080/abc"))
+		})
+
+		It("should use the subdomain with the path as fallback in both mode", func() {
+			routing = routingBoth
+			Expect(tunnelURL(domainURI, "abc", 80)).To(Equal("https://abc.domain.io"))
+			Expect(tunnelPathURL(domainURI, "abc", 8080)).To(Equal("https://domain.io:8080/abc"))
+		})
+	})
+
+	Context("prefixLocation", func() {
+		It("should keep redirects of path routed requests within the tunnel", func() {
+			Expect(prefixLocation("/login?next=%2F", "/abc", "domain.io")).To(Equal("/abc/login?next=%2F"))
+			Expect(prefixLocation("https://domain.io/login", "/abc", "domain.io")).To(Equal("https://domain.io/abc/login"))
+			Expect(prefixLocation("https://Domain.io:8080/", "/abc", "domain.io:8080")).To(Equal("https://Domain.io:8080/abc/"))
+		})
+
+		It("should not change other redirects", func() {
+			for _, location := range []string{"/abc", "/abc/login", "login", "../login", "https://example.com/login", "//example.com/login"} {
+				Expect(prefixLocation(location, "/abc", "domain.io")).To(Equal(location))
+			}
+			Expect(prefixLocation("/login", "", "domain.io")).To(Equal("/login"))
+		})
+	})
+
+	Context("domains", func() {
+		BeforeEach(func() {
+			for _, d := range []string{"https://tun1.io", "http://tun2.dev", "https://a.tun2.dev"} {
+				u, _ := url.Parse(d)
+				domainURIs = append(domainURIs, *u)
+			}
+			domainURI = domainURIs[0]
+		})
+		AfterEach(func() {
+			domainURIs = nil
+			domainURI = url.URL{}
+		})
+
+		It("should find the domain of a request host", func() {
+			Expect(requestDomain("abc.tun2.dev:80").Host).To(Equal("tun2.dev"))
+			Expect(requestDomain("ABC.TUN1.IO").Host).To(Equal("tun1.io"))
+			Expect(requestDomain("b.a.tun2.dev").Host).To(Equal("a.tun2.dev"))
+			Expect(requestDomain("other.com").Host).To(Equal("tun1.io"))
+		})
+
+		It("should find a domain by name", func() {
+			d, ok := findDomain("tun2.dev")
+			Expect(ok).To(BeTrue())
+			Expect(tunnelURL(d, "abc", 80)).To(Equal("http://abc.tun2.dev"))
+			_, ok = findDomain("tun3.dev")
+			Expect(ok).To(BeFalse())
+		})
+	})
 })
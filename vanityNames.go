@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Serializes the changes made to reservedNamesFile by bindTunnelName.
+var reservedNamesFileLock sync.Mutex
+
+func init() {
+	// Served by the admin (pprof) port.
+	http.HandleFunc("/names", serveVanityNames)
+}
+
+// serveVanityNames lists the reserved names with the keys allowed to claim them (GET), binds a name to a key so
+// that only the keys bound to it can ever claim it (POST ?name=acme&fingerprint=SHA256:...) and unbinds a key, or
+// every key and the name itself without a fingerprint (DELETE ?name=acme). Changes are written to the reserved
+// names file and apply to the next tunnels: tunnels already open keep their name until they close.
+func serveVanityNames(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		names, _ := reservedNames.Load().(map[string][]string)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(names)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "names are listed with GET, bound with POST and unbound with DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	if reservedNamesFile == "" {
+		http.Error(w, "reserved names are disabled, start the server with --reservedNames", http.StatusConflict)
+		return
+	}
+	name := strings.ToLower(r.URL.Query().Get("name"))
+	fingerprint := r.URL.Query().Get("fingerprint")
+	if !tunnelNameValid(name) {
+		http.Error(w, fmt.Sprintf("name '%s' not valid", name), http.StatusBadRequest)
+		return
+	}
+	if fingerprint != "" && !strings.HasPrefix(fingerprint, "SHA256:") {
+		http.Error(w, fmt.Sprintf("invalid key fingerprint %s, expected SHA256:...", fingerprint), http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodPost && fingerprint == "" {
+		http.Error(w, "missing fingerprint query parameter", http.StatusBadRequest)
+		return
+	}
+
+	action := "name.bind"
+	if r.Method == http.MethodDelete {
+		action = "name.unbind"
+	}
+	if err := bindTunnelName(name, fingerprint, r.Method == http.MethodPost); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(adminActor(r), action, name, fingerprint)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bindTunnelName adds fingerprint to the keys allowed to claim name in reservedNamesFile, or removes it (all of them
+// and the name if fingerprint is empty), keeping the other lines and comments of the file. The reserved names are
+// reloaded from the file once it is written.
+func bindTunnelName(name string, fingerprint string, bind bool) error {
+	reservedNamesFileLock.Lock()
+	defer reservedNamesFileLock.Unlock()
+
+	b, err := os.ReadFile(reservedNamesFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var lines []string
+	found := false
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.ToLower(fields[0]) != name {
+			lines = append(lines, line)
+			continue
+		}
+		found = true
+		fingerprints := fields[1:]
+		if bind && !containsString(fingerprints, fingerprint) {
+			fingerprints = append(fingerprints, fingerprint)
+		} else if !bind && fingerprint == "" {
+			continue
+		} else if !bind {
+			var kept []string
+			for _, f := range fingerprints {
+				if f != fingerprint {
+					kept = append(kept, f)
+				}
+			}
+			fingerprints = kept
+		}
+		lines = append(lines, strings.Join(append([]string{name}, fingerprints...), " "))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !found && bind {
+		lines = append(lines, name+" "+fingerprint)
+	}
+
+	if err := writeFileAtomic(reservedNamesFile, []byte(strings.Join(lines, "\n")+"\n")); err != nil {
+		return err
+	}
+	names, err := loadReservedNames()
+	if err != nil {
+		return err
+	}
+	reservedNames.Store(names)
+	return nil
+}
+
+// writeFileAtomic writes b to a temporary file renamed over path so that a crash does not leave it half written.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
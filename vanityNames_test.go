@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("vanity names", func() {
+	var dir string
+	var previous map[string][]string
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "vanityNames")
+		Expect(err).To(Not(HaveOccurred()))
+		reservedNamesFile = filepath.Join(dir, "reserved_names")
+		previous, _ = reservedNames.Load().(map[string][]string)
+	})
+	AfterEach(func() {
+		reservedNamesFile = ""
+		if previous == nil {
+			previous = map[string][]string{}
+		}
+		reservedNames.Store(previous)
+		os.RemoveAll(dir)
+	})
+
+	request := func(method string, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		serveVanityNames(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	It("should bind names to keys in the reserved names file", func() {
+		os.WriteFile(reservedNamesFile, []byte("# Nobody gets these\nwww\nacme SHA256:key1\n"), 0o600)
+
+		Expect(request(http.MethodPost, "/names?name=Acme&fingerprint=SHA256:key2").Code).To(Equal(http.StatusNoContent))
+		Expect(request(http.MethodPost, "/names?name=acme&fingerprint=SHA256:key2").Code).To(Equal(http.StatusNoContent))
+		Expect(request(http.MethodPost, "/names?name=demo&fingerprint=SHA256:key3").Code).To(Equal(http.StatusNoContent))
+		b, _ := os.ReadFile(reservedNamesFile)
+		Expect(string(b)).To(Equal("# Nobody gets these\nwww\nacme SHA256:key1 SHA256:key2\ndemo SHA256:key3\n"))
+		Expect(reservedNameAllowed("acme", "SHA256:key2")).To(BeTrue())
+		Expect(reservedNameAllowed("demo", "SHA256:key1")).To(BeFalse())
+
+		w := request(http.MethodGet, "/names")
+		var names map[string][]string
+		Expect(json.Unmarshal(w.Body.Bytes(), &names)).To(Succeed())
+		Expect(names).To(HaveKeyWithValue("demo", []string{"SHA256:key3"}))
+
+		Expect(request(http.MethodDelete, "/names?name=acme&fingerprint=SHA256:key1").Code).To(Equal(http.StatusNoContent))
+		Expect(request(http.MethodDelete, "/names?name=demo").Code).To(Equal(http.StatusNoContent))
+		b, _ = os.ReadFile(reservedNamesFile)
+		Expect(string(b)).To(Equal("# Nobody gets these\nwww\nacme SHA256:key2\n"))
+		Expect(reservedNameAllowed("acme", "SHA256:key1")).To(BeFalse())
+		Expect(reservedNameAllowed("demo", "SHA256:key1")).To(BeTrue())
+	})
+
+	It("should reject invalid requests", func() {
+		Expect(request(http.MethodPost, "/names?name=a--b&fingerprint=SHA256:key1").Code).To(Equal(http.StatusBadRequest))
+		Expect(request(http.MethodPost, "/names?name=acme&fingerprint=MD5:12").Code).To(Equal(http.StatusBadRequest))
+		Expect(request(http.MethodPost, "/names?name=acme").Code).To(Equal(http.StatusBadRequest))
+		Expect(request(http.MethodPut, "/names?name=acme").Code).To(Equal(http.StatusMethodNotAllowed))
+		reservedNamesFile = ""
+		Expect(request(http.MethodPost, "/names?name=acme&fingerprint=SHA256:key1").Code).To(Equal(http.StatusConflict))
+	})
+})
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+)
+
+// Networks of the visitors that reach private tunnels (visibility=private), eg a VPN, or 127.0.0.1/32 for the server
+// host itself through ssh -L. Loopback is not trusted unless listed, as behind a local reverse proxy every visitor
+// comes from it. Empty lets no one in.
+var internalCIDRs ipAllowList
+
+// Requests and TCP connections refused by private tunnels, published at /debug/vars of the pprof port.
+var privateTunnelVisitorsRejected = expvar.NewInt("privateTunnelVisitorsRejected")
+
+// internalVisitor returns true if the visitor at addr may reach private tunnels.
+func internalVisitor(addr net.Addr) bool {
+	return len(internalCIDRs) > 0 && internalCIDRs.Allowed(addr)
+}
+
+// privateTunnelNotice tells the client of a private tunnel who reaches it.
+func privateTunnelNotice() string {
+	if len(internalCIDRs) == 0 {
+		return "The tunnel is private but the server has no internal networks: no visitor reaches it."
+	}
+	return fmt.Sprintf("The tunnel is private: only visitors from %s reach it.", internalCIDRs)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("private tunnels", func() {
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+
+	It("should parse the visibility option", func() {
+		options, err := parseTunnelOptions("type=http,visibility=private")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.internal).To(BeTrue())
+		options, err = parseTunnelOptions("visibility=Public")
+		Expect(err).To(Not(HaveOccurred()))
+		Expect(options.internal).To(BeFalse())
+		_, err = parseTunnelOptions("visibility=hidden")
+		Expect(err).To(MatchError("invalid visibility value hidden"))
+	})
+
+	It("should only let internal networks in", func() {
+		defer func(cidrs ipAllowList) { internalCIDRs = cidrs }(internalCIDRs)
+		internalCIDRs = nil
+		Expect(internalVisitor(addr("127.0.0.1"))).To(BeFalse())
+		Expect(internalVisitor(addr("10.1.2.3"))).To(BeFalse())
+		Expect(privateTunnelNotice()).To(Equal("The tunnel is private but the server has no internal networks: no visitor reaches it."))
+
+		Expect(internalCIDRs.Add("10.0.0.0/8, 192.168.1.7")).To(Succeed())
+		Expect(internalVisitor(addr("10.1.2.3"))).To(BeTrue())
+		Expect(internalVisitor(addr("192.168.1.7"))).To(BeTrue())
+		Expect(internalVisitor(addr("203.0.113.5"))).To(BeFalse())
+		// Behind a local reverse proxy, every visitor comes from the server host
+		Expect(internalVisitor(addr("127.0.0.1"))).To(BeFalse())
+		Expect(internalVisitor(&net.UnixAddr{Name: "@", Net: "unix"})).To(BeFalse())
+		Expect(privateTunnelNotice()).To(Equal("The tunnel is private: only visitors from 10.0.0.0/8,192.168.1.7/32 reach it."))
+
+		Expect(internalCIDRs.Add("127.0.0.1/32")).To(Succeed())
+		Expect(internalVisitor(addr("127.0.0.1"))).To(BeTrue())
+	})
+})